@@ -0,0 +1,254 @@
+package wile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AuditEntry is an entry of an AuditLog. Hash covers all other fields,
+// including the hash of the previous entry, so entries can't be changed,
+// removed or reordered without breaking the chain.
+type AuditEntry struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Domain string    `json:"domain,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Prev   string    `json:"prev"`
+	Hash   string    `json:"hash"`
+}
+
+func (a *AuditEntry) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n%s\n%s\n%s", a.Seq, a.Time.UTC().Format(time.RFC3339Nano), a.Event, a.Domain, a.Detail, a.Prev)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditLog is an append-only, hash-chained log in etcd. It is safe to append
+// from several processes at once.
+//
+// The chain alone doesn't stop someone with write access to etcd from
+// dropping the latest entries, or from writing a new chain. Checkpoints
+// anchor it: they sign the hash of the last entry with a key that isn't in
+// etcd, so that the log can't be changed up to a checkpoint without the key.
+type AuditLog struct {
+	etcd       *clientv3.Client
+	etcdPrefix string
+	macKey     []byte
+}
+
+// NewAuditLog creates an AuditLog in etcd under etcdPrefix. Checkpoints are
+// signed with a key derived from key.
+func NewAuditLog(etcd *clientv3.Client, etcdPrefix string, key []byte) (*AuditLog, error) {
+	macKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("audit checkpoints")), macKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key for checkpoints")
+	}
+	return &AuditLog{etcd, etcdPrefix, macKey}, nil
+}
+
+// AuditCheckpoint records the hash of an AuditEntry, signed by MAC.
+type AuditCheckpoint struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Hash string    `json:"hash"`
+	MAC  string    `json:"mac"`
+}
+
+func (a *AuditLog) mac(c *AuditCheckpoint) string {
+	h := hmac.New(sha256.New, a.macKey)
+	fmt.Fprintf(h, "%d\n%s\n%s", c.Seq, c.Time.UTC().Format(time.RFC3339Nano), c.Hash)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Checkpoint signs the last entry, unless the log is empty or the entry
+// already has a checkpoint. It returns the checkpoint, if any.
+func (a *AuditLog) Checkpoint(ctx context.Context) (*AuditCheckpoint, error) {
+	last, err := a.last(ctx)
+	if err != nil || last == nil {
+		return nil, err
+	}
+
+	c := &AuditCheckpoint{
+		Seq:  last.Seq,
+		Time: time.Now().UTC(),
+		Hash: last.Hash,
+	}
+	c.MAC = a.mac(c)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal audit checkpoint")
+	}
+
+	key := a.checkpointKey(c.Seq)
+	_, err = a.etcd.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+	).Then(
+		clientv3.OpPut(key, string(data)),
+	).Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to store audit checkpoint")
+	}
+	return c, nil
+}
+
+// Checkpoints returns all checkpoints, oldest first.
+func (a *AuditLog) Checkpoints(ctx context.Context) ([]AuditCheckpoint, error) {
+	gr, err := a.etcd.Get(ctx, a.checkpointPrefix()+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read audit checkpoints")
+	}
+
+	var checkpoints []AuditCheckpoint
+	for _, kv := range gr.Kvs {
+		var c AuditCheckpoint
+		err := json.Unmarshal(kv.Value, &c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid audit checkpoint %q", kv.Key)
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, nil
+}
+
+// VerifyCheckpoints checks that checkpoints are signed with the key of a, and
+// that entries, which must pass VerifyAuditLog, contain the entries they
+// sign.
+func (a *AuditLog) VerifyCheckpoints(entries []AuditEntry, checkpoints []AuditCheckpoint) error {
+	for _, c := range checkpoints {
+		if !hmac.Equal([]byte(c.MAC), []byte(a.mac(&c))) {
+			return errors.Errorf("checkpoint of entry %d has an invalid signature", c.Seq)
+		}
+		if c.Seq < 1 || c.Seq > int64(len(entries)) {
+			return errors.Errorf("entry %d of checkpoint is missing", c.Seq)
+		}
+		if entries[c.Seq-1].Hash != c.Hash {
+			return errors.Errorf("entry %d doesn't match its checkpoint", c.Seq)
+		}
+	}
+	return nil
+}
+
+func (a *AuditLog) checkpointPrefix() string {
+	return a.etcdPrefix + "_checkpoints"
+}
+
+func (a *AuditLog) checkpointKey(seq int64) string {
+	return path.Join(a.checkpointPrefix(), fmt.Sprintf("%020d", seq))
+}
+
+// Append adds an entry to the end of the log.
+func (a *AuditLog) Append(ctx context.Context, event, domain, detail string) (*AuditEntry, error) {
+	for {
+		last, err := a.last(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		e := &AuditEntry{
+			Seq:    1,
+			Time:   time.Now().UTC(),
+			Event:  event,
+			Domain: domain,
+			Detail: detail,
+		}
+		if last != nil {
+			e.Seq = last.Seq + 1
+			e.Prev = last.Hash
+		}
+		e.Hash = e.hash()
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal audit entry")
+		}
+
+		// Someone else may have appended since we read the last entry, in
+		// which case we retry on top of theirs.
+		key := a.etcdKey(e.Seq)
+		tr, err := a.etcd.Txn(ctx).If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+		).Then(
+			clientv3.OpPut(key, string(data)),
+		).Commit()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to append audit entry")
+		}
+		if tr.Succeeded {
+			return e, nil
+		}
+	}
+}
+
+// Entries returns all entries, oldest first.
+func (a *AuditLog) Entries(ctx context.Context) ([]AuditEntry, error) {
+	gr, err := a.etcd.Get(ctx, a.etcdPrefix+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read audit log")
+	}
+
+	var entries []AuditEntry
+	for _, kv := range gr.Kvs {
+		var e AuditEntry
+		err := json.Unmarshal(kv.Value, &e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid audit entry %q", kv.Key)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (a *AuditLog) last(ctx context.Context) (*AuditEntry, error) {
+	gr, err := a.etcd.Get(ctx, a.etcdPrefix+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend), clientv3.WithLimit(1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read audit log")
+	}
+	if len(gr.Kvs) == 0 {
+		return nil, nil
+	}
+
+	var e AuditEntry
+	err = json.Unmarshal(gr.Kvs[0].Value, &e)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid audit entry %q", gr.Kvs[0].Key)
+	}
+	return &e, nil
+}
+
+// Keys are zero-padded so that they sort by sequence number.
+func (a *AuditLog) etcdKey(seq int64) string {
+	return path.Join(a.etcdPrefix, fmt.Sprintf("%020d", seq))
+}
+
+// VerifyAuditLog checks that entries, as returned by Entries, form an unbroken
+// chain starting at the first entry of the log.
+func VerifyAuditLog(entries []AuditEntry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != int64(i+1) {
+			return errors.Errorf("entry %d has sequence number %d", i+1, e.Seq)
+		}
+		if e.Prev != prev {
+			return errors.Errorf("entry %d doesn't follow entry %d", e.Seq, e.Seq-1)
+		}
+		if e.Hash != e.hash() {
+			return errors.Errorf("entry %d was modified", e.Seq)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package wile
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+)
+
+// backupMagic starts every backup, so that Import can reject other files
+// before trying the passphrase.
+const backupMagic = "wile-backup-v1\n"
+
+const backupSaltSize = 16
+
+// Export writes all entries of cache, including the ACME account, to w as a
+// gzipped tarball encrypted with a key derived from passphrase. Values are
+// written as they are stored, so a backup of the cache underlying an
+// EncryptingCache stays encrypted with the cert key too.
+func Export(ctx context.Context, cache autocert.Cache, w io.Writer, passphrase []byte) error {
+	lister, ok := cache.(Lister)
+	if !ok {
+		return errors.New("cache can't list its keys")
+	}
+	keys, err := lister.List(ctx, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to list keys")
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, key := range keys {
+		data, err := cache.Get(ctx, key)
+		if err == autocert.ErrCacheMiss {
+			// Deleted since we listed it.
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to get %q", key)
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    key,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write header of %q", key)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return errors.Wrapf(err, "failed to write %q", key)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish tarball")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish gzip stream")
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return errors.Wrap(err, "failed to read salt")
+	}
+	aead, err := backupAEAD(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "failed to read nonce")
+	}
+
+	var out []byte
+	out = append(out, backupMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, buf.Bytes(), []byte(backupMagic))
+
+	_, err = w.Write(out)
+	return errors.Wrap(err, "failed to write backup")
+}
+
+// Import decrypts a backup written by Export and puts all of its entries
+// into cache, overwriting existing ones. It returns the imported keys.
+func Import(ctx context.Context, cache autocert.Cache, r io.Reader, passphrase []byte) ([]string, error) {
+	in, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read backup")
+	}
+	if !bytes.HasPrefix(in, []byte(backupMagic)) {
+		return nil, errors.New("not a wile backup")
+	}
+	in = in[len(backupMagic):]
+
+	if len(in) < backupSaltSize {
+		return nil, errors.New("backup is truncated")
+	}
+	aead, err := backupAEAD(passphrase, in[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	in = in[backupSaltSize:]
+
+	n := aead.NonceSize()
+	if len(in) < n {
+		return nil, errors.New("backup is truncated")
+	}
+	plain, err := aead.Open(nil, in[:n], in[n:], []byte(backupMagic))
+	if err != nil {
+		return nil, errors.New("failed to decrypt backup, wrong passphrase?")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read gzip stream")
+	}
+	tr := tar.NewReader(gz)
+
+	var keys []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return keys, errors.Wrap(err, "failed to read tarball")
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return keys, errors.Wrapf(err, "failed to read %q", h.Name)
+		}
+		if err := cache.Put(ctx, h.Name, data); err != nil {
+			return keys, errors.Wrapf(err, "failed to put %q", h.Name)
+		}
+		keys = append(keys, h.Name)
+	}
+	return keys, nil
+}
+
+func backupAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create GCM AEAD")
+	}
+	return aead, nil
+}
@@ -0,0 +1,44 @@
+package wile
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// bundleContext is signed along with the payload of config bundles, so that
+// signatures made with the same key for other purposes don't verify.
+const bundleContext = "wile-config-bundle-v1\n"
+
+type configBundle struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// SignConfigBundle returns a bundle of payload signed with key, for
+// distributing config to servers over channels that aren't trusted, such as a
+// shared etcd or a web server. The bundle is JSON.
+func SignConfigBundle(key ed25519.PrivateKey, payload []byte) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	sig := ed25519.Sign(key, append([]byte(bundleContext), payload...))
+	return json.Marshal(configBundle{payload, sig})
+}
+
+// OpenConfigBundle verifies a bundle written by SignConfigBundle against key
+// and returns its payload.
+func OpenConfigBundle(key ed25519.PublicKey, bundle []byte) ([]byte, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+	var b configBundle
+	if err := json.Unmarshal(bundle, &b); err != nil {
+		return nil, errors.Wrap(err, "invalid config bundle")
+	}
+	if !ed25519.Verify(key, append([]byte(bundleContext), b.Payload...), b.Signature) {
+		return nil, errors.New("config bundle has an invalid signature")
+	}
+	return b.Payload, nil
+}
@@ -0,0 +1,55 @@
+package wile
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Lister is implemented by caches that can enumerate their keys.
+type Lister interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Purger is implemented by caches that can garbage-collect stale keys. Purge
+// deletes the keys last written before olderThan and returns them. Keys that
+// are written once, such as the ACME account key, are never purged, and
+// neither are those in keep, which lets caches storing keys under other names
+// pass those of the permanent keys on.
+type Purger interface {
+	Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error)
+}
+
+// Versioner is implemented by caches that support optimistic locking. Every
+// write changes the version of a key. PutIfVersion only writes key if its
+// version is still version, as returned by GetVersion, or, for version 0, if
+// there is no key yet, and returns the new version, or 0 if it didn't write.
+type Versioner interface {
+	GetVersion(ctx context.Context, key string) ([]byte, int64, error)
+	PutIfVersion(ctx context.Context, key string, data []byte, version int64) (int64, error)
+}
+
+// permanentKeys returns the keys that are written once and must survive any
+// purge: the ACME account keys and the session ticket keys.
+func permanentKeys() []string {
+	keys := []string{TicketKeysCacheKey}
+	for _, t := range []KeyType{ECDSAP256, ECDSAP384, RSA2048, RSA4096} {
+		keys = append(keys, accountKeyName(t))
+	}
+	return keys
+}
+
+// purgeable reports whether Purge may delete key.
+func purgeable(key string, keep []string) bool {
+	for _, k := range permanentKeys() {
+		if key == k {
+			return false
+		}
+	}
+	for _, k := range keep {
+		if key == k {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package wile
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+func TestPurgeKeepsPermanentKeys(t *testing.T) {
+	ctx := context.Background()
+	keys := []string{
+		"acme_account+key",
+		"acme_account+key+rsa2048",
+		TicketKeysCacheKey,
+		"example.com",
+		"example.com+rsa",
+		"kept.example.com",
+		"token+http-01",
+	}
+	want := []string{"example.com", "example.com+rsa", "token+http-01"}
+
+	mem := NewMemoryCache()
+	e, err := NewEncryptingCache(NewMemoryCache(), []byte("test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layered := NewLayeredCache(NewMemoryCache(), time.Hour)
+
+	tests := []struct {
+		name  string
+		cache interface {
+			autocert.Cache
+			Purger
+		}
+		// stored maps keys to the names they are stored under.
+		stored func(string) string
+	}{
+		{"MemoryCache", mem, func(k string) string { return k }},
+		{"EncryptingCache", e, e.HashKey},
+		{"LayeredCache", layered, func(k string) string { return k }},
+	}
+	for _, tt := range tests {
+		for _, k := range keys {
+			if err := tt.cache.Put(ctx, k, []byte("value of "+k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		purged, err := tt.cache.Purge(ctx, time.Now().Add(time.Hour), []string{"kept.example.com"})
+		if err != nil {
+			t.Fatalf("%s: Purge: %v", tt.name, err)
+		}
+		var wantPurged []string
+		for _, k := range want {
+			wantPurged = append(wantPurged, tt.stored(k))
+		}
+		if !sameKeys(purged, wantPurged) {
+			t.Errorf("%s: Purge = %q, want %q", tt.name, purged, wantPurged)
+		}
+
+		for _, k := range keys {
+			_, err := tt.cache.Get(ctx, k)
+			gone := err == autocert.ErrCacheMiss
+			if wantGone := contains(want, k); gone != wantGone {
+				t.Errorf("%s: %q purged = %v, want %v", tt.name, k, gone, wantGone)
+			}
+		}
+	}
+}
+
+func TestPurgeKeepsRecentKeys(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryCache()
+	if err := mem.Put(ctx, "old.example.com", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if err := mem.Put(ctx, "new.example.com", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := mem.Purge(ctx, cutoff, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(purged, []string{"old.example.com"}) {
+		t.Errorf("Purge = %q, want only the old key", purged)
+	}
+}
+
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, k := range a {
+		if !contains(b, k) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
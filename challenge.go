@@ -0,0 +1,45 @@
+package wile
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const challengePrefix = "/.well-known/acme-challenge/"
+
+// NewHTTPChallengeHandler answers HTTP-01 challenges with the responses that
+// autocert stored in cache, and passes all other requests to fallback. Unlike
+// autocert.Manager.HTTPHandler, it doesn't need the Manager that created the
+// challenge, so any process sharing the cache can answer it.
+//
+// Applications with their own HTTP server can mount it on
+// /.well-known/acme-challenge/ with a nil fallback, which answers other
+// requests with 404s.
+func NewHTTPChallengeHandler(cache autocert.Cache, fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, challengePrefix) {
+			fallback.ServeHTTP(rw, req)
+			return
+		}
+
+		// autocert stores responses under "<token>+http-01".
+		data, err := cache.Get(req.Context(), path.Base(req.URL.Path)+"+http-01")
+		if err == autocert.ErrCacheMiss {
+			http.NotFound(rw, req)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Failed to read challenge", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Write(data)
+	})
+}
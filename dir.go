@@ -0,0 +1,43 @@
+package wile
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// DirCache is an autocert.DirCache that can list its keys.
+type DirCache struct {
+	autocert.DirCache
+}
+
+func NewDirCache(dir string) *DirCache {
+	return &DirCache{autocert.DirCache(dir)}
+}
+
+// List returns all keys starting with prefix. Files that a concurrent Put is
+// still writing are listed too.
+func (d *DirCache) List(ctx context.Context, prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(string(d.DirCache))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list cache directory")
+	}
+
+	var keys []string
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		keys = append(keys, fi.Name())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
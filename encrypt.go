@@ -8,7 +8,10 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"fmt"
+	"hash"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -21,6 +24,8 @@ type EncryptingCache struct {
 	impl autocert.Cache
 	kh   []byte
 	aead cipher.AEAD
+	// hashes pools the HMACs of hashKey, which is called on every Get.
+	hashes sync.Pool
 }
 
 func NewEncryptingCache(impl autocert.Cache, key []byte) (*EncryptingCache, error) {
@@ -48,11 +53,13 @@ func NewEncryptingCache(impl autocert.Cache, key []byte) (*EncryptingCache, erro
 		return nil, errors.Wrap(err, "failed to create GCM AEAD")
 	}
 
-	return &EncryptingCache{
+	e := &EncryptingCache{
 		impl: impl,
 		kh:   kh[:],
 		aead: aead,
-	}, nil
+	}
+	e.hashes.New = func() interface{} { return hmac.New(sha256.New, e.kh) }
+	return e, nil
 }
 
 func (e *EncryptingCache) Get(ctx context.Context, key string) ([]byte, error) {
@@ -71,17 +78,14 @@ func (e *EncryptingCache) Get(ctx context.Context, key string) ([]byte, error) {
 }
 
 func (e *EncryptingCache) Put(ctx context.Context, key string, data []byte) error {
-	nonce := make([]byte, e.aead.NonceSize())
-	_, err := io.ReadFull(rand.Reader, nonce)
+	n := e.aead.NonceSize()
+	final := make([]byte, n, n+len(data)+e.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, final)
 	if err != nil {
 		return errors.Wrap(err, "failed to read nonce")
 	}
 
-	ciphertext := e.aead.Seal(nil, nonce, data, []byte(key))
-
-	var final []byte
-	final = append(final, nonce...)
-	final = append(final, ciphertext...)
+	final = e.aead.Seal(final, final[:n], data, []byte(key))
 
 	return e.impl.Put(ctx, e.hashKey(key), final)
 }
@@ -90,12 +94,39 @@ func (e *EncryptingCache) Delete(ctx context.Context, key string) error {
 	return e.impl.Delete(ctx, e.hashKey(key))
 }
 
+// Purge purges the underlying cache, which must be a Purger, and returns the
+// purged keys as stored, see HashKey.
+func (e *EncryptingCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	purger, ok := e.impl.(Purger)
+	if !ok {
+		return nil, errors.New("underlying cache doesn't support purging")
+	}
+
+	// The underlying cache only sees hashed keys, so it can't tell the
+	// permanent ones.
+	var hashed []string
+	for _, k := range append(permanentKeys(), keep...) {
+		hashed = append(hashed, e.hashKey(k))
+	}
+	return purger.Purge(ctx, olderThan, hashed)
+}
+
+// HashKey returns the key under which the value of key is stored in the
+// underlying cache.
+func (e *EncryptingCache) HashKey(key string) string {
+	return e.hashKey(key)
+}
+
 func (e *EncryptingCache) hashKey(key string) string {
-	hash := hmac.New(sha256.New, e.kh)
-	_, err := io.WriteString(hash, key)
+	h := e.hashes.Get().(hash.Hash)
+	defer e.hashes.Put(h)
+	h.Reset()
+
+	_, err := io.WriteString(h, key)
 	if err != nil {
 		panic(err)
 	}
 
-	return base32.HexEncoding.EncodeToString(hash.Sum(nil))
+	var sum [sha256.Size]byte
+	return base32.HexEncoding.EncodeToString(h.Sum(sum[:0]))
 }
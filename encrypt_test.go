@@ -0,0 +1,156 @@
+package wile
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+func TestEncryptingCacheRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryCache()
+	e, err := NewEncryptingCache(mem, []byte("test key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		data []byte
+	}{
+		{"example.com", []byte("cert and key")},
+		{"example.com+rsa", []byte("rsa cert and key")},
+		{"empty", []byte{}},
+		{"large", bytes.Repeat([]byte{0xAB}, 1<<16)},
+	}
+	for _, tt := range tests {
+		if err := e.Put(ctx, tt.key, tt.data); err != nil {
+			t.Fatalf("Put(%q): %v", tt.key, err)
+		}
+		got, err := e.Get(ctx, tt.key)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", tt.key, err)
+		}
+		if !bytes.Equal(got, tt.data) {
+			t.Errorf("Get(%q) = %d bytes, want the %d bytes put", tt.key, len(got), len(tt.data))
+		}
+
+		if _, err := mem.Get(ctx, tt.key); err != autocert.ErrCacheMiss {
+			t.Errorf("key %q stored in plain, err = %v", tt.key, err)
+		}
+		stored, err := mem.Get(ctx, e.HashKey(tt.key))
+		if err != nil {
+			t.Fatalf("underlying Get(HashKey(%q)): %v", tt.key, err)
+		}
+		if len(tt.data) > 0 && bytes.Contains(stored, tt.data) {
+			t.Errorf("value of %q stored in plain", tt.key)
+		}
+	}
+
+	if _, err := e.Get(ctx, "missing"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get of missing key: err = %v, want ErrCacheMiss", err)
+	}
+	if err := e.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get after Delete: err = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestEncryptingCacheTamper(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, mem *MemoryCache, e *EncryptingCache)
+	}{
+		{"flipped ciphertext bit", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			modify(t, mem, e.HashKey("example.com"), func(v []byte) []byte { v[len(v)-1] ^= 1; return v })
+		}},
+		{"flipped nonce bit", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			modify(t, mem, e.HashKey("example.com"), func(v []byte) []byte { v[0] ^= 1; return v })
+		}},
+		{"truncated", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			modify(t, mem, e.HashKey("example.com"), func(v []byte) []byte { return v[:len(v)-1] })
+		}},
+		{"shorter than nonce", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			modify(t, mem, e.HashKey("example.com"), func(v []byte) []byte { return v[:4] })
+		}},
+		{"value of another key", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			if err := e.Put(ctx, "other.com", []byte("other secret")); err != nil {
+				t.Fatal(err)
+			}
+			other, err := mem.Get(ctx, e.HashKey("other.com"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			modify(t, mem, e.HashKey("example.com"), func([]byte) []byte { return other })
+		}},
+		{"written with another key", func(t *testing.T, mem *MemoryCache, e *EncryptingCache) {
+			attacker, err := NewEncryptingCache(NewMemoryCache(), []byte("attacker key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := attacker.Put(ctx, "example.com", []byte("forged")); err != nil {
+				t.Fatal(err)
+			}
+			forged, err := attacker.impl.Get(ctx, attacker.HashKey("example.com"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			modify(t, mem, e.HashKey("example.com"), func([]byte) []byte { return forged })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryCache()
+			e, err := NewEncryptingCache(mem, []byte("test key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := e.Put(ctx, "example.com", []byte("secret")); err != nil {
+				t.Fatal(err)
+			}
+
+			tt.tamper(t, mem, e)
+			if got, err := e.Get(ctx, "example.com"); err == nil {
+				t.Errorf("Get of tampered value = %q, want error", got)
+			}
+		})
+	}
+}
+
+// modify replaces the value of key in mem with what f returns for a copy of it.
+func modify(t *testing.T, mem *MemoryCache, key string, f func([]byte) []byte) {
+	ctx := context.Background()
+	v, err := mem.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.Put(ctx, key, f(append([]byte(nil), v...))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkEncryptingCacheGet(b *testing.B) {
+	ctx := context.Background()
+	e, err := NewEncryptingCache(NewMemoryCache(), []byte("benchmark key"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	if err := e.Put(ctx, "example.com", data); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Get(ctx, "example.com"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
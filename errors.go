@@ -0,0 +1,49 @@
+package wile
+
+import "github.com/pkg/errors"
+
+var (
+	// ErrUnknownHost means a cert was requested for a host that isn't allowed.
+	ErrUnknownHost = errors.New("unknown host")
+	// ErrCertExpired means the only cert available has expired.
+	ErrCertExpired = errors.New("certificate expired")
+	// ErrCacheUnavailable means the cache couldn't be reached.
+	ErrCacheUnavailable = errors.New("cache unavailable")
+	// ErrACMERateLimited means the ACME server refused a request because of
+	// its rate limits.
+	ErrACMERateLimited = errors.New("ACME rate limited")
+)
+
+// Error is an error of one of the kinds above, such as ErrUnknownHost, with
+// the error that caused it. Callers can branch on the kind with
+// errors.Cause(err) == ErrUnknownHost, which also works through errors
+// wrapped with github.com/pkg/errors, or with the standard errors.Is.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Cause returns the kind, for errors.Cause.
+func (e *Error) Cause() error {
+	return e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// withKind returns err as an Error of kind, or nil if err is nil.
+func withKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{kind, err}
+}
@@ -1,7 +1,12 @@
 package wile
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"path"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/net/context"
@@ -10,6 +15,47 @@ import (
 	"github.com/pkg/errors"
 )
 
+// mtimePrefix holds the time each key was last written, so that Purge can tell
+// stale entries apart. autocert never uses keys starting with a dot.
+const mtimePrefix = ".mtime/"
+
+// NewEtcdClient connects to etcd. If caFile is set, the connection uses TLS,
+// optionally authenticating with the client cert in certFile and keyFile.
+func NewEtcdClient(endpoints []string, caFile, certFile, keyFile, username, password string, dialTimeout time.Duration) (*clientv3.Client, error) {
+	cfg := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		Username:    username,
+		Password:    password,
+	}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read etcd CA")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in %q", caFile)
+		}
+
+		cfg.TLS = &tls.Config{RootCAs: pool}
+
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to load etcd client cert")
+			}
+			cfg.TLS.Certificates = []tls.Certificate{cert}
+		}
+	} else if certFile != "" {
+		return nil, errors.New("etcd client cert requires a CA")
+	}
+
+	return clientv3.New(cfg)
+}
+
 type EtcdCache struct {
 	etcd       *clientv3.Client
 	etcdPrefix string
@@ -20,9 +66,9 @@ func NewEtcdCache(etcd *clientv3.Client, etcdPrefix string) *EtcdCache {
 }
 
 func (e *EtcdCache) Get(ctx context.Context, key string) ([]byte, error) {
-	gr, err := e.etcd.Get(ctx, key)
+	gr, err := e.etcd.Get(ctx, e.etcdKey(key))
 	if err != nil {
-		return nil, err
+		return nil, withKind(ErrCacheUnavailable, err)
 	}
 	if len(gr.Kvs) == 0 {
 		return nil, autocert.ErrCacheMiss
@@ -31,15 +77,146 @@ func (e *EtcdCache) Get(ctx context.Context, key string) ([]byte, error) {
 }
 
 func (e *EtcdCache) Put(ctx context.Context, key string, data []byte) error {
-	_, err := e.etcd.Put(ctx, e.etcdKey(key), string(data))
-	return errors.Wrap(err, "failed to put into etcd")
+	mtime := time.Now().UTC().Format(time.RFC3339)
+	_, err := e.etcd.Txn(ctx).Then(
+		clientv3.OpPut(e.etcdKey(key), string(data)),
+		clientv3.OpPut(e.etcdKey(mtimePrefix+key), mtime),
+	).Commit()
+	return withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to put into etcd"))
+}
+
+// GetVersion returns the value of key and the etcd revision it was last
+// written at, see Versioner.
+func (e *EtcdCache) GetVersion(ctx context.Context, key string) ([]byte, int64, error) {
+	gr, err := e.etcd.Get(ctx, e.etcdKey(key))
+	if err != nil {
+		return nil, 0, withKind(ErrCacheUnavailable, err)
+	}
+	if len(gr.Kvs) == 0 {
+		return nil, 0, autocert.ErrCacheMiss
+	}
+	return gr.Kvs[0].Value, gr.Kvs[0].ModRevision, nil
+}
+
+// PutIfVersion stores data under key if it wasn't written since version, see
+// Versioner.
+func (e *EtcdCache) PutIfVersion(ctx context.Context, key string, data []byte, version int64) (int64, error) {
+	mtime := time.Now().UTC().Format(time.RFC3339)
+	tr, err := e.etcd.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(e.etcdKey(key)), "=", version),
+	).Then(
+		clientv3.OpPut(e.etcdKey(key), string(data)),
+		clientv3.OpPut(e.etcdKey(mtimePrefix+key), mtime),
+	).Commit()
+	if err != nil {
+		return 0, withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to put into etcd"))
+	}
+	if !tr.Succeeded {
+		return 0, nil
+	}
+	return tr.Header.Revision, nil
 }
 
 func (e *EtcdCache) Delete(ctx context.Context, key string) error {
-	_, err := e.etcd.Delete(ctx, e.etcdKey(key))
-	return errors.Wrap(err, "failed to delete from etcd")
+	_, err := e.etcd.Txn(ctx).Then(
+		clientv3.OpDelete(e.etcdKey(key)),
+		clientv3.OpDelete(e.etcdKey(mtimePrefix+key)),
+	).Commit()
+	return withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to delete from etcd"))
+}
+
+// List returns all keys starting with prefix.
+func (e *EtcdCache) List(ctx context.Context, prefix string) ([]string, error) {
+	// path.Join drops trailing slashes, which still have to limit the
+	// listing to keys below a directory.
+	listPrefix := e.etcdKey(prefix)
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		listPrefix += "/"
+	}
+	gr, err := e.etcd.Get(ctx, listPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to list etcd keys"))
+	}
+
+	var keys []string
+	for _, kv := range gr.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), e.etcdDir())
+		if strings.HasPrefix(key, mtimePrefix) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Purge deletes the keys last written before olderThan and returns them, see
+// Purger. Keys written before write times were recorded are never purged.
+func (e *EtcdCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	mtimeDir := e.etcdKey(mtimePrefix) + "/"
+	gr, err := e.etcd.Get(ctx, mtimeDir, clientv3.WithPrefix())
+	if err != nil {
+		return nil, withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to list etcd write times"))
+	}
+
+	var purged []string
+	for _, kv := range gr.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), mtimeDir)
+
+		mtime, err := time.Parse(time.RFC3339, string(kv.Value))
+		if err != nil {
+			return purged, errors.Wrapf(err, "invalid write time for %q", key)
+		}
+		if !mtime.Before(olderThan) || !purgeable(key, keep) {
+			continue
+		}
+
+		// Only delete if the key wasn't rewritten since we listed it.
+		tr, err := e.etcd.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		).Then(
+			clientv3.OpDelete(e.etcdKey(key)),
+			clientv3.OpDelete(string(kv.Key)),
+		).Commit()
+		if err != nil {
+			return purged, errors.Wrapf(err, "failed to purge %q", key)
+		}
+		if !tr.Succeeded {
+			continue
+		}
+		purged = append(purged, key)
+	}
+	return purged, nil
+}
+
+// Watch sends the keys that are put or deleted from now on, until ctx is done.
+func (e *EtcdCache) Watch(ctx context.Context) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+
+		for wr := range e.etcd.Watch(ctx, e.etcdDir(), clientv3.WithPrefix()) {
+			for _, ev := range wr.Events {
+				key := strings.TrimPrefix(string(ev.Kv.Key), e.etcdDir())
+				if strings.HasPrefix(key, mtimePrefix) {
+					continue
+				}
+
+				select {
+				case keys <- key:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return keys
 }
 
 func (e *EtcdCache) etcdKey(key string) string {
 	return path.Join(e.etcdPrefix, key)
 }
+
+// etcdDir returns the prefix of all keys of the cache.
+func (e *EtcdCache) etcdDir() string {
+	return e.etcdKey("") + "/"
+}
@@ -0,0 +1,150 @@
+package wile
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// Faults are the faults a FaultInjectingCache injects. Rates are
+// probabilities between 0 and 1.
+type Faults struct {
+	GetErrorRate    float64
+	PutErrorRate    float64
+	DeleteErrorRate float64
+	// ListErrorRate also applies to Purge.
+	ListErrorRate float64
+	// PartialWriteRate is the probability that a Put stores only a prefix of
+	// its data and still succeeds, like a store without atomic writes might
+	// after a crash.
+	PartialWriteRate float64
+	// Latency is added to every operation, unless its context is done first.
+	Latency time.Duration
+	// Err is the injected error. If nil, it is an ErrCacheUnavailable.
+	Err error
+}
+
+// FaultInjectingCache wraps a cache with failures, slowness and corruption,
+// for testing how code using it copes with storage problems. Faults are
+// drawn from a random source with a fixed seed, so runs are repeatable as
+// long as the operations happen in the same order.
+type FaultInjectingCache struct {
+	impl autocert.Cache
+
+	mu       sync.Mutex
+	faults   Faults
+	rand     *rand.Rand
+	injected int
+}
+
+func NewFaultInjectingCache(impl autocert.Cache, faults Faults, seed int64) *FaultInjectingCache {
+	return &FaultInjectingCache{
+		impl:   impl,
+		faults: faults,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFaults changes the faults, e.g. to start or end an outage during a test.
+func (f *FaultInjectingCache) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+// Injected returns the number of faults injected so far, not counting
+// latency.
+func (f *FaultInjectingCache) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+// inject waits for the latency, and returns the error to fail with, if any,
+// with the given rate.
+func (f *FaultInjectingCache) inject(ctx context.Context, rate func(Faults) float64) error {
+	f.mu.Lock()
+	faults := f.faults
+	fail := f.roll(rate(faults))
+	f.mu.Unlock()
+
+	if faults.Latency > 0 {
+		t := time.NewTimer(faults.Latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !fail {
+		return nil
+	}
+	if faults.Err != nil {
+		return faults.Err
+	}
+	return withKind(ErrCacheUnavailable, errors.New("injected fault"))
+}
+
+// roll reports whether to inject a fault with probability rate. f.mu must be
+// held.
+func (f *FaultInjectingCache) roll(rate float64) bool {
+	if rate <= 0 || f.rand.Float64() >= rate {
+		return false
+	}
+	f.injected++
+	return true
+}
+
+func (f *FaultInjectingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := f.inject(ctx, func(fs Faults) float64 { return fs.GetErrorRate }); err != nil {
+		return nil, err
+	}
+	return f.impl.Get(ctx, key)
+}
+
+func (f *FaultInjectingCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := f.inject(ctx, func(fs Faults) float64 { return fs.PutErrorRate }); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if len(data) > 0 && f.roll(f.faults.PartialWriteRate) {
+		data = data[:f.rand.Intn(len(data))]
+	}
+	f.mu.Unlock()
+	return f.impl.Put(ctx, key, data)
+}
+
+func (f *FaultInjectingCache) Delete(ctx context.Context, key string) error {
+	if err := f.inject(ctx, func(fs Faults) float64 { return fs.DeleteErrorRate }); err != nil {
+		return err
+	}
+	return f.impl.Delete(ctx, key)
+}
+
+func (f *FaultInjectingCache) List(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := f.impl.(Lister)
+	if !ok {
+		return nil, errors.New("underlying cache doesn't support listing")
+	}
+	if err := f.inject(ctx, func(fs Faults) float64 { return fs.ListErrorRate }); err != nil {
+		return nil, err
+	}
+	return lister.List(ctx, prefix)
+}
+
+func (f *FaultInjectingCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	purger, ok := f.impl.(Purger)
+	if !ok {
+		return nil, errors.New("underlying cache doesn't support purging")
+	}
+	if err := f.inject(ctx, func(fs Faults) float64 { return fs.ListErrorRate }); err != nil {
+		return nil, err
+	}
+	return purger.Purge(ctx, olderThan, keep)
+}
@@ -0,0 +1,112 @@
+package wile
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+type KeyType string
+
+const (
+	RSA2048   KeyType = "rsa2048"
+	RSA4096   KeyType = "rsa4096"
+	ECDSAP256 KeyType = "ecdsa-p256"
+	ECDSAP384 KeyType = "ecdsa-p384"
+)
+
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", t)
+	}
+}
+
+// AccountKey loads the ACME account key of type t from cache, generating and
+// storing a new one if there isn't one yet. P-256 keys are stored under the
+// same name autocert uses, so existing accounts keep working.
+func AccountKey(ctx context.Context, cache autocert.Cache, t KeyType) (crypto.Signer, error) {
+	name := accountKeyName(t)
+
+	data, err := cache.Get(ctx, name)
+	if err == autocert.ErrCacheMiss {
+		key, err := GenerateKey(t)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate account key")
+		}
+
+		data, err = encodeKey(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode account key")
+		}
+
+		err = cache.Put(ctx, name, data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to store account key")
+		}
+
+		return key, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get account key")
+	}
+
+	return decodeKey(data)
+}
+
+func accountKeyName(t KeyType) string {
+	if t == ECDSAP256 {
+		return "acme_account+key"
+	}
+	return "acme_account+key+" + string(t)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	var pb *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		pb = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pb = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return pem.EncodeToMemory(pb), nil
+}
+
+func decodeKey(data []byte) (crypto.Signer, error) {
+	pb, _ := pem.Decode(data)
+	if pb == nil {
+		return nil, errors.New("failed to decode key PEM")
+	}
+
+	switch pb.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(pb.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(pb.Bytes)
+	default:
+		return nil, fmt.Errorf("unknown key PEM type %q", pb.Type)
+	}
+}
@@ -0,0 +1,162 @@
+package wile
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// DefaultLayeredCacheEntries is the number of entries a LayeredCache keeps in
+// memory, unless set with SetMaxEntries.
+const DefaultLayeredCacheEntries = 10000
+
+// LayeredCache keeps values read from or written to impl in memory for ttl.
+// If impl fails, expired values are still served, so an outage of the
+// underlying cache doesn't affect entries that were seen before, as long as
+// they haven't been evicted to make room for others.
+type LayeredCache struct {
+	impl       autocert.Cache
+	ttl        time.Duration
+	clock      Clock
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]layeredEntry
+}
+
+type layeredEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+func NewLayeredCache(impl autocert.Cache, ttl time.Duration) *LayeredCache {
+	return &LayeredCache{
+		impl:       impl,
+		ttl:        ttl,
+		clock:      SystemClock,
+		maxEntries: DefaultLayeredCacheEntries,
+		entries:    make(map[string]layeredEntry),
+	}
+}
+
+// SetClock sets the clock entries expire by, e.g. to a FakeClock in tests. It
+// must be called before the cache is used.
+func (l *LayeredCache) SetClock(c Clock) {
+	l.clock = c
+}
+
+// SetMaxEntries sets the number of entries kept in memory. Once there are
+// that many, expired entries are evicted first, then the ones expiring
+// soonest. It must be called before the cache is used.
+func (l *LayeredCache) SetMaxEntries(n int) {
+	l.maxEntries = n
+}
+
+func (l *LayeredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	l.mu.Lock()
+	e, ok := l.entries[key]
+	l.mu.Unlock()
+
+	if ok && l.clock.Now().Before(e.expires) {
+		return e.data, nil
+	}
+
+	data, err := l.impl.Get(ctx, key)
+	if err == autocert.ErrCacheMiss {
+		l.forget(key)
+		return nil, err
+	}
+	if err != nil {
+		if ok {
+			return e.data, nil
+		}
+		return nil, err
+	}
+
+	l.remember(key, data)
+	return data, nil
+}
+
+func (l *LayeredCache) Put(ctx context.Context, key string, data []byte) error {
+	err := l.impl.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+
+	l.remember(key, data)
+	return nil
+}
+
+func (l *LayeredCache) Delete(ctx context.Context, key string) error {
+	l.forget(key)
+	return l.impl.Delete(ctx, key)
+}
+
+// Invalidate drops key from memory, so that the next Get reads it from impl.
+func (l *LayeredCache) Invalidate(key string) {
+	l.forget(key)
+}
+
+func (l *LayeredCache) remember(key string, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if _, ok := l.entries[key]; !ok && len(l.entries) >= l.maxEntries {
+		l.evict(now)
+	}
+	l.entries[key] = layeredEntry{
+		data:    data,
+		expires: now.Add(l.ttl),
+	}
+}
+
+// evict makes room for an entry, by dropping the expired entries, or the one
+// expiring soonest if none has expired. l.mu must be held.
+func (l *LayeredCache) evict(now time.Time) {
+	var soonest string
+	var soonestExpires time.Time
+	for key, e := range l.entries {
+		if !now.Before(e.expires) {
+			delete(l.entries, key)
+			continue
+		}
+		if soonestExpires.IsZero() || e.expires.Before(soonestExpires) {
+			soonest, soonestExpires = key, e.expires
+		}
+	}
+	if len(l.entries) >= l.maxEntries {
+		delete(l.entries, soonest)
+	}
+}
+
+func (l *LayeredCache) forget(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+func (l *LayeredCache) List(ctx context.Context, prefix string) ([]string, error) {
+	lister, ok := l.impl.(Lister)
+	if !ok {
+		return nil, errors.New("underlying cache doesn't support listing")
+	}
+	return lister.List(ctx, prefix)
+}
+
+func (l *LayeredCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	purger, ok := l.impl.(Purger)
+	if !ok {
+		return nil, errors.New("underlying cache doesn't support purging")
+	}
+
+	purged, err := purger.Purge(ctx, olderThan, keep)
+	for _, key := range purged {
+		l.forget(key)
+	}
+	return purged, err
+}
@@ -0,0 +1,150 @@
+package wile
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// TestLayeredCacheOutage checks that LayeredCache serves what it has seen
+// while the underlying cache fails, and reads it again once the cache is back
+// and the entry expired.
+func TestLayeredCacheOutage(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))
+	faulty := NewFaultInjectingCache(NewMemoryCache(), Faults{}, 1)
+	l := NewLayeredCache(faulty, time.Minute)
+	l.SetClock(clock)
+
+	if err := l.Put(ctx, "seen", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := faulty.Put(ctx, "unseen", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	faulty.SetFaults(Faults{GetErrorRate: 1, PutErrorRate: 1})
+	clock.Advance(time.Hour)
+
+	tests := []struct {
+		key     string
+		want    []byte
+		wantErr error
+	}{
+		{"seen", []byte("v1"), nil},
+		{"unseen", nil, ErrCacheUnavailable},
+	}
+	for _, tt := range tests {
+		got, err := l.Get(ctx, tt.key)
+		if errors.Cause(err) != tt.wantErr || !bytes.Equal(got, tt.want) {
+			t.Errorf("Get(%q) during outage = %q, %v; want %q, %v", tt.key, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if err := l.Put(ctx, "seen", []byte("v2")); errors.Cause(err) != ErrCacheUnavailable {
+		t.Errorf("Put during outage = %v, want %v", err, ErrCacheUnavailable)
+	}
+	if n := faulty.Injected(); n != 3 {
+		t.Errorf("Injected() = %d, want 3", n)
+	}
+
+	// Another writer changes the value once the outage is over. The old one
+	// is served until it expires.
+	faulty.SetFaults(Faults{})
+	if err := faulty.Put(ctx, "seen", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := l.Get(ctx, "seen"); string(got) != "v2" {
+		t.Errorf("Get after outage = %q, want %q", got, "v2")
+	}
+	if err := faulty.Put(ctx, "seen", []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	if got, _ := l.Get(ctx, "seen"); string(got) != "v2" {
+		t.Errorf("Get before expiry = %q, want %q", got, "v2")
+	}
+	clock.Advance(time.Minute)
+	if got, _ := l.Get(ctx, "seen"); string(got) != "v3" {
+		t.Errorf("Get after expiry = %q, want %q", got, "v3")
+	}
+}
+
+// TestLayeredCacheEviction checks that LayeredCache keeps at most
+// maxEntries in memory, evicting expired entries before live ones.
+func TestLayeredCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock(time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))
+	faulty := NewFaultInjectingCache(NewMemoryCache(), Faults{}, 1)
+	l := NewLayeredCache(faulty, time.Minute)
+	l.SetClock(clock)
+	l.SetMaxEntries(3)
+
+	put := func(key string) {
+		if err := l.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("a")
+	put("b")
+	clock.Advance(30 * time.Second)
+	put("c")
+	// Updating an entry doesn't evict another.
+	put("c")
+	clock.Advance(40 * time.Second)
+
+	// a and b have expired, so both make room for d.
+	put("d")
+	put("e")
+	// c expires before d and e, so it makes room for f.
+	put("f")
+
+	l.mu.Lock()
+	var kept []string
+	for key := range l.entries {
+		kept = append(kept, key)
+	}
+	l.mu.Unlock()
+	sort.Strings(kept)
+	if want := []string{"d", "e", "f"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %q, want %q", kept, want)
+	}
+
+	// Evicted entries are no longer served during an outage.
+	faulty.SetFaults(Faults{GetErrorRate: 1})
+	clock.Advance(time.Hour)
+	if got, err := l.Get(ctx, "d"); err != nil || string(got) != "d" {
+		t.Errorf("Get of a kept entry during outage = %q, %v", got, err)
+	}
+	if _, err := l.Get(ctx, "c"); errors.Cause(err) != ErrCacheUnavailable {
+		t.Errorf("Get of an evicted entry during outage = %v, want %v", err, ErrCacheUnavailable)
+	}
+}
+
+func TestFaultInjectingCachePartialWrites(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryCache()
+	f := NewFaultInjectingCache(mem, Faults{PartialWriteRate: 1}, 1)
+
+	data := []byte("0123456789")
+	if err := f.Put(ctx, "key", data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mem.Get(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) >= len(data) || !bytes.HasPrefix(data, got) {
+		t.Errorf("stored %q, want a strict prefix of %q", got, data)
+	}
+
+	f.SetFaults(Faults{})
+	if _, err := f.Get(ctx, "missing"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get of missing key = %v, want %v", err, autocert.ErrCacheMiss)
+	}
+}
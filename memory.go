@@ -0,0 +1,81 @@
+package wile
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+type MemoryCache struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+	// mtimes are the times keys were last written, for Purge.
+	mtimes map[string]time.Time
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{data: make(map[string][]byte), mtimes: make(map[string]time.Time)}
+}
+
+func (m *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.data[key]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (m *MemoryCache) Put(ctx context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data[key] = data
+	m.mtimes[key] = time.Now()
+	return nil
+}
+
+func (m *MemoryCache) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, key)
+	delete(m.mtimes, key)
+	return nil
+}
+
+func (m *MemoryCache) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []string
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged []string
+	for k, mtime := range m.mtimes {
+		if mtime.Before(olderThan) && purgeable(k, keep) {
+			delete(m.data, k)
+			delete(m.mtimes, k)
+			purged = append(purged, k)
+		}
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
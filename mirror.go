@@ -0,0 +1,99 @@
+package wile
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// MirrorCache writes to all of its caches and reads from the first one that
+// has a value. Values found in a later cache are copied into the earlier
+// caches that missed them.
+type MirrorCache struct {
+	caches []autocert.Cache
+}
+
+func NewMirrorCache(caches ...autocert.Cache) *MirrorCache {
+	return &MirrorCache{caches}
+}
+
+func (m *MirrorCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var (
+		missed   []autocert.Cache
+		firstErr error
+	)
+	for i, c := range m.caches {
+		data, err := c.Get(ctx, key)
+		if err == autocert.ErrCacheMiss {
+			missed = append(missed, c)
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to get from cache %d", i)
+			}
+			continue
+		}
+
+		for _, mc := range missed {
+			// Best effort; the value will be copied on the next read otherwise.
+			_ = mc.Put(ctx, key, data)
+		}
+		return data, nil
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, autocert.ErrCacheMiss
+}
+
+func (m *MirrorCache) Put(ctx context.Context, key string, data []byte) error {
+	var firstErr error
+	for i, c := range m.caches {
+		err := c.Put(ctx, key, data)
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to put into cache %d", i)
+		}
+	}
+	return firstErr
+}
+
+func (m *MirrorCache) Delete(ctx context.Context, key string) error {
+	var firstErr error
+	for i, c := range m.caches {
+		err := c.Delete(ctx, key)
+		if err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "failed to delete from cache %d", i)
+		}
+	}
+	return firstErr
+}
+
+// List returns the union of the keys of all caches that support listing.
+func (m *MirrorCache) List(ctx context.Context, prefix string) ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+	for i, c := range m.caches {
+		lister, ok := c.(Lister)
+		if !ok {
+			continue
+		}
+
+		ck, err := lister.List(ctx, prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list cache %d", i)
+		}
+
+		for _, k := range ck {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,85 @@
+package wile
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// HostPatterns matches hosts against a list of patterns. A pattern is either
+// an exact host, a wildcard such as *.example.com, which matches every
+// subdomain of example.com but not example.com itself, or a regular
+// expression between slashes, such as /^api-[0-9]+\.example\.com$/.
+type HostPatterns struct {
+	exact    map[string]bool
+	suffixes []string
+	regexps  []*regexp.Regexp
+}
+
+func NewHostPatterns(patterns ...string) (*HostPatterns, error) {
+	p := &HostPatterns{exact: make(map[string]bool)}
+	for _, pat := range patterns {
+		switch {
+		case pat == "":
+			return nil, errors.New("empty host pattern")
+
+		case len(pat) >= 2 && strings.HasPrefix(pat, "/") && strings.HasSuffix(pat, "/"):
+			re, err := regexp.Compile(pat[1 : len(pat)-1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid host pattern %q", pat)
+			}
+			p.regexps = append(p.regexps, re)
+
+		case strings.HasPrefix(pat, "*."):
+			if len(pat) == 2 || strings.Contains(pat[2:], "*") {
+				return nil, errors.Errorf("invalid host pattern %q", pat)
+			}
+			p.suffixes = append(p.suffixes, pat[1:])
+
+		case strings.Contains(pat, "*"):
+			return nil, errors.Errorf("invalid host pattern %q, wildcards are only allowed as the first label", pat)
+
+		default:
+			p.exact[pat] = true
+		}
+	}
+	return p, nil
+}
+
+// Match reports whether host matches any of the patterns.
+func (p *HostPatterns) Match(host string) bool {
+	if p == nil {
+		return false
+	}
+	if p.exact[host] {
+		return true
+	}
+	for _, s := range p.suffixes {
+		if len(host) > len(s) && strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostPolicy returns a policy that allows the hosts matched by allow, unless
+// they are also matched by deny. Either may be nil.
+func HostPolicy(allow, deny *HostPatterns) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		if deny.Match(host) {
+			return withKind(ErrUnknownHost, errors.Errorf("host %q is denied", host))
+		}
+		if !allow.Match(host) {
+			return withKind(ErrUnknownHost, errors.Errorf("host %q not allowed", host))
+		}
+		return nil
+	}
+}
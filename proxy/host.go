@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/idna"
+)
+
+// NormalizeHost returns host the way hosts are compared: lowercase, without a
+// trailing dot, and with Unicode labels converted to punycode. A port is kept
+// as is.
+func NormalizeHost(host string) (string, error) {
+	if isNormalized(host) {
+		return host, nil
+	}
+
+	port := ""
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		port = p
+	}
+	host = StripPort(host)
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !isASCII(host) {
+		var err error
+		host, err = idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return joinHost(host, port), nil
+}
+
+// StripPort returns host without its port, if any, and without the brackets
+// of an IPv6 literal.
+func StripPort(host string) string {
+	if !strings.Contains(host, ":") {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// joinHost is the inverse of StripPort, adding port unless it is empty.
+func joinHost(host, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// isNormalized reports whether NormalizeHost would return host unchanged,
+// without allocating.
+func isNormalized(host string) bool {
+	for i := 0; i < len(host); i++ {
+		if c := host[i]; c >= 0x80 || 'A' <= c && c <= 'Z' {
+			return false
+		}
+	}
+	return !strings.HasSuffix(host, ".") && !strings.Contains(host, ".:")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRequestHost normalizes the Host of requests before passing them to
+// h, and rejects requests with invalid hosts.
+func normalizeRequestHost(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, err := NormalizeHost(req.Host)
+		if err != nil {
+			http.Error(rw, "Invalid host", http.StatusBadRequest)
+			return
+		}
+		req.Host = host
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// normalizeServerName normalizes the SNI of handshakes before passing them to
+// getCertificate.
+func normalizeServerName(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name, err := NormalizeHost(hello.ServerName)
+		if err != nil {
+			return nil, errors.Errorf("invalid server name %q: %v", hello.ServerName, err)
+		}
+		if name != hello.ServerName {
+			h := *hello
+			h.ServerName = name
+			hello = &h
+		}
+		return getCertificate(hello)
+	}
+}
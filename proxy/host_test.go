@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:443", "example.com:443"},
+		{"Example.com.:8080", "example.com:8080"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example:443", "xn--bcher-kva.example:443"},
+		{"[::1]", "[::1]"},
+		{"[::1]:443", "[::1]:443"},
+		{"[FE80::1]", "[fe80::1]"},
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeHost(tt.host)
+		if err != nil {
+			t.Errorf("NormalizeHost(%q): %v", tt.host, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NormalizeHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:443", "example.com"},
+		{"[::1]", "::1"},
+		{"[::1]:443", "::1"},
+		{"::1", "::1"},
+		{"127.0.0.1:80", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := StripPort(tt.host); got != tt.want {
+			t.Errorf("StripPort(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	served := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("served"))
+	})
+	tests := []struct {
+		port       int
+		host, path string
+		want       string
+	}{
+		{0, "example.com", "/a?b=c", "https://example.com/a?b=c"},
+		{443, "example.com:80", "/", "https://example.com/"},
+		{8443, "example.com:8080", "/", "https://example.com:8443/"},
+		{0, "Example.COM.", "/", "https://example.com/"},
+		{0, "[::1]:80", "/", "https://[::1]/"},
+		{8443, "[::1]", "/", "https://[::1]:8443/"},
+		// Plain hosts are served over HTTP, whatever their port.
+		{0, "plain.example.com:8080", "/", ""},
+	}
+	for _, tt := range tests {
+		s := NewServer(served, nil, WithRedirectPort(tt.port), WithPlainHosts("plain.example.com"))
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		rw := httptest.NewRecorder()
+		s.HTTP().Handler.ServeHTTP(rw, req)
+
+		if tt.want == "" {
+			if rw.Body.String() != "served" {
+				t.Errorf("%q wasn't served over HTTP: %d %q", tt.host, rw.Code, rw.Header().Get("Location"))
+			}
+			continue
+		}
+		if got := rw.Header().Get("Location"); rw.Code/100 != 3 || got != tt.want {
+			t.Errorf("%q%s with port %d redirected to %q (%d), want %q", tt.host, tt.path, tt.port, got, rw.Code, tt.want)
+		}
+	}
+}
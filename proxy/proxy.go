@@ -0,0 +1,74 @@
+// Package proxy contains the building blocks of the wile server: a Router
+// that picks a handler by host, a Proxy to a single backend and a Server that
+// serves them over HTTPS.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Proxy is a reverse proxy to a single backend.
+type Proxy struct {
+	rp           *httputil.ReverseProxy
+	transformers []Transformer
+}
+
+type Option func(*Proxy)
+
+// WithErrorHandler sets the function that answers requests the backend
+// failed. The default answers with ErrorStatus(err) and no body.
+func WithErrorHandler(f func(rw http.ResponseWriter, req *http.Request, err error)) Option {
+	return func(p *Proxy) {
+		p.rp.ErrorHandler = f
+	}
+}
+
+// WithTransport sets the transport used to reach the backend. The default is
+// http.DefaultTransport.
+func WithTransport(t http.RoundTripper) Option {
+	return func(p *Proxy) {
+		p.rp.Transport = t
+	}
+}
+
+// New creates a Proxy that forwards requests to target.
+func New(target *url.URL, opts ...Option) *Proxy {
+	p := &Proxy{rp: httputil.NewSingleHostReverseProxy(target)}
+	p.rp.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		rw.WriteHeader(ErrorStatus(err))
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	base := p.rp.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	p.rp.Transport = &transformingTransport{base, p.transformers}
+	return p
+}
+
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.rp.ServeHTTP(rw, req)
+}
+
+// ErrorStatus returns the status to answer a request the backend failed with:
+// 504 Gateway Timeout if it timed out, 502 Bad Gateway otherwise.
+func ErrorStatus(err error) int {
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	if strings.Contains(err.Error(), "timeout awaiting response headers") {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
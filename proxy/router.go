@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// Router passes requests to the handler of their host. Handlers can be added
+// while it serves.
+type Router struct {
+	notFound http.Handler
+
+	mu           sync.RWMutex
+	hosts        map[string]http.Handler
+	patterns     []pattern
+	transformers map[string][]Transformer
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	handler http.Handler
+}
+
+type RouterOption func(*Router)
+
+// WithNotFound sets the handler for requests to unknown hosts. The default is
+// http.NotFoundHandler.
+func WithNotFound(h http.Handler) RouterOption {
+	return func(r *Router) {
+		r.notFound = h
+	}
+}
+
+func NewRouter(opts ...RouterOption) *Router {
+	r := &Router{
+		notFound:     http.NotFoundHandler(),
+		hosts:        make(map[string]http.Handler),
+		transformers: make(map[string][]Transformer),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Handle routes requests for host to h, replacing any previous handler. Hosts
+// are compared after NormalizeHost, and without their port.
+func (r *Router) Handle(host string, h http.Handler) {
+	if n, err := NormalizeHost(host); err == nil {
+		host = n
+	}
+	host = StripPort(host)
+	r.mu.Lock()
+	r.hosts[host] = h
+	r.mu.Unlock()
+}
+
+// HandleMatching routes requests for hosts matching re to h, unless they have
+// a handler of their own. Patterns are tried in the order they were added.
+func (r *Router) HandleMatching(re *regexp.Regexp, h http.Handler) {
+	r.mu.Lock()
+	r.patterns = append(r.patterns, pattern{re, h})
+	r.mu.Unlock()
+}
+
+// Transform adds transformers to the requests for host that are proxied, by
+// whichever Proxy they are routed to. They are applied after the transformers
+// of the Proxy itself.
+func (r *Router) Transform(host string, ts ...Transformer) {
+	if n, err := NormalizeHost(host); err == nil {
+		host = n
+	}
+	host = StripPort(host)
+	r.mu.Lock()
+	r.transformers[host] = append(r.transformers[host], ts...)
+	r.mu.Unlock()
+}
+
+func (r *Router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	host, err := NormalizeHost(req.Host)
+	if err != nil {
+		r.notFound.ServeHTTP(rw, req)
+		return
+	}
+	h, ts := r.handler(StripPort(host))
+	if len(ts) > 0 {
+		req = withRouteTransformers(req, ts)
+	}
+	h.ServeHTTP(rw, req)
+}
+
+func (r *Router) handler(host string) (http.Handler, []Transformer) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ts := r.transformers[host]
+	if h, ok := r.hosts[host]; ok {
+		return h, ts
+	}
+	for _, p := range r.patterns {
+		if p.re.MatchString(host) {
+			return p.handler, ts
+		}
+	}
+	return r.notFound, ts
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRouterHostMatching(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		})
+	}
+	r := NewRouter(WithNotFound(named("not found")))
+	r.Handle("example.com", named("example.com"))
+	r.Handle("Upper.Example.COM.", named("upper"))
+	r.Handle("bücher.example", named("idn"))
+	r.Handle("[::1]:8443", named("ipv6"))
+	r.HandleMatching(regexp.MustCompile(`^[a-z]+\.example\.org$`), named("first pattern"))
+	r.HandleMatching(regexp.MustCompile(`\.org$`), named("second pattern"))
+	r.Handle("www.example.org", named("exact over pattern"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:443", "example.com"},
+		{"Example.Com.:8080", "example.com"},
+		{"upper.example.com", "upper"},
+		{"xn--bcher-kva.example", "idn"},
+		{"BÜCHER.example", "idn"},
+		{"[::1]", "ipv6"},
+		{"[::1]:443", "ipv6"},
+		{"app.example.org", "first pattern"},
+		{"a.b.example.org", "second pattern"},
+		{"www.example.org", "exact over pattern"},
+		{"sub.example.com", "not found"},
+		{"example.com.evil.test", "not found"},
+		{"evilexample.com", "not found"},
+		{"", "not found"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, req)
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("host %q routed to %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkRouterLookup(b *testing.B) {
+	r := NewRouter()
+	nop := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for i := 0; i < 1000; i++ {
+		r.Handle(fmt.Sprintf("host%d.example.com", i), nop)
+	}
+	r.HandleMatching(regexp.MustCompile(`^[a-z]+\.example\.org$`), nop)
+
+	for _, host := range []string{"host500.example.com", "HOST500.Example.com.:443", "app.example.org"} {
+		b.Run(host, func(b *testing.B) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+			rw := httptest.NewRecorder()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.ServeHTTP(rw, req)
+			}
+		})
+	}
+}
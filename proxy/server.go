@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unrolled/secure"
+)
+
+// Server serves a handler over HTTPS and redirects HTTP requests to HTTPS.
+type Server struct {
+	handler        http.Handler
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	isDev        bool
+	wrapHTTP     func(http.Handler) http.Handler
+	redirectPort int
+	exemptPaths  []string
+	plainHosts   map[string]bool
+
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	tlsConfigHook     func(*tls.Config)
+}
+
+type ServerOption func(*Server)
+
+// WithDevelopment relaxes the security headers for local development.
+func WithDevelopment(isDev bool) ServerOption {
+	return func(s *Server) {
+		s.isDev = isDev
+	}
+}
+
+// WithHTTPHandler wraps the HTTP handler, e.g. with
+// autocert.Manager.HTTPHandler to answer ACME challenges.
+func WithHTTPHandler(wrap func(http.Handler) http.Handler) ServerOption {
+	return func(s *Server) {
+		s.wrapHTTP = wrap
+	}
+}
+
+// WithRedirectPort sets the port HTTP requests are redirected to. The
+// default is 443.
+func WithRedirectPort(port int) ServerOption {
+	return func(s *Server) {
+		s.redirectPort = port
+	}
+}
+
+// WithRedirectExemptPaths makes requests for paths with one of prefixes be
+// served over HTTP instead of redirected.
+func WithRedirectExemptPaths(prefixes ...string) ServerOption {
+	return func(s *Server) {
+		s.exemptPaths = append(s.exemptPaths, prefixes...)
+	}
+}
+
+// WithPlainHosts makes requests for hosts be served over HTTP instead of
+// redirected.
+func WithPlainHosts(hosts ...string) ServerOption {
+	return func(s *Server) {
+		for _, h := range hosts {
+			if n, err := NormalizeHost(h); err == nil {
+				h = n
+			}
+			s.plainHosts[StripPort(h)] = true
+		}
+	}
+}
+
+// WithTimeouts limits how long clients may take to send the headers of a
+// request, and how long idle connections are kept open. Zero means no limit.
+func WithTimeouts(readHeader, idle time.Duration) ServerOption {
+	return func(s *Server) {
+		s.readHeaderTimeout = readHeader
+		s.idleTimeout = idle
+	}
+}
+
+// WithTLSConfigHook calls f with the tls.Config of every HTTPS server, e.g. to
+// manage its session ticket keys.
+func WithTLSConfigHook(f func(*tls.Config)) ServerOption {
+	return func(s *Server) {
+		s.tlsConfigHook = f
+	}
+}
+
+// NewServer creates a Server for handler, using getCertificate for the certs
+// of HTTPS connections.
+func NewServer(handler http.Handler, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), opts ...ServerOption) *Server {
+	s := &Server{
+		handler:        handler,
+		getCertificate: getCertificate,
+		wrapHTTP:       func(h http.Handler) http.Handler { return h },
+		plainHosts:     make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// HTTPS returns a new http.Server to serve HTTPS with. Hosts and server names
+// are normalized with NormalizeHost before they are passed on.
+func (s *Server) HTTPS() *http.Server {
+	hs := &http.Server{
+		Handler:           normalizeRequestHost(SecurityHeaders(s.handler, s.isDev)),
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		IdleTimeout:       s.idleTimeout,
+		TLSConfig: &tls.Config{
+			GetCertificate: normalizeServerName(s.getCertificate),
+			MinVersion:     tls.VersionTLS13,
+		},
+	}
+	if s.tlsConfigHook != nil {
+		s.tlsConfigHook(hs.TLSConfig)
+	}
+	return hs
+}
+
+// HTTP returns a new http.Server to serve HTTP with.
+func (s *Server) HTTP() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", SecurityHeaders(http.HandlerFunc(s.redirect), s.isDev))
+
+	return &http.Server{
+		Handler:           normalizeRequestHost(s.wrapHTTP(mux)),
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		IdleTimeout:       s.idleTimeout,
+	}
+}
+
+func (s *Server) redirect(rw http.ResponseWriter, req *http.Request) {
+	host := StripPort(req.Host)
+	if s.plainHosts[host] {
+		s.handler.ServeHTTP(rw, req)
+		return
+	}
+	for _, p := range s.exemptPaths {
+		if strings.HasPrefix(req.URL.Path, p) {
+			s.handler.ServeHTTP(rw, req)
+			return
+		}
+	}
+
+	port := ""
+	if s.redirectPort != 0 && s.redirectPort != 443 {
+		port = strconv.Itoa(s.redirectPort)
+	}
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     joinHost(host, port),
+		Path:     req.URL.Path,
+		RawQuery: req.URL.RawQuery,
+	}
+	http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+}
+
+// SecurityHeaders adds HSTS, CSP and other security headers to the responses
+// of handler. If isDev is true, HSTS is left out.
+func SecurityHeaders(handler http.Handler, isDev bool) http.Handler {
+	secureMiddleware := secure.New(secure.Options{
+		STSSeconds:            60 * 60 * 24 * 365, // One year.
+		STSIncludeSubdomains:  true,
+		STSPreload:            true,
+		FrameDeny:             true,
+		ContentTypeNosniff:    true,
+		BrowserXssFilter:      true,
+		ContentSecurityPolicy: "object-src 'none'; script-src $NONCE 'unsafe-inline' 'strict-dynamic' https:; base-uri 'none';",
+		IsDevelopment:         isDev,
+	})
+	return secureMiddleware.Handler(handler)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Transformer wraps the transport a Proxy reaches its backend with, so that it
+// can change requests before they are sent and responses before they are
+// returned, e.g. to exchange auth tokens or rewrite HTML. Transformers that
+// change a response body must also fix or remove its Content-Length.
+type Transformer func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is a function that is an http.RoundTripper, for writing
+// Transformers.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WithTransformers adds transformers to all requests of a Proxy. The first one
+// sees requests first and responses last.
+func WithTransformers(ts ...Transformer) Option {
+	return func(p *Proxy) {
+		p.transformers = append(p.transformers, ts...)
+	}
+}
+
+type routeTransformersKey struct{}
+
+// withRouteTransformers makes the Proxy serving req also apply ts, after its
+// own transformers.
+func withRouteTransformers(req *http.Request, ts []Transformer) *http.Request {
+	if prev, ok := req.Context().Value(routeTransformersKey{}).([]Transformer); ok {
+		ts = append(prev[:len(prev):len(prev)], ts...)
+	}
+	return req.WithContext(context.WithValue(req.Context(), routeTransformersKey{}, ts))
+}
+
+// transformingTransport applies the transformers of a Proxy and of the route
+// of each request to base.
+type transformingTransport struct {
+	base         http.RoundTripper
+	transformers []Transformer
+}
+
+func (t *transformingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.base
+	route, _ := req.Context().Value(routeTransformersKey{}).([]Transformer)
+	for i := len(route) - 1; i >= 0; i-- {
+		rt = route[i](rt)
+	}
+	for i := len(t.transformers) - 1; i >= 0; i-- {
+		rt = t.transformers[i](rt)
+	}
+	return rt.RoundTrip(req)
+}
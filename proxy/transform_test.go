@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// trace is a Transformer that adds name to the X-Trace header of requests
+// and responses.
+func trace(name string) Transformer {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Add("X-Trace", name)
+			resp, err := next.RoundTrip(req)
+			if err == nil {
+				resp.Header.Add("X-Trace", name)
+			}
+			return resp, err
+		})
+	}
+}
+
+// newTraceBackend returns a backend that answers with the X-Trace header of
+// the request.
+func newTraceBackend(t *testing.T) (*url.URL, func()) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(strings.Join(req.Header["X-Trace"], ",")))
+	}))
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, s.Close
+}
+
+func TestTransformerOrder(t *testing.T) {
+	backend, closeBackend := newTraceBackend(t)
+	defer closeBackend()
+
+	p := New(backend, WithTransformers(trace("p1"), trace("p2")), WithTransformers(trace("p3")))
+	inner := NewRouter()
+	inner.Handle("a.example.com", p)
+	inner.Handle("b.example.com", p)
+	inner.Transform("A.example.com.", trace("inner"))
+	outer := NewRouter()
+	outer.Handle("a.example.com", inner)
+	outer.Handle("b.example.com", inner)
+	outer.Transform("a.example.com:443", trace("outer"))
+
+	tests := []struct {
+		host     string
+		wantReq  string
+		wantResp string
+	}{
+		// The transformers of the Proxy come first, then those of the routes
+		// from the outermost one.
+		{"a.example.com", "p1,p2,p3,outer,inner", "inner,outer,p3,p2,p1"},
+		{"b.example.com", "p1,p2,p3", "p3,p2,p1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		rw := httptest.NewRecorder()
+		outer.ServeHTTP(rw, req)
+
+		if got := rw.Body.String(); got != tt.wantReq {
+			t.Errorf("%s: request transformed by %q, want %q", tt.host, got, tt.wantReq)
+		}
+		if got := strings.Join(rw.Header()["X-Trace"], ","); got != tt.wantResp {
+			t.Errorf("%s: response transformed by %q, want %q", tt.host, got, tt.wantResp)
+		}
+	}
+}
+
+func TestTransformerRewritesBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Write([]byte("<p>Hello</p>"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	rewrite := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			body = bytes.Replace(body, []byte("Hello"), []byte("Hello, world"), -1)
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			return resp, nil
+		})
+	}
+
+	s := httptest.NewServer(New(u, WithTransformers(rewrite)))
+	defer s.Close()
+	resp, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<p>Hello, world</p>"; string(body) != want || resp.ContentLength != int64(len(want)) {
+		t.Errorf("got %q with length %d, want %q", body, resp.ContentLength, want)
+	}
+}
+
+func TestTransformerError(t *testing.T) {
+	backend, closeBackend := newTraceBackend(t)
+	defer closeBackend()
+
+	var failed error
+	deny := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("token exchange failed")
+		})
+	}
+	p := New(backend, WithTransformers(deny), WithErrorHandler(func(rw http.ResponseWriter, req *http.Request, err error) {
+		failed = err
+		rw.WriteHeader(ErrorStatus(err))
+	}))
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+	if failed == nil || failed.Error() != "token exchange failed" {
+		t.Errorf("error handler got %v", failed)
+	}
+}
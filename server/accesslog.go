@@ -0,0 +1,123 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+)
+
+// otherHosts is the metrics label of hosts beyond the cap of hostLabels.
+const otherHosts = "other"
+
+var (
+	httpRequests  = expvar.NewMap("http_requests")
+	httpResponses = expvar.NewMap("http_responses")
+)
+
+// hostLabels caps the number of hosts metrics are broken down by, so that
+// requests for random hosts can't grow them without bound. The configured
+// hosts are always labels of their own; other hosts get one until there are
+// max labels, and are counted as otherHosts after that.
+type hostLabels struct {
+	max int
+
+	mu     sync.RWMutex
+	labels map[string]bool
+}
+
+func newHostLabels(hosts []string, max int) *hostLabels {
+	l := &hostLabels{max: max, labels: make(map[string]bool)}
+	for _, h := range hosts {
+		l.labels[h] = true
+	}
+	return l
+}
+
+func (l *hostLabels) label(host string) string {
+	l.mu.RLock()
+	ok := l.labels[host]
+	l.mu.RUnlock()
+	if ok {
+		return host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.labels) >= l.max {
+		return otherHosts
+	}
+	l.labels[host] = true
+	return host
+}
+
+// accessLog counts requests by host and status class, and logs them. Only 1
+// in sample successful requests is logged; failed ones always are. If sample
+// is 0, nothing is logged.
+type accessLog struct {
+	hosts  *hostLabels
+	sample uint64
+	n      uint64
+}
+
+func newAccessLog(hosts *hostLabels, sample int) *accessLog {
+	return &accessLog{hosts: hosts, sample: uint64(sample)}
+}
+
+func (a *accessLog) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(sr, req)
+
+		httpRequests.Add(a.hosts.label(proxy.StripPort(req.Host)), 1)
+		httpResponses.Add(fmt.Sprintf("%dxx", sr.status/100), 1)
+
+		if a.sample == 0 {
+			return
+		}
+		if sr.status < 400 && atomic.AddUint64(&a.n, 1)%a.sample != 0 {
+			return
+		}
+		glog.Infof("%s %s %s%s %d %d %v", req.RemoteAddr, req.Method, req.Host, req.URL.RequestURI(), sr.status, sr.bytes, time.Since(start))
+	})
+}
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMECertManager creates a certManager that obtains certs with ACME as
+// configured by cfg, and stores them in etcd.
+func newACMECertManager(etcd *clientv3.Client, cfg *config, tenants *tenants, domains []string, configured, policy autocert.HostPolicy, auditLog *wile.AuditLog) *certManager {
+	if cfg.certKey == "" {
+		log.Fatal("Must provide -cert_key")
+	}
+
+	etcdCache := wile.NewEtcdCache(etcd, "/wile/acme/http")
+	health := newCacheHealth(cfg.outagePolicy)
+	layered := wile.NewLayeredCache(&healthCache{etcdCache, health}, cfg.cacheTTL)
+
+	var backing autocert.Cache = layered
+	if cfg.mirrorDir != "" {
+		backing = wile.NewMirrorCache(backing, autocert.DirCache(cfg.mirrorDir))
+	}
+
+	encrypting, err := wile.NewEncryptingCache(backing, []byte(cfg.certKey))
+	if err != nil {
+		log.Fatalf("Failed to create cache: %v", err)
+	}
+
+	if tenants != nil {
+		tenants.certs = encrypting
+	}
+	auditor := &auditor{log: auditLog, tenants: tenants}
+	var cache autocert.Cache = &auditingCache{Cache: encrypting, auditor: auditor}
+	if cfg.challengeWebhook != "" {
+		cache = newWebhookCache(cache, cfg.challengeWebhook, cfg.challengeWebhookSecret)
+	}
+
+	for _, endpoint := range strings.Split(cfg.acmeEndpoints, ",") {
+		if endpoint == "" {
+			log.Fatal("Empty ACME server not allowed")
+		}
+	}
+
+	switch wile.KeyType(cfg.certKeyType) {
+	case "auto", "rsa":
+	case wile.RSA2048, wile.RSA4096, wile.ECDSAP256, wile.ECDSAP384:
+		log.Fatalf("Unsupported -cert_key_type %q: autocert only generates ECDSA P-256 and RSA 2048 certificate keys, use auto or rsa", cfg.certKeyType)
+	default:
+		log.Fatalf("Unknown -cert_key_type %q", cfg.certKeyType)
+	}
+
+	var (
+		key       crypto.Signer
+		transport http.RoundTripper
+	)
+	if cfg.standby {
+		// Without a key, autocert would read or create the account in the
+		// cache. This one is never used.
+		key, err = wile.GenerateKey(wile.ECDSAP256)
+		if err != nil {
+			log.Fatalf("Failed to generate account key: %v", err)
+		}
+		transport = standbyTransport{}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		key, err = wile.AccountKey(ctx, cache, wile.KeyType(cfg.accountKeyType))
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to get account key: %v", err)
+		}
+		transport = newACMETransport(http.DefaultTransport)
+	}
+
+	var extensions []pkix.Extension
+	if cfg.mustStaple {
+		extensions = append(extensions, mustStapleExtension)
+	}
+	newManagers := func(cache autocert.Cache, transport http.RoundTripper) []*autocert.Manager {
+		var managers []*autocert.Manager
+		for _, endpoint := range strings.Split(cfg.acmeEndpoints, ",") {
+			hostPolicy := policy
+			if cfg.checkCAA && !cfg.standby {
+				hostPolicy = newCAAPolicy(policy, endpoint).HostPolicy
+			}
+			managers = append(managers, &autocert.Manager{
+				Prompt:      autocert.AcceptTOS,
+				Cache:       cache,
+				HostPolicy:  hostPolicy,
+				RenewBefore: renewBefore,
+				Client: &acme.Client{
+					Key:          key,
+					DirectoryURL: endpoint,
+					HTTPClient:   &http.Client{Transport: transport},
+				},
+				Email:           cfg.acmeEmail,
+				ExtraExtensions: extensions,
+			})
+		}
+		return managers
+	}
+
+	c := newCertManager(newManagers, configured, cache, transport, cfg.acmeAttempts, cfg.certKeyType == "rsa", auditor)
+	c.standby = cfg.standby
+	c.health = health
+	c.hashKey = encrypting.HashKey
+	go health.probeLoop(etcdCache)
+	go c.watchCerts(etcdCache.Watch(context.Background()), layered, domains)
+	return c
+}
+
+func hostPolicy(domains []string, onDemand *regexp.Regexp, discovered *discovery, deny *wile.HostPatterns) autocert.HostPolicy {
+	whitelist := autocert.HostWhitelist(domains...)
+	return func(ctx context.Context, host string) error {
+		if deny.Match(host) {
+			return &wile.Error{Kind: wile.ErrUnknownHost, Err: fmt.Errorf("host %q is denied", host)}
+		}
+		if onDemand != nil && onDemand.MatchString(host) {
+			return nil
+		}
+		if discovered.allows(host) {
+			return nil
+		}
+		if err := whitelist(ctx, host); err != nil {
+			return &wile.Error{Kind: wile.ErrUnknownHost, Err: err}
+		}
+		return nil
+	}
+}
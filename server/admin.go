@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"github.com/jonathanwei/wile/proxy"
+)
+
+type admin struct {
+	etcd     *clientv3.Client
+	certs    *certManager
+	domains  []string
+	pages    *statusPages
+	audit    *wile.AuditLog
+	renewals *renewalQueue
+	// tenants, if set, restrict every endpoint but /healthz and /debug/ to
+	// the hosts of the tenant whose API key is sent.
+	tenants *tenants
+	// debugToken, if set, is the bearer token required for /debug/ and the
+	// endpoints acting on certs, see operatorAuth.
+	debugToken string
+}
+
+func adminServer(addr string, a *admin) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/certs", a.tenants.tenantAuth(a.certStatus))
+	mux.HandleFunc("/maintenance", a.operatorAuth(addr, a.maintenance))
+	mux.HandleFunc("/renew", a.operatorAuth(addr, a.renew))
+	mux.HandleFunc("/revoke", a.operatorAuth(addr, a.revoke))
+	mux.HandleFunc("/audit", a.operatorAuth(addr, a.auditLog))
+	mux.HandleFunc("/renewals", a.tenants.tenantAuth(a.renewalStates))
+	mux.HandleFunc("/diagnose", a.operatorAuth(addr, a.diagnose))
+	if a.debugToken == "" && a.tenants == nil && !isLoopback(addr) {
+		glog.Warningf("Rejecting /maintenance, /renew, /revoke, /audit and /diagnose on non-loopback -admin_addr %q without -admin_debug_token", addr)
+	}
+
+	// Profiles and vars leak enough about the process that they are only
+	// served to clients with the token or, without one, on loopback.
+	if a.debugToken != "" || isLoopback(addr) {
+		debug := http.NewServeMux()
+		debug.HandleFunc("/debug/pprof/", pprof.Index)
+		debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debug.Handle("/debug/vars", expvar.Handler())
+		mux.Handle("/debug/", a.checkDebugToken(debug))
+	} else {
+		glog.Warningf("Not serving /debug/ on non-loopback -admin_addr %q without -admin_debug_token", addr)
+	}
+
+	glog.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func (a *admin) checkDebugToken(h http.Handler) http.Handler {
+	if a.debugToken == "" {
+		return h
+	}
+	want := []byte("Bearer " + a.debugToken)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// operatorAuth guards the endpoints that act on certs or reveal more than
+// their status the same way as /debug/: they require the debug token or,
+// without one, a loopback address. With tenants, the API key of a tenant also
+// gives access to its hosts. Anything else is rejected.
+func (a *admin) operatorAuth(addr string, h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + a.debugToken)
+	open := a.debugToken == "" && isLoopback(addr)
+	tenantH := a.tenants.tenantAuth(h)
+	return func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case a.debugToken != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) == 1:
+			h(rw, req)
+		case a.tenants != nil:
+			tenantH(rw, req)
+		case open:
+			h(rw, req)
+		default:
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		}
+	}
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// healthz reports the health of every etcd endpoint. It fails only if none of
+// them is reachable, since etcd itself tolerates losing a minority.
+func (a *admin) healthz(rw http.ResponseWriter, req *http.Request) {
+	if a.etcd == nil {
+		fmt.Fprintln(rw, "etcd: not configured")
+		return
+	}
+
+	var lines []string
+	healthy := 0
+	for _, ep := range a.etcd.Endpoints() {
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		status, err := a.etcd.Status(ctx, ep)
+		cancel()
+
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("etcd %s: unhealthy: %v", ep, err))
+			continue
+		}
+
+		healthy++
+		lines = append(lines, fmt.Sprintf("etcd %s: ok, version %s", ep, status.Version))
+	}
+
+	if healthy == 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, l := range lines {
+		fmt.Fprintln(rw, l)
+	}
+}
+
+// certStatus reports the certs of all configured hosts, as a table or, with
+// ?format=json, as JSON.
+func (a *admin) certStatus(rw http.ResponseWriter, req *http.Request) {
+	if a.certs == nil {
+		http.Error(rw, "Certs are not managed by ACME", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+
+	var domains []string
+	for _, d := range a.domains {
+		if a.tenants.allows(req, d) {
+			domains = append(domains, d)
+		}
+	}
+	statuses, err := a.certs.status(ctx, domains)
+	if err != nil {
+		glog.Errorf("Failed to get cert status: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(rw).Encode(statuses)
+		if err != nil {
+			glog.Errorf("Failed to write cert status: %v", err)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(rw, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tKEY\tSERIAL\tISSUER\tNOT BEFORE\tNOT AFTER\tDAYS LEFT\tLAST ERROR")
+	for _, s := range statuses {
+		var notBefore, notAfter, daysLeft string
+		if s.NotAfter != nil {
+			notBefore = s.NotBefore.Format(time.RFC3339)
+			notAfter = s.NotAfter.Format(time.RFC3339)
+			daysLeft = fmt.Sprint(s.DaysRemaining)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Domain, s.KeyType, s.Serial, s.Issuer, notBefore, notAfter, daysLeft, s.LastError)
+	}
+	tw.Flush()
+}
+
+// renew forces renewal of the certs of ?domain=.
+func (a *admin) renew(rw http.ResponseWriter, req *http.Request) {
+	domain, ok := a.certAction(rw, req)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Minute)
+	defer cancel()
+
+	err := a.certs.renew(ctx, domain)
+	if err != nil {
+		glog.Errorf("Failed to renew cert for %q: %v", domain, err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(rw, "Renewed cert for %s\n", domain)
+}
+
+// revoke revokes the certs of ?domain= for the optional ?reason=, e.g.
+// keyCompromise, and obtains new ones.
+func (a *admin) revoke(rw http.ResponseWriter, req *http.Request) {
+	domain, ok := a.certAction(rw, req)
+	if !ok {
+		return
+	}
+
+	reason, err := parseCRLReason(req.FormValue("reason"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Minute)
+	defer cancel()
+
+	err = a.certs.revoke(ctx, domain, reason)
+	if err != nil {
+		glog.Errorf("Failed to revoke cert for %q: %v", domain, err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(rw, "Revoked and renewed cert for %s\n", domain)
+}
+
+// certAction checks the common parts of requests that modify a cert and
+// returns the domain they are for.
+func (a *admin) certAction(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return "", false
+	}
+
+	if a.certs == nil {
+		http.Error(rw, "Certs are not managed by ACME", http.StatusNotFound)
+		return "", false
+	}
+
+	domain := req.FormValue("domain")
+	for _, d := range a.domains {
+		if d == domain && a.tenants.allows(req, d) {
+			return domain, true
+		}
+	}
+	http.Error(rw, fmt.Sprintf("Unknown domain %q", domain), http.StatusBadRequest)
+	return "", false
+}
+
+// maintenance lists the hosts in maintenance mode or, on POST, puts ?host= into
+// (?enabled=true) or out of (?enabled=false) maintenance mode.
+func (a *admin) maintenance(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		host := req.FormValue("host")
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if host == "" || err != nil {
+			http.Error(rw, "Need ?host= and ?enabled=true|false", http.StatusBadRequest)
+			return
+		}
+		// Hosts are matched the way the router matches them.
+		host, err = proxy.NormalizeHost(host)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid host: %v", err), http.StatusBadRequest)
+			return
+		}
+		host = proxy.StripPort(host)
+		if !a.tenants.allows(req, host) {
+			http.Error(rw, fmt.Sprintf("Host %q doesn't belong to tenant", host), http.StatusForbidden)
+			return
+		}
+
+		a.pages.setMaintenance(host, enabled)
+		glog.Infof("Set maintenance mode of %q to %v", host, enabled)
+	}
+
+	for _, h := range a.pages.maintenanceHosts() {
+		if a.tenants.allows(req, h) {
+			fmt.Fprintln(rw, h)
+		}
+	}
+}
+
+// auditLog returns the audit log as JSON, optionally only the entries of
+// ?domain=, along with whether the chain is intact and matches its
+// checkpoints.
+func (a *admin) auditLog(rw http.ResponseWriter, req *http.Request) {
+	if a.audit == nil {
+		http.Error(rw, "Certs are not managed by ACME", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+
+	entries, err := a.audit.Entries(ctx)
+	if err != nil {
+		glog.Errorf("Failed to read audit log: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	checkpoints, err := a.audit.Checkpoints(ctx)
+	if err != nil {
+		glog.Errorf("Failed to read audit checkpoints: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Verified bool              `json:"verified"`
+		Error    string            `json:"error,omitempty"`
+		Entries  []wile.AuditEntry `json:"entries"`
+		// Checkpoint is the latest checkpoint.
+		Checkpoint *wile.AuditCheckpoint `json:"checkpoint,omitempty"`
+	}{Verified: true, Entries: entries}
+
+	err = wile.VerifyAuditLog(entries)
+	if err == nil {
+		err = a.audit.VerifyCheckpoints(entries, checkpoints)
+	}
+	if err != nil {
+		resp.Verified = false
+		resp.Error = err.Error()
+	}
+	if len(checkpoints) > 0 {
+		resp.Checkpoint = &checkpoints[len(checkpoints)-1]
+	}
+
+	domain := req.FormValue("domain")
+	resp.Entries = nil
+	for _, e := range entries {
+		if (domain == "" || e.Domain == domain) && a.tenants.allows(req, e.Domain) {
+			resp.Entries = append(resp.Entries, e)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(resp)
+	if err != nil {
+		glog.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// renewalStates returns the renewal attempts and next retry of every domain
+// that needed a forced renewal, as JSON.
+func (a *admin) renewalStates(rw http.ResponseWriter, req *http.Request) {
+	if a.renewals == nil {
+		http.Error(rw, "Certs are not managed by ACME", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+
+	all, err := a.renewals.states(ctx)
+	if err != nil {
+		glog.Errorf("Failed to read renewal states: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var states []renewalState
+	for _, s := range all {
+		if a.tenants.allows(req, s.Domain) {
+			states = append(states, s)
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(states)
+	if err != nil {
+		glog.Errorf("Failed to write renewal states: %v", err)
+	}
+}
+
+// diagnose checks whether a cert could be issued for ?domain=, which doesn't
+// need to be configured yet, and reports why not, as a table or, with
+// ?format=json, as JSON. It fails if any check does.
+func (a *admin) diagnose(rw http.ResponseWriter, req *http.Request) {
+	if a.certs == nil {
+		http.Error(rw, "Certs are not managed by ACME", http.StatusNotFound)
+		return
+	}
+
+	domain, err := proxy.NormalizeHost(req.FormValue("domain"))
+	if err != nil || domain == "" {
+		http.Error(rw, "Need a valid ?domain=", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), time.Minute)
+	defer cancel()
+
+	domain = proxy.StripPort(domain)
+	if !a.tenants.allows(req, domain) {
+		http.Error(rw, fmt.Sprintf("Domain %q doesn't belong to tenant", domain), http.StatusForbidden)
+		return
+	}
+	ds := a.certs.diagnose(ctx, domain, a.renewals)
+	status := http.StatusOK
+	for _, d := range ds {
+		if !d.OK {
+			status = http.StatusConflict
+		}
+	}
+
+	if req.FormValue("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		err := json.NewEncoder(rw).Encode(ds)
+		if err != nil {
+			glog.Errorf("Failed to write diagnosis: %v", err)
+		}
+		return
+	}
+
+	rw.WriteHeader(status)
+	tw := tabwriter.NewWriter(rw, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, d := range ds {
+		result := "ok"
+		if !d.OK {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Check, result, d.Detail)
+	}
+	tw.Flush()
+}
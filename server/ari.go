@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultARIRetryAfter is how long renewal information is cached when the CA
+// doesn't say.
+const defaultARIRetryAfter = 6 * time.Hour
+
+// ariClient fetches ACME Renewal Information (RFC 9773), the window in which
+// a CA wants a cert to be renewed, e.g. earlier than usual ahead of a mass
+// revocation.
+type ariClient struct {
+	directoryURLs []string
+	client        *http.Client
+
+	mu sync.Mutex
+	// endpoints holds the renewalInfo URL of each directory, or "" if the CA
+	// doesn't support ARI.
+	endpoints map[string]string
+	windows   map[string]ariWindow
+}
+
+type ariWindow struct {
+	start, end time.Time
+	expires    time.Time
+}
+
+func newARIClient(directoryURLs []string) *ariClient {
+	return &ariClient{
+		directoryURLs: directoryURLs,
+		client:        &http.Client{Timeout: time.Minute},
+		endpoints:     make(map[string]string),
+		windows:       make(map[string]ariWindow),
+	}
+}
+
+// suggestedStart returns the start of the renewal window of leaf, and false
+// if none of the CAs has renewal information for it.
+func (a *ariClient) suggestedStart(ctx context.Context, leaf *x509.Certificate) (time.Time, bool, error) {
+	id := ariCertID(leaf)
+
+	a.mu.Lock()
+	w, ok := a.windows[id]
+	a.mu.Unlock()
+	if ok && time.Now().Before(w.expires) {
+		return w.start, !w.start.IsZero(), nil
+	}
+
+	var lastErr error
+	for _, dir := range a.directoryURLs {
+		endpoint, err := a.endpoint(ctx, dir)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if endpoint == "" {
+			continue
+		}
+
+		w, found, err := a.fetch(ctx, endpoint+"/"+id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		a.mu.Lock()
+		a.windows[id] = w
+		a.mu.Unlock()
+		return w.start, true, nil
+	}
+
+	// Remember that there is no window, so that the CAs aren't asked again
+	// on every check.
+	if lastErr == nil {
+		a.mu.Lock()
+		a.windows[id] = ariWindow{expires: time.Now().Add(defaultARIRetryAfter)}
+		a.mu.Unlock()
+	}
+	return time.Time{}, false, lastErr
+}
+
+func (a *ariClient) endpoint(ctx context.Context, directoryURL string) (string, error) {
+	a.mu.Lock()
+	endpoint, ok := a.endpoints[directoryURL]
+	a.mu.Unlock()
+	if ok {
+		return endpoint, nil
+	}
+
+	req, err := http.NewRequest("GET", directoryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get directory %q", directoryURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to get directory %q: %s", directoryURL, resp.Status)
+	}
+
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid directory %q", directoryURL)
+	}
+
+	a.mu.Lock()
+	a.endpoints[directoryURL] = dir.RenewalInfo
+	a.mu.Unlock()
+	return dir.RenewalInfo, nil
+}
+
+// fetch gets the renewal information at u, and false if the CA doesn't know
+// the cert.
+func (a *ariClient) fetch(ctx context.Context, u string) (ariWindow, bool, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return ariWindow{}, false, err
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ariWindow{}, false, errors.Wrap(err, "failed to get renewal information")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ariWindow{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ariWindow{}, false, errors.Errorf("failed to get renewal information: %s", resp.Status)
+	}
+
+	var info struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+		} `json:"suggestedWindow"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		return ariWindow{}, false, errors.Wrap(err, "invalid renewal information")
+	}
+
+	retryAfter := defaultARIRetryAfter
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		retryAfter = time.Duration(s) * time.Second
+	}
+	return ariWindow{
+		start:   info.SuggestedWindow.Start,
+		end:     info.SuggestedWindow.End,
+		expires: time.Now().Add(retryAfter),
+	}, true, nil
+}
+
+// ariCertID returns the ARI identifier of leaf: its authority key identifier
+// and the DER encoding of its serial number, base64url-encoded and joined by
+// a dot.
+func ariCertID(leaf *x509.Certificate) string {
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		// DER integers are signed, so positive ones can't start with a 1 bit.
+		serial = append([]byte{0}, serial...)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(leaf.AuthorityKeyId) + "." + enc.EncodeToString(serial)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// auditCheckpointInterval is how often the audit log is checkpointed.
+const auditCheckpointInterval = time.Hour
+
+// checkpointLoop regularly anchors the audit log, see wile.AuditLog.
+func checkpointLoop(log *wile.AuditLog) {
+	for range time.Tick(auditCheckpointInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err := log.Checkpoint(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("Failed to checkpoint audit log: %v", err)
+		}
+	}
+}
+
+// auditor records cert lifecycle events in the audit log and counts them in
+// the cert_events var. A nil auditor records nothing.
+type auditor struct {
+	log *wile.AuditLog
+	// tenants label events with the tenant of their domain.
+	tenants *tenants
+
+	// writes counts the certs stored for each domain.
+	writes sync.Map
+}
+
+func (a *auditor) record(event, domain, detail string) {
+	if a == nil {
+		return
+	}
+	certEvents.Add(event, 1)
+	if t := a.tenants.forHost(domain); t != nil {
+		detail = strings.TrimSpace(detail + " tenant=" + t.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := a.log.Append(ctx, event, domain, detail)
+	if err != nil {
+		// Failing to audit shouldn't take certs down with it.
+		glog.Errorf("Failed to record %s of %q in audit log: %v", event, domain, err)
+	}
+}
+
+// auditingCache records every cert autocert stores as issued or, if it
+// replaces an existing one, renewed. Whether one exists is known from the
+// reads passing through, since certs are looked up before they are obtained;
+// the cache is only read again for keys that haven't been read yet.
+type auditingCache struct {
+	autocert.Cache
+	auditor *auditor
+
+	// seen holds the SHA-256 digest of the cert under each key read or
+	// written, or "" if there was none.
+	seen sync.Map
+}
+
+func (a *auditingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := a.Cache.Get(ctx, key)
+	if _, _, ok := certCacheKey(key); ok {
+		switch err {
+		case nil:
+			a.seen.Store(key, certDigest(data))
+		case autocert.ErrCacheMiss:
+			a.seen.Store(key, "")
+		}
+	}
+	return data, err
+}
+
+func (a *auditingCache) Put(ctx context.Context, key string, data []byte) error {
+	domain, keyType, ok := certCacheKey(key)
+	if !ok {
+		return a.Cache.Put(ctx, key, data)
+	}
+
+	digest := certDigest(data)
+	event := "renewed"
+	prev, seen := a.seen.Load(key)
+	switch {
+	case !seen:
+		if _, err := a.Get(ctx, key); err == autocert.ErrCacheMiss {
+			event = "issued"
+		}
+	case prev == "":
+		event = "issued"
+	case prev == digest:
+		// The same cert written again isn't an event.
+		return a.Cache.Put(ctx, key, data)
+	}
+
+	err := a.Cache.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+	a.seen.Store(key, digest)
+
+	detail := "key=" + keyType
+	if leaf, err := parseLeaf(data); err == nil {
+		detail += fmt.Sprintf(" serial=%x issuer=%q not_after=%s", leaf.SerialNumber, leaf.Issuer.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	a.auditor.countWrite(domain)
+	a.auditor.record(event, domain, detail)
+	// Also on renewals, in case the cert was deleted and obtained again
+	// without this replica noticing.
+	if err := a.auditor.tenants.addCert(ctx, domain); err != nil {
+		glog.Errorf("Failed to count cert of %q: %v", domain, err)
+	}
+	return nil
+}
+
+func (a *auditingCache) Delete(ctx context.Context, key string) error {
+	err := a.Cache.Delete(ctx, key)
+	domain, _, ok := certCacheKey(key)
+	if !ok || err != nil {
+		return err
+	}
+	a.seen.Store(key, "")
+
+	if a.auditor == nil || a.auditor.tenants.forHost(domain) == nil {
+		return nil
+	}
+	// The slot of the domain's tenant is released once it has no cert left.
+	deleted, err := certDeleted(ctx, a.Cache, domain)
+	if err == nil && deleted {
+		err = a.auditor.tenants.removeCert(ctx, domain)
+	}
+	if err != nil {
+		glog.Errorf("Failed to release cert of %q: %v", domain, err)
+	}
+	return nil
+}
+
+func certDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
+
+func (a *auditor) countWrite(domain string) {
+	if a == nil {
+		return
+	}
+	n, _ := a.writes.LoadOrStore(domain, new(int64))
+	atomic.AddInt64(n.(*int64), 1)
+}
+
+// certWrites returns the number of certs stored for domain.
+func (a *auditor) certWrites(domain string) int64 {
+	if a == nil {
+		return 0
+	}
+	n, ok := a.writes.Load(domain)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(n.(*int64))
+}
+
+// certCacheKey returns the domain and key type of a cache key under which
+// autocert stores certs, and false for its other keys (account key, tokens)
+// and wile's own, such as wile.TicketKeysCacheKey.
+func certCacheKey(key string) (domain, keyType string, ok bool) {
+	if strings.HasPrefix(key, "acme_account") || strings.HasPrefix(key, "wile_") || strings.HasSuffix(key, "+token") || strings.HasSuffix(key, "+http-01") {
+		return "", "", false
+	}
+	if strings.HasSuffix(key, "+rsa") {
+		return strings.TrimSuffix(key, "+rsa"), "rsa", true
+	}
+	return key, "ecdsa", true
+}
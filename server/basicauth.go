@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// credentialGate only lets requests with valid credentials through: HTTP Basic
+// auth against an htpasswd file, or a bearer token from a list of them.
+type credentialGate struct {
+	realm string
+	// users maps user names to htpasswd hashes.
+	users  map[string]string
+	tokens []string
+}
+
+func (g *credentialGate) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if g.allowed(req) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		if g.users != nil {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="`+g.realm+`"`)
+		} else {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="`+g.realm+`"`)
+		}
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (g *credentialGate) allowed(req *http.Request) bool {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		ok := false
+		for _, t := range g.tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				ok = true
+			}
+		}
+		return ok
+	}
+
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := g.users[user]
+	return ok && checkHtpasswd(hash, pass)
+}
+
+// checkHtpasswd checks pass against an htpasswd hash. Only bcrypt and SHA-1
+// hashes are supported; loadHtpasswd rejects the others.
+func checkHtpasswd(hash, pass string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(strings.TrimPrefix(hash, "{SHA}"))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+func loadHtpasswd(path string) (map[string]string, error) {
+	users := make(map[string]string)
+	err := readLines(path, func(line string) error {
+		idx := strings.Index(line, ":")
+		if idx == -1 {
+			return errors.Errorf("invalid line %q", line)
+		}
+
+		user, hash := line[:idx], line[idx+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return errors.Errorf("unsupported hash for user %q, use bcrypt (htpasswd -B)", user)
+		}
+		users[user] = hash
+		return nil
+	})
+	return users, errors.Wrapf(err, "failed to read htpasswd file %q", path)
+}
+
+func loadTokens(path string) ([]string, error) {
+	var tokens []string
+	err := readLines(path, func(line string) error {
+		tokens = append(tokens, line)
+		return nil
+	})
+	return tokens, errors.Wrapf(err, "failed to read token file %q", path)
+}
+
+// readLines calls f with every line of the file at path that isn't empty or a
+// comment.
+func readLines(path string, f func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := f(line)
+		if err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// minRateGrace is how long clients may send request bodies at any rate before
+// the minimum rate is enforced.
+const minRateGrace = 10 * time.Second
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errTooSlow      = errors.New("request body sent too slowly")
+)
+
+// requestBuffer reads request bodies completely before passing requests on,
+// so that slow clients tie up a goroutine of ours instead of a backend
+// connection. Bodies are kept in memory up to memory bytes and spill to a
+// temporary file beyond that.
+type requestBuffer struct {
+	memory  int64
+	maxBody int64
+	// minRate is the minimum average rate in bytes per second clients must
+	// send bodies at after minRateGrace, or 0.
+	minRate int64
+}
+
+func newRequestBuffer(memory, maxBody, minRate int64) *requestBuffer {
+	return &requestBuffer{memory, maxBody, minRate}
+}
+
+func (b *requestBuffer) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		body, size, cleanup, err := b.read(rw, req)
+		defer cleanup()
+		switch {
+		case err == errBodyTooLarge:
+			http.Error(rw, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			glog.Infof("Failed to read request body from %s: %v", req.RemoteAddr, err)
+			http.Error(rw, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+		req.TransferEncoding = nil
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// read reads the body of req. cleanup must be called once the body is no
+// longer needed.
+func (b *requestBuffer) read(rw http.ResponseWriter, req *http.Request) (body io.Reader, size int64, cleanup func(), err error) {
+	cleanup = func() {}
+	if b.maxBody > 0 && req.ContentLength > b.maxBody {
+		return nil, 0, cleanup, errBodyTooLarge
+	}
+
+	var r io.Reader = req.Body
+	if b.minRate > 0 {
+		r = &rateReader{r: r, rc: http.NewResponseController(rw), minRate: b.minRate, start: time.Now()}
+	}
+	if b.maxBody > 0 {
+		// One more byte, to tell bodies of exactly maxBody from larger ones.
+		r = io.LimitReader(r, b.maxBody+1)
+	}
+
+	var mem bytes.Buffer
+	n, err := io.Copy(&mem, io.LimitReader(r, b.memory))
+	if err != nil {
+		return nil, 0, cleanup, err
+	}
+	if n < b.memory {
+		return &mem, n, cleanup, nil
+	}
+
+	f, err := ioutil.TempFile("", "wile-body-")
+	if err != nil {
+		return nil, 0, cleanup, errors.Wrap(err, "failed to create temporary file")
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	m, err := io.Copy(f, r)
+	if err != nil {
+		return nil, 0, cleanup, err
+	}
+	size = n + m
+	if b.maxBody > 0 && size > b.maxBody {
+		return nil, 0, cleanup, errBodyTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, cleanup, errors.Wrap(err, "failed to rewind temporary file")
+	}
+	return io.MultiReader(&mem, f), size, cleanup, nil
+}
+
+// rateReader fails reads once the average rate since start drops below
+// minRate, after minRateGrace. The deadline of each read is the time by
+// which the next byte is due, so that a stalled client doesn't block forever.
+type rateReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	minRate int64
+	start   time.Time
+	n       int64
+}
+
+func (rr *rateReader) Read(p []byte) (int, error) {
+	due := rr.start.Add(minRateGrace + time.Duration(rr.n)*time.Second/time.Duration(rr.minRate))
+	if time.Now().After(due) {
+		return 0, errTooSlow
+	}
+	rr.rc.SetReadDeadline(due)
+
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if err != nil && err != io.EOF && time.Now().After(due) {
+		err = errTooSlow
+	}
+	if err == io.EOF {
+		rr.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jonathanwei/wile"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// maxBundleSize limits how much of a config bundle is read.
+const maxBundleSize = 1 << 20
+
+// loadConfigBundle fetches the config bundle at source, either an https URL or
+// etcd:///<key>, verifies it against the base64 ed25519 public key in keyFile,
+// and sets the flags in it. The payload of the bundle is a JSON object of flag
+// names to values. Flags set on the command line can't also be in the bundle.
+func loadConfigBundle(source, keyFile string, connectEtcd func() (*clientv3.Client, error)) error {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read public key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.Errorf("%q doesn't hold a base64 ed25519 public key", keyFile)
+	}
+
+	bundle, err := fetchConfigBundle(source, connectEtcd)
+	if err != nil {
+		return err
+	}
+	payload, err := wile.OpenConfigBundle(ed25519.PublicKey(key), bundle)
+	if err != nil {
+		return err
+	}
+
+	var flags map[string]string
+	if err := json.Unmarshal(payload, &flags); err != nil {
+		return errors.Wrap(err, "invalid config in bundle")
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range flags {
+		switch {
+		case strings.HasPrefix(name, "config_bundle"):
+			return errors.Errorf("bundle can't set -%s", name)
+		case set[name]:
+			return errors.Errorf("-%s is set both on the command line and in the bundle", name)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return errors.Wrapf(err, "invalid -%s in bundle", name)
+		}
+	}
+	return nil
+}
+
+func fetchConfigBundle(source string, connectEtcd func() (*clientv3.Client, error)) ([]byte, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid bundle URL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch {
+	case u.Scheme == "https":
+		req, err := http.NewRequest("GET", source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to fetch bundle")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("failed to fetch bundle: %s", resp.Status)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to fetch bundle")
+		}
+		if len(data) > maxBundleSize {
+			return nil, errors.New("bundle is too large")
+		}
+		return data, nil
+
+	case u.Scheme == "etcd" && u.Host == "" && u.Path != "":
+		etcd, err := connectEtcd()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to etcd")
+		}
+		defer etcd.Close()
+
+		gr, err := etcd.Get(ctx, u.Path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read bundle")
+		}
+		if len(gr.Kvs) == 0 {
+			return nil, errors.Errorf("no bundle at %q in etcd", u.Path)
+		}
+		return gr.Kvs[0].Value, nil
+
+	default:
+		return nil, errors.Errorf("bundle URL %q must be https://... or etcd:///<key>", source)
+	}
+}
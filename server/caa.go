@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// caaTTL is how long CAA checks are cached, so that handshakes for hosts
+// without certs don't query DNS every time.
+const caaTTL = 5 * time.Minute
+
+// caaError means the CAA records of a domain don't allow a CA to issue certs
+// for it.
+type caaError struct {
+	msg string
+}
+
+func (e *caaError) Error() string {
+	return e.msg
+}
+
+// caaPolicy extends a host policy to reject domains whose CAA records don't
+// allow the CA at directoryURL to issue certs for them. autocert checks the
+// policy before ordering certs, so such orders never reach the CA. Failing to
+// look up the records doesn't reject domains; the CA will check them again.
+type caaPolicy struct {
+	policy       autocert.HostPolicy
+	directoryURL string
+
+	mu      sync.Mutex
+	results map[string]caaResult
+}
+
+type caaResult struct {
+	err     error
+	expires time.Time
+}
+
+func newCAAPolicy(policy autocert.HostPolicy, directoryURL string) *caaPolicy {
+	return &caaPolicy{
+		policy:       policy,
+		directoryURL: directoryURL,
+		results:      make(map[string]caaResult),
+	}
+}
+
+func (p *caaPolicy) HostPolicy(ctx context.Context, host string) error {
+	if err := p.policy(ctx, host); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	r, ok := p.results[host]
+	p.mu.Unlock()
+	if ok && time.Now().Before(r.expires) {
+		return r.err
+	}
+
+	_, err := checkCAA(ctx, host, []string{p.directoryURL})
+	if err != nil {
+		if _, ok := err.(*caaError); !ok {
+			glog.Warningf("Failed to check CAA records of %q, ordering anyway: %v", host, err)
+			return nil
+		}
+		glog.Errorf("Not ordering cert for %q from %s: %v", host, p.directoryURL, err)
+	}
+
+	p.mu.Lock()
+	p.results[host] = caaResult{err, time.Now().Add(caaTTL)}
+	p.mu.Unlock()
+	return err
+}
+
+// checkCAA checks that the CAA records of domain, if any, allow at least one
+// of the CAs with the directory URLs cas to issue certs for it, and returns a
+// *caaError if they don't. CAs are matched by the domain of their directory
+// URL, e.g. letsencrypt.org for https://acme-v02.api.letsencrypt.org/directory.
+func checkCAA(ctx context.Context, domain string, cas []string) (string, error) {
+	records, at, err := lookupCAA(ctx, domain)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to look up CAA records")
+	}
+
+	var issuers []string
+	for _, r := range records {
+		switch r.tag {
+		case "issue":
+			id := strings.TrimSpace(strings.SplitN(r.value, ";", 2)[0])
+			if id != "" {
+				issuers = append(issuers, id)
+			}
+		case "issuewild", "iodef":
+		default:
+			if r.critical {
+				return "", &caaError{fmt.Sprintf("CAA records at %s have unknown critical tag %q, so no CA may issue", at, r.tag)}
+			}
+		}
+	}
+	if len(records) == 0 {
+		return "no CAA records, any CA may issue", nil
+	}
+	if len(issuers) == 0 {
+		return "", &caaError{fmt.Sprintf("CAA records at %s allow no CA to issue", at)}
+	}
+
+	for _, ca := range cas {
+		u, err := url.Parse(ca)
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		for _, id := range issuers {
+			id = strings.ToLower(id)
+			if host == id || strings.HasSuffix(host, "."+id) {
+				return fmt.Sprintf("CAA records at %s allow %s", at, id), nil
+			}
+		}
+	}
+	return "", &caaError{fmt.Sprintf("CAA records at %s only allow %s, add an issue record for the CA of %s", at, strings.Join(issuers, ", "), strings.Join(cas, ", "))}
+}
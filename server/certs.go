@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type certSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// renewBefore is how long before they expire certs are renewed.
+const renewBefore = 30 * 24 * time.Hour
+
+// certManager obtains certificates from an ordered list of ACME CAs, falling
+// back to the next CA when issuance against the previous one fails.
+//
+// All managers must share the same cache, so that a cert issued by any CA is
+// served by all of them and HTTP-01 tokens are visible to every manager.
+type certManager struct {
+	// configured accepts the hosts certs are served for, without the CAA,
+	// quota and sharding checks of the managers' policies.
+	configured autocert.HostPolicy
+	certCache  autocert.Cache
+	// attempts is the number of times certs that failed to be obtained in a
+	// handshake are tried, see retry.
+	attempts int
+	forceRSA bool
+	auditor  *auditor
+	// standby means renew and revoke always fail.
+	standby bool
+
+	// health is nil without etcd.
+	health *cacheHealth
+
+	// served holds the hosts certs were served for.
+	served sync.Map
+	// lastGood holds the certs last served for each host, by key type, for
+	// when etcd is unavailable.
+	lastGood sync.Map
+
+	// certs are the certs served from memory, see cached.
+	certs *servedCerts
+	// armed holds the cache keys whose renewal autocert has scheduled.
+	armed sync.Map
+	// hashKey maps cache keys to the keys watchCerts sees.
+	hashKey   func(key string) string
+	ownWrites ownWrites
+
+	// registered holds the ACME clients whose account renew has registered.
+	registered sync.Map
+	// challengeCerts holds the TLS-ALPN-01 certs of renew, by domain.
+	challengeCerts sync.Map
+	// retrying holds the cache keys being retried.
+	retrying sync.Map
+
+	mu       sync.RWMutex
+	managers []*autocert.Manager
+	http01   bool
+	lastErrs map[string]certError
+}
+
+type certError struct {
+	err  error
+	time time.Time
+}
+
+// newCertManager creates a certManager. newManagers must return managers using
+// the given cache and ACME transport.
+func newCertManager(newManagers func(cache autocert.Cache, transport http.RoundTripper) []*autocert.Manager, configured autocert.HostPolicy, cache autocert.Cache, transport http.RoundTripper, attempts int, forceRSA bool, auditor *auditor) *certManager {
+	if attempts < 1 {
+		attempts = 1
+	}
+	c := &certManager{
+		configured: configured,
+		certCache:  cache,
+		attempts:   attempts,
+		forceRSA:   forceRSA,
+		auditor:    auditor,
+		certs:      newServedCerts(),
+		hashKey:    func(key string) string { return key },
+		lastErrs:   make(map[string]certError),
+	}
+	c.managers = newManagers(&servingCache{cache, c}, transport)
+	return c
+}
+
+func (c *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if wantsTokenCert(hello) {
+		if cert, ok := c.challengeCerts.Load(hello.ServerName); ok {
+			return cert.(*tls.Certificate), nil
+		}
+	}
+	if c.forceRSA {
+		// autocert picks the key type from the ClientHello, so pretend every
+		// client is unable to do ECDSA.
+		rsaHello := *hello
+		rsaHello.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+		hello = &rsaHello
+	}
+
+	if err := c.rejectDegraded(); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	managers := c.managers
+	c.mu.RUnlock()
+
+	// Issuance is timed by checking whether a cert was stored for the domain
+	// during the call.
+	writes := c.auditor.certWrites(hello.ServerName)
+	start := time.Now()
+
+	var err error
+	cert := c.cached(managers, hello)
+	if cert == nil {
+		cert, err = c.getCertificate(managers, hello)
+		if err != nil {
+			c.retry(hello)
+			if good, ok := c.lastKnownGood(hello, err); ok {
+				return good, nil
+			}
+		}
+	}
+	c.recordError(hello.ServerName, err)
+	if err == nil {
+		c.served.Store(hello.ServerName, true)
+		if c.health != nil {
+			c.rememberGood(hello.ServerName, cert)
+		}
+		if c.auditor.certWrites(hello.ServerName) != writes {
+			obtainLatency.observe(time.Since(start))
+		}
+	}
+	return cert, err
+}
+
+func (c *certManager) getCertificate(managers []*autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var lastErr error
+	for i, m := range managers {
+		cert, err := m.GetCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+		glog.Warningf("Failed to get cert for %q from CA %d: %v", hello.ServerName, i, err)
+		lastErr = err
+	}
+	return nil, c.classifyError(hello.ServerName, lastErr)
+}
+
+// retryBackoff is how long retry waits before its first attempt; it doubles
+// after every failure.
+var retryBackoff = time.Minute
+
+// retry obtains the cert for hello in the background, up to c.attempts-1
+// times, after it failed to be obtained in a handshake. Retrying in the
+// handshake is pointless: autocert keeps failures for a minute, during which
+// it only reports a missing cert.
+func (c *certManager) retry(hello *tls.ClientHelloInfo) {
+	domain := strings.TrimSuffix(hello.ServerName, ".")
+	if c.attempts < 2 || c.standby || wantsTokenCert(hello) || c.configured(context.Background(), domain) != nil {
+		return
+	}
+	key := domain
+	if !supportsECDSA(hello) {
+		key += "+rsa"
+	}
+	if _, loaded := c.retrying.LoadOrStore(key, true); loaded {
+		return
+	}
+
+	go func() {
+		defer c.retrying.Delete(key)
+
+		backoff := retryBackoff
+		for attempt := 2; attempt <= c.attempts; attempt++ {
+			time.Sleep(backoff)
+			backoff *= 2
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			err := c.obtain(ctx, domain, key)
+			cancel()
+			c.recordError(domain, err)
+			if err == nil {
+				glog.Infof("Obtained cert for %q on attempt %d", key, attempt)
+				return
+			}
+			glog.Warningf("Failed to obtain cert for %q (attempt %d): %v", key, attempt, err)
+			if we, ok := err.(*wile.Error); ok && we.Kind == wile.ErrACMERateLimited {
+				return
+			}
+		}
+	}()
+}
+
+// classifyError returns err as a wile.Error of the matching kind, if any, so
+// that callers can tell rate limits and expired certs from other failures.
+func (c *certManager) classifyError(domain string, err error) error {
+	if _, ok := err.(*wile.Error); ok {
+		return err
+	}
+
+	if ae, ok := err.(*acme.Error); ok && acmeErrorCategory(ae.ProblemType, ae.StatusCode) == "rate_limit" {
+		return &wile.Error{Kind: wile.ErrACMERateLimited, Err: err}
+	}
+	// autocert doesn't always keep the type of ACME errors, but their message
+	// includes the problem type.
+	if strings.Contains(err.Error(), "urn:ietf:params:acme:error:rateLimited") {
+		return &wile.Error{Kind: wile.ErrACMERateLimited, Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if leaf, lerr := cachedLeaf(ctx, c.certCache, domain); lerr == nil && time.Now().After(leaf.NotAfter) {
+		return &wile.Error{Kind: wile.ErrCertExpired, Err: err}
+	}
+	return err
+}
+
+func (c *certManager) recordError(host string, err error) {
+	// Don't let clients fill up memory by asking for random hosts. Hosts
+	// rejected for their CAA records or quotas are configured, and need to be
+	// flagged. This is checked before locking, as every handshake needs c.mu.
+	if err != nil && c.configured(context.Background(), host) != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		delete(c.lastErrs, host)
+		return
+	}
+	c.lastErrs[host] = certError{err, time.Now()}
+}
+
+func (c *certManager) lastError(host string) (certError, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ce, ok := c.lastErrs[host]
+	return ce, ok
+}
+
+func (c *certManager) cache() autocert.Cache {
+	return c.certCache
+}
+
+// HTTPHandler enables HTTP-01 challenges on every manager. Challenges are
+// answered from the shared cache, so it doesn't matter which manager, or which
+// replica, created them.
+func (c *certManager) HTTPHandler(fallback http.Handler) http.Handler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.http01 = true
+	for _, m := range c.managers {
+		m.HTTPHandler(nil)
+	}
+	return wile.NewHTTPChallengeHandler(c.certCache, fallback)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jonathanwei/wile"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// testCertEntry returns an autocert cache entry with a self-signed ECDSA cert
+// for domain, valid until notAfter.
+func testCertEntry(tb testing.TB, domain string, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return b.Bytes()
+}
+
+// newTestCertManager returns a certManager whose managers never reach a CA.
+func newTestCertManager(cache autocert.Cache, domains ...string) *certManager {
+	newManagers := func(cache autocert.Cache, transport http.RoundTripper) []*autocert.Manager {
+		return []*autocert.Manager{{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      cache,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Client:     &acme.Client{HTTPClient: &http.Client{Transport: transport}},
+		}}
+	}
+	return newCertManager(newManagers, autocert.HostWhitelist(domains...), cache, standbyTransport{}, 1, false, &auditor{})
+}
+
+var testECDSAHello = tls.ClientHelloInfo{
+	ServerName:       "example.com",
+	CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	SupportedCurves:  []tls.CurveID{tls.CurveP256},
+	SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+}
+
+func BenchmarkGetCertificate(b *testing.B) {
+	cache := wile.NewMemoryCache()
+	if err := cache.Put(context.Background(), "example.com", testCertEntry(b, "example.com", time.Now().Add(time.Hour))); err != nil {
+		b.Fatal(err)
+	}
+	c := newTestCertManager(cache, "example.com")
+	hello := testECDSAHello
+	if _, err := c.GetCertificate(&hello); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.GetCertificate(&hello); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRecordErrorOnlyConfiguredHosts(t *testing.T) {
+	c := newTestCertManager(wile.NewMemoryCache(), "example.com")
+	// The managers' policies may reach the network, and are never consulted.
+	for _, m := range c.managers {
+		m.HostPolicy = func(context.Context, string) error {
+			t.Error("recordError called the manager's host policy")
+			return nil
+		}
+	}
+
+	tests := []struct {
+		host     string
+		recorded bool
+	}{
+		{"example.com", true},
+		{"random.example.net", false},
+	}
+	for _, tt := range tests {
+		c.recordError(tt.host, errors.New("failed"))
+		if _, ok := c.lastError(tt.host); ok != tt.recorded {
+			t.Errorf("error of %q recorded = %v, want %v", tt.host, ok, tt.recorded)
+		}
+	}
+
+	c.recordError("example.com", nil)
+	if _, ok := c.lastError("example.com"); ok {
+		t.Error("error of example.com kept after success")
+	}
+}
+
+func TestRetryInBackground(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = 10 * time.Millisecond
+
+	f := newFakeCA(t)
+	defer f.Close()
+	cache := wile.NewMemoryCache()
+	c := newFakeCACertManager(t, f, cache, 3, "example.com")
+
+	f.setFailNew(true)
+	if _, err := c.GetCertificate(&testECDSAHello); err == nil {
+		t.Fatal("got a cert from a failing CA")
+	}
+	f.setFailNew(false)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := cachedLeaf(context.Background(), cache, "example.com"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cert wasn't obtained in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var certs int
+	for _, r := range f.resources() {
+		if r == "new-cert" {
+			certs++
+		}
+	}
+	if certs != 2 {
+		t.Errorf("got %d cert requests, want 1 in the handshake and 1 retry", certs)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configCheck reports on the parts of the config that can only be checked by
+// contacting other systems, for -check_config. It never binds any ports or
+// writes to etcd.
+type configCheck struct {
+	problems int
+}
+
+func (c *configCheck) ok(format string, args ...interface{}) {
+	fmt.Printf("OK       "+format+"\n", args...)
+}
+
+func (c *configCheck) problem(format string, args ...interface{}) {
+	c.problems++
+	fmt.Printf("PROBLEM  "+format+"\n", args...)
+}
+
+// report prints a summary and reports whether there were no problems.
+func (c *configCheck) report() bool {
+	if c.problems > 0 {
+		fmt.Printf("%d problems found\n", c.problems)
+		return false
+	}
+	fmt.Println("Config OK")
+	return true
+}
+
+// etcd checks that etcd is reachable and that certKey decrypts the account
+// key and certs already in the cache.
+func (c *configCheck) etcd(etcd *clientv3.Client, certKey, accountKeyType string, domains []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := etcd.Get(ctx, "/wile/acme/http", clientv3.WithPrefix(), clientv3.WithCountOnly()); err != nil {
+		c.problem("etcd: %v", err)
+		return
+	}
+	c.ok("etcd: reachable")
+
+	if certKey == "" {
+		c.problem("-cert_key: missing")
+		return
+	}
+	cache, err := wile.NewEncryptingCache(wile.NewEtcdCache(etcd, "/wile/acme/http"), []byte(certKey))
+	if err != nil {
+		c.problem("-cert_key: %v", err)
+		return
+	}
+
+	account := "acme_account+key"
+	if wile.KeyType(accountKeyType) != wile.ECDSAP256 {
+		account += "+" + accountKeyType
+	}
+	// Keys are hashed in etcd, so only the entries whose names are known can
+	// be checked.
+	keys := []string{account}
+	for _, d := range domains {
+		keys = append(keys, d, d+"+rsa")
+	}
+	found := 0
+	for _, k := range keys {
+		_, err := cache.Get(ctx, k)
+		switch {
+		case err == autocert.ErrCacheMiss:
+		case err != nil:
+			c.problem("-cert_key: failed to decrypt %q, wrong key? %v", k, err)
+			return
+		default:
+			found++
+		}
+	}
+	c.ok("-cert_key: decrypts all %d cached entries checked", found)
+}
+
+// backends checks that the instances of all backends can be found.
+func (c *configCheck) backends(backends map[string][]*url.URL, etcd *clientv3.Client) {
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, u := range backends[name] {
+			switch {
+			case u.Scheme == "consul":
+				c.ok("backend %s: %s is resolved at runtime", name, u)
+			case u.Scheme == "etcd":
+				if etcd == nil {
+					c.problem("backend %s: %s needs etcd", name, u)
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				resp, err := etcd.Get(ctx, u.Path, clientv3.WithPrefix(), clientv3.WithCountOnly())
+				cancel()
+				switch {
+				case err != nil:
+					c.problem("backend %s: %v", name, err)
+				case resp.Count == 0:
+					c.problem("backend %s: no instances under %s", name, u.Path)
+				default:
+					c.ok("backend %s: %d instances under %s", name, resp.Count, u.Path)
+				}
+			case isDNSURL(u):
+				urls, _, err := resolveDNSURL(u)
+				switch {
+				case err != nil:
+					c.problem("backend %s: %v", name, err)
+				case len(urls) == 0:
+					c.problem("backend %s: no instances for %s", name, u)
+				default:
+					c.ok("backend %s: %d instances for %s", name, len(urls), u)
+				}
+			default:
+				if net.ParseIP(u.Hostname()) != nil {
+					c.ok("backend %s: %s", name, u)
+					continue
+				}
+				if _, err := net.LookupHost(u.Hostname()); err != nil {
+					c.problem("backend %s: %v", name, err)
+					continue
+				}
+				c.ok("backend %s: %s resolves", name, u)
+			}
+		}
+	}
+}
+
+// acmeEligibility checks that all domains resolve to one of addrs, so that
+// the ACME servers can reach this host to validate them.
+func (c *configCheck) acmeEligibility(domains []string, addrs []net.IP) {
+	sort.Strings(domains)
+	for _, d := range domains {
+		ips, err := net.LookupIP(d)
+		if err != nil {
+			c.problem("host %s: %v", d, err)
+			continue
+		}
+		if !containsIP(addrs, ips) {
+			c.problem("host %s: resolves to %v, not this host", d, ips)
+			continue
+		}
+		c.ok("host %s: eligible for ACME", d)
+	}
+}
+
+func containsIP(addrs, ips []net.IP) bool {
+	for _, a := range addrs {
+		for _, ip := range ips {
+			if a.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// localAddrs returns the IPs of the network interfaces.
+func localAddrs() ([]net.IP, error) {
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []net.IP
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok {
+			addrs = append(addrs, n.IP)
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/jonathanwei/wile"
+)
+
+// config holds the flags of the server.
+type config struct {
+	backends               string
+	backendTransport       string
+	consulAddr             string
+	consulToken            string
+	affinityKey            string
+	hosts                  string
+	splitAffinity          string
+	onDemandHosts          string
+	denyHosts              string
+	onDemandBackend        string
+	unknownSNI             string
+	staticCerts            string
+	ingressClass           string
+	ingressNamespace       string
+	dockerSocket           string
+	passthroughHosts       string
+	oidcHosts              string
+	oidcIssuer             string
+	oidcClientID           string
+	oidcSecret             string
+	oidcCookieKey          string
+	oidcSessionTTL         time.Duration
+	basicAuth              string
+	bearerTokens           string
+	rewrites               string
+	cors                   string
+	mirror                 string
+	geoIPDB                string
+	geoIPHeaders           string
+	geoIPRoutes            string
+	signedURLs             string
+	requestFilters         string
+	wellKnown              string
+	maintenanceHosts       string
+	maintenancePage        string
+	retryAfter             time.Duration
+	errorPagesDir          string
+	readHeaderTimeout      time.Duration
+	idleTimeout            time.Duration
+	listenerSettings       string
+	bufferRequests         bool
+	bufferMemory           int64
+	maxRequestBody         int64
+	minRequestRate         int64
+	hostBandwidth          string
+	clientBandwidth        int64
+	accessLogSample        int
+	metricsMaxHosts        int
+	httpAddrs              string
+	httpsAddrs             string
+	drainTimeout           time.Duration
+	redirectPort           int
+	redirectExempt         string
+	plainHosts             string
+	acceptProxy            bool
+	sendProxy              bool
+	development            bool
+	devCertDir             string
+	acmeEndpoints          string
+	acmeAttempts           int
+	acmeEmail              string
+	etcdEndpoints          string
+	etcdCA                 string
+	etcdCert               string
+	etcdKey                string
+	etcdUsername           string
+	etcdPassword           string
+	etcdDialTimeout        time.Duration
+	verifyInterval         time.Duration
+	verifyAddr             string
+	adminAddr              string
+	adminDebugToken        string
+	certKey                string
+	accountKeyType         string
+	outagePolicy           string
+	cacheTTL               time.Duration
+	mirrorDir              string
+	challengeWebhook       string
+	challengeWebhookSecret string
+	ocspStapling           bool
+	tenantsFile            string
+	checkCAA               bool
+	mustStaple             bool
+	standby                bool
+	shardIssuance          bool
+	replicaID              string
+	ticketKeyRotation      time.Duration
+	configBundle           string
+	configBundleKey        string
+	checkConfig            bool
+	checkAddrs             string
+	certKeyType            string
+}
+
+// registerFlags defines the flags of the server in fs, to be parsed into c.
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.backends, "backends", "", "Comma-separated list of backends. Each backend is of the form <short-name>:<url>, or <short-name>:<url>|<url>|... for a backend with several instances. Clients are pinned to one instance with a cookie. The url can also be consul://<service>, for the passing instances of a Consul service, etcd:///<prefix>, for the instance URLs stored under a prefix in etcd, dns+http://<host>:<port>, for an instance per address of host, or srv+http(s)://<name>, for an instance per SRV record of name. DNS names are resolved again when their TTL expires.")
+	fs.StringVar(&c.backendTransport, "backend_transport", "", "Comma-separated list of connection settings of backends. Each backend is of the form <backend>:<setting>=<value>|<setting>=<value>|..., where the settings are max_idle_conns, max_idle_conns_per_host, idle_conn_timeout, disable_keep_alives, dial_timeout, tls_handshake_timeout and response_header_timeout, e.g. api:max_idle_conns_per_host=100|response_header_timeout=30s. Other backends use the Go defaults.")
+	fs.StringVar(&c.consulAddr, "consul_addr", "http://127.0.0.1:8500", "The Consul HTTP API to resolve consul:// backends with.")
+	fs.StringVar(&c.consulToken, "consul_token", "", "The ACL token to send to -consul_addr.")
+	fs.StringVar(&c.affinityKey, "affinity_key", "", "The key to sign instance affinity cookies with. If empty, a random key is used and clients are re-pinned after restarts.")
+	fs.StringVar(&c.hosts, "hosts", "", "Comma-separated list of hosts to serve and their correspondin backend. Each host is of the form <host>:<backend>, or <host>:<backend>=<weight>|<backend>=<weight>|... to split its traffic between several backends.")
+	fs.StringVar(&c.splitAffinity, "split_affinity", "ip", "How to keep a client on the same backend of a host with several. Either ip, to hash the client IP, or cookie:<name>, to hash the value of the named cookie, falling back to the client IP if it's missing.")
+	fs.StringVar(&c.onDemandHosts, "on_demand_hosts", "", "Regular expression matching additional hosts to serve. Certs for these hosts are obtained the first time they are requested.")
+	fs.StringVar(&c.denyHosts, "deny_hosts", "", "Comma-separated list of hosts never to obtain certs for, even if they match -on_demand_hosts or are discovered. Each host is either exact, a wildcard such as *.internal.example.com, or a regular expression between slashes, such as /^test-.*$/.")
+	fs.StringVar(&c.onDemandBackend, "on_demand_backend", "", "The backend for hosts matching -on_demand_hosts.")
+	fs.StringVar(&c.unknownSNI, "unknown_sni", "error", "How to handle handshakes without SNI or for unknown hosts. One of error, to fail with an internal error alert, reject, to fail with an unrecognized_name alert, self-signed, to serve a self-signed cert, or <cert file>:<key file>, to serve that cert.")
+	fs.StringVar(&c.staticCerts, "static_certs", "", "Comma-separated list of hosts to serve certs from files for instead of obtaining them with ACME. Each host is of the form <host>:<cert file>:<key file>. The files are checked for changes every 30 seconds, so a rotated cert is served up to 30 seconds after it is written. Until the cert and key match again, the old cert is kept.")
+	fs.StringVar(&c.ingressClass, "kubernetes_ingress_class", "", "If set, also serve the hosts of the Kubernetes Ingresses of this class, using the service account of the pod. Only Service backends and exact hosts are supported.")
+	fs.StringVar(&c.ingressNamespace, "kubernetes_namespace", "", "The namespace to watch Ingresses in. If empty, all namespaces.")
+	fs.StringVar(&c.dockerSocket, "docker_socket", "", "If set, the Unix socket of the Docker API, e.g. /var/run/docker.sock. The hosts of running containers labeled wile.host and wile.port are then also served.")
+	fs.StringVar(&c.passthroughHosts, "passthrough_hosts", "", "Comma-separated list of hosts whose TLS connections are proxied as is, without terminating TLS. Each host is of the form <host>:<address>, e.g. example.com:10.0.0.1:443")
+	fs.StringVar(&c.oidcHosts, "oidc_hosts", "", "Comma-separated list of hosts that require logging in with -oidc_issuer. The identity of users is passed to backends in the X-Forwarded-User and X-Forwarded-Email headers.")
+	fs.StringVar(&c.oidcIssuer, "oidc_issuer", "", "The OpenID Connect issuer URL, e.g. https://accounts.google.com. Its redirect URIs must include https://<host>/_wile/oidc/callback for every -oidc_hosts host.")
+	fs.StringVar(&c.oidcClientID, "oidc_client_id", "", "The OpenID Connect client ID.")
+	fs.StringVar(&c.oidcSecret, "oidc_client_secret", "", "The OpenID Connect client secret.")
+	fs.StringVar(&c.oidcCookieKey, "oidc_cookie_key", "", "The key to sign session cookies with. Must be the same on all replicas.")
+	fs.DurationVar(&c.oidcSessionTTL, "oidc_session_ttl", 12*time.Hour, "How long users stay logged in.")
+	fs.StringVar(&c.basicAuth, "basic_auth", "", "Comma-separated list of hosts that require HTTP Basic auth. Each host is of the form <host>:<htpasswd file>. Only bcrypt and SHA-1 hashes are supported.")
+	fs.StringVar(&c.bearerTokens, "bearer_tokens", "", "Comma-separated list of hosts that accept bearer tokens. Each host is of the form <host>:<file>, where the file holds one token per line. Hosts in both -basic_auth and -bearer_tokens accept either.")
+	fs.StringVar(&c.rewrites, "rewrites", "", "Comma-separated list of URL rewrites of hosts, applied before proxying. Each host is of the form <host>:<rule>|<rule>|..., where the rules are strip_prefix=<prefix>, add_prefix=<prefix>, regex=<regexp>=><replacement> and query=<name>=<value>, applied in order, e.g. example.com:strip_prefix=/api|add_prefix=/v2.")
+	fs.StringVar(&c.cors, "cors", "", "Comma-separated list of CORS policies of hosts. Each host is of the form <host>:<setting>=<value>|<setting>=<value>|..., where the settings are origins, methods and headers, ';'-separated lists, credentials and max_age, e.g. api.example.com:origins=https://example.com|methods=GET;POST|max_age=10m. Preflight requests are answered without reaching the backend.")
+	fs.StringVar(&c.mirror, "mirror", "", "Comma-separated list of hosts whose requests are copied to a shadow backend, whose responses are ignored. Each host is of the form <host>:<backend>=<percent>, e.g. example.com:api-next=10 to copy 10% of requests.")
+	fs.StringVar(&c.geoIPDB, "geoip_db", "", "A MaxMind DB file, such as GeoLite2-City.mmdb, to look up the location of clients in for -geoip_headers and -geoip_routes.")
+	fs.StringVar(&c.geoIPHeaders, "geoip_headers", "", "Comma-separated list of hosts whose backends get the country and city of clients in the X-Geo-Country and X-Geo-City headers. Requires -geoip_db.")
+	fs.StringVar(&c.geoIPRoutes, "geoip_routes", "", "Comma-separated list of hosts that send clients from some countries to other backends. Each host is of the form <host>:<country>=<backend>|<country>=<backend>|..., with ISO 3166-1 country codes, e.g. example.com:DE=eu|FR=eu. Requires -geoip_db.")
+	fs.StringVar(&c.signedURLs, "signed_urls", "", "Comma-separated list of hosts whose paths under some prefixes require signed URLs. Each host is of the form <host>:<key file>:<prefix>|<prefix>|..., where the file holds one key per line. URLs are signed with the query parameters expires, a Unix time, and signature, the hex HMAC-SHA256 of \"<path>\\n<expires>\" with any of the keys.")
+	fs.StringVar(&c.requestFilters, "request_filters", "", "Comma-separated list of hosts whose requests are checked against rules in a file. Each host is of the form <host>:<file>. Each line of the file is a rule <action> [if <condition>]; rules are applied in order until one answers the request. The actions are allow, deny [<status>], route <backend>, set_header <name> <value> and remove_header <name>. Conditions compare the values method, path, host, ip, header(\"<name>\"), cookie(\"<name>\"), query(\"<name>\") and \"<string>\" with ==, !=, =~ \"<regexp>\" and in \"<CIDR>\", combined with &&, ||, ! and parentheses; a value on its own is true if it isn't empty. Rules see requests after authentication and rewrites. The files are reloaded when they change.")
+	fs.StringVar(&c.wellKnown, "well_known", "", "Comma-separated list of paths under /.well-known/ that are served the same for all hosts instead of by their backends, e.g. security.txt or mta-sts.txt. Each path is of the form <path>=file:<file> or <path>=<backend>; paths ending in '/' are prefixes, served from a directory with file:. acme-challenge can't be routed.")
+	fs.StringVar(&c.maintenanceHosts, "maintenance_hosts", "", "Comma-separated list of hosts to start in maintenance mode. Hosts can also be put into and out of maintenance mode with the /maintenance admin endpoint.")
+	fs.StringVar(&c.maintenancePage, "maintenance_page", "", "The HTML file to serve for hosts in maintenance mode. If empty, a generic page is served.")
+	fs.DurationVar(&c.retryAfter, "retry_after", 5*time.Minute, "The Retry-After of the maintenance page.")
+	fs.StringVar(&c.errorPagesDir, "error_pages_dir", "", "If set, a directory with 502.html and 504.html, served when a backend fails or times out.")
+	fs.DurationVar(&c.readHeaderTimeout, "read_header_timeout", 10*time.Second, "How long clients may take to send the headers of a request. Zero means no limit.")
+	fs.DurationVar(&c.idleTimeout, "idle_timeout", 2*time.Minute, "How long idle client connections are kept open. Zero means no limit.")
+	fs.StringVar(&c.listenerSettings, "listener_settings", "", "Comma-separated list of connection settings of listeners, for workloads the defaults don't suit, such as long polling or bursts of requests. Each listener is of the form <address>:<setting>=<value>|<setting>=<value>|..., where the address is one of -http_addr or -https_addr, and the settings are http2_max_concurrent_streams, http2_max_frame_size, http2_idle_timeout, idle_timeout, keep_alives, to enable or disable HTTP/1.1 keep-alives, and tcp_keep_alive, the TCP keep-alive period, negative to disable them, e.g. :443:http2_max_concurrent_streams=1000|idle_timeout=10m. The HTTP/2 settings only apply to HTTPS listeners.")
+	fs.BoolVar(&c.bufferRequests, "buffer_requests", false, "True iff request bodies should be read completely before they are proxied, so that slow clients don't tie up backend connections.")
+	fs.Int64Var(&c.bufferMemory, "request_buffer_memory", 1<<20, "With -buffer_requests, the size up to which a request body is kept in memory. Larger bodies are written to a temporary file.")
+	fs.Int64Var(&c.maxRequestBody, "max_request_body", 100<<20, "With -buffer_requests, the maximum size of a request body. Zero means no limit.")
+	fs.Int64Var(&c.minRequestRate, "min_request_rate", 0, "With -buffer_requests, the minimum average rate in bytes per second clients must send request bodies at, after a grace period of 10s. Zero means no limit.")
+	fs.StringVar(&c.hostBandwidth, "host_bandwidth", "", "Comma-separated list of response bandwidth limits of hosts, shared by all of their clients. Each host is of the form <host>:<bytes per second>.")
+	fs.Int64Var(&c.clientBandwidth, "client_bandwidth", 0, "If set, the response bandwidth limit of each client IP, in bytes per second.")
+	fs.IntVar(&c.accessLogSample, "access_log_sample", 0, "If set, log 1 in this many successful requests. Failed requests, with a status of 400 or more, are all logged. 0 disables the access log.")
+	fs.IntVar(&c.metricsMaxHosts, "metrics_max_hosts", 1000, "The maximum number of hosts the http_requests var is broken down by. Configured hosts always count; requests for other hosts beyond the limit are counted as \"other\".")
+	fs.StringVar(&c.httpAddrs, "http_addr", ":80", "Comma-separated list of addresses to serve HTTP on, for redirects and ACME challenges. May be empty.")
+	fs.StringVar(&c.httpsAddrs, "https_addr", ":443", "Comma-separated list of addresses to serve HTTPS on.")
+	fs.DurationVar(&c.drainTimeout, "drain_timeout", time.Minute, "On SIGUSR2, the server starts a new copy of its binary on the same sockets and exits once that is ready. This is how long it waits for open requests to finish before exiting.")
+	fs.IntVar(&c.redirectPort, "redirect_port", 443, "The port HTTP requests are redirected to.")
+	fs.StringVar(&c.redirectExempt, "redirect_exempt_paths", "", "Comma-separated list of path prefixes that are proxied over HTTP instead of redirected to HTTPS.")
+	fs.StringVar(&c.plainHosts, "plain_http_hosts", "", "Comma-separated list of hosts that are proxied over HTTP instead of redirected to HTTPS.")
+	fs.BoolVar(&c.acceptProxy, "accept_proxy_protocol", false, "True iff every connection starts with a PROXY protocol v1 or v2 header from a load balancer. Connections without one are rejected.")
+	fs.BoolVar(&c.sendProxy, "passthrough_proxy_protocol", false, "True iff connections to -passthrough_hosts backends should start with a PROXY protocol v1 header.")
+	fs.BoolVar(&c.development, "insecure_development_mode", false, "True iff the server should run in an insecure development mode.")
+	fs.StringVar(&c.devCertDir, "dev_cert_dir", "", "In development mode, the directory to store the self-signed CA in, so that it survives restarts and can be trusted. If empty, a new CA is generated on every start.")
+	fs.StringVar(&c.acmeEndpoints, "acme", "https://acme-staging.api.letsencrypt.org/directory", "Comma-separated list of ACME servers to sign certs, in order of preference.")
+	fs.IntVar(&c.acmeAttempts, "acme_attempts", 1, "The number of times to obtain a cert that failed to be obtained during a handshake. Handshakes try each ACME server once; the other attempts are made in the background, backing off exponentially from a minute.")
+	fs.StringVar(&c.acmeEmail, "email", "", "The email to use when registering with acme.")
+	fs.StringVar(&c.etcdEndpoints, "etcd_endpoints", "localhost:2378", "Comma-separated list of etcd endpoints.")
+	fs.StringVar(&c.etcdCA, "etcd_ca", "", "If set, connect to etcd over TLS and verify its certificate against the CA certificates in this PEM file.")
+	fs.StringVar(&c.etcdCert, "etcd_cert", "", "The client certificate to present to etcd, in PEM format. Requires -etcd_ca.")
+	fs.StringVar(&c.etcdKey, "etcd_key", "", "The private key of -etcd_cert, in PEM format.")
+	fs.StringVar(&c.etcdUsername, "etcd_username", "", "The user to authenticate to etcd as.")
+	fs.StringVar(&c.etcdPassword, "etcd_password", "", "The password of -etcd_username.")
+	fs.DurationVar(&c.etcdDialTimeout, "etcd_dial_timeout", 5*time.Second, "The timeout for establishing a connection to etcd.")
+	fs.DurationVar(&c.verifyInterval, "verify_interval", 0, "If set, how often to connect to every host and check that the served cert is the cached one. Mismatches are logged and counted in the cert_verify_failures var.")
+	fs.StringVar(&c.verifyAddr, "verify_addr", "", "The address -verify_interval connects to. If empty, each host on port 443.")
+	fs.StringVar(&c.adminAddr, "admin_addr", "", "If set, the address to serve the admin endpoints on, e.g. localhost:8080.")
+	fs.StringVar(&c.adminDebugToken, "admin_debug_token", "", "If set, the bearer token required for the pprof and expvar endpoints under /debug/ on -admin_addr, and for /maintenance, /renew, /revoke, /audit and /diagnose. Without it, they are only served if -admin_addr is a loopback address. Tenant API keys also give access to the latter for the tenant's hosts.")
+	fs.StringVar(&c.certKey, "cert_key", "", "The key to encrypt certificates in etcd.")
+	fs.StringVar(&c.accountKeyType, "account_key_type", string(wile.ECDSAP256), "The type of the ACME account key. One of rsa2048, rsa4096, ecdsa-p256 or ecdsa-p384.")
+	fs.StringVar(&c.outagePolicy, "etcd_outage_policy", "open", "What to do while etcd is unavailable. Either open, to keep serving the certs in memory, including the last ones served for each host, or closed, to fail all handshakes. Outages are counted in the cache_degraded var.")
+	fs.DurationVar(&c.cacheTTL, "cache_ttl", 10*time.Minute, "How long to keep values read from etcd in memory before reading them again.")
+	fs.StringVar(&c.mirrorDir, "mirror_dir", "", "If set, a directory to mirror the (encrypted) etcd cache to. Values are read from it when they are missing from etcd or etcd is unavailable.")
+	fs.StringVar(&c.challengeWebhook, "challenge_webhook", "", "If set, a URL to POST HTTP-01 challenges to when they are created and done, so that they can be served elsewhere, e.g. by a CDN.")
+	fs.StringVar(&c.challengeWebhookSecret, "challenge_webhook_secret", "", "If set, sent to -challenge_webhook as a bearer token.")
+	fs.BoolVar(&c.ocspStapling, "ocsp_stapling", false, "True iff OCSP responses should be stapled to ACME certs.")
+	fs.StringVar(&c.tenantsFile, "tenants_file", "", "If set, a JSON file with an array of tenants of a shared deployment, each of the form {\"name\": ..., \"domains\": [<host pattern>, ...], \"api_keys\": [...], \"max_certs\": ..., \"request_rate\": ...}. Host patterns are like those of -deny_hosts. The domains of different tenants must not overlap. The admin server then requires an API key as a bearer token and only shows and changes the hosts of its tenant. max_certs limits the hosts certs are obtained for, and request_rate the requests per second, if set; hosts whose certs are deleted no longer count. Requests are counted per tenant in the tenant_requests var, and audit log entries are labelled with tenants.")
+	fs.BoolVar(&c.checkCAA, "check_caa", true, "True iff the CAA records of hosts should be checked before ordering certs, so that hosts whose records don't allow a CA are never ordered from it.")
+	fs.BoolVar(&c.mustStaple, "must_staple", false, "True iff new ACME certs should have the OCSP Must-Staple extension. Implies -ocsp_stapling. Must-staple certs are only served with a valid OCSP response.")
+	fs.BoolVar(&c.standby, "standby", false, "True iff the server should only serve the certs other replicas obtained, without ever contacting the ACME servers. Hosts without a cert in etcd fail their handshakes.")
+	fs.BoolVar(&c.shardIssuance, "shard_issuance", false, "True iff the -hosts domains should be split between the replicas registered in etcd, each obtaining and renewing the certs of its share before they are requested. Other replicas refuse to obtain certs of a share that isn't theirs, and renew them only if the owner hasn't within 2 days of its schedule. All replicas still serve all certs. Hosts not in -hosts, e.g. -on_demand ones, aren't sharded.")
+	fs.StringVar(&c.replicaID, "replica_id", "", "The name of this replica for -shard_issuance. If empty, the hostname.")
+	fs.DurationVar(&c.ticketKeyRotation, "session_ticket_rotation", 0, "If set, share TLS session ticket keys between replicas through etcd, encrypted with -cert_key, and rotate them this often. Otherwise each replica has its own keys and sessions only resume on the replica that created them.")
+	fs.StringVar(&c.configBundle, "config_bundle", "", "If set, an https URL or etcd:///<key> to load a signed config bundle from at startup. Its payload is a JSON object of flag names to values, e.g. {\"hosts\": \"...\"}, which are set unless they are also set on the command line, which is an error. Bundles are created with wilectl sign-config.")
+	fs.StringVar(&c.configBundleKey, "config_bundle_key", "", "The file holding the base64 ed25519 public key -config_bundle must be signed with.")
+	fs.BoolVar(&c.checkConfig, "check_config", false, "True iff the server should only check its config, including that etcd is reachable, -cert_key decrypts the cache, the backends resolve and the hosts resolve to this host for ACME, then exit with a nonzero status on problems. No ports are bound.")
+	fs.StringVar(&c.checkAddrs, "check_addrs", "", "Comma-separated list of the public IPs of this host for -check_config. If empty, the IPs of its network interfaces.")
+	fs.StringVar(&c.certKeyType, "cert_key_type", "auto", "The type of certificate keys. Either auto, for ECDSA P-256 with an RSA 2048 fallback for legacy clients, or rsa, for RSA 2048 only. Unlike -account_key_type, rsa4096 and ecdsa-p384 aren't supported, since autocert generates certificate keys itself and only makes those two types.")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// corsPolicy answers CORS preflight requests and adds CORS headers to the
+// responses of a host, for backends that don't support CORS themselves.
+type corsPolicy struct {
+	// origins holds the allowed origins. "*" allows all of them.
+	origins     map[string]bool
+	methods     string
+	headers     string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// newCORSPolicy creates a policy with the settings in spec, a '|'-separated
+// list of <setting>=<value>. Lists in values are separated by ';'.
+func newCORSPolicy(spec string) (*corsPolicy, error) {
+	p := &corsPolicy{
+		origins: make(map[string]bool),
+		methods: "GET, HEAD, POST",
+	}
+
+	for _, setting := range strings.Split(spec, "|") {
+		idx := strings.Index(setting, "=")
+		if idx == -1 {
+			return nil, errors.Errorf("setting %q is missing '='", setting)
+		}
+		name, value := setting[:idx], setting[idx+1:]
+
+		var err error
+		switch name {
+		case "origins":
+			for _, o := range strings.Split(value, ";") {
+				p.origins[o] = true
+			}
+		case "methods":
+			p.methods = strings.Join(strings.Split(strings.ToUpper(value), ";"), ", ")
+		case "headers":
+			p.headers = strings.Join(strings.Split(value, ";"), ", ")
+		case "credentials":
+			p.credentials, err = strconv.ParseBool(value)
+		case "max_age":
+			p.maxAge, err = time.ParseDuration(value)
+		default:
+			return nil, errors.Errorf("unknown setting %q", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+
+	if len(p.origins) == 0 {
+		return nil, errors.New("no origins")
+	}
+	return p, nil
+}
+
+func (p *corsPolicy) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		rw.Header().Add("Vary", "Origin")
+		allowed := p.origins[origin] || p.origins["*"]
+		preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+		if !allowed {
+			if preflight {
+				http.Error(rw, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		if p.origins["*"] && !p.credentials {
+			rw.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// Credentials can't be used with "*", so the origin is echoed.
+			rw.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		rw.Header().Set("Access-Control-Allow-Methods", p.methods)
+		if p.headers != "" {
+			rw.Header().Set("Access-Control-Allow-Headers", p.headers)
+		}
+		if p.maxAge > 0 {
+			rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// alertUnrecognizedName is the TLS alert for an unknown SNI, see RFC 6066.
+const alertUnrecognizedName = tls.AlertError(112)
+
+// defaultCertSource handles handshakes without SNI or for hosts not allowed by
+// policy, which next would fail with an internal error alert. If cert is set,
+// it is served to them; otherwise they get an unrecognized_name alert.
+type defaultCertSource struct {
+	next   certSource
+	policy autocert.HostPolicy
+	cert   *tls.Certificate
+}
+
+// newDefaultCertSource creates a defaultCertSource for the -unknown_sni mode,
+// which is one of reject, self-signed or <cert file>:<key file>.
+func newDefaultCertSource(mode string, policy autocert.HostPolicy, next certSource) (*defaultCertSource, error) {
+	d := &defaultCertSource{next: next, policy: policy}
+
+	switch {
+	case mode == "reject":
+	case mode == "self-signed":
+		cert, err := selfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		d.cert = cert
+	case strings.Contains(mode, ":"):
+		idx := strings.Index(mode, ":")
+		cert, err := tls.LoadX509KeyPair(mode[:idx], mode[idx+1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load default cert")
+		}
+		d.cert = &cert
+	default:
+		return nil, errors.Errorf("unknown mode %q", mode)
+	}
+
+	return d, nil
+}
+
+func (d *defaultCertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(hello.ServerName, ".")
+	if host != "" && d.policy(context.Background(), host) == nil {
+		return d.next.GetCertificate(hello)
+	}
+
+	if d.cert == nil {
+		glog.V(1).Infof("Rejecting handshake for unknown host %q", host)
+		return nil, alertUnrecognizedName
+	}
+	return d.cert, nil
+}
+
+func (d *defaultCertSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return d.next.HTTPHandler(fallback)
+}
+
+func selfSignedCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "wile default"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cert")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// cacheProbeInterval is how often etcd is probed, so that outages are noticed
+// even while every cert is served from memory.
+const cacheProbeInterval = 10 * time.Second
+
+// cacheDegraded counts what happened while etcd was unavailable: active is 1
+// during an outage, outages counts them, last_known_good_served counts
+// handshakes answered with a cert remembered from before, stale_certs_served
+// those among them whose cert was due for renewal, and handshakes_rejected
+// the handshakes failed by the closed policy.
+var cacheDegraded = func() *expvar.Map {
+	m := expvar.NewMap("cache_degraded")
+	m.Set("active", new(expvar.Int))
+	return m
+}()
+
+// cacheHealth tracks whether etcd is reachable, from the results of cache
+// operations and of probes.
+type cacheHealth struct {
+	// failClosed means handshakes are rejected while etcd is unavailable.
+	failClosed bool
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+func newCacheHealth(policy string) *cacheHealth {
+	switch policy {
+	case "open":
+		return &cacheHealth{}
+	case "closed":
+		return &cacheHealth{failClosed: true}
+	}
+	glog.Fatalf("Unknown -etcd_outage_policy %q", policy)
+	return nil
+}
+
+// observe records the result of an operation on etcd.
+func (h *cacheHealth) observe(err error) {
+	unavailable := err != nil && errors.Cause(err) == wile.ErrCacheUnavailable
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case unavailable && h.since.IsZero():
+		h.since = time.Now()
+		cacheDegraded.Add("outages", 1)
+		cacheDegraded.Get("active").(*expvar.Int).Set(1)
+		if h.failClosed {
+			glog.Errorf("etcd is unavailable, rejecting handshakes until it is back: %v", err)
+		} else {
+			glog.Errorf("etcd is unavailable, serving certs from memory until it is back: %v", err)
+		}
+	case !unavailable && !h.since.IsZero():
+		glog.Infof("etcd is available again after %v", time.Since(h.since))
+		h.since = time.Time{}
+		cacheDegraded.Get("active").(*expvar.Int).Set(0)
+	}
+}
+
+// degraded reports whether etcd is unavailable.
+func (h *cacheHealth) degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.since.IsZero()
+}
+
+func (h *cacheHealth) probeLoop(cache autocert.Cache) {
+	for range time.Tick(cacheProbeInterval) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := cache.Get(ctx, "health-probe")
+		cancel()
+		if err == autocert.ErrCacheMiss {
+			err = nil
+		}
+		h.observe(err)
+	}
+}
+
+// healthCache reports the result of every operation on the etcd cache to
+// health.
+type healthCache struct {
+	impl   *wile.EtcdCache
+	health *cacheHealth
+}
+
+func (c *healthCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.impl.Get(ctx, key)
+	if err != autocert.ErrCacheMiss {
+		c.health.observe(err)
+	}
+	return data, err
+}
+
+func (c *healthCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.impl.Put(ctx, key, data)
+	c.health.observe(err)
+	return err
+}
+
+func (c *healthCache) Delete(ctx context.Context, key string) error {
+	err := c.impl.Delete(ctx, key)
+	c.health.observe(err)
+	return err
+}
+
+func (c *healthCache) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := c.impl.List(ctx, prefix)
+	c.health.observe(err)
+	return keys, err
+}
+
+func (c *healthCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	purged, err := c.impl.Purge(ctx, olderThan, keep)
+	c.health.observe(err)
+	return purged, err
+}
+
+// rejectDegraded returns an error if handshakes must fail because etcd is
+// unavailable.
+func (c *certManager) rejectDegraded() error {
+	if c.health == nil || !c.health.failClosed || !c.health.degraded() {
+		return nil
+	}
+	cacheDegraded.Add("handshakes_rejected", 1)
+	return &wile.Error{Kind: wile.ErrCacheUnavailable, Err: errors.New("etcd is unavailable and -etcd_outage_policy is closed")}
+}
+
+// lastKnownGood returns a cert served for hello's server name before, which
+// the client supports and which hasn't expired, if getting one failed with err
+// because etcd is unavailable.
+func (c *certManager) lastKnownGood(hello *tls.ClientHelloInfo, err error) (*tls.Certificate, bool) {
+	if c.health == nil || c.health.failClosed {
+		return nil, false
+	}
+	if !c.health.degraded() && errors.Cause(err) != wile.ErrCacheUnavailable {
+		return nil, false
+	}
+	v, ok := c.lastGood.Load(hello.ServerName)
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	for _, cert := range v.([]*tls.Certificate) {
+		if cert.Leaf == nil || now.After(cert.Leaf.NotAfter) || hello.SupportsCertificate(cert) != nil {
+			continue
+		}
+		cacheDegraded.Add("last_known_good_served", 1)
+		if now.Add(renewBefore).After(cert.Leaf.NotAfter) {
+			cacheDegraded.Add("stale_certs_served", 1)
+			glog.Warningf("Serving cert of %q from memory while etcd is unavailable; it expires %v and couldn't be renewed", hello.ServerName, cert.Leaf.NotAfter)
+		}
+		return cert, true
+	}
+	return nil, false
+}
+
+// rememberGood keeps cert as the last known good one of its key type for
+// domain.
+func (c *certManager) rememberGood(domain string, cert *tls.Certificate) {
+	var certs []*tls.Certificate
+	if v, ok := c.lastGood.Load(domain); ok {
+		for _, old := range v.([]*tls.Certificate) {
+			if old == cert {
+				return
+			}
+			if !sameKeyType(old, cert) {
+				certs = append(certs, old)
+			}
+		}
+	}
+	c.lastGood.Store(domain, append(certs, cert))
+}
+
+func sameKeyType(a, b *tls.Certificate) bool {
+	if a.Leaf == nil || b.Leaf == nil {
+		return false
+	}
+	return a.Leaf.PublicKeyAlgorithm == b.Leaf.PublicKeyAlgorithm
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// devCertManager issues certs from a local, self-signed CA. It lets the HTTPS
+// path be exercised in development mode without talking to an ACME server.
+type devCertManager struct {
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	policy autocert.HostPolicy
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func newDevCertManager(dir string, policy autocert.HostPolicy) (*devCertManager, error) {
+	ca, caKey, err := loadDevCA(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &devCertManager{
+		ca:     ca,
+		caKey:  caKey,
+		policy: policy,
+		certs:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+func (d *devCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(hello.ServerName, ".")
+	if host == "" {
+		host = "localhost"
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cert, ok := d.certs[host]; ok {
+		return cert, nil
+	}
+
+	if host != "localhost" && net.ParseIP(host) == nil {
+		if err := d.policy(context.Background(), host); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := d.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	d.certs[host] = cert
+	return cert, nil
+}
+
+func (d *devCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func (d *devCertManager) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, d.ca, key.Public(), d.caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cert")
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse cert")
+	}
+
+	glog.Infof("Issued development cert for %q", host)
+	return &tls.Certificate{
+		Certificate: [][]byte{der, d.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// loadDevCA reads the CA from dir, creating it if it doesn't exist yet. If dir
+// is empty, the CA only lives in memory.
+func loadDevCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	if dir != "" {
+		certPEM, certErr := ioutil.ReadFile(certPath)
+		keyPEM, keyErr := ioutil.ReadFile(keyPath)
+		if certErr == nil && keyErr == nil {
+			return parseDevCA(certPEM, keyPEM)
+		}
+		if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+			return nil, nil, errors.Errorf("failed to read CA from %q: %v, %v", dir, certErr, keyErr)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate CA key")
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "wile development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create CA cert")
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA cert")
+	}
+
+	if dir == "" {
+		return ca, key, nil
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal CA key")
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create CA dir")
+	}
+
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to write CA key")
+	}
+
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to write CA cert")
+	}
+
+	glog.Infof("Wrote development CA to %q; add it to your trust store to avoid cert warnings", certPath)
+	return ca, key, nil
+}
+
+func parseDevCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, errors.New("failed to decode CA cert PEM")
+	}
+
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA cert")
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("failed to decode CA key PEM")
+	}
+
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA key")
+	}
+
+	return ca, key, nil
+}
+
+func randSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.Wrap(err, "failed to generate serial number")
+}
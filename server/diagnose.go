@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jonathanwei/wile"
+	"github.com/pkg/errors"
+)
+
+// diagnosis is the result of one of the checks of diagnose.
+type diagnosis struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// diagnose checks everything issuing a cert for domain depends on, so that
+// operators can tell why issuance would fail without waiting for it to.
+// renewals may be nil.
+func (c *certManager) diagnose(ctx context.Context, domain string, renewals *renewalQueue) []diagnosis {
+	var ds []diagnosis
+	add := func(check string, err error, detail string) {
+		d := diagnosis{Check: check, OK: err == nil, Detail: detail}
+		if err != nil {
+			d.Detail = err.Error()
+		}
+		ds = append(ds, d)
+	}
+
+	c.mu.RLock()
+	managers := c.managers
+	http01 := c.http01
+	c.mu.RUnlock()
+
+	add("host policy", managers[0].HostPolicy(ctx, domain), "allowed")
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if err == nil && len(addrs) == 0 {
+		err = errors.Errorf("no addresses for %q", domain)
+	}
+	add("dns", err, fmt.Sprint(addrs))
+
+	var cas []string
+	for _, m := range managers {
+		cas = append(cas, m.Client.DirectoryURL)
+	}
+	detail, err := checkCAA(ctx, domain, cas)
+	add("caa", err, detail)
+
+	if http01 {
+		add("http-01", c.checkHTTP01(ctx, domain), "challenges reach this server")
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(domain, "443"))
+	if err == nil {
+		conn.Close()
+	}
+	add("tls-alpn-01", err, "port 443 reachable")
+
+	add("rate limit", c.checkRateLimit(ctx, domain, renewals), "no recent rate limit or backoff")
+	return ds
+}
+
+// checkHTTP01 stores a challenge response in the cache, the way autocert does,
+// and fetches it from domain on port 80, the way the CA would.
+func (c *certManager) checkHTTP01(ctx context.Context, domain string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return errors.Wrap(err, "failed to generate token")
+	}
+	token := "wile-diagnose-" + hex.EncodeToString(b)
+	want := hex.EncodeToString(b)
+
+	key := token + "+http-01"
+	if err := c.cache().Put(ctx, key, []byte(want)); err != nil {
+		return errors.Wrap(err, "failed to store challenge")
+	}
+	defer c.cache().Delete(context.Background(), key)
+
+	req, err := http.NewRequest("GET", "http://"+domain+"/.well-known/acme-challenge/"+token, nil)
+	if err != nil {
+		return err
+	}
+	// Like the CA, follow redirects, e.g. to HTTPS.
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch challenge")
+	}
+	defer resp.Body.Close()
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read challenge")
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != want {
+		return errors.Errorf("challenge answered with %s, not by this server", resp.Status)
+	}
+	return nil
+}
+
+// checkRateLimit checks that domain didn't recently hit a rate limit of the
+// CA and isn't backing off after failed renewals.
+func (c *certManager) checkRateLimit(ctx context.Context, domain string, renewals *renewalQueue) error {
+	if ce, ok := c.lastError(domain); ok {
+		if err := c.classifyError(domain, ce.err); errors.Cause(err) == wile.ErrACMERateLimited {
+			return errors.Errorf("rate limited at %s: %v", ce.time.Format(time.RFC3339), ce.err)
+		}
+	}
+
+	if renewals == nil {
+		return nil
+	}
+	state, _, err := renewals.get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if state.Failures > 0 && time.Now().Before(state.NextRetry) {
+		msg := fmt.Sprintf("backing off after %d failed renewals until %s", state.Failures, state.NextRetry.Format(time.RFC3339))
+		if n := len(state.Attempts); n > 0 && state.Attempts[n-1].Error != "" {
+			msg += ": " + state.Attempts[n-1].Error
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+)
+
+// discovery serves the hosts found at runtime by discovery sources, such as
+// Kubernetes Ingresses. Requests for other hosts are passed to next.
+type discovery struct {
+	next http.Handler
+
+	mu sync.RWMutex
+	// sources holds the handler of every host by source.
+	sources map[string]map[string]http.Handler
+}
+
+func newDiscovery(next http.Handler) *discovery {
+	return &discovery{
+		next:    next,
+		sources: make(map[string]map[string]http.Handler),
+	}
+}
+
+// update replaces the hosts of source. Requests already passed to a removed
+// or replaced handler finish on it, since handlers share their transports
+// and are never closed.
+func (d *discovery) update(source string, hosts map[string]http.Handler) {
+	normalized := make(map[string]http.Handler, len(hosts))
+	for h, handler := range hosts {
+		n, err := proxy.NormalizeHost(h)
+		if err != nil {
+			glog.Warningf("Ignoring invalid host %q of %s: %v", h, source, err)
+			continue
+		}
+		normalized[proxy.StripPort(n)] = handler
+	}
+	hosts = normalized
+
+	d.mu.Lock()
+	old := d.sources[source]
+	d.sources[source] = hosts
+	d.mu.Unlock()
+
+	var added, removed []string
+	for h := range hosts {
+		if _, ok := old[h]; !ok {
+			added = append(added, h)
+		}
+	}
+	for h := range old {
+		if _, ok := hosts[h]; !ok {
+			removed = append(removed, h)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		glog.Infof("Discovered hosts of %s changed, added %q, removed %q", source, added, removed)
+	}
+}
+
+func (d *discovery) handler(host string) (http.Handler, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, hosts := range d.sources {
+		if h, ok := hosts[host]; ok {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+// allows reports whether host was discovered, for the host policy.
+func (d *discovery) allows(host string) bool {
+	_, ok := d.handler(host)
+	return ok
+}
+
+func (d *discovery) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h, ok := d.handler(proxy.StripPort(req.Host))
+	if !ok {
+		h = d.next
+	}
+	h.ServeHTTP(rw, req)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// The TTLs of records are clamped to these, so that backends are neither
+	// resolved on every request nor kept for hours.
+	minDNSTTL = 5 * time.Second
+	maxDNSTTL = 5 * time.Minute
+	// fallbackDNSTTL is used when the TTL is unknown because there is no
+	// nameserver in /etc/resolv.conf and the system resolver is used.
+	fallbackDNSTTL = 30 * time.Second
+
+	// dnsTimeout bounds queries whose context has no deadline.
+	dnsTimeout = 10 * time.Second
+	// dnsUDPAttempts is how often a query is sent over UDP, where answers can
+	// be lost, before giving up.
+	dnsUDPAttempts = 3
+)
+
+// isDNSURL reports whether u is dns+http://<host>:<port>, for an instance per
+// A and AAAA record of host, or srv+http(s)://<name>, for an instance per SRV
+// record of name with the lowest priority.
+func isDNSURL(u *url.URL) bool {
+	return u.Scheme == "dns+http" || u.Scheme == "srv+http" || u.Scheme == "srv+https"
+}
+
+// watchDNS keeps the instances of b up to date with the records of u,
+// resolving them again when their TTL expires.
+func watchDNS(u *url.URL, b *dynamicBackend) {
+	for {
+		urls, ttl, err := resolveDNSURL(u)
+		if err != nil {
+			glog.Errorf("Failed to resolve %s: %v", u, err)
+			time.Sleep(minDNSTTL)
+			continue
+		}
+
+		b.setInstances(urls)
+		time.Sleep(ttl)
+	}
+}
+
+func resolveDNSURL(u *url.URL) ([]*url.URL, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	scheme := u.Scheme[strings.Index(u.Scheme, "+")+1:]
+
+	var (
+		urls []*url.URL
+		ttl  time.Duration
+	)
+	if strings.HasPrefix(u.Scheme, "srv+") {
+		srvs, t, err := lookupSRV(ctx, u.Host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, srv := range srvs {
+			urls = append(urls, &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+			})
+		}
+		ttl = t
+	} else {
+		ips, t, err := lookupIP(ctx, u.Hostname())
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ip := range ips {
+			urls = append(urls, &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(ip.String(), u.Port()),
+			})
+		}
+		ttl = t
+	}
+
+	if ttl < minDNSTTL {
+		ttl = minDNSTTL
+	}
+	if ttl > maxDNSTTL {
+		ttl = maxDNSTTL
+	}
+	return urls, ttl, nil
+}
+
+func lookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	conf, err := readResolvConf()
+	if err != nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ips []net.IP
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, fallbackDNSTTL, nil
+	}
+
+	for _, name := range conf.names(host) {
+		var (
+			ips []net.IP
+			ttl = maxDNSTTL
+		)
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			answers, err := queryDNS(ctx, conf.server, name, qtype)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, a := range answers {
+				switch r := a.Body.(type) {
+				case *dnsmessage.AResource:
+					ips = append(ips, net.IP(r.A[:]))
+				case *dnsmessage.AAAAResource:
+					ips = append(ips, net.IP(r.AAAA[:]))
+				default:
+					continue
+				}
+				ttl = minTTL(ttl, a.Header.TTL)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, errors.Errorf("no addresses for %q", host)
+}
+
+// lookupSRV returns the SRV records of name with the lowest priority.
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	conf, err := readResolvConf()
+	if err != nil {
+		_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return lowestPriority(srvs), fallbackDNSTTL, nil
+	}
+
+	for _, n := range conf.names(name) {
+		answers, err := queryDNS(ctx, conf.server, n, dnsmessage.TypeSRV)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var (
+			srvs []*net.SRV
+			ttl  = maxDNSTTL
+		)
+		for _, a := range answers {
+			r, ok := a.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+			srvs = append(srvs, &net.SRV{
+				Target:   r.Target.String(),
+				Port:     r.Port,
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			})
+			ttl = minTTL(ttl, a.Header.TTL)
+		}
+		if len(srvs) > 0 {
+			return lowestPriority(srvs), ttl, nil
+		}
+	}
+	return nil, 0, errors.Errorf("no SRV records for %q", name)
+}
+
+// typeCAA isn't known to dnsmessage, so CAA answers are parsed by hand.
+const typeCAA dnsmessage.Type = 257
+
+type caaRecord struct {
+	critical bool
+	tag      string
+	value    string
+}
+
+// lookupCAA returns the CAA records that apply to name: those of the closest
+// of name and its parents that has any, and the name they were found at.
+func lookupCAA(ctx context.Context, name string) ([]caaRecord, string, error) {
+	conf, err := readResolvConf()
+	if err != nil {
+		return nil, "", err
+	}
+	server := conf.server
+
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		resp, err := rawQueryDNS(ctx, server, name, typeCAA)
+		if err != nil {
+			return nil, "", err
+		}
+		records, err := parseCAA(resp)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "invalid CAA answer for %q", name)
+		}
+		if len(records) > 0 {
+			return records, name, nil
+		}
+
+		i := strings.Index(name, ".")
+		if i == -1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return nil, "", nil
+}
+
+// parseCAA returns the CAA records among the answers of msg.
+func parseCAA(msg []byte) ([]caaRecord, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("truncated message")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		// Type and class.
+		off += 4
+	}
+
+	var records []caaRecord
+	for i := 0; i < answers; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		// Type, class, TTL and length.
+		if off+10 > len(msg) {
+			return nil, errors.New("truncated message")
+		}
+		typ := dnsmessage.Type(binary.BigEndian.Uint16(msg[off:]))
+		n := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+n > len(msg) {
+			return nil, errors.New("truncated message")
+		}
+		data := msg[off : off+n]
+		off += n
+
+		if typ != typeCAA {
+			continue
+		}
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, errors.New("invalid CAA record")
+		}
+		records = append(records, caaRecord{
+			critical: data[0]&0x80 != 0,
+			tag:      strings.ToLower(string(data[2 : 2+data[1]])),
+			value:    string(data[2+data[1]:]),
+		})
+	}
+	return records, nil
+}
+
+// skipDNSName returns the offset after the name at off in msg.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// A pointer ends the name.
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+	return 0, errors.New("truncated name")
+}
+
+func lowestPriority(srvs []*net.SRV) []*net.SRV {
+	var lowest []*net.SRV
+	for _, s := range srvs {
+		if len(lowest) > 0 && s.Priority > lowest[0].Priority {
+			continue
+		}
+		if len(lowest) > 0 && s.Priority < lowest[0].Priority {
+			lowest = nil
+		}
+		lowest = append(lowest, s)
+	}
+	return lowest
+}
+
+func minTTL(d time.Duration, ttl uint32) time.Duration {
+	if t := time.Duration(ttl) * time.Second; t < d {
+		return t
+	}
+	return d
+}
+
+// resolvConf is what is used of /etc/resolv.conf to resolve names the way the
+// system resolver does. The system resolver itself is only used without a
+// nameserver, since it doesn't return TTLs.
+type resolvConf struct {
+	// server is the address of the first nameserver.
+	server string
+	search []string
+	ndots  int
+}
+
+func readResolvConf() (*resolvConf, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseResolvConf(f)
+}
+
+func parseResolvConf(r io.Reader) (*resolvConf, error) {
+	conf := &resolvConf{ndots: 1}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if conf.server == "" {
+				conf.server = net.JoinHostPort(fields[1], "53")
+			}
+		case "domain":
+			// The last of domain and search wins.
+			conf.search = fields[1:2]
+		case "search":
+			conf.search = fields[1:]
+		case "options":
+			for _, o := range fields[1:] {
+				if strings.HasPrefix(o, "ndots:") {
+					if n, err := strconv.Atoi(strings.TrimPrefix(o, "ndots:")); err == nil && n >= 0 {
+						conf.ndots = n
+					}
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if conf.server == "" {
+		return nil, errors.New("no nameserver in /etc/resolv.conf")
+	}
+	return conf, nil
+}
+
+// names returns the fully qualified names to try for name, in order. Names
+// with a trailing dot are only tried as they are. Others are tried with each
+// search domain, after the name itself if it has at least ndots dots and
+// before it otherwise.
+func (c *resolvConf) names(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	var names []string
+	absolute := strings.Count(name, ".") >= c.ndots
+	if absolute {
+		names = append(names, name+".")
+	}
+	for _, s := range c.search {
+		names = append(names, name+"."+strings.TrimSuffix(s, ".")+".")
+	}
+	if !absolute {
+		names = append(names, name+".")
+	}
+	return names
+}
+
+// queryDNS asks server for the records of type qtype of name, over UDP and,
+// if the answer doesn't fit, over TCP.
+func queryDNS(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	resp, err := rawQueryDNS(ctx, server, name, qtype)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, errors.Wrapf(err, "invalid answer for %q", name)
+	}
+	return msg.Answers, nil
+}
+
+// rawQueryDNS is like queryDNS, but returns the packed answer, or nil if name
+// doesn't exist. It's for record types dnsmessage can't unpack.
+func rawQueryDNS(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid name %q", name)
+	}
+
+	id := uint16(rand.Uint32())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: n, Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err == nil && h.Truncated {
+		resp, err = exchangeDNS(ctx, "tcp", server, query)
+		if err != nil {
+			return nil, err
+		}
+		h, err = p.Start(resp)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid answer for %q", name)
+	}
+
+	if h.ID != id {
+		return nil, errors.Errorf("answer for %q has the wrong ID", name)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+		return resp, nil
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("query for %q failed: %v", name, h.RCode)
+	}
+}
+
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", server)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		// The time left is split between the attempts, the last one getting
+		// all that remains.
+		resp := make([]byte, 4096)
+		for attempt := 1; ; attempt++ {
+			_, err = conn.Write(query)
+			if err != nil {
+				return nil, err
+			}
+			wait := time.Until(deadline) / time.Duration(dnsUDPAttempts-attempt+1)
+			conn.SetReadDeadline(time.Now().Add(wait))
+			n, err := conn.Read(resp)
+			if err == nil {
+				return resp[:n], nil
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || attempt == dnsUDPAttempts {
+				return nil, errors.Wrapf(err, "failed to read from %s", server)
+			}
+		}
+	}
+
+	// Over TCP, messages are prefixed with their length.
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	_, err = io.ReadFull(conn, l[:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read from %s", server)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read from %s", server)
+	}
+	return resp, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolvConfNames(t *testing.T) {
+	tests := []struct {
+		conf string
+		name string
+		want []string
+	}{
+		{"nameserver 10.0.0.1\n", "example.com", []string{"example.com."}},
+		{"nameserver 10.0.0.1\n", "example.com.", []string{"example.com."}},
+		{"nameserver 10.0.0.1\nsearch a.svc b.svc\n", "db", []string{"db.a.svc.", "db.b.svc.", "db."}},
+		{"nameserver 10.0.0.1\nsearch a.svc\n", "db.ns", []string{"db.ns.", "db.ns.a.svc."}},
+		{"nameserver 10.0.0.1\nsearch a.svc\noptions ndots:5\n", "db.ns", []string{"db.ns.a.svc.", "db.ns."}},
+		{"nameserver 10.0.0.1\nsearch a.svc\n", "db.", []string{"db."}},
+		{"nameserver 10.0.0.1\nsearch a.svc\ndomain b.svc\n", "db", []string{"db.b.svc.", "db."}},
+	}
+	for _, tt := range tests {
+		conf, err := parseResolvConf(strings.NewReader(tt.conf))
+		if err != nil {
+			t.Fatalf("parseResolvConf(%q): %v", tt.conf, err)
+		}
+		if conf.server != "10.0.0.1:53" {
+			t.Errorf("parseResolvConf(%q).server = %q", tt.conf, conf.server)
+		}
+		if got := conf.names(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("names(%q) with %q = %q, want %q", tt.name, tt.conf, got, tt.want)
+		}
+	}
+}
+
+func TestParseResolvConfNoNameserver(t *testing.T) {
+	if _, err := parseResolvConf(strings.NewReader("search a.svc\n")); err == nil {
+		t.Error("parseResolvConf without nameserver succeeded")
+	}
+}
+
+func TestExchangeDNSResendsUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// Drop the first query, and echo the next one.
+	go func() {
+		buf := make([]byte, 512)
+		for i := 0; ; i++ {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if i > 0 {
+				pc.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	resp, err := exchangeDNS(ctx, "udp", pc.LocalAddr().String(), []byte("query"))
+	if err != nil {
+		t.Fatalf("exchangeDNS: %v", err)
+	}
+	if string(resp) != "query" {
+		t.Errorf("exchangeDNS = %q, want the echoed query", resp)
+	}
+}
+
+func TestExchangeDNSGivesUp(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := exchangeDNS(ctx, "udp", pc.LocalAddr().String(), []byte("query")); err == nil {
+		t.Error("exchangeDNS without answer succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("exchangeDNS took %v past its deadline", d)
+	}
+}
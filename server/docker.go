@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerHostLabel    = "wile.host"
+	dockerPortLabel    = "wile.port"
+	dockerNetworkLabel = "wile.network"
+)
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerWatcher serves the hosts of the running Docker containers labeled
+// with wile.host, a comma-separated list of hosts, and wile.port, the port
+// the container serves HTTP on. Containers with several networks need
+// wile.network to pick one. Containers with the same host share its traffic.
+type dockerWatcher struct {
+	client     *http.Client
+	discovered *discovery
+	key        []byte
+	pages      *statusPages
+}
+
+// newDockerWatcher creates a dockerWatcher for the Docker API on the Unix
+// socket at socket.
+func newDockerWatcher(socket string, discovered *discovery, key []byte, pages *statusPages) *dockerWatcher {
+	return &dockerWatcher{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		discovered: discovered,
+		key:        key,
+		pages:      pages,
+	}
+}
+
+func (w *dockerWatcher) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", "http://docker"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %q", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("failed to get %q: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// run syncs the hosts with the containers whenever a container starts or
+// stops.
+func (w *dockerWatcher) run() {
+	ctx := context.Background()
+	for {
+		since := time.Now()
+		err := w.sync(ctx)
+		if err == nil {
+			err = w.waitForChange(ctx, since)
+		}
+		if err != nil {
+			glog.Errorf("Failed to sync Docker containers: %v", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+func (w *dockerWatcher) sync(ctx context.Context) error {
+	filters, _ := json.Marshal(map[string][]string{"label": {dockerHostLabel}})
+	resp, err := w.get(ctx, "/containers/json", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var containers []dockerContainer
+	err = json.NewDecoder(resp.Body).Decode(&containers)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode containers")
+	}
+
+	urls := make(map[string][]*url.URL)
+	for _, c := range containers {
+		u, err := c.url()
+		if err != nil {
+			glog.Warningf("Ignoring container %s: %v", c.name(), err)
+			continue
+		}
+		for _, h := range strings.Split(c.Labels[dockerHostLabel], ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				urls[h] = append(urls[h], u)
+			}
+		}
+	}
+
+	hosts := make(map[string]http.Handler)
+	for h, us := range urls {
+		// Sorted so that affinity cookies don't depend on the listing order.
+		sort.Slice(us, func(i, j int) bool { return us[i].Host < us[j].Host })
+		hosts[h] = newBackendHandler(h, us, w.key, nil, w.pages)
+	}
+	w.discovered.update("docker", hosts)
+	return nil
+}
+
+// waitForChange returns once a container has started or stopped since since.
+func (w *dockerWatcher) waitForChange(ctx context.Context, since time.Time) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die"},
+	})
+	resp, err := w.get(ctx, "/events", url.Values{
+		"since":   {strconv.FormatInt(since.Unix(), 10)},
+		"filters": {string(filters)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var event struct{}
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to watch events")
+	}
+	return nil
+}
+
+func (c *dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
+
+func (c *dockerContainer) url() (*url.URL, error) {
+	port, err := strconv.Atoi(c.Labels[dockerPortLabel])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.Errorf("invalid %s label %q", dockerPortLabel, c.Labels[dockerPortLabel])
+	}
+
+	networks := c.NetworkSettings.Networks
+	network := c.Labels[dockerNetworkLabel]
+	if network == "" {
+		if len(networks) != 1 {
+			return nil, errors.Errorf("in %d networks, %s label needed", len(networks), dockerNetworkLabel)
+		}
+		for n := range networks {
+			network = n
+		}
+	}
+
+	n, ok := networks[network]
+	if !ok || n.IPAddress == "" {
+		return nil, errors.Errorf("no address in network %q", network)
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(n.IPAddress, fmt.Sprint(port)),
+	}, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanwei/wile/proxy"
+)
+
+const testContainers = `[
+  {"Id": "a", "Names": ["/a"], "Labels": {"wile.host": "a.example.com, b.example.com", "wile.port": "8080"},
+   "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}},
+  {"Id": "b", "Names": ["/b"], "Labels": {"wile.host": "a.example.com", "wile.port": "8080", "wile.network": "front"},
+   "NetworkSettings": {"Networks": {"back": {"IPAddress": "10.1.0.2"}, "front": {"IPAddress": "172.17.0.2"}}}},
+  {"Id": "c", "Labels": {"wile.host": "c.example.com", "wile.port": "http"},
+   "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.4"}}}}
+]`
+
+// serveTestDocker serves a fake Docker API on a Unix socket in dir, and
+// returns the socket.
+func serveTestDocker(t *testing.T, dir string, h http.Handler) (string, func()) {
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(h)
+	s.Listener = l
+	s.Start()
+	return socket, s.Close
+}
+
+func TestDockerWatcherSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket, closeDocker := serveTestDocker(t, dir, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/containers/json" || req.URL.Query().Get("filters") != `{"label":["wile.host"]}` {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte(testContainers))
+	}))
+	defer closeDocker()
+
+	pages, err := newStatusPages("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovered := newDiscovery(http.NotFoundHandler())
+	w := newDockerWatcher(socket, discovered, []byte("key"), pages)
+	if err := w.sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Containers sharing a host are pooled, in order of address.
+	h, ok := discovered.handler("a.example.com")
+	if !ok {
+		t.Fatal("a.example.com wasn't discovered")
+	}
+	pool, ok := h.(*poolHandler)
+	if !ok {
+		t.Fatalf("a.example.com is served by a %T, want a pool", h)
+	}
+	var urls []string
+	for _, in := range pool.instances {
+		urls = append(urls, in.url.String())
+	}
+	if want := []string{"http://172.17.0.2:8080", "http://172.17.0.3:8080"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("a.example.com is pooled to %q, want %q", urls, want)
+	}
+
+	if h, ok := discovered.handler("b.example.com"); !ok {
+		t.Error("b.example.com wasn't discovered")
+	} else if _, ok := h.(*proxy.Proxy); !ok {
+		t.Errorf("b.example.com is served by a %T, want a proxy", h)
+	}
+	if discovered.allows("c.example.com") {
+		t.Error("c.example.com was discovered, despite its invalid port")
+	}
+}
+
+func TestDockerWatcherWaitForChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	since := time.Unix(1500000000, 0)
+	socket, closeDocker := serveTestDocker(t, dir, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var filters map[string][]string
+		json.Unmarshal([]byte(req.URL.Query().Get("filters")), &filters)
+		if req.URL.Path != "/events" || req.URL.Query().Get("since") != "1500000000" ||
+			!reflect.DeepEqual(filters, map[string][]string{"type": {"container"}, "event": {"start", "die"}}) {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		rw.Write([]byte(`{"status": "start", "id": "a"}`))
+	}))
+	defer closeDocker()
+
+	w := newDockerWatcher(socket, nil, nil, nil)
+	if err := w.waitForChange(context.Background(), since); err != nil {
+		t.Error(err)
+	}
+	if err := w.waitForChange(context.Background(), since.Add(time.Second)); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("got error %v, want a 400", err)
+	}
+}
+
+func TestDockerContainerURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		container string
+		want      string
+		wantErr   string
+	}{
+		{"one network", `{"Labels": {"wile.port": "80"}, "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}`, "http://172.17.0.2:80", ""},
+		{"IPv6", `{"Labels": {"wile.port": "80"}, "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "fd00::2"}}}}`, "http://[fd00::2]:80", ""},
+		{"picked network", `{"Labels": {"wile.port": "80", "wile.network": "b"}, "NetworkSettings": {"Networks": {"a": {"IPAddress": "10.0.0.2"}, "b": {"IPAddress": "10.1.0.2"}}}}`, "http://10.1.0.2:80", ""},
+		{"no port", `{"NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}`, "", `invalid wile.port label ""`},
+		{"port out of range", `{"Labels": {"wile.port": "70000"}, "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}}`, "", `invalid wile.port label "70000"`},
+		{"several networks", `{"Labels": {"wile.port": "80"}, "NetworkSettings": {"Networks": {"a": {"IPAddress": "10.0.0.2"}, "b": {"IPAddress": "10.1.0.2"}}}}`, "", "in 2 networks, wile.network label needed"},
+		{"no networks", `{"Labels": {"wile.port": "80"}}`, "", "in 0 networks"},
+		{"missing network", `{"Labels": {"wile.port": "80", "wile.network": "c"}, "NetworkSettings": {"Networks": {"a": {"IPAddress": "10.0.0.2"}}}}`, "", `no address in network "c"`},
+		{"no address", `{"Labels": {"wile.port": "80"}, "NetworkSettings": {"Networks": {"host": {"IPAddress": ""}}}}`, "", `no address in network "host"`},
+	}
+	for _, tt := range tests {
+		var c dockerContainer
+		if err := json.Unmarshal([]byte(tt.container), &c); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		u, err := c.url()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if u.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, u, tt.want)
+		}
+	}
+}
+
+func TestDockerContainerName(t *testing.T) {
+	if got := (&dockerContainer{ID: "abc", Names: []string{"/web", "/alias"}}).name(); got != "web" {
+		t.Errorf("name = %q, want web", got)
+	}
+	if got := (&dockerContainer{ID: "abc"}).name(); got != "abc" {
+		t.Errorf("name without names = %q, want the ID", got)
+	}
+}
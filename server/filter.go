@@ -0,0 +1,480 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+	"github.com/pkg/errors"
+)
+
+var requestFilterActions = expvar.NewMap("request_filter_actions")
+
+// requestFilter applies the rules of a file to the requests of a host, so
+// that policies can change without rebuilding wile. Each line of the file is
+// a rule of the form <action> [if <condition>], e.g.
+//
+//	deny 403 if path =~ "^/admin" && !(ip in "10.0.0.0/8")
+//	set_header X-Client-IP ip
+//	route beta if cookie("beta") == "1"
+//
+// Rules are applied in order until one answers the request. The file is
+// reloaded when it changes; if it has errors, the old rules are kept.
+type requestFilter struct {
+	host     string
+	file     string
+	backends map[string]http.Handler
+
+	mu    sync.RWMutex
+	rules []filterRule
+	mod   time.Time
+}
+
+type filterRule struct {
+	action string
+	// cond is nil for rules without a condition.
+	cond func(req *http.Request) bool
+	// do applies the action and reports whether it answered the request.
+	do func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool
+}
+
+// newRequestFilter loads the rules of host from file. Routes may go to the
+// handlers in backends.
+func newRequestFilter(host, file string, backends map[string]http.Handler) (*requestFilter, error) {
+	f := &requestFilter{
+		host:     host,
+		file:     file,
+		backends: backends,
+	}
+	if _, err := f.load(); err != nil {
+		return nil, err
+	}
+	go f.pollLoop()
+	return f, nil
+}
+
+func (f *requestFilter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.mu.RLock()
+		rules := f.rules
+		f.mu.RUnlock()
+
+		for _, r := range rules {
+			if r.cond != nil && !r.cond(req) {
+				continue
+			}
+			requestFilterActions.Add(f.host+" "+r.action, 1)
+			if r.do(rw, req, h) {
+				return
+			}
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func (f *requestFilter) pollLoop() {
+	for range time.Tick(pollInterval) {
+		changed, err := f.load()
+		if err != nil {
+			glog.Errorf("Failed to reload request filters of %q, keeping the old ones: %v", f.host, err)
+			continue
+		}
+		if changed {
+			glog.Infof("Reloaded request filters of %q", f.host)
+		}
+	}
+}
+
+// load parses the file if it changed since it was last read, and reports
+// whether it did.
+func (f *requestFilter) load() (bool, error) {
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat filter file")
+	}
+	f.mu.RLock()
+	unchanged := f.rules != nil && info.ModTime().Equal(f.mod)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read filter file")
+	}
+	rules := []filterRule{}
+	for i, line := range strings.Split(string(data), "\n") {
+		toks, err := tokenizeFilter(line)
+		if err != nil {
+			return false, errors.Wrapf(err, "line %d", i+1)
+		}
+		if len(toks) == 0 {
+			continue
+		}
+		p := &filterParser{toks: toks, backends: f.backends}
+		r, err := p.rule()
+		if err != nil {
+			return false, errors.Wrapf(err, "line %d", i+1)
+		}
+		rules = append(rules, r)
+	}
+
+	f.mu.Lock()
+	f.rules, f.mod = rules, info.ModTime()
+	f.mu.Unlock()
+	return true, nil
+}
+
+// tokenizeFilter splits a rule into identifiers, quoted strings and
+// operators, dropping comments.
+func tokenizeFilter(line string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			return toks, nil
+		case c == '"':
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, line[i:j+1])
+			i = j + 1
+		case isFilterIdent(c):
+			j := i
+			for j < len(line) && isFilterIdent(line[j]) {
+				j++
+			}
+			toks = append(toks, line[i:j])
+			i = j
+		default:
+			if i+1 < len(line) {
+				switch op := line[i : i+2]; op {
+				case "==", "!=", "=~", "&&", "||":
+					toks = append(toks, op)
+					i += 2
+					continue
+				}
+			}
+			if c != '!' && c != '(' && c != ')' {
+				return nil, errors.Errorf("unexpected %q", c)
+			}
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks, nil
+}
+
+func isFilterIdent(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.'
+}
+
+type filterParser struct {
+	toks     []string
+	pos      int
+	backends map[string]http.Handler
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *filterParser) rule() (filterRule, error) {
+	r := filterRule{action: p.next()}
+	switch r.action {
+	case "allow":
+		r.do = func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool {
+			next.ServeHTTP(rw, req)
+			return true
+		}
+
+	case "deny":
+		status := http.StatusForbidden
+		if t := p.peek(); t != "" && t != "if" {
+			n, err := strconv.Atoi(p.next())
+			if err != nil || n < 200 || n > 599 {
+				return r, errors.Errorf("invalid status %q", t)
+			}
+			status = n
+		}
+		r.do = func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool {
+			http.Error(rw, http.StatusText(status), status)
+			return true
+		}
+
+	case "route":
+		name, err := p.name()
+		if err != nil {
+			return r, err
+		}
+		h, ok := p.backends[name]
+		if !ok {
+			return r, errors.Errorf("unknown backend %q", name)
+		}
+		r.do = func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool {
+			h.ServeHTTP(rw, req)
+			return true
+		}
+
+	case "set_header":
+		name, err := p.name()
+		if err != nil {
+			return r, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return r, err
+		}
+		r.do = func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool {
+			req.Header.Set(name, v(req))
+			return false
+		}
+
+	case "remove_header":
+		name, err := p.name()
+		if err != nil {
+			return r, err
+		}
+		r.do = func(rw http.ResponseWriter, req *http.Request, next http.Handler) bool {
+			req.Header.Del(name)
+			return false
+		}
+
+	default:
+		return r, errors.Errorf("unknown action %q", r.action)
+	}
+
+	if p.peek() == "if" {
+		p.next()
+		cond, err := p.or()
+		if err != nil {
+			return r, err
+		}
+		r.cond = cond
+	}
+	if t := p.peek(); t != "" {
+		return r, errors.Errorf("unexpected %q", t)
+	}
+	return r, nil
+}
+
+// name parses the name of a header or backend, either bare or quoted.
+func (p *filterParser) name() (string, error) {
+	t := p.next()
+	switch {
+	case t == "" || t == "if":
+		return "", errors.New("missing name")
+	case strings.HasPrefix(t, `"`):
+		return p.unquote(t)
+	case isFilterIdent(t[0]):
+		return t, nil
+	}
+	return "", errors.Errorf("invalid name %q", t)
+}
+
+func (p *filterParser) unquote(t string) (string, error) {
+	s, err := strconv.Unquote(t)
+	if err != nil {
+		return "", errors.Errorf("invalid string %s", t)
+	}
+	return s, nil
+}
+
+func (p *filterParser) or() (func(*http.Request) bool, error) {
+	a, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		b, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a = func(a, b func(*http.Request) bool) func(*http.Request) bool {
+			return func(req *http.Request) bool { return a(req) || b(req) }
+		}(a, b)
+	}
+	return a, nil
+}
+
+func (p *filterParser) and() (func(*http.Request) bool, error) {
+	a, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		b, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		a = func(a, b func(*http.Request) bool) func(*http.Request) bool {
+			return func(req *http.Request) bool { return a(req) && b(req) }
+		}(a, b)
+	}
+	return a, nil
+}
+
+func (p *filterParser) not() (func(*http.Request) bool, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		a, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) bool { return !a(req) }, nil
+
+	case "(":
+		p.next()
+		a, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		return a, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (func(*http.Request) bool, error) {
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.peek(); op {
+	case "==", "!=":
+		p.next()
+		w, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if op == "==" {
+			return func(req *http.Request) bool { return v(req) == w(req) }, nil
+		}
+		return func(req *http.Request) bool { return v(req) != w(req) }, nil
+
+	case "=~":
+		p.next()
+		s, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regexp %q", s)
+		}
+		return func(req *http.Request) bool { return re.MatchString(v(req)) }, nil
+
+	case "in":
+		p.next()
+		s, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid CIDR %q", s)
+		}
+		return func(req *http.Request) bool {
+			ip := net.ParseIP(v(req))
+			return ip != nil && ipNet.Contains(ip)
+		}, nil
+	}
+
+	// A value on its own is true if it isn't empty.
+	return func(req *http.Request) bool { return v(req) != "" }, nil
+}
+
+func (p *filterParser) literal() (string, error) {
+	t := p.next()
+	if !strings.HasPrefix(t, `"`) {
+		return "", errors.Errorf("expected a string, got %q", t)
+	}
+	return p.unquote(t)
+}
+
+func (p *filterParser) value() (func(*http.Request) string, error) {
+	t := p.next()
+	switch t {
+	case "method":
+		return func(req *http.Request) string { return req.Method }, nil
+	case "path":
+		return func(req *http.Request) string { return req.URL.Path }, nil
+	case "host":
+		return func(req *http.Request) string { return proxy.StripPort(req.Host) }, nil
+	case "ip":
+		return func(req *http.Request) string {
+			ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+			return ip
+		}, nil
+
+	case "header", "cookie", "query":
+		if p.next() != "(" {
+			return nil, errors.Errorf("%s must be followed by (\"<name>\")", t)
+		}
+		name, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		switch t {
+		case "header":
+			return func(req *http.Request) string { return req.Header.Get(name) }, nil
+		case "cookie":
+			return func(req *http.Request) string {
+				if c, err := req.Cookie(name); err == nil {
+					return c.Value
+				}
+				return ""
+			}, nil
+		}
+		return func(req *http.Request) string { return req.URL.Query().Get(name) }, nil
+	}
+
+	if strings.HasPrefix(t, `"`) {
+		s, err := p.unquote(t)
+		if err != nil {
+			return nil, err
+		}
+		return func(*http.Request) string { return s }, nil
+	}
+	if t == "" {
+		return nil, errors.New("missing value")
+	}
+	return nil, errors.Errorf("unknown value %q", t)
+}
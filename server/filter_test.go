@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestFilter returns a filter with rules, without polling for changes.
+func loadTestFilter(t *testing.T, rules string) (*requestFilter, error) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules")
+	if err := ioutil.WriteFile(file, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name + " " + req.Header.Get("X-Client-IP") + req.Header.Get("X-Secret")))
+		})
+	}
+	f := &requestFilter{host: "example.com", file: file, backends: map[string]http.Handler{"beta": echo("beta")}}
+	_, err = f.load()
+	return f, err
+}
+
+func TestRequestFilter(t *testing.T) {
+	f, err := loadTestFilter(t, `
+# Comments and blank lines are skipped.
+remove_header X-Secret
+deny 429 if path =~ "^/admin" && !(ip in "10.0.0.0/8")
+deny if method == "DELETE" || header("X-Evil") != ""
+set_header X-Client-IP ip
+route beta if cookie("beta") == "1" || query("beta")
+allow if host == "example.com"
+deny 404
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("next " + req.Header.Get("X-Client-IP") + req.Header.Get("X-Secret")))
+	})
+	h := f.middleware(next)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		host     string
+		ip       string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{"allowed", "GET", "/", "example.com", "192.0.2.1", nil, 200, "next 192.0.2.1"},
+		{"host port ignored", "GET", "/", "example.com:443", "192.0.2.1", nil, 200, "next 192.0.2.1"},
+		{"other host", "GET", "/", "other.example.com", "192.0.2.1", nil, 404, ""},
+		{"admin denied", "GET", "/admin/users", "example.com", "192.0.2.1", nil, 429, ""},
+		{"admin from inside", "GET", "/admin/users", "example.com", "10.1.2.3", nil, 200, "next 10.1.2.3"},
+		{"delete", "DELETE", "/", "example.com", "10.1.2.3", nil, 403, ""},
+		{"evil header", "GET", "/", "example.com", "192.0.2.1", http.Header{"X-Evil": {"1"}}, 403, ""},
+		{"header removed", "GET", "/", "example.com", "192.0.2.1", http.Header{"X-Secret": {"s"}}, 200, "next 192.0.2.1"},
+		{"beta cookie", "GET", "/", "example.com", "192.0.2.1", http.Header{"Cookie": {"beta=1"}}, 200, "beta 192.0.2.1"},
+		{"other cookie", "GET", "/", "example.com", "192.0.2.1", http.Header{"Cookie": {"beta=0"}}, 200, "next 192.0.2.1"},
+		{"beta query", "GET", "/?beta=yes", "example.com", "192.0.2.1", nil, 200, "beta 192.0.2.1"},
+		{"empty query", "GET", "/?beta=", "example.com", "192.0.2.1", nil, 200, "next 192.0.2.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Host = tt.host
+		req.RemoteAddr = tt.ip + ":1234"
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, rw.Code, tt.wantCode)
+		}
+		if tt.wantBody != "" && rw.Body.String() != tt.wantBody {
+			t.Errorf("%s: got %q, want %q", tt.name, rw.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestRequestFilterErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{"block", `unknown action "block"`},
+		{"deny 700", `invalid status "700"`},
+		{"deny teapot", `invalid status "teapot"`},
+		{"route alpha", `unknown backend "alpha"`},
+		{"set_header", "missing name"},
+		{"set_header X-A", "missing value"},
+		{"allow if", "missing value"},
+		{"allow if path =~ \"(\"", "invalid regexp"},
+		{"allow if ip in \"10.0.0.0\"", "invalid CIDR"},
+		{"allow if path =~ path", "expected a string"},
+		{"allow if (path", "missing ')'"},
+		{"allow if header(X)", "expected a string"},
+		{"allow if user == \"x\"", `unknown value "user"`},
+		{"allow if path == \"/\" path", `unexpected "path"`},
+		{"allow if path == \"/", "unterminated string"},
+		{"allow if path = \"/\"", `unexpected '='`},
+		{"allow\nallow if", "line 2"},
+	}
+	for _, tt := range tests {
+		_, err := loadTestFilter(t, tt.rules)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("rules %q: got error %v, want %q", tt.rules, err, tt.want)
+		}
+	}
+}
+
+func TestTokenizeFilter(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  # comment", nil},
+		{"allow", []string{"allow"}},
+		{`deny 403 if path =~ "^/a b" # why`, []string{"deny", "403", "if", "path", "=~", `"^/a b"`}},
+		{`route x if !(a==b)&&c!="d\"e"||f`, []string{"route", "x", "if", "!", "(", "a", "==", "b", ")", "&&", "c", "!=", `"d\"e"`, "||", "f"}},
+		{"set_header X-Client-IP ip", []string{"set_header", "X-Client-IP", "ip"}},
+	}
+	for _, tt := range tests {
+		got, err := tokenizeFilter(tt.line)
+		if err != nil {
+			t.Errorf("tokenizeFilter(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeFilter(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
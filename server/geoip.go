@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// mmdbMetadataStart marks the start of the metadata of a MaxMind DB file.
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoIP looks up the location of IPs in a MaxMind DB file, such as
+// GeoLite2-City.mmdb. See https://maxmind.github.io/MaxMind-DB/ for the
+// format; only what's needed for country and city lookups is implemented.
+type geoIP struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node IPv4 lookups start at in an IPv6 tree.
+	ipv4Start uint
+}
+
+type geoLocation struct {
+	// country is an ISO 3166-1 code, e.g. "DE".
+	country string
+	// city is the English name of the city.
+	city string
+}
+
+func newGeoIP(file string) (*geoIP, error) {
+	db, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read GeoIP database")
+	}
+
+	i := bytes.LastIndex(db, mmdbMetadataStart)
+	if i == -1 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metaStart := i + len(mmdbMetadataStart)
+	meta, _, err := (&mmdbDecoder{db[metaStart:]}).decode(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid GeoIP metadata")
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid GeoIP metadata")
+	}
+
+	g := &geoIP{}
+	for name, v := range map[string]*uint{"node_count": &g.nodeCount, "record_size": &g.recordSize, "ip_version": &g.ipVersion} {
+		n, ok := m[name].(uint64)
+		if !ok {
+			return nil, errors.Errorf("GeoIP metadata is missing %s", name)
+		}
+		*v = uint(n)
+	}
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, errors.Errorf("unsupported GeoIP record size %d", g.recordSize)
+	}
+
+	treeSize := g.nodeCount * g.recordSize / 4
+	// The tree is followed by 16 zero bytes, then the data.
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("GeoIP database is truncated")
+	}
+	g.tree = db[:treeSize]
+	g.data = db[treeSize+16 : i]
+
+	if g.ipVersion == 6 {
+		for n := 0; n < 96 && g.ipv4Start < g.nodeCount; n++ {
+			g.ipv4Start = g.record(g.ipv4Start, 0)
+		}
+	}
+	return g, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (g *geoIP) record(node, bit uint) uint {
+	b := g.tree[node*g.recordSize/4:]
+	switch g.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+func (g *geoIP) lookup(ip net.IP) (geoLocation, error) {
+	var loc geoLocation
+
+	bits := ip.To4()
+	node := g.ipv4Start
+	if bits == nil {
+		if g.ipVersion == 4 {
+			return loc, nil
+		}
+		bits = ip.To16()
+		node = 0
+	}
+
+	for i := 0; i < len(bits)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node <= g.nodeCount {
+		// Not found.
+		return loc, nil
+	}
+
+	v, _, err := (&mmdbDecoder{g.data}).decode(node - g.nodeCount - 16)
+	if err != nil {
+		return loc, errors.Wrapf(err, "invalid GeoIP record for %v", ip)
+	}
+	loc.country, _ = mmdbPath(v, "country", "iso_code").(string)
+	loc.city, _ = mmdbPath(v, "city", "names", "en").(string)
+	return loc, nil
+}
+
+// mmdbPath returns the value under the keys of nested maps, or nil.
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// mmdbDecoder decodes the data section of a MaxMind DB file. Pointers are
+// offsets into data.
+type mmdbDecoder struct {
+	data []byte
+}
+
+var errMMDBTruncated = errors.New("truncated data")
+
+func (d *mmdbDecoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.data)) || off+n < off {
+		return nil, errMMDBTruncated
+	}
+	return d.data[off : off+n], nil
+}
+
+// decode decodes the value at off, and returns it with the offset after it.
+func (d *mmdbDecoder) decode(off uint) (interface{}, uint, error) {
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		return d.decodePointer(ctrl, off)
+	}
+	if typ == 0 {
+		b, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		var ext uint
+		for _, c := range b {
+			ext = ext<<8 | uint(c)
+		}
+		switch size {
+		case 29:
+			size = 29 + ext
+		case 30:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+	}
+
+	switch typ {
+	case 2, 4:
+		b, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 2 {
+			return string(b), off + size, nil
+		}
+		return append([]byte(nil), b...), off + size, nil
+
+	case 3, 15:
+		b, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 3 && size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), off + size, nil
+		}
+		if typ == 15 && size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off + size, nil
+		}
+		return nil, 0, errors.Errorf("invalid float size %d", size)
+
+	case 5, 6, 8, 9, 10:
+		b, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		// uint128s that don't fit are truncated; they aren't used for
+		// locations.
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(n)), off + size, nil
+		}
+		return n, off + size, nil
+
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key isn't a string")
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+
+	case 14:
+		return size != 0, off, nil
+
+	default:
+		return nil, 0, errors.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// decodePointer decodes the value a pointer points to. The returned offset
+// is the one after the pointer itself.
+func (d *mmdbDecoder) decodePointer(ctrl byte, off uint) (interface{}, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+
+	v, _, err := d.decode(p)
+	return v, off + n, err
+}
+
+// geoHeaders sets X-Geo-Country and X-Geo-City for backends, dropping any
+// sent by the client.
+func (g *geoIP) geoHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Header.Del("X-Geo-Country")
+		req.Header.Del("X-Geo-City")
+
+		loc := g.clientLocation(req)
+		if loc.country != "" {
+			req.Header.Set("X-Geo-Country", loc.country)
+		}
+		if loc.city != "" {
+			req.Header.Set("X-Geo-City", loc.city)
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// geoRoutes sends requests from the countries in routes to their handler,
+// and all others to the next handler.
+func (g *geoIP) geoRoutes(routes map[string]http.Handler) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if rh, ok := routes[g.clientLocation(req).country]; ok {
+				rh.ServeHTTP(rw, req)
+				return
+			}
+			h.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func (g *geoIP) clientLocation(req *http.Request) geoLocation {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return geoLocation{}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return geoLocation{}
+	}
+	loc, err := g.lookup(ip)
+	if err != nil {
+		return geoLocation{}
+	}
+	return loc
+}
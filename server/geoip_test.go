@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mmdb encodes values of the MaxMind DB data format.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(n uint32) []byte {
+	return []byte{6<<5 | 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func mmdbMap(kv ...interface{}) []byte {
+	b := []byte{7<<5 | byte(len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, mmdbString(kv[i].(string))...)
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+// writeTestMMDB writes an IPv4 database in which prefix has the location of
+// data, and returns its file.
+func writeTestMMDB(t *testing.T, dir string, recordSize uint, prefix *net.IPNet, data []byte) string {
+	ones, _ := prefix.Mask.Size()
+	nodeCount := uint(ones)
+	notFound := nodeCount
+	found := nodeCount + 16
+
+	var tree []byte
+	ip := prefix.IP.To4()
+	for i := uint(0); i < nodeCount; i++ {
+		next := i + 1
+		if i == nodeCount-1 {
+			next = found
+		}
+		records := [2]uint{notFound, notFound}
+		records[ip[i/8]>>(7-i%8)&1] = next
+
+		l, r := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>20&0xf0|r>>24&0x0f), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			tree = append(tree, make([]byte, 8)...)
+			binary.BigEndian.PutUint32(tree[len(tree)-8:], uint32(l))
+			binary.BigEndian.PutUint32(tree[len(tree)-4:], uint32(r))
+		}
+	}
+
+	var db bytes.Buffer
+	db.Write(tree)
+	db.Write(make([]byte, 16))
+	db.Write(data)
+	db.Write(mmdbMetadataStart)
+	db.Write(mmdbMap(
+		"node_count", mmdbUint(uint32(nodeCount)),
+		"record_size", mmdbUint(uint32(recordSize)),
+		"ip_version", mmdbUint(4),
+	))
+
+	file := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(file, db.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+var berlin = mmdbMap(
+	"country", mmdbMap("iso_code", mmdbString("DE")),
+	"city", mmdbMap("names", mmdbMap("en", mmdbString("Berlin"), "de", mmdbString("Berlin"))),
+)
+
+func TestMMDBDecode(t *testing.T) {
+	float32Bits := make([]byte, 4)
+	binary.BigEndian.PutUint32(float32Bits, math.Float32bits(0.5))
+	float64Bits := make([]byte, 8)
+	binary.BigEndian.PutUint64(float64Bits, math.Float64bits(1.5))
+	long := strings.Repeat("x", 30)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		want     interface{}
+		wantNext uint
+	}{
+		{"string", mmdbString("abc"), "abc", 4},
+		{"long string", append([]byte{2<<5 | 29, 1}, long...), long, 32},
+		{"double", append([]byte{3<<5 | 8}, float64Bits...), 1.5, 9},
+		{"bytes", []byte{4<<5 | 2, 1, 2}, []byte{1, 2}, 3},
+		{"uint16", []byte{5<<5 | 2, 1, 0}, uint64(256), 3},
+		{"uint32", mmdbUint(5), uint64(5), 5},
+		{"empty uint32", []byte{6 << 5}, uint64(0), 1},
+		{"map", mmdbMap("a", []byte{5<<5 | 1, 7}), map[string]interface{}{"a": uint64(7)}, 5},
+		{"int32", []byte{4, 1, 0xff, 0xff, 0xff, 0xfe}, int64(-2), 6},
+		{"uint64", []byte{2, 2, 1, 0}, uint64(256), 4},
+		{"array", append(append([]byte{2, 4}, mmdbString("x")...), 5<<5|1, 1), []interface{}{"x", uint64(1)}, 6},
+		{"true", []byte{1, 7}, true, 2},
+		{"false", []byte{0, 7}, false, 2},
+		{"float", append([]byte{4, 8}, float32Bits...), 0.5, 6},
+		// The offset after a pointer is the one after the pointer itself.
+		{"pointer", append([]byte{1 << 5, 3, 0xff}, mmdbString("abc")...), "abc", 2},
+	}
+	for _, tt := range tests {
+		got, next, err := (&mmdbDecoder{tt.data}).decode(0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || next != tt.wantNext {
+			t.Errorf("%s: got %#v, %d, want %#v, %d", tt.name, got, next, tt.want, tt.wantNext)
+		}
+	}
+}
+
+func TestMMDBDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "truncated"},
+		{"short string", []byte{2<<5 | 3, 'a'}, "truncated"},
+		{"short extended type", []byte{0}, "truncated"},
+		{"short size", []byte{2<<5 | 30, 1}, "truncated"},
+		{"short pointer", []byte{1<<5 | 1<<3, 0}, "truncated"},
+		{"bad pointer", []byte{1 << 5, 100}, "truncated"},
+		{"unsupported type", []byte{0, 5}, "unsupported data type 12"},
+		{"float size", []byte{3<<5 | 2, 0, 0}, "invalid float size 2"},
+		{"map key", []byte{7<<5 | 1, 5<<5 | 1, 1, 5<<5 | 1, 1}, "map key isn't a string"},
+		{"short map", []byte{7<<5 | 2, 2<<5 | 1, 'a', 5<<5 | 1, 1}, "truncated"},
+	}
+	for _, tt := range tests {
+		_, _, err := (&mmdbDecoder{tt.data}).decode(0)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+
+	for _, size := range []uint{24, 28, 32} {
+		g, err := newGeoIP(writeTestMMDB(t, dir, size, prefix, berlin))
+		if err != nil {
+			t.Fatalf("record size %d: %v", size, err)
+		}
+
+		tests := []struct {
+			ip   string
+			want geoLocation
+		}{
+			{"192.0.2.1", geoLocation{"DE", "Berlin"}},
+			{"192.0.2.255", geoLocation{"DE", "Berlin"}},
+			{"192.0.3.1", geoLocation{}},
+			{"10.0.0.1", geoLocation{}},
+			// An IPv4 database has no IPv6 addresses.
+			{"2001:db8::1", geoLocation{}},
+		}
+		for _, tt := range tests {
+			got, err := g.lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Errorf("record size %d: lookup(%s): %v", size, tt.ip, err)
+			}
+			if got != tt.want {
+				t.Errorf("record size %d: lookup(%s) = %+v, want %+v", size, tt.ip, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewGeoIPErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var n int
+	write := func(data []byte) string {
+		n++
+		file := filepath.Join(dir, fmt.Sprintf("bad%d.mmdb", n))
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	meta := func(kv ...interface{}) []byte {
+		return append(append([]byte(nil), mmdbMetadataStart...), mmdbMap(kv...)...)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"missing", filepath.Join(dir, "missing.mmdb"), "failed to read"},
+		{"not mmdb", write([]byte("hello")), "not a MaxMind DB file"},
+		{"bad metadata", write(append(append([]byte(nil), mmdbMetadataStart...), 0)), "invalid GeoIP metadata"},
+		{"metadata not a map", write(append(append([]byte(nil), mmdbMetadataStart...), mmdbString("x")...)), "invalid GeoIP metadata"},
+		{"missing field", write(meta("node_count", mmdbUint(1), "record_size", mmdbUint(24))), "missing ip_version"},
+		{"record size", write(meta("node_count", mmdbUint(1), "record_size", mmdbUint(20), "ip_version", mmdbUint(4))), "unsupported GeoIP record size 20"},
+		{"truncated", write(meta("node_count", mmdbUint(100), "record_size", mmdbUint(24), "ip_version", mmdbUint(4))), "truncated"},
+	}
+	for _, tt := range tests {
+		_, err := newGeoIP(tt.file)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestGeoIPMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+	g, err := newGeoIP(writeTestMMDB(t, dir, 24, prefix, berlin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			var geo []string
+			for k := range req.Header {
+				if strings.HasPrefix(k, "X-Geo-") {
+					geo = append(geo, k+"="+req.Header.Get(k))
+				}
+			}
+			sort.Strings(geo)
+			rw.Write([]byte(name + " " + strings.Join(geo, ",")))
+		})
+	}
+	h := g.geoHeaders(g.geoRoutes(map[string]http.Handler{"DE": echo("de")})(echo("default")))
+
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "de X-Geo-City=Berlin,X-Geo-Country=DE"},
+		{"198.51.100.1:1234", "default "},
+		{"[2001:db8::1]:1234", "default "},
+		{"bogus", "default "},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		// Clients can't set the headers themselves.
+		req.Header.Set("X-Geo-Country", "US")
+		req.Header.Set("X-Geo-City", "Springfield")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("from %s: got %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
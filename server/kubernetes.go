@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal client of the Kubernetes API, authenticated as the
+// service account of the pod.
+type kubeClient struct {
+	base   string
+	client *http.Client
+	// token is the file of the service account token.
+	token string
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cluster CA")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certs in cluster CA")
+	}
+
+	return &kubeClient{
+		base: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		},
+		token: filepath.Join(serviceAccountDir, "token"),
+	}, nil
+}
+
+func (k *kubeClient) do(ctx context.Context, path string) (*http.Response, error) {
+	// The token is read on every request, since it's rotated.
+	token, err := ioutil.ReadFile(k.token)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service account token")
+	}
+
+	req, err := http.NewRequest("GET", k.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %q", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("failed to get %q: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (k *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := k.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "failed to decode %q", path)
+}
+
+// waitForChange watches the collection at path from resourceVersion and
+// returns once it changes, or after a few minutes.
+func (k *kubeClient) waitForChange(ctx context.Context, path, resourceVersion string) error {
+	q := url.Values{
+		"watch":           {"1"},
+		"resourceVersion": {resourceVersion},
+		"timeoutSeconds":  {"300"},
+	}
+	resp, err := k.do(ctx, path+"?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var event struct {
+		Type string `json:"type"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&event)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to watch %q", path)
+	}
+	return nil
+}
+
+type ingressList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []ingress `json:"items"`
+}
+
+type ingress struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		IngressClassName string          `json:"ingressClassName"`
+		DefaultBackend   *ingressBackend `json:"defaultBackend"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string         `json:"path"`
+					PathType string         `json:"pathType"`
+					Backend  ingressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type ingressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int    `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+type service struct {
+	Spec struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// ingressController serves the hosts of the Kubernetes Ingresses of an
+// ingress class. Requests are proxied to the cluster DNS name of the
+// Services, so that kube-proxy balances them between the pods.
+type ingressController struct {
+	kube       *kubeClient
+	class      string
+	namespace  string
+	discovered *discovery
+	pages      *statusPages
+	// transport reaches the Services. If nil, http.DefaultTransport is used.
+	transport http.RoundTripper
+}
+
+func newIngressController(class, namespace string, discovered *discovery, pages *statusPages) (*ingressController, error) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return &ingressController{
+		kube:       kube,
+		class:      class,
+		namespace:  namespace,
+		discovered: discovered,
+		pages:      pages,
+	}, nil
+}
+
+func (c *ingressController) path() string {
+	if c.namespace == "" {
+		return "/apis/networking.k8s.io/v1/ingresses"
+	}
+	return "/apis/networking.k8s.io/v1/namespaces/" + url.PathEscape(c.namespace) + "/ingresses"
+}
+
+// run syncs the hosts with the Ingresses whenever they change.
+func (c *ingressController) run() {
+	ctx := context.Background()
+	for {
+		rv, err := c.sync(ctx)
+		if err == nil {
+			err = c.kube.waitForChange(ctx, c.path(), rv)
+		}
+		if err != nil {
+			glog.Errorf("Failed to sync Kubernetes Ingresses: %v", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// sync updates the hosts from the current Ingresses and returns their
+// resource version.
+func (c *ingressController) sync(ctx context.Context) (string, error) {
+	var list ingressList
+	err := c.kube.get(ctx, c.path(), &list)
+	if err != nil {
+		return "", err
+	}
+
+	routers := make(map[string]*pathRouter)
+	proxies := make(map[string]http.Handler)
+	backend := func(ing *ingress, b *ingressBackend) (http.Handler, error) {
+		if b == nil || b.Service == nil {
+			return nil, errors.New("only Service backends are supported")
+		}
+		port := b.Service.Port.Number
+		if port == 0 {
+			var err error
+			port, err = c.servicePort(ctx, ing.Metadata.Namespace, b.Service.Name, b.Service.Port.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		u := fmt.Sprintf("http://%s.%s.svc:%d", b.Service.Name, ing.Metadata.Namespace, port)
+		if _, ok := proxies[u]; !ok {
+			backendURL, err := url.Parse(u)
+			if err != nil {
+				return nil, err
+			}
+			proxies[u] = c.pages.reverseProxy(backendURL, c.transport)
+		}
+		return proxies[u], nil
+	}
+
+	for i := range list.Items {
+		ing := &list.Items[i]
+		class := ing.Spec.IngressClassName
+		if class == "" {
+			class = ing.Metadata.Annotations["kubernetes.io/ingress.class"]
+		}
+		if class != c.class {
+			continue
+		}
+		name := ing.Metadata.Namespace + "/" + ing.Metadata.Name
+
+		var fallback http.Handler
+		if ing.Spec.DefaultBackend != nil {
+			fallback, err = backend(ing, ing.Spec.DefaultBackend)
+			if err != nil {
+				glog.Warningf("Ignoring default backend of Ingress %s: %v", name, err)
+			}
+		}
+
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+				glog.Warningf("Ignoring rule of Ingress %s for host %q, only exact hosts are supported", name, rule.Host)
+				continue
+			}
+
+			r, ok := routers[rule.Host]
+			if !ok {
+				r = &pathRouter{}
+				routers[rule.Host] = r
+			}
+			if r.fallback == nil {
+				r.fallback = fallback
+			}
+			if rule.HTTP == nil {
+				continue
+			}
+
+			for _, p := range rule.HTTP.Paths {
+				h, err := backend(ing, &p.Backend)
+				if err != nil {
+					glog.Warningf("Ignoring path %q of Ingress %s: %v", p.Path, name, err)
+					continue
+				}
+				path := p.Path
+				if path == "" {
+					path = "/"
+				}
+				r.paths = append(r.paths, ingressPath{path, p.PathType == "Exact", h})
+			}
+		}
+	}
+
+	hosts := make(map[string]http.Handler)
+	for host, r := range routers {
+		r.sort()
+		hosts[host] = r
+	}
+	c.discovered.update("kubernetes", hosts)
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (c *ingressController) servicePort(ctx context.Context, namespace, name, portName string) (int, error) {
+	var svc service
+	err := c.kube.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/services/"+url.PathEscape(name), &svc)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name == portName {
+			return p.Port, nil
+		}
+	}
+	return 0, errors.Errorf("Service %s/%s has no port %q", namespace, name, portName)
+}
+
+type ingressPath struct {
+	path    string
+	exact   bool
+	handler http.Handler
+}
+
+// pathRouter routes the requests of a host by the paths of its Ingress
+// rules. Requests that match no path go to fallback, the default backend.
+type pathRouter struct {
+	paths    []ingressPath
+	fallback http.Handler
+}
+
+// sort orders the paths so that the longest match wins, and exact matches
+// win over prefix matches of the same length. The trailing slash of a prefix
+// doesn't count, since /foo/ matches /foo too.
+func (r *pathRouter) sort() {
+	sort.SliceStable(r.paths, func(i, j int) bool {
+		a, b := r.paths[i], r.paths[j]
+		if la, lb := len(a.matched()), len(b.matched()); la != lb {
+			return la > lb
+		}
+		return a.exact && !b.exact
+	})
+}
+
+func (r *pathRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	for _, p := range r.paths {
+		if p.matches(req.URL.Path) {
+			p.handler.ServeHTTP(rw, req)
+			return
+		}
+	}
+	if r.fallback != nil {
+		r.fallback.ServeHTTP(rw, req)
+		return
+	}
+	http.NotFound(rw, req)
+}
+
+// matches reports whether path matches p. Prefixes match whole path
+// elements, so /foo matches /foo/bar but not /foobar.
+func (p ingressPath) matches(path string) bool {
+	if p.exact {
+		return path == p.path
+	}
+	prefix := p.matched()
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// matched returns the path p matches, without the trailing slash of a prefix.
+func (p ingressPath) matched() string {
+	if p.exact {
+		return p.path
+	}
+	return strings.TrimSuffix(p.path, "/")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathanwei/wile/proxy"
+)
+
+const testIngresses = `{
+  "metadata": {"resourceVersion": "42"},
+  "items": [
+    {
+      "metadata": {"name": "site", "namespace": "web"},
+      "spec": {
+        "ingressClassName": "wile",
+        "defaultBackend": {"service": {"name": "default", "port": {"number": 80}}},
+        "rules": [
+          {"host": "example.com", "http": {"paths": [
+            {"path": "/", "pathType": "Prefix", "backend": {"service": {"name": "site", "port": {"number": 80}}}},
+            {"path": "/api", "pathType": "Prefix", "backend": {"service": {"name": "api", "port": {"name": "http"}}}},
+            {"path": "/api/v1", "pathType": "Exact", "backend": {"service": {"name": "v1", "port": {"number": 81}}}},
+            {"path": "/grpc", "pathType": "Prefix", "backend": {"service": {"name": "api", "port": {"name": "grpc"}}}},
+            {"path": "/bucket", "pathType": "Prefix", "backend": {"resource": {"kind": "Bucket"}}}
+          ]}},
+          {"host": "*.example.com", "http": {"paths": [
+            {"path": "/", "backend": {"service": {"name": "site", "port": {"number": 80}}}}
+          ]}},
+          {"host": "docs.example.com"}
+        ]
+      }
+    },
+    {
+      "metadata": {"name": "x", "namespace": "other", "annotations": {"kubernetes.io/ingress.class": "wile"}},
+      "spec": {"rules": [{"host": "annotated.example.com", "http": {"paths": [
+        {"backend": {"service": {"name": "x", "port": {"number": 8000}}}}
+      ]}}]}
+    },
+    {
+      "metadata": {"name": "y", "namespace": "other"},
+      "spec": {"ingressClassName": "nginx", "rules": [{"host": "nginx.example.com", "http": {"paths": [
+        {"path": "/", "backend": {"service": {"name": "y", "port": {"number": 80}}}}
+      ]}}]}
+    }
+  ]
+}`
+
+// newTestKubeClient returns a client of a fake Kubernetes API serving paths.
+func newTestKubeClient(t *testing.T, dir string, paths map[string]string) (*kubeClient, func()) {
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, ok := paths[req.URL.RequestURI()]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Write([]byte(body))
+	}))
+	return &kubeClient{base: s.URL, client: s.Client(), token: token}, s.Close
+}
+
+func TestIngressControllerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kube, closeKube := newTestKubeClient(t, dir, map[string]string{
+		"/apis/networking.k8s.io/v1/ingresses": testIngresses,
+		"/api/v1/namespaces/web/services/api":  `{"spec": {"ports": [{"name": "http", "port": 8080}]}}`,
+	})
+	defer closeKube()
+
+	pages, err := newStatusPages("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discovered := newDiscovery(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("next"))
+	}))
+	c := &ingressController{
+		kube:       kube,
+		class:      "wile",
+		discovered: discovered,
+		pages:      pages,
+		transport: proxy.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			rec := httptest.NewRecorder()
+			rec.Write([]byte(req.URL.Host + req.URL.Path))
+			return rec.Result(), nil
+		}),
+	}
+
+	rv, err := c.sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv != "42" {
+		t.Errorf("sync returned resource version %q, want 42", rv)
+	}
+
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{"example.com", "/", "site.web.svc:80/"},
+		{"example.com", "/apiary", "site.web.svc:80/apiary"},
+		{"example.com", "/api", "api.web.svc:8080/api"},
+		{"example.com", "/api/v1", "v1.web.svc:81/api/v1"},
+		{"example.com", "/api/v1/users", "api.web.svc:8080/api/v1/users"},
+		// Paths whose backend can't be resolved are ignored.
+		{"example.com", "/grpc", "site.web.svc:80/grpc"},
+		{"example.com", "/bucket", "site.web.svc:80/bucket"},
+		{"docs.example.com", "/a", "default.web.svc:80/a"},
+		{"annotated.example.com", "/a", "x.other.svc:8000/a"},
+		{"www.example.com", "/", "next"},
+		{"nginx.example.com", "/", "next"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		rw := httptest.NewRecorder()
+		discovered.ServeHTTP(rw, req)
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("%s%s went to %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIngressControllerPath(t *testing.T) {
+	tests := []struct {
+		namespace, want string
+	}{
+		{"", "/apis/networking.k8s.io/v1/ingresses"},
+		{"web", "/apis/networking.k8s.io/v1/namespaces/web/ingresses"},
+	}
+	for _, tt := range tests {
+		if got := (&ingressController{namespace: tt.namespace}).path(); got != tt.want {
+			t.Errorf("path in namespace %q = %q, want %q", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func TestKubeClientWaitForChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kube, closeKube := newTestKubeClient(t, dir, map[string]string{
+		"/ingresses?resourceVersion=42&timeoutSeconds=300&watch=1": `{"type": "MODIFIED", "object": {}}`,
+		"/ingresses?resourceVersion=43&timeoutSeconds=300&watch=1": ``,
+	})
+	defer closeKube()
+
+	ctx := context.Background()
+	if err := kube.waitForChange(ctx, "/ingresses", "42"); err != nil {
+		t.Errorf("watch with an event: %v", err)
+	}
+	// Watches time out without events.
+	if err := kube.waitForChange(ctx, "/ingresses", "43"); err != nil {
+		t.Errorf("watch without events: %v", err)
+	}
+	if err := kube.waitForChange(ctx, "/ingresses", "44"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("watch of a missing path: got error %v, want a 404", err)
+	}
+
+	kube.token = filepath.Join(dir, "missing")
+	if err := kube.waitForChange(ctx, "/ingresses", "42"); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Errorf("watch without a token: got error %v", err)
+	}
+}
+
+func TestPathRouter(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(name))
+		})
+	}
+	r := &pathRouter{paths: []ingressPath{
+		{"/", false, handler("root")},
+		{"/foo/", false, handler("foo")},
+		{"/foo", true, handler("exact foo")},
+		{"/foo/bar", false, handler("bar")},
+	}}
+	r.sort()
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "root"},
+		{"/foo", "exact foo"},
+		{"/foo/", "foo"},
+		{"/foo/baz", "foo"},
+		{"/foobar", "root"},
+		{"/foo/bar", "bar"},
+		{"/foo/bar/baz", "bar"},
+		{"/foo/barbaz", "foo"},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest("GET", tt.path, nil))
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("%s went to %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// Without a default backend, unmatched paths aren't found.
+	r = &pathRouter{paths: []ingressPath{{"/a", true, handler("a")}}}
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest("GET", "/b", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("unmatched path got status %d, want 404", rw.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type listenOptions struct {
+	httpAddrs  []string
+	httpsAddrs []string
+
+	// acceptProxy means every connection must start with a PROXY protocol
+	// header.
+	acceptProxy bool
+	// passthroughProxy means a PROXY protocol header is sent to passthrough
+	// backends.
+	passthroughProxy bool
+
+	// drainTimeout is how long to wait for open requests to finish before
+	// exiting after an upgrade.
+	drainTimeout time.Duration
+
+	// tuning holds the connection settings of listeners by address.
+	tuning map[string]*listenerTuning
+}
+
+// tuningFor returns the connection settings of l, or nil if it has none.
+func (opts listenOptions) tuningFor(l net.Listener) (string, *listenerTuning) {
+	for addr, t := range opts.tuning {
+		if sameAddr(addr, l) {
+			return addr, t
+		}
+	}
+	return "", nil
+}
+
+// listeners returns the HTTP and HTTPS listeners. If the process was started
+// by systemd socket activation or by an upgrade, the passed sockets are used
+// instead of the configured addresses: sockets named "http" (with
+// FileDescriptorName= in systemd) serve HTTP, all others HTTPS.
+func listeners(opts listenOptions) (httpLs, httpsLs []net.Listener) {
+	files := systemdFiles()
+	if len(files) == 0 {
+		files = upgradeFiles()
+	}
+	if len(files) > 0 {
+		for _, f := range files {
+			l, err := net.FileListener(f)
+			if err != nil {
+				glog.Fatalf("Failed to use inherited socket %q: %v", f.Name(), err)
+			}
+			f.Close()
+
+			if f.Name() == "http" {
+				httpLs = append(httpLs, l)
+			} else {
+				httpsLs = append(httpsLs, l)
+			}
+		}
+	} else {
+		for _, addr := range opts.httpAddrs {
+			httpLs = append(httpLs, listen(addr))
+		}
+		for _, addr := range opts.httpsAddrs {
+			httpsLs = append(httpsLs, listen(addr))
+		}
+	}
+
+	if len(httpsLs) == 0 {
+		glog.Fatal("No HTTPS listeners")
+	}
+	return httpLs, httpsLs
+}
+
+func listen(addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	return l
+}
+
+// systemdFiles returns the sockets passed by systemd socket activation, see
+// sd_listen_fds(3).
+func systemdFiles() []*os.File {
+	const firstFD = 3
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
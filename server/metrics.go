@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	acmeRequests     = expvar.NewMap("acme_requests")
+	acmeErrors       = expvar.NewMap("acme_errors")
+	acmeLatency      = newHistogram("acme_request_seconds")
+	challengeLatency = newHistogram("acme_challenge_seconds")
+	obtainLatency    = newHistogram("cert_obtain_seconds")
+	renewLatency     = newHistogram("cert_renew_seconds")
+	certEvents       = expvar.NewMap("cert_events")
+)
+
+// histogramBuckets are the upper bounds of the buckets of histograms, in
+// seconds. ACME requests take about a second, issuance up to minutes.
+var histogramBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// histogram is an expvar.Var counting observations in cumulative buckets,
+// like a Prometheus histogram.
+type histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(name string) *histogram {
+	h := &histogram{counts: make([]int64, len(histogramBuckets))}
+	expvar.Publish(name, h)
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range histogramBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	for i, bound := range histogramBuckets {
+		fmt.Fprintf(&b, `"%g": %d, `, bound, h.counts[i])
+	}
+	fmt.Fprintf(&b, `"+Inf": %d}, "sum": %g, "count": %d}`, h.count, h.sum, h.count)
+	return b.String()
+}
+
+// acmeTransport counts the requests to ACME CAs and their errors, and times
+// them and the validation of challenges.
+type acmeTransport struct {
+	next http.RoundTripper
+
+	mu sync.Mutex
+	// polled holds when authorizations were first polled. autocert polls an
+	// authorization after accepting one of its challenges, until the CA has
+	// validated it.
+	polled map[string]time.Time
+}
+
+func newACMETransport(next http.RoundTripper) *acmeTransport {
+	return &acmeTransport{
+		next:   next,
+		polled: make(map[string]time.Time),
+	}
+}
+
+func (t *acmeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	acmeRequests.Add(req.URL.Host, 1)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	acmeLatency.observe(time.Since(start))
+	if err != nil {
+		acmeErrors.Add("network", 1)
+		return nil, err
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		if resp.StatusCode >= 500 {
+			acmeErrors.Add("ca", 1)
+		}
+		return resp, nil
+	}
+
+	// Responses are small JSON documents, so they can be read whole.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		acmeErrors.Add("network", 1)
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var doc struct {
+		Type       string          `json:"type"`
+		Status     string          `json:"status"`
+		Identifier json.RawMessage `json:"identifier"`
+		Challenges json.RawMessage `json:"challenges"`
+	}
+	json.Unmarshal(body, &doc)
+
+	if resp.StatusCode >= 400 {
+		acmeErrors.Add(acmeErrorCategory(doc.Type, resp.StatusCode), 1)
+		return resp, nil
+	}
+	if req.Method == "GET" && doc.Identifier != nil && doc.Challenges != nil {
+		t.authorizationPolled(req.URL.String(), doc.Status)
+	}
+	return resp, nil
+}
+
+func (t *acmeTransport) authorizationPolled(url, status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	first, ok := t.polled[url]
+	switch status {
+	case "pending", "processing":
+		if !ok {
+			t.polled[url] = time.Now()
+		}
+	case "valid", "invalid":
+		if ok {
+			challengeLatency.observe(time.Since(first))
+			delete(t.polled, url)
+		}
+		if status == "invalid" {
+			acmeErrors.Add("challenge", 1)
+		}
+	}
+}
+
+// acmeErrorCategory groups ACME problem types, e.g.
+// urn:ietf:params:acme:error:rateLimited, into rate_limit, dns (DNS and CAA
+// lookups), challenge (the CA couldn't validate a challenge), ca (server
+// errors) and other.
+func acmeErrorCategory(problemType string, status int) string {
+	i := strings.LastIndex(problemType, ":")
+	switch problemType[i+1:] {
+	case "rateLimited":
+		return "rate_limit"
+	case "dns", "caa":
+		return "dns"
+	case "connection", "tls", "unauthorized", "incorrectResponse":
+		return "challenge"
+	case "serverInternal":
+		return "ca"
+	case "badNonce":
+		// autocert retries these.
+		return "bad_nonce"
+	}
+	if status >= 500 {
+		return "ca"
+	}
+	return "other"
+}
@@ -0,0 +1,21 @@
+package main
+
+import "net/http"
+
+// middleware wraps the handler of a host, e.g. to require authentication.
+type middleware func(http.Handler) http.Handler
+
+// hostMiddleware holds the middleware of each host, outermost first.
+type hostMiddleware map[string][]middleware
+
+func (hm hostMiddleware) add(host string, m middleware) {
+	hm[host] = append(hm[host], m)
+}
+
+func (hm hostMiddleware) wrap(host string, h http.Handler) http.Handler {
+	ms := hm[host]
+	for i := len(ms) - 1; i >= 0; i-- {
+		h = ms[i](h)
+	}
+	return h
+}
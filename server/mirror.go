@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxMirrorBody is the largest request body that is mirrored. Requests
+	// with larger bodies are only sent to the backend.
+	maxMirrorBody = 1 << 20
+	// maxMirrorRequests is the number of mirrored requests in flight, beyond
+	// which requests aren't mirrored.
+	maxMirrorRequests = 100
+	mirrorTimeout     = 30 * time.Second
+)
+
+// mirror sends a copy of a percentage of requests to a shadow backend, whose
+// responses are thrown away, e.g. to test a new version with real traffic.
+type mirror struct {
+	shadow  http.Handler
+	percent float64
+	// inFlight limits the mirrored requests in flight.
+	inFlight chan struct{}
+}
+
+func newMirror(shadow http.Handler, percent float64) *mirror {
+	return &mirror{shadow, percent, make(chan struct{}, maxMirrorRequests)}
+}
+
+func (m *mirror) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if rand.Float64()*100 >= m.percent {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		var body []byte
+		if req.Body != nil && req.Body != http.NoBody {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxMirrorBody+1))
+			if err != nil {
+				http.Error(rw, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			if len(body) > maxMirrorBody {
+				h.ServeHTTP(rw, req)
+				return
+			}
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+			// The copy must not be canceled when the original request ends.
+			ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+			shadowReq := req.Clone(ctx)
+			shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+			go func() {
+				defer func() { <-m.inFlight }()
+				defer cancel()
+				m.shadow.ServeHTTP(discardResponseWriter{make(http.Header)}, shadowReq)
+			}()
+		default:
+		}
+
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// discardResponseWriter throws away the response of mirrored requests.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
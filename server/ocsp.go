@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// oidTLSFeature is the TLS feature extension of RFC 7633. With the
+// status_request feature, it marks certs as must-staple.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// mustStapleExtension requests the status_request (5) TLS feature.
+var mustStapleExtension = pkix.Extension{
+	Id:    oidTLSFeature,
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// ocspStapler staples OCSP responses to the certs of next. Responses are
+// fetched in the background and refreshed halfway through their validity.
+// Must-staple certs are refused until they have a valid response.
+type ocspStapler struct {
+	next   certSource
+	client *http.Client
+
+	mu      sync.Mutex
+	staples map[string]*ocspStaple
+}
+
+type ocspStaple struct {
+	// notAfter is when the cert expires, after which the staple is pruned.
+	notAfter   time.Time
+	raw        []byte
+	nextUpdate time.Time
+	refreshAt  time.Time
+	fetching   bool
+}
+
+func newOCSPStapler(next certSource) *ocspStapler {
+	return &ocspStapler{
+		next:    next,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		staples: make(map[string]*ocspStaple),
+	}
+}
+
+func (s *ocspStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.next.GetCertificate(hello)
+	if err != nil || len(cert.Certificate) < 2 {
+		return cert, err
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse cert")
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return cert, nil
+	}
+
+	staple := s.staple(leaf, cert.Certificate[1])
+	if staple == nil {
+		if isMustStaple(leaf) {
+			return nil, errors.Errorf("no OCSP response yet for must-staple cert of %q", hello.ServerName)
+		}
+		return cert, nil
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	return &stapled, nil
+}
+
+func (s *ocspStapler) HTTPHandler(fallback http.Handler) http.Handler {
+	return s.next.HTTPHandler(fallback)
+}
+
+// staple returns the current OCSP response for leaf, or nil if there is none.
+// It starts a refresh if one is due; must-staple certs without a response
+// wait for it.
+func (s *ocspStapler) staple(leaf *x509.Certificate, issuerDER []byte) []byte {
+	key := fmt.Sprintf("%x/%x", leaf.AuthorityKeyId, leaf.SerialNumber)
+	now := time.Now()
+
+	s.mu.Lock()
+	st, ok := s.staples[key]
+	if !ok {
+		// A new cert usually replaces one, so this is when old ones are
+		// dropped.
+		s.prune(now)
+		st = &ocspStaple{notAfter: leaf.NotAfter}
+		s.staples[key] = st
+	}
+	refresh := !st.fetching && !now.Before(st.refreshAt)
+	if refresh {
+		st.fetching = true
+	}
+	var raw []byte
+	if now.Before(st.nextUpdate) {
+		raw = st.raw
+	}
+	s.mu.Unlock()
+
+	if !refresh {
+		return raw
+	}
+	if raw == nil && isMustStaple(leaf) {
+		s.refresh(key, leaf, issuerDER)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if now.Before(st.nextUpdate) {
+			return st.raw
+		}
+		return nil
+	}
+	go s.refresh(key, leaf, issuerDER)
+	return raw
+}
+
+// prune drops the staples of expired certs. s.mu must be held.
+func (s *ocspStapler) prune(now time.Time) {
+	for key, st := range s.staples {
+		if !st.fetching && now.After(st.notAfter) {
+			delete(s.staples, key)
+		}
+	}
+}
+
+func (s *ocspStapler) refresh(key string, leaf *x509.Certificate, issuerDER []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	raw, resp, err := s.fetch(ctx, leaf, issuerDER)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.staples[key]
+	if !ok {
+		return
+	}
+	st.fetching = false
+	if err != nil {
+		glog.Errorf("Failed to get OCSP response for %q: %v", leaf.Subject.CommonName, err)
+		st.refreshAt = time.Now().Add(time.Minute)
+		return
+	}
+
+	st.raw = raw
+	st.nextUpdate = resp.NextUpdate
+	st.refreshAt = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
+
+func (s *ocspStapler) fetch(ctx context.Context, leaf *x509.Certificate, issuerDER []byte) ([]byte, *ocsp.Response, error) {
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse issuer")
+	}
+
+	reqData, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create OCSP request")
+	}
+
+	req, err := http.NewRequest("POST", leaf.OCSPServer[0], bytes.NewReader(reqData))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to query OCSP responder")
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("OCSP responder returned %s", httpResp.Status)
+	}
+	raw, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read OCSP response")
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid OCSP response")
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, errors.Errorf("cert status is %d, not good", resp.Status)
+	}
+	if resp.NextUpdate.IsZero() || !time.Now().Before(resp.NextUpdate) {
+		return nil, nil, errors.New("OCSP response is expired")
+	}
+	return raw, resp, nil
+}
+
+func isMustStaple(leaf *x509.Certificate) bool {
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidTLSFeature) && bytes.Equal(ext.Value, mustStapleExtension.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	oidcCallbackPath = "/_wile/oidc/callback"
+	oidcSessionName  = "wile_session"
+	oidcStateName    = "wile_oidc_state"
+)
+
+// oidcAuth makes wile an OpenID Connect relying party for some hosts: users
+// without a session are sent to the identity provider to log in, and requests
+// of users with one are passed on with their identity in the X-Forwarded-User
+// and X-Forwarded-Email headers.
+//
+// Sessions are kept in cookies signed with cookieKey, so they are valid on
+// every replica sharing the key.
+type oidcAuth struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	sessionTTL   time.Duration
+	signer       *cookieSigner
+	client       *http.Client
+
+	mu        sync.Mutex
+	provider  *oidcProvider
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Host    string `json:"host"`
+	Expires int64  `json:"exp"`
+}
+
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+func newOIDCAuth(issuer, clientID, clientSecret string, cookieKey []byte, sessionTTL time.Duration) *oidcAuth {
+	return &oidcAuth{
+		issuer:       strings.TrimSuffix(issuer, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		sessionTTL:   sessionTTL,
+		signer:       &cookieSigner{cookieKey},
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// middleware returns the middleware protecting host.
+func (o *oidcAuth) middleware(host string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == oidcCallbackPath {
+				o.callback(rw, req, host)
+				return
+			}
+
+			// Never let clients set these themselves.
+			req.Header.Del("X-Forwarded-User")
+			req.Header.Del("X-Forwarded-Email")
+
+			var s oidcSession
+			if o.signer.readCookie(req, oidcSessionName, &s) && s.Host == host && time.Now().Unix() < s.Expires {
+				req.Header.Set("X-Forwarded-User", s.Subject)
+				if s.Email != "" {
+					req.Header.Set("X-Forwarded-Email", s.Email)
+				}
+				h.ServeHTTP(rw, req)
+				return
+			}
+
+			o.login(rw, req, host)
+		})
+	}
+}
+
+func (o *oidcAuth) login(rw http.ResponseWriter, req *http.Request, host string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p, err := o.discover()
+	if err != nil {
+		glog.Errorf("OIDC discovery failed: %v", err)
+		http.Error(rw, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	st := oidcState{
+		State:    randToken(),
+		Nonce:    randToken(),
+		Redirect: req.URL.RequestURI(),
+		Expires:  time.Now().Add(10 * time.Minute).Unix(),
+	}
+	o.signer.setCookie(rw, oidcStateName, st, 10*time.Minute)
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.clientID},
+		"redirect_uri":  {redirectURI(host)},
+		"scope":         {"openid email"},
+		"state":         {st.State},
+		"nonce":         {st.Nonce},
+	}
+	http.Redirect(rw, req, p.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+func (o *oidcAuth) callback(rw http.ResponseWriter, req *http.Request, host string) {
+	var st oidcState
+	if !o.signer.readCookie(req, oidcStateName, &st) || time.Now().Unix() >= st.Expires || req.FormValue("state") != st.State {
+		http.Error(rw, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if e := req.FormValue("error"); e != "" {
+		http.Error(rw, "Login failed: "+e, http.StatusForbidden)
+		return
+	}
+
+	claims, err := o.exchange(req.FormValue("code"), host)
+	if err == nil && claims.Nonce != st.Nonce {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		glog.Warningf("OIDC login for %q failed: %v", host, err)
+		http.Error(rw, "Login failed", http.StatusForbidden)
+		return
+	}
+
+	s := oidcSession{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Host:    host,
+		Expires: time.Now().Add(o.sessionTTL).Unix(),
+	}
+	o.signer.setCookie(rw, oidcSessionName, s, o.sessionTTL)
+	http.SetCookie(rw, &http.Cookie{Name: oidcStateName, Path: "/", MaxAge: -1})
+
+	redirect := st.Redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+type idTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	Email    string          `json:"email"`
+}
+
+// exchange redeems code for an ID token and returns its verified claims.
+func (o *oidcAuth) exchange(code, host string) (*idTokenClaims, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.PostForm(p.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI(host)},
+		"client_id":     {o.clientID},
+		"client_secret": {o.clientSecret},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "token request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("token request failed with status %s", resp.Status)
+	}
+
+	var tr struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode token response")
+	}
+
+	return o.verify(tr.IDToken)
+}
+
+func (o *oidcAuth) verify(token string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed ID token signature")
+	}
+
+	key, err := o.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if hdr.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if hdr.Alg != "ES256" || len(sig) != 64 || !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, errors.Errorf("unsupported key type %T", key)
+	}
+
+	var c idTokenClaims
+	err = decodeSegment(parts[1], &c)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuer of the token must be exactly the one the provider reports,
+	// which may have a trailing slash unlike o.issuer.
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	if c.Issuer != p.Issuer {
+		return nil, errors.Errorf("ID token from wrong issuer %q", c.Issuer)
+	}
+	if !audienceContains(c.Audience, o.clientID) {
+		return nil, errors.New("ID token for another client")
+	}
+	if time.Now().Unix() >= c.Expires {
+		return nil, errors.New("ID token expired")
+	}
+	return &c, nil
+}
+
+func (o *oidcAuth) discover() (*oidcProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+
+	var p oidcProvider
+	err := o.getJSON(o.issuer+"/.well-known/openid-configuration", &p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != o.issuer {
+		return nil, errors.Errorf("provider reports issuer %q", p.Issuer)
+	}
+
+	o.provider = &p
+	return o.provider, nil
+}
+
+// key returns the provider's signing key with ID kid. The keys are fetched
+// again if kid is unknown, since providers rotate them, but at most once a
+// minute.
+func (o *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(o.keysFetch) < time.Minute {
+		return nil, errors.Errorf("unknown key %q", kid)
+	}
+	o.keysFetch = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err = o.getJSON(p.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	o.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+			e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+			if nerr != nil || eerr != nil {
+				continue
+			}
+			o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, xerr := base64.RawURLEncoding.DecodeString(k.X)
+			y, yerr := base64.RawURLEncoding.DecodeString(k.Y)
+			if xerr != nil || yerr != nil {
+				continue
+			}
+			o.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.Errorf("unknown key %q", kid)
+}
+
+func (o *oidcAuth) getJSON(u string, v interface{}) error {
+	resp, err := o.client.Get(u)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %q", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to get %q: %s", u, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "failed to decode %q", u)
+}
+
+func redirectURI(host string) string {
+	return "https://" + host + oidcCallbackPath
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.Wrap(err, "malformed ID token")
+	}
+	return errors.Wrap(json.Unmarshal(b, v), "malformed ID token")
+}
+
+// audienceContains handles "aud" being either a string or a list of them.
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) == nil {
+		for _, a := range many {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// cookieSigner stores JSON values in cookies, signed so that clients can't
+// forge or modify them.
+type cookieSigner struct {
+	key []byte
+}
+
+func (c *cookieSigner) setCookie(rw http.ResponseWriter, name string, v interface{}, ttl time.Duration) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    p + "." + base64.RawURLEncoding.EncodeToString(c.mac(name, p)),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (c *cookieSigner) readCookie(req *http.Request, name string, v interface{}) bool {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+
+	idx := strings.Index(cookie.Value, ".")
+	if idx == -1 {
+		return false
+	}
+	p := cookie.Value[:idx]
+	sig, err := base64.RawURLEncoding.DecodeString(cookie.Value[idx+1:])
+	if err != nil || !hmac.Equal(sig, c.mac(name, p)) {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+// The cookie name is part of the MAC so that a value can't be moved to another
+// cookie.
+func (c *cookieSigner) mac(name, payload string) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(name + "\x00" + payload))
+	return m.Sum(nil)
+}
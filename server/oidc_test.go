@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testOIDCProvider serves the discovery document and the keys of an identity
+// provider with an RSA key "rsa" and an ECDSA key "ec".
+type testOIDCProvider struct {
+	*httptest.Server
+	issuer string
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testOIDCProvider{rsaKey: rsaKey, ecKey: ecKey}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(oidcProvider{Issuer: p.issuer, JWKSURI: p.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		}})
+	})
+	p.Server = httptest.NewServer(mux)
+	p.issuer = p.URL
+	return p
+}
+
+// sign returns an ID token with header hdr and claims, signed with the key
+// named by hdr["kid"].
+func (p *testOIDCProvider) sign(t *testing.T, hdr map[string]string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(hdr) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch hdr["kid"] {
+	case "rsa":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		r, s, err := ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	defer p.Close()
+	o := newOIDCAuth(p.URL, "client", "secret", []byte("cookie key"), time.Hour)
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   p.issuer,
+			"sub":   "user",
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "nonce",
+			"email": "user@example.com",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	es256 := map[string]string{"alg": "ES256", "kid": "ec"}
+	rs256 := map[string]string{"alg": "RS256", "kid": "rsa"}
+	valid := p.sign(t, es256, claims(nil))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", valid, true},
+		{"RS256", p.sign(t, rs256, claims(nil)), true},
+		{"audience list", p.sign(t, es256, claims(map[string]interface{}{"aud": []string{"other", "client"}})), true},
+		{"other audience", p.sign(t, es256, claims(map[string]interface{}{"aud": "other"})), false},
+		{"other audiences", p.sign(t, es256, claims(map[string]interface{}{"aud": []string{"other"}})), false},
+		{"no audience", p.sign(t, es256, claims(map[string]interface{}{"aud": nil})), false},
+		{"other issuer", p.sign(t, es256, claims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"issuer with slash", p.sign(t, es256, claims(map[string]interface{}{"iss": p.issuer + "/"})), false},
+		{"expired", p.sign(t, es256, claims(map[string]interface{}{"exp": time.Now().Add(-time.Second).Unix()})), false},
+		{"alg none", p.sign(t, map[string]string{"alg": "none", "kid": "ec"}, claims(nil)), false},
+		{"RS256 header with EC key", p.sign(t, map[string]string{"alg": "RS256", "kid": "ec"}, claims(nil)), false},
+		{"ES256 header with RSA key", p.sign(t, map[string]string{"alg": "ES256", "kid": "rsa"}, claims(nil)), false},
+		{"unknown key", p.sign(t, map[string]string{"alg": "ES256", "kid": "other"}, claims(nil)), false},
+		{"tampered claims", valid[:len(valid)/2] + "x" + valid[len(valid)/2+1:], false},
+		{"no signature", valid[:len(valid)-86], false},
+		{"two parts", "a.b", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		c, err := o.verify(tt.token)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s: verify: %v", tt.name, err)
+			} else if c.Subject != "user" || c.Nonce != "nonce" {
+				t.Errorf("%s: verify = %+v", tt.name, c)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: verify succeeded", tt.name)
+		}
+	}
+}
+
+func TestOIDCDiscoverIssuerMismatch(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	defer p.Close()
+	p.issuer = "https://evil.example"
+
+	o := newOIDCAuth(p.URL, "client", "secret", []byte("cookie key"), time.Hour)
+	if _, err := o.discover(); err == nil {
+		t.Error("discover accepted a provider reporting another issuer")
+	}
+}
+
+func TestCookieSigner(t *testing.T) {
+	c := &cookieSigner{[]byte("cookie key")}
+	rw := httptest.NewRecorder()
+	c.setCookie(rw, oidcSessionName, oidcSession{Subject: "user", Host: "example.com"}, time.Hour)
+	value := rw.Result().Cookies()[0].Value
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		ok     bool
+	}{
+		{"signed", &http.Cookie{Name: oidcSessionName, Value: value}, true},
+		{"other name", &http.Cookie{Name: oidcStateName, Value: value}, false},
+		{"tampered payload", &http.Cookie{Name: oidcSessionName, Value: "x" + value[1:]}, false},
+		{"tampered signature", &http.Cookie{Name: oidcSessionName, Value: value[:len(value)-1] + "x"}, false},
+		{"no signature", &http.Cookie{Name: oidcSessionName, Value: value[:len(value)-44]}, false},
+		{"signed with another key", nil, false},
+	}
+	other := httptest.NewRecorder()
+	(&cookieSigner{[]byte("other key")}).setCookie(other, oidcSessionName, oidcSession{Subject: "admin", Host: "example.com"}, time.Hour)
+	tests[len(tests)-1].cookie = other.Result().Cookies()[0]
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(tt.cookie)
+		var s oidcSession
+		ok := c.readCookie(req, oidcSessionName, &s)
+		if ok != tt.ok {
+			t.Errorf("%s: readCookie = %v, want %v", tt.name, ok, tt.ok)
+		}
+		if ok && s.Subject != "user" {
+			t.Errorf("%s: read subject %q", tt.name, s.Subject)
+		}
+	}
+}
+
+func TestOIDCMiddlewareSession(t *testing.T) {
+	o := newOIDCAuth("https://idp.example", "client", "secret", []byte("cookie key"), time.Hour)
+	h := o.middleware("app.example.com")(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("X-Forwarded-User")))
+	}))
+	session := func(s oidcSession) *http.Cookie {
+		rw := httptest.NewRecorder()
+		o.signer.setCookie(rw, oidcSessionName, s, time.Hour)
+		return rw.Result().Cookies()[0]
+	}
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		// user is the user passed on, or "" if the request is not.
+		user string
+	}{
+		{"session", session(oidcSession{Subject: "user", Host: "app.example.com", Expires: future}), "user"},
+		{"session of another host", session(oidcSession{Subject: "user", Host: "other.example.com", Expires: future}), ""},
+		{"expired session", session(oidcSession{Subject: "user", Host: "app.example.com", Expires: time.Now().Unix() - 1}), ""},
+		{"no session", nil, ""},
+	}
+	for _, tt := range tests {
+		// POSTs aren't sent to log in, so the provider isn't needed.
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("X-Forwarded-User", "spoofed")
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if tt.user == "" {
+			if rw.Code != http.StatusUnauthorized {
+				t.Errorf("%s: status %d, want %d", tt.name, rw.Code, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if got := rw.Body.String(); got != tt.user {
+			t.Errorf("%s: passed on user %q, want %q", tt.name, got, tt.user)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+	"github.com/pkg/errors"
+)
+
+// sniListener proxies connections for passthrough hosts to their backends at
+// the TCP level, without terminating TLS, and hands all other connections to
+// the caller of Accept.
+type sniListener struct {
+	net.Listener
+	backends  map[string]string
+	sendProxy bool
+
+	conns chan net.Conn
+	errs  chan error
+}
+
+// newSNIListener creates an sniListener. If sendProxy is set, connections to
+// the backends start with a PROXY protocol header carrying the client address.
+func newSNIListener(l net.Listener, backends map[string]string, sendProxy bool) *sniListener {
+	s := &sniListener{
+		Listener:  l,
+		backends:  backends,
+		sendProxy: sendProxy,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, 1),
+	}
+	go s.acceptLoop()
+	return s
+}
+
+func (s *sniListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case err := <-s.errs:
+		// Keep returning the error to later callers too.
+		s.errs <- err
+		return nil, err
+	}
+}
+
+func (s *sniListener) acceptLoop() {
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			s.errs <- err
+			return
+		}
+		go s.route(c)
+	}
+}
+
+func (s *sniListener) route(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	host, peeked, err := peekSNI(c)
+	c.SetReadDeadline(time.Time{})
+
+	pc := &peekedConn{Conn: c, r: io.MultiReader(bytes.NewReader(peeked), c)}
+
+	if n, nerr := proxy.NormalizeHost(host); nerr == nil {
+		host = n
+	}
+	backend, ok := s.backends[host]
+	if err != nil || !ok {
+		// Let the TLS server deal with anything that isn't passthrough,
+		// including garbage.
+		s.conns <- pc
+		return
+	}
+
+	defer c.Close()
+
+	bc, err := net.DialTimeout("tcp", backend, 10*time.Second)
+	if err != nil {
+		glog.Errorf("Failed to connect to passthrough backend %q for %q: %v", backend, host, err)
+		return
+	}
+	defer bc.Close()
+
+	if s.sendProxy {
+		err := writeProxyV1(bc, c.RemoteAddr(), c.LocalAddr())
+		if err != nil {
+			glog.Errorf("Failed to send PROXY header to %q: %v", backend, err)
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(bc, pc)
+		closeWrite(bc)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, bc)
+		closeWrite(c)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+var errSNIPeeked = errors.New("SNI peeked")
+
+// peekSNI reads the ClientHello from c and returns the server name in it,
+// along with everything read from c.
+func peekSNI(c net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var host string
+
+	err := tls.Server(readOnlyConn{io.TeeReader(c, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+
+	if host == "" {
+		return "", buf.Bytes(), errors.Wrap(err, "failed to read SNI")
+	}
+	return host, buf.Bytes(), nil
+}
+
+// readOnlyConn is a net.Conn that can only be read from, for letting the TLS
+// server parse a ClientHello without answering it.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the bytes read while peeking before reading from the
+// underlying conn.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
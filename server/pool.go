@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+)
+
+const (
+	affinityCookiePrefix = "wile_affinity_"
+	// unhealthyFor is how long an instance is skipped after a failed request.
+	unhealthyFor = 30 * time.Second
+)
+
+// newAffinityKey returns the key to sign instance affinity cookies with, or a
+// random one if key is empty.
+func newAffinityKey(key string) []byte {
+	if key != "" {
+		return []byte(key)
+	}
+
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		glog.Fatalf("Failed to generate affinity key: %v", err)
+	}
+	return k
+}
+
+// newBackendHandlers creates the handlers of all backends. Backends with
+// several instances pin clients to one of them with a cookie signed with
+// key. Backends reach their instances with their transport in transports,
+// or http.DefaultTransport. Backends with a service URL get their instances
+// from registries. Failed requests are answered with the error pages of
+// pages.
+func newBackendHandlers(backends map[string][]*url.URL, key []byte, transports map[string]http.RoundTripper, pages *statusPages, registries *serviceRegistries) map[string]http.Handler {
+	handlers := make(map[string]http.Handler)
+	for name, urls := range backends {
+		if isServiceURL(urls[0]) {
+			b := newDynamicBackend(name, key, transports[name], pages)
+			go registries.watch(urls[0], b)
+			handlers[name] = b
+			continue
+		}
+		handlers[name] = newBackendHandler(name, urls, key, transports[name], pages)
+	}
+	return handlers
+}
+
+func newBackendHandler(name string, urls []*url.URL, key []byte, transport http.RoundTripper, pages *statusPages) http.Handler {
+	if len(urls) == 1 {
+		return pages.reverseProxy(urls[0], transport)
+	}
+	return newPoolHandler(name, urls, key, transport, pages)
+}
+
+// poolHandler proxies to one of several instances of a backend. A client
+// stays on the instance named by its affinity cookie for as long as that
+// instance is healthy, and is re-pinned to another one otherwise.
+type poolHandler struct {
+	name      string
+	cookie    string
+	instances []*poolInstance
+	// byCookie maps affinity cookie values to instances.
+	byCookie map[string]*poolInstance
+}
+
+type poolInstance struct {
+	url    *url.URL
+	proxy  *proxy.Proxy
+	cookie string
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+func newPoolHandler(name string, urls []*url.URL, key []byte, transport http.RoundTripper, pages *statusPages) *poolHandler {
+	p := &poolHandler{
+		name:     name,
+		cookie:   affinityCookiePrefix + name,
+		byCookie: make(map[string]*poolInstance),
+	}
+
+	for _, u := range urls {
+		// The cookie is a MAC of the instance, so clients can't pin
+		// themselves to arbitrary instances and cookies stay valid when
+		// instances are reordered.
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(name + "\x00" + u.String()))
+
+		in := &poolInstance{
+			url:    u,
+			cookie: hex.EncodeToString(mac.Sum(nil)),
+		}
+		in.proxy = proxy.New(u, proxy.WithTransport(transport), proxy.WithErrorHandler(func(rw http.ResponseWriter, req *http.Request, err error) {
+			glog.Warningf("Instance %s of backend %q failed, skipping it for %v: %v", in.url, name, unhealthyFor, err)
+			in.markUnhealthy()
+			pages.writeError(rw, proxy.ErrorStatus(err))
+		}))
+
+		p.instances = append(p.instances, in)
+		p.byCookie[in.cookie] = in
+	}
+	return p
+}
+
+func (p *poolHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if c, err := req.Cookie(p.cookie); err == nil {
+		if in, ok := p.byCookie[c.Value]; ok && in.healthy() {
+			in.proxy.ServeHTTP(rw, req)
+			return
+		}
+	}
+
+	in := p.pick()
+	http.SetCookie(rw, &http.Cookie{
+		Name:     p.cookie,
+		Value:    in.cookie,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	in.proxy.ServeHTTP(rw, req)
+}
+
+// pick returns a random healthy instance, or a random instance if none is
+// healthy.
+func (p *poolHandler) pick() *poolInstance {
+	var healthy []*poolInstance
+	for _, in := range p.instances {
+		if in.healthy() {
+			healthy = append(healthy, in)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = p.instances
+	}
+	return healthy[mrand.Intn(len(healthy))]
+}
+
+func (in *poolInstance) healthy() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return time.Now().After(in.unhealthyUntil)
+}
+
+func (in *poolInstance) markUnhealthy() {
+	in.mu.Lock()
+	in.unhealthyUntil = time.Now().Add(unhealthyFor)
+	in.mu.Unlock()
+}
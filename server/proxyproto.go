@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// proxyProtoListener expects every connection to start with a PROXY protocol
+// v1 or v2 header, as sent by load balancers such as HAProxy or ELB, and
+// reports the client address from it as the conn's RemoteAddr.
+//
+// Connections without a valid header are closed, so that clients can't spoof
+// their address by talking to the server directly.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyProtoConn reads the PROXY header on first use rather than in Accept, so
+// that a slow client doesn't block accepting other connections.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			glog.Warningf("Closing connection from %v: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol header from r and returns the source
+// address in it, or nil if the header doesn't carry one (e.g. health checks).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY header")
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid v1 header is 107 bytes.
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || fields[1] == "TCP4" && ip.To4() == nil {
+		return nil, errors.Errorf("invalid PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY v2 header")
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY v2 header")
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, errors.Errorf("unsupported PROXY version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: sent by the load balancer itself, e.g. for health checks.
+		return nil, nil
+	case 1:
+	default:
+		return nil, errors.Errorf("unsupported PROXY v2 command %d", verCmd&0xf)
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4.
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6.
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// writeProxyV1 writes a PROXY protocol v1 header for a connection from src to
+// dst.
+func writeProxyV1(w io.Writer, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+
+	var err error
+	switch {
+	case !sok || !dok:
+		_, err = io.WriteString(w, "PROXY UNKNOWN\r\n")
+	case s.IP.To4() != nil && d.IP.To4() != nil:
+		_, err = fmt.Fprintf(w, "PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)
+	default:
+		_, err = fmt.Fprintf(w, "PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port)
+	}
+	return errors.Wrap(err, "failed to write PROXY header")
+}
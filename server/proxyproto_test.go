@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a PROXY v2 header with the given version and command, family
+// and address block.
+func proxyV2(verCmd, fam byte, body []byte) string {
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(verCmd)
+	b.WriteByte(fam)
+	binary.Write(&b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.String()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Body := []byte{
+		192, 0, 2, 1, // source
+		198, 51, 100, 1, // destination
+		0x30, 0x39, // source port 12345
+		0x01, 0xbb, // destination port 443
+	}
+	v6Body := make([]byte, 36)
+	copy(v6Body, net.ParseIP("2001:db8::1"))
+	copy(v6Body[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6Body[32:], 12345)
+	binary.BigEndian.PutUint16(v6Body[34:], 443)
+
+	tests := []struct {
+		name   string
+		header string
+		// want is the address read, or "" for none.
+		want    string
+		wantErr bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", "192.0.2.1:12345", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", "[2001:db8::1]:12345", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"v1 without CR", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n", "", true},
+		{"v1 lowercase", "proxy TCP4 192.0.2.1 198.51.100.1 12345 443\r\n", "", true},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n", "", true},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n", "", true},
+		{"v1 invalid IP", "PROXY TCP4 192.0.2.300 198.51.100.1 12345 443\r\n", "", true},
+		{"v1 IPv6 in TCP4", "PROXY TCP4 2001:db8::1 198.51.100.1 12345 443\r\n", "", true},
+		// writeProxyV1 sends these for IPv4 clients of IPv6 listeners.
+		{"v1 IPv4 in TCP6", "PROXY TCP6 192.0.2.1 2001:db8::2 12345 443\r\n", "192.0.2.1:12345", false},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 192.0.2.1 198.51.100.1 12345 443" + strings.Repeat(" ", 100) + "\r\n", "", true},
+		{"no header", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+		{"short", "PROXY", "", true},
+		{"v2 TCP4", proxyV2(0x21, 0x11, v4Body), "192.0.2.1:12345", false},
+		{"v2 TCP6", proxyV2(0x21, 0x21, v6Body), "[2001:db8::1]:12345", false},
+		{"v2 TCP4 with TLVs", proxyV2(0x21, 0x11, append(v4Body, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:12345", false},
+		{"v2 LOCAL", proxyV2(0x20, 0x00, nil), "", false},
+		{"v2 UNIX", proxyV2(0x21, 0x31, make([]byte, 216)), "", false},
+		{"v2 version 1", proxyV2(0x11, 0x11, v4Body), "", true},
+		{"v2 unknown command", proxyV2(0x22, 0x11, v4Body), "", true},
+		{"v2 short IPv4 address", proxyV2(0x21, 0x11, v4Body[:8]), "", true},
+		{"v2 short IPv6 address", proxyV2(0x21, 0x21, v6Body[:32]), "", true},
+		{"v2 truncated body", proxyV2(0x21, 0x11, v4Body)[:20], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const payload = "payload"
+			r := bufio.NewReader(strings.NewReader(tt.header + payload))
+			addr, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader = %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readProxyHeader = %q, want %q", got, tt.want)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != payload {
+				t.Errorf("read %q after the header, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func TestWriteProxyV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, "192.0.2.1:12345"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "[2001:db8::1]:12345"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "192.0.2.1:12345"},
+		{&net.UnixAddr{Name: "/run/wile.sock"}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, ""},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := writeProxyV1(&b, tt.src, tt.dst); err != nil {
+			t.Fatal(err)
+		}
+		addr, err := readProxyHeader(bufio.NewReader(&b))
+		if err != nil {
+			t.Fatalf("reading header for %v -> %v: %v", tt.src, tt.dst, err)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("header for %v -> %v read as %q, want %q", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// renew obtains new certs for domain, regardless of when the current ones
+// expire. The ECDSA cert is always renewed, the RSA one only if it exists.
+//
+// autocert doesn't reissue certs it holds, and every cert it obtains gets a
+// renewal timer that can't be stopped, so the certs are issued with the
+// managers' ACME clients directly, see issue. Storing the new certs replaces
+// them in c.certs; the certs of other domains are left alone.
+func (c *certManager) renew(ctx context.Context, domain string) error {
+	if c.standby {
+		return errStandby
+	}
+
+	start := time.Now()
+	var keys []string
+	if !c.forceRSA {
+		keys = append(keys, domain)
+	}
+
+	_, err := c.certCache.Get(ctx, domain+"+rsa")
+	switch {
+	case err == nil || c.forceRSA:
+		keys = append(keys, domain+"+rsa")
+	case err != autocert.ErrCacheMiss:
+		return errors.Wrapf(err, "failed to read RSA cert for %q", domain)
+	}
+
+	for _, key := range keys {
+		err := c.obtain(ctx, domain, key)
+		c.recordError(domain, err)
+		if err != nil {
+			return errors.Wrapf(err, "failed to renew cert for %q", domain)
+		}
+	}
+
+	renewLatency.observe(time.Since(start))
+	glog.Infof("Renewed cert for %q", domain)
+	return nil
+}
+
+// revoke renews the certs of domain and then revokes the ones it replaced, so
+// that a revoked cert is never left in the cache.
+func (c *certManager) revoke(ctx context.Context, domain string, reason acme.CRLReasonCode) error {
+	if c.standby {
+		return errStandby
+	}
+
+	old := make(map[string]*x509.Certificate)
+	for _, key := range []string{domain, domain + "+rsa"} {
+		leaf, err := cachedLeaf(ctx, c.certCache, key)
+		if err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read cert for %q", key)
+		}
+		old[key] = leaf
+	}
+
+	if err := c.renew(ctx, domain); err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	managers := c.managers
+	c.mu.RUnlock()
+
+	for key, leaf := range old {
+		// The cert may have been issued by any of the CAs; only the right one
+		// will accept the revocation.
+		var lastErr error
+		for _, m := range managers {
+			lastErr = m.Client.RevokeCert(ctx, nil, leaf.Raw, reason)
+			if lastErr == nil {
+				break
+			}
+		}
+		if lastErr != nil {
+			return errors.Wrapf(lastErr, "failed to revoke cert for %q", key)
+		}
+		glog.Infof("Revoked cert for %q, serial %x", key, leaf.SerialNumber)
+		c.auditor.record("revoked", domain, fmt.Sprintf("serial=%x reason=%d", leaf.SerialNumber, reason))
+	}
+	return nil
+}
+
+// obtain issues a new cert for domain and stores it under key, which is
+// domain for ECDSA certs and domain+"+rsa" for RSA ones.
+func (c *certManager) obtain(ctx context.Context, domain, key string) error {
+	c.mu.RLock()
+	managers := c.managers
+	c.mu.RUnlock()
+
+	cert, err := c.issueAny(ctx, managers, domain, key != domain)
+	if err != nil {
+		return err
+	}
+	data, err := encodeCert(cert)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode cert for %q", key)
+	}
+	if err := (&servingCache{c.certCache, c}).Put(ctx, key, data); err != nil {
+		return errors.Wrapf(err, "failed to store cert for %q", key)
+	}
+	return nil
+}
+
+// issueAny issues a cert for domain from the first CA that will issue one.
+func (c *certManager) issueAny(ctx context.Context, managers []*autocert.Manager, domain string, useRSA bool) (*tls.Certificate, error) {
+	var lastErr error
+	for i, m := range managers {
+		cert, err := c.issue(ctx, m, domain, useRSA)
+		if err == nil {
+			return cert, nil
+		}
+		glog.Warningf("Failed to issue cert for %q from CA %d: %v", domain, i, err)
+		lastErr = err
+	}
+	return nil, c.classifyError(domain, lastErr)
+}
+
+// issue obtains a new cert for domain from the CA of m, with the client, host
+// policy and extensions of m but none of its state.
+func (c *certManager) issue(ctx context.Context, m *autocert.Manager, domain string, useRSA bool) (*tls.Certificate, error) {
+	if m.HostPolicy != nil {
+		if err := m.HostPolicy(ctx, domain); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.register(ctx, m); err != nil {
+		return nil, errors.Wrap(err, "failed to register ACME account")
+	}
+	if err := c.authorize(ctx, m.Client, domain); err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	var err error
+	if useRSA {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		ExtraExtensions: m.ExtraExtensions,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.Client.CreateCert(ctx, csr, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// register registers the account key of m's client, which autocert only does
+// when it first issues a cert.
+func (c *certManager) register(ctx context.Context, m *autocert.Manager) error {
+	if m.Client == nil || m.Client.Key == nil {
+		return errors.New("ACME client has no account key")
+	}
+	if _, ok := c.registered.Load(m.Client); ok {
+		return nil
+	}
+
+	var contact []string
+	if m.Email != "" {
+		contact = []string{"mailto:" + m.Email}
+	}
+	_, err := m.Client.Register(ctx, &acme.Account{Contact: contact}, m.Prompt)
+	if ae, ok := err.(*acme.Error); ok && ae.StatusCode == http.StatusConflict {
+		// The key is already registered.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	c.registered.Store(m.Client, true)
+	return nil
+}
+
+// authorize proves control of domain to the CA of client, with TLS-ALPN-01 or,
+// if enabled, HTTP-01.
+func (c *certManager) authorize(ctx context.Context, client *acme.Client, domain string) error {
+	types := []string{"tls-alpn-01"}
+	c.mu.RLock()
+	if c.http01 {
+		types = append(types, "http-01")
+	}
+	c.mu.RUnlock()
+
+	var errs []string
+	for _, typ := range types {
+		authz, err := client.Authorize(ctx, domain)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case acme.StatusValid:
+			return nil
+		case acme.StatusInvalid:
+			return errors.Errorf("invalid authorization %q for %q", authz.URI, domain)
+		}
+
+		var chal *acme.Challenge
+		for _, ch := range authz.Challenges {
+			if ch.Type == typ {
+				chal = ch
+			}
+		}
+		if chal == nil {
+			continue
+		}
+		err = c.accept(ctx, client, authz, chal, domain)
+		if err == nil {
+			return nil
+		}
+		go client.RevokeAuthorization(context.Background(), authz.URI)
+		errs = append(errs, fmt.Sprintf("%s: %v", typ, err))
+	}
+	return errors.Errorf("unable to authorize %q: %s", domain, strings.Join(errs, "; "))
+}
+
+// accept provisions the response to chal and waits for the CA to validate it.
+func (c *certManager) accept(ctx context.Context, client *acme.Client, authz *acme.Authorization, chal *acme.Challenge, domain string) error {
+	switch chal.Type {
+	case "tls-alpn-01":
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return err
+		}
+		c.challengeCerts.Store(domain, &cert)
+		defer c.challengeCerts.Delete(domain)
+	case "http-01":
+		resp, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		// Stored like autocert does, see wile.NewHTTPChallengeHandler.
+		key := chal.Token + "+http-01"
+		if err := c.certCache.Put(ctx, key, []byte(resp)); err != nil {
+			return err
+		}
+		defer c.certCache.Delete(context.Background(), key)
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err := client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// encodeCert encodes cert the way autocert caches it: the private key
+// followed by the chain.
+func encodeCert(cert *tls.Certificate) ([]byte, error) {
+	var b bytes.Buffer
+	switch key := cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case *rsa.PrivateKey:
+		pem.Encode(&b, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	default:
+		return nil, errors.Errorf("unknown key type %T", key)
+	}
+	for _, der := range cert.Certificate {
+		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return b.Bytes(), nil
+}
+
+var crlReasons = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keycompromise":        acme.CRLReasonKeyCompromise,
+	"cacompromise":         acme.CRLReasonCACompromise,
+	"affiliationchanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationofoperation": acme.CRLReasonCessationOfOperation,
+	"certificatehold":      acme.CRLReasonCertificateHold,
+	"removefromcrl":        acme.CRLReasonRemoveFromCRL,
+	"privilegewithdrawn":   acme.CRLReasonPrivilegeWithdrawn,
+	"aacompromise":         acme.CRLReasonAACompromise,
+}
+
+// parseCRLReason parses an RFC 5280 revocation reason such as
+// "keyCompromise". The empty string means unspecified.
+func parseCRLReason(s string) (acme.CRLReasonCode, error) {
+	if s == "" {
+		return acme.CRLReasonUnspecified, nil
+	}
+	r, ok := crlReasons[strings.ToLower(s)]
+	if !ok {
+		return 0, errors.Errorf("unknown revocation reason %q", s)
+	}
+	return r, nil
+}
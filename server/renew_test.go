@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// fakeCA is an ACME CA that authorizes every domain up front.
+type fakeCA struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	ca  *x509.Certificate
+
+	mu      sync.Mutex
+	failNew bool
+	calls   []string
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	f := &fakeCA{key: key, ca: ca}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeCA) serve(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Replay-Nonce", "nonce")
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if req.Method == "GET" {
+		switch req.URL.Path {
+		case "/":
+			fmt.Fprintf(rw, `{"new-reg": %[1]q, "new-authz": %[1]q, "new-cert": %[1]q, "revoke-cert": %[1]q}`, f.URL+"/")
+		case "/ca":
+			rw.Write(f.ca.Raw)
+		}
+		return
+	}
+
+	var jws struct{ Payload string }
+	if err := json.NewDecoder(req.Body).Decode(&jws); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	var body struct {
+		Resource string
+		CSR      string
+	}
+	json.Unmarshal(payload, &body)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, body.Resource)
+	failNew := f.failNew
+	f.mu.Unlock()
+
+	switch body.Resource {
+	case "new-reg":
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{}`)
+	case "new-authz":
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprint(rw, `{"status": "valid"}`)
+	case "new-cert":
+		if failNew {
+			http.Error(rw, `{"type": "urn:acme:error:unauthorized"}`, http.StatusForbidden)
+			return
+		}
+		der, _ := base64.RawURLEncoding.DecodeString(body.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, err = x509.CreateCertificate(rand.Reader, leaf, f.ca, csr.PublicKey, f.key)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Link", fmt.Sprintf("<%s/ca>;rel=up", f.URL))
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(der)
+	case "revoke-cert":
+	default:
+		http.Error(rw, "unknown resource", http.StatusBadRequest)
+	}
+}
+
+func (f *fakeCA) setFailNew(fail bool) {
+	f.mu.Lock()
+	f.failNew = fail
+	f.mu.Unlock()
+}
+
+// resources returns the resources requested from the CA, in order.
+func (f *fakeCA) resources() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func newFakeCACertManager(t *testing.T, f *fakeCA, cache autocert.Cache, attempts int, domains ...string) *certManager {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newManagers := func(cache autocert.Cache, transport http.RoundTripper) []*autocert.Manager {
+		return []*autocert.Manager{{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      cache,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Client:     &acme.Client{Key: key, DirectoryURL: f.URL + "/"},
+		}}
+	}
+	return newCertManager(newManagers, autocert.HostWhitelist(domains...), cache, http.DefaultTransport, attempts, false, nil)
+}
+
+func TestRenewReplacesCert(t *testing.T) {
+	f := newFakeCA(t)
+	defer f.Close()
+	cache := wile.NewMemoryCache()
+	cache.Put(context.Background(), "example.com", testCertEntry(t, "example.com", time.Now().Add(24*time.Hour)))
+	c := newFakeCACertManager(t, f, cache, 1, "example.com")
+
+	old, err := cachedLeaf(context.Background(), cache, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.renew(context.Background(), "example.com"); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	leaf, err := cachedLeaf(context.Background(), cache, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Cmp(old.SerialNumber) == 0 || leaf.Issuer.CommonName != "fake CA" {
+		t.Errorf("cached cert wasn't replaced: serial %x, issuer %q", leaf.SerialNumber, leaf.Issuer.CommonName)
+	}
+	if _, err := cache.Get(context.Background(), "example.com+rsa"); err != autocert.ErrCacheMiss {
+		t.Errorf("RSA cert was created: %v", err)
+	}
+
+	cert, err := c.GetCertificate(&testECDSAHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		t.Error("renewed cert isn't served")
+	}
+
+	// The account is registered once.
+	if err := c.renew(context.Background(), "example.com"); err != nil {
+		t.Fatalf("second renew: %v", err)
+	}
+	want := []string{"new-reg", "new-authz", "new-cert", "new-authz", "new-cert"}
+	if got := f.resources(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("CA requests = %v, want %v", got, want)
+	}
+}
+
+func TestRevokeRenewsFirst(t *testing.T) {
+	f := newFakeCA(t)
+	defer f.Close()
+	cache := wile.NewMemoryCache()
+	cache.Put(context.Background(), "example.com", testCertEntry(t, "example.com", time.Now().Add(24*time.Hour)))
+	c := newFakeCACertManager(t, f, cache, 1, "example.com")
+	old, err := cachedLeaf(context.Background(), cache, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.setFailNew(true)
+	if err := c.revoke(context.Background(), "example.com", acme.CRLReasonKeyCompromise); err == nil {
+		t.Fatal("revoke succeeded without a new cert")
+	}
+	for _, r := range f.resources() {
+		if r == "revoke-cert" {
+			t.Fatal("cert revoked before it was replaced")
+		}
+	}
+	leaf, err := cachedLeaf(context.Background(), cache, "example.com")
+	if err != nil || leaf.SerialNumber.Cmp(old.SerialNumber) != 0 {
+		t.Fatalf("cached cert changed after a failed renewal: %v", err)
+	}
+
+	f.setFailNew(false)
+	if err := c.revoke(context.Background(), "example.com", acme.CRLReasonKeyCompromise); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	got := f.resources()
+	if n := len(got); n < 2 || got[n-2] != "new-cert" || got[n-1] != "revoke-cert" {
+		t.Errorf("CA requests = %v, want new-cert then revoke-cert last", got)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// renewalBackstop is how long before expiry renewalQueue renews certs.
+	// autocert renews them 30 days before, so this only kicks in when it
+	// failed, or its renewal timers were lost in a restart.
+	renewalBackstop = 25 * 24 * time.Hour
+	// shardedRenewalBefore is how long before expiry the owners of domains
+	// renew them with -shard_issuance. It's ahead of autocert, so that the
+	// renewal timers of the other replicas find the new cert in the cache
+	// instead of renewing it too.
+	shardedRenewalBefore = renewBefore + 2*24*time.Hour
+	renewalCheckInterval = 10 * time.Minute
+	minRenewalBackoff    = 10 * time.Minute
+	maxRenewalBackoff    = 24 * time.Hour
+	// maxRenewalAttempts is the number of attempts kept in the history.
+	maxRenewalAttempts = 20
+)
+
+type renewalAttempt struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+type renewalState struct {
+	Domain string `json:"domain"`
+	// Failures is the number of consecutive failed attempts.
+	Failures  int              `json:"failures"`
+	NextRetry time.Time        `json:"next_retry"`
+	Attempts  []renewalAttempt `json:"attempts"`
+}
+
+// renewalQueue renews certs close to expiry, or once the CA's renewal window
+// has started, backing off exponentially after failures. The state of each
+// domain is kept in store, e.g. etcd, so that the backoff survives restarts,
+// and written only if it's unchanged, so that replicas don't renew the same
+// cert at once.
+//
+// If shards isn't nil, only the domains of this replica are checked, and
+// their certs are also obtained before they are first requested.
+type renewalQueue struct {
+	store   renewalStore
+	certs   *certManager
+	domains []string
+	ari     *ariClient
+	shards  *shardRing
+}
+
+// renewalStore holds the renewal states by domain.
+type renewalStore interface {
+	wile.Versioner
+	wile.Lister
+}
+
+func newRenewalQueue(store renewalStore, certs *certManager, domains []string, ari *ariClient, shards *shardRing) *renewalQueue {
+	return &renewalQueue{store, certs, domains, ari, shards}
+}
+
+func (q *renewalQueue) run() {
+	for range time.Tick(renewalCheckInterval) {
+		for _, d := range q.domains {
+			if q.shards != nil && !q.shards.owns(d) {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			err := q.check(ctx, d)
+			cancel()
+
+			if err != nil {
+				glog.Errorf("Failed to check renewal of %q: %v", d, err)
+			}
+		}
+	}
+}
+
+// check renews the cert of domain if it's due and not backing off.
+func (q *renewalQueue) check(ctx context.Context, domain string) error {
+	key := domain
+	if q.certs.forceRSA {
+		key += "+rsa"
+	}
+	leaf, err := cachedLeaf(ctx, q.certs.cache(), key)
+	switch {
+	case err == autocert.ErrCacheMiss && q.shards == nil:
+		// Certs are first obtained when they are requested.
+		return nil
+	case err == autocert.ErrCacheMiss:
+		// Obtain it now, so that the other replicas find it in the cache
+		// instead of all obtaining it on their first handshake.
+		leaf = nil
+	case err != nil:
+		return errors.Wrapf(err, "failed to read cert for %q", key)
+	case time.Until(leaf.NotAfter) > q.renewBefore():
+		start, ok, err := q.ari.suggestedStart(ctx, leaf)
+		if err != nil {
+			glog.Warningf("Failed to get renewal information for %q: %v", domain, err)
+		}
+		if !ok || time.Now().Before(start) {
+			return nil
+		}
+		glog.Infof("Renewal window of %q started at %v", domain, start)
+	}
+
+	state, rev, err := q.get(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if time.Now().Before(state.NextRetry) {
+		return nil
+	}
+
+	// Claim the attempt, so that other replicas skip it.
+	state.NextRetry = time.Now().Add(minRenewalBackoff)
+	rev, err = q.put(ctx, state, rev)
+	if err != nil || rev == 0 {
+		return err
+	}
+
+	if leaf == nil {
+		glog.Infof("Obtaining cert for %q", domain)
+	} else {
+		glog.Infof("Renewing cert for %q, which expires at %v", domain, leaf.NotAfter)
+	}
+	renewErr := q.certs.renew(ctx, domain)
+
+	attempt := renewalAttempt{Time: time.Now().UTC()}
+	if renewErr != nil {
+		attempt.Error = renewErr.Error()
+		state.Failures++
+		backoff := maxRenewalBackoff
+		if state.Failures < 10 {
+			backoff = minRenewalBackoff << uint(state.Failures-1)
+		}
+		if backoff > maxRenewalBackoff {
+			backoff = maxRenewalBackoff
+		}
+		state.NextRetry = time.Now().Add(backoff)
+	} else {
+		state.Failures = 0
+		state.NextRetry = time.Time{}
+	}
+	state.Attempts = append(state.Attempts, attempt)
+	if len(state.Attempts) > maxRenewalAttempts {
+		state.Attempts = state.Attempts[len(state.Attempts)-maxRenewalAttempts:]
+	}
+
+	_, err = q.put(ctx, state, rev)
+	if renewErr != nil {
+		return errors.Wrapf(renewErr, "retrying at %v", state.NextRetry)
+	}
+	return err
+}
+
+func (q *renewalQueue) renewBefore() time.Duration {
+	if q.shards != nil {
+		return shardedRenewalBefore
+	}
+	return renewalBackstop
+}
+
+// get returns the state of domain and its version, or 0 if there is none yet.
+func (q *renewalQueue) get(ctx context.Context, domain string) (*renewalState, int64, error) {
+	data, version, err := q.store.GetVersion(ctx, domain)
+	if err == autocert.ErrCacheMiss {
+		return &renewalState{Domain: domain}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read renewal state of %q", domain)
+	}
+
+	var state renewalState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid renewal state of %q", domain)
+	}
+	return &state, version, nil
+}
+
+// put stores state if it's still at version, and returns its new version, or
+// 0 if it was changed in the meantime.
+func (q *renewalQueue) put(ctx context.Context, state *renewalState, version int64) (int64, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to marshal renewal state")
+	}
+
+	version, err = q.store.PutIfVersion(ctx, state.Domain, data, version)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to store renewal state of %q", state.Domain)
+	}
+	return version, nil
+}
+
+// states returns the state of every domain that has one.
+func (q *renewalQueue) states(ctx context.Context) ([]renewalState, error) {
+	domains, err := q.store.List(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list renewal states")
+	}
+
+	var states []renewalState
+	for _, d := range domains {
+		state, version, err := q.get(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if version != 0 {
+			states = append(states, *state)
+		}
+	}
+	return states, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// versionedMemory is a renewalStore in memory.
+type versionedMemory struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	versions map[string]int64
+	last     int64
+}
+
+func newVersionedMemory() *versionedMemory {
+	return &versionedMemory{data: make(map[string][]byte), versions: make(map[string]int64)}
+}
+
+func (m *versionedMemory) GetVersion(ctx context.Context, key string) ([]byte, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[key]
+	if !ok {
+		return nil, 0, autocert.ErrCacheMiss
+	}
+	return data, m.versions[key], nil
+}
+
+func (m *versionedMemory) PutIfVersion(ctx context.Context, key string, data []byte, version int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.versions[key] != version {
+		return 0, nil
+	}
+	m.last++
+	m.data[key] = data
+	m.versions[key] = m.last
+	return m.last, nil
+}
+
+func (m *versionedMemory) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func TestRenewalStateConflicts(t *testing.T) {
+	ctx := context.Background()
+	q := newRenewalQueue(newVersionedMemory(), nil, nil, nil, nil)
+
+	state, version, err := q.get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || state.Domain != "example.com" {
+		t.Fatalf("get of a new domain = %+v, %d", state, version)
+	}
+
+	// Two replicas claim the same attempt; only the first one gets it.
+	state.NextRetry = time.Now().Add(minRenewalBackoff)
+	claimed, err := q.put(ctx, state, version)
+	if err != nil || claimed == 0 {
+		t.Fatalf("first claim failed: %d, %v", claimed, err)
+	}
+	if v, err := q.put(ctx, state, version); err != nil || v != 0 {
+		t.Fatalf("second claim = %d, %v, want a conflict", v, err)
+	}
+
+	state.Failures = 1
+	if v, err := q.put(ctx, state, claimed); err != nil || v == 0 {
+		t.Fatalf("update after the claim = %d, %v", v, err)
+	}
+	states, err := q.states(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Failures != 1 {
+		t.Errorf("states = %+v, want the updated state", states)
+	}
+}
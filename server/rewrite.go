@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// rewriter changes the URL of requests before they are proxied, for backends
+// that expect a different layout. Rules are applied in order.
+type rewriter struct {
+	rules []func(req *http.Request)
+}
+
+// newRewriter creates a rewriter with the rules in spec, a '|'-separated list
+// of strip_prefix=<prefix>, add_prefix=<prefix>, regex=<regexp>=><replacement>
+// and query=<name>=<value>.
+func newRewriter(spec string) (*rewriter, error) {
+	r := &rewriter{}
+	for _, rule := range strings.Split(spec, "|") {
+		idx := strings.Index(rule, "=")
+		if idx == -1 {
+			return nil, errors.Errorf("rule %q is missing '='", rule)
+		}
+		name, value := rule[:idx], rule[idx+1:]
+
+		switch name {
+		case "strip_prefix":
+			if !strings.HasPrefix(value, "/") {
+				return nil, errors.Errorf("prefix %q must start with '/'", value)
+			}
+			r.rules = append(r.rules, func(req *http.Request) {
+				if p := strings.TrimPrefix(req.URL.Path, value); p != req.URL.Path {
+					if !strings.HasPrefix(p, "/") {
+						p = "/" + p
+					}
+					req.URL.Path = p
+				}
+			})
+
+		case "add_prefix":
+			if !strings.HasPrefix(value, "/") {
+				return nil, errors.Errorf("prefix %q must start with '/'", value)
+			}
+			value = strings.TrimSuffix(value, "/")
+			r.rules = append(r.rules, func(req *http.Request) {
+				req.URL.Path = value + req.URL.Path
+			})
+
+		case "regex":
+			idx := strings.Index(value, "=>")
+			if idx == -1 {
+				return nil, errors.Errorf("regex rule %q is missing '=>'", value)
+			}
+			re, err := regexp.Compile(value[:idx])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid regex in %q", value)
+			}
+			repl := value[idx+len("=>"):]
+			r.rules = append(r.rules, func(req *http.Request) {
+				req.URL.Path = re.ReplaceAllString(req.URL.Path, repl)
+			})
+
+		case "query":
+			idx := strings.Index(value, "=")
+			if idx == -1 || idx == 0 {
+				return nil, errors.Errorf("query rule %q must be <name>=<value>", value)
+			}
+			k, v := value[:idx], value[idx+1:]
+			r.rules = append(r.rules, func(req *http.Request) {
+				q := req.URL.Query()
+				q.Set(k, v)
+				req.URL.RawQuery = q.Encode()
+			})
+
+		default:
+			return nil, errors.Errorf("unknown rule %q", name)
+		}
+	}
+	return r, nil
+}
+
+func (r *rewriter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		r2 := new(http.Request)
+		*r2 = *req
+		u := *req.URL
+		r2.URL = &u
+
+		for _, rule := range r.rules {
+			rule(r2)
+		}
+		// The rules work on the decoded path, so let the URL encode it again.
+		r2.URL.RawPath = ""
+		h.ServeHTTP(rw, r2)
+	})
+}
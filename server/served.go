@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ownWriteTTL is how long a write of this replica waits for its event from
+// etcd before it is forgotten.
+const ownWriteTTL = time.Minute
+
+// servedCerts holds the certs served for each cache key, a domain followed by
+// "+rsa" for RSA certs. autocert keeps certs in memory too, but has no way to
+// replace one of them; here single entries are replaced when autocert stores
+// a cert, and dropped when another replica changes one.
+//
+// Updates touch a single entry, and reads only take a read lock. An entry
+// with a small self-signed cert takes about 3.5 KB; a leaf and intermediate
+// as issued by public CAs take roughly three times that. autocert keeps
+// another copy of every cert it loads, so budget about 20 KB per domain and
+// key type, e.g. 200 MB for 10,000 domains with ECDSA certs.
+type servedCerts struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func newServedCerts() *servedCerts {
+	return &servedCerts{certs: make(map[string]*tls.Certificate)}
+}
+
+// get returns the cert of key, unless there is none or it expired.
+func (s *servedCerts) get(key string) *tls.Certificate {
+	s.mu.RLock()
+	cert := s.certs[key]
+	s.mu.RUnlock()
+
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+func (s *servedCerts) set(key string, cert *tls.Certificate) {
+	s.mu.Lock()
+	s.certs[key] = cert
+	s.mu.Unlock()
+}
+
+func (s *servedCerts) drop(key string) {
+	s.mu.Lock()
+	delete(s.certs, key)
+	s.mu.Unlock()
+}
+
+// cached returns the cert for hello from memory or from the cache, or nil if
+// there is no valid one and autocert has to obtain it.
+func (c *certManager) cached(managers []*autocert.Manager, hello *tls.ClientHelloInfo) *tls.Certificate {
+	domain := strings.TrimSuffix(hello.ServerName, ".")
+	// Leave challenges and invalid names to autocert.
+	if wantsTokenCert(hello) || !strings.Contains(strings.Trim(domain, "."), ".") || strings.ContainsAny(domain, `+/\`) {
+		return nil
+	}
+	key := domain
+	if !supportsECDSA(hello) {
+		key += "+rsa"
+	}
+	if cert := c.certs.get(key); cert != nil {
+		return cert
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, err := c.certCache.Get(ctx, key)
+	if err != nil {
+		return nil
+	}
+	cert, err := parseCachedCert(data, domain, key != domain)
+	if err != nil {
+		return nil
+	}
+	c.certs.set(key, cert)
+
+	// autocert only schedules the renewal of certs it has loaded.
+	if _, loaded := c.armed.LoadOrStore(key, true); !loaded {
+		h := *hello
+		go func() {
+			if _, err := c.getCertificate(managers, &h); err != nil {
+				c.armed.Delete(key)
+			}
+		}()
+	}
+	return cert
+}
+
+// parseCachedCert parses an autocert cache entry, and checks that it's a
+// valid cert of domain with the right key type.
+func parseCachedCert(data []byte, domain string, isRSA bool) (*tls.Certificate, error) {
+	// The entry holds the private key followed by the chain, so it can be
+	// passed as both.
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return nil, errors.New("cert isn't valid now")
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		return nil, err
+	}
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		if !isRSA {
+			return nil, errors.New("RSA key in ECDSA entry")
+		}
+	case *ecdsa.PrivateKey:
+		if isRSA {
+			return nil, errors.New("ECDSA key in RSA entry")
+		}
+	default:
+		return nil, errors.New("unknown key type")
+	}
+	return &cert, nil
+}
+
+// isCertKey reports whether key is the cache key of a cert, as opposed to the
+// account key or challenge data.
+func isCertKey(key string) bool {
+	return !strings.Contains(key, "+") || strings.HasSuffix(key, "+rsa")
+}
+
+// servingCache is the cache of the managers. It replaces served certs when
+// autocert stores new ones, and notes the writes so that watchCerts can tell
+// them from changes by other replicas.
+type servingCache struct {
+	autocert.Cache
+	c *certManager
+}
+
+func (s *servingCache) Put(ctx context.Context, key string, data []byte) error {
+	s.c.ownWrites.add(s.c.hashKey(key))
+	if err := s.Cache.Put(ctx, key, data); err != nil {
+		s.c.ownWrites.consume(s.c.hashKey(key))
+		return err
+	}
+
+	if isCertKey(key) {
+		domain := strings.TrimSuffix(key, "+rsa")
+		if cert, err := parseCachedCert(data, domain, key != domain); err == nil {
+			s.c.certs.set(key, cert)
+		} else {
+			s.c.certs.drop(key)
+		}
+	}
+	return nil
+}
+
+func (s *servingCache) Delete(ctx context.Context, key string) error {
+	s.c.certs.drop(key)
+	s.c.ownWrites.add(s.c.hashKey(key))
+	if err := s.Cache.Delete(ctx, key); err != nil {
+		s.c.ownWrites.consume(s.c.hashKey(key))
+		return err
+	}
+	return nil
+}
+
+// ownWrites counts the writes of this replica to each key that etcd hasn't
+// reported yet.
+type ownWrites struct {
+	mu     sync.Mutex
+	writes map[string]ownWrite
+}
+
+type ownWrite struct {
+	n    int
+	last time.Time
+}
+
+func (o *ownWrites) add(key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.writes == nil {
+		o.writes = make(map[string]ownWrite)
+	}
+	w := o.writes[key]
+	if time.Since(w.last) > ownWriteTTL {
+		w.n = 0
+	}
+	o.writes[key] = ownWrite{w.n + 1, time.Now()}
+}
+
+// consume reports whether a write to key by this replica is pending, and
+// forgets one.
+func (o *ownWrites) consume(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w, ok := o.writes[key]
+	if !ok {
+		return false
+	}
+	if w.n <= 1 || time.Since(w.last) > ownWriteTTL {
+		delete(o.writes, key)
+	} else {
+		o.writes[key] = ownWrite{w.n - 1, w.last}
+	}
+	return time.Since(w.last) <= ownWriteTTL
+}
+
+// wantsTokenCert and supportsECDSA are copied from autocert, so that certs
+// are looked up under the same keys.
+
+func wantsTokenCert(hello *tls.ClientHelloInfo) bool {
+	// tls-alpn-01
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == "acme-tls/1" {
+		return true
+	}
+	// tls-sni-xx
+	return strings.HasSuffix(hello.ServerName, ".acme.invalid")
+}
+
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	// The "signature_algorithms" extension, if present, limits the key exchange
+	// algorithms allowed by the cipher suites. See RFC 5246, section 7.4.1.4.1.
+	if hello.SignatureSchemes != nil {
+		ecdsaOK := false
+	schemeLoop:
+		for _, scheme := range hello.SignatureSchemes {
+			const tlsECDSAWithSHA1 tls.SignatureScheme = 0x0203 // constant added in Go 1.10
+			switch scheme {
+			case tlsECDSAWithSHA1, tls.ECDSAWithP256AndSHA256,
+				tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+				ecdsaOK = true
+				break schemeLoop
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	if hello.SupportedCurves != nil {
+		ecdsaOK := false
+		for _, curve := range hello.SupportedCurves {
+			if curve == tls.CurveP256 {
+				ecdsaOK = true
+				break
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
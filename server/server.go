@@ -1,89 +1,97 @@
 package main
 
 import (
-	"crypto/tls"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"regexp"
 
 	"github.com/golang/glog"
-	"github.com/unrolled/secure"
-	"golang.org/x/crypto/acme/autocert"
+	"github.com/jonathanwei/wile/proxy"
 )
 
-func run(backends map[string]*url.URL, hosts map[string]string, isDev bool, certMgr *autocert.Manager) {
-	go httpServer(isDev, certMgr)
-	httpsServer(backends, hosts, isDev, certMgr)
-}
-
-type proxy struct {
-	handlers map[string]http.Handler
-}
+func run(srv *proxy.Server, passthrough map[string]string, listenOpts listenOptions) {
+	u := &upgrader{drainTimeout: listenOpts.drainTimeout}
 
-func newProxy(backends map[string]*url.URL, hosts map[string]string) *proxy {
-	handlers := make(map[string]http.Handler)
+	httpLs, httpsLs := listeners(listenOpts)
+	tuned := make(map[string]bool)
+	tune := func(s *http.Server, l net.Listener, useTLS bool) net.Listener {
+		addr, t := listenOpts.tuningFor(l)
+		if t == nil {
+			return l
+		}
+		tuned[addr] = true
+		l, err := t.apply(s, l, useTLS)
+		if err != nil {
+			glog.Fatalf("Invalid listener settings of %q: %v", addr, err)
+		}
+		return l
+	}
+	for _, l := range httpLs {
+		s := srv.HTTP()
+		u.add("http", l, s)
 
-	for host, backendName := range hosts {
-		backendURL := backends[backendName]
-		handlers[host] = httputil.NewSingleHostReverseProxy(backendURL)
+		l = tune(s, l, false)
+		if listenOpts.acceptProxy {
+			l = proxyProtoListener{l}
+		}
+		go serve(s, l, false)
 	}
+	for _, l := range httpsLs {
+		s := srv.HTTPS()
+		u.add("https", l, s)
 
-	return &proxy{
-		handlers: handlers,
+		l = tune(s, l, true)
+		if listenOpts.acceptProxy {
+			l = proxyProtoListener{l}
+		}
+		if len(passthrough) > 0 {
+			l = newSNIListener(l, passthrough, listenOpts.passthroughProxy)
+		}
+		go serve(s, l, true)
 	}
-}
 
-func (p *proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	h, ok := p.handlers[req.Host]
-	if !ok {
-		glog.Infof("Got request for non-existent hostname %q", req.Host)
-		http.NotFound(rw, req)
-		return
+	for addr := range listenOpts.tuning {
+		if !tuned[addr] {
+			glog.Warningf("No listener on %q for -listener_settings", addr)
+		}
 	}
 
-	h.ServeHTTP(rw, req)
+	u.ready()
+	u.waitForUpgrade()
 }
 
-func httpsServer(backends map[string]*url.URL, hosts map[string]string, isDev bool, certMgr *autocert.Manager) {
-	handler := newProxy(backends, hosts)
-	server := &http.Server{
-		Addr:    ":443",
-		Handler: securify(isDev, handler),
-		TLSConfig: &tls.Config{
-			GetCertificate: certMgr.GetCertificate,
-			MinVersion:     tls.VersionTLS13,
-		},
+func serve(s *http.Server, l net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = s.ServeTLS(l, "", "")
+	} else {
+		err = s.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		glog.Fatal(err)
 	}
-	glog.Fatal(server.ListenAndServeTLS("", ""))
 }
 
-func httpServer(isDev bool, certMgr *autocert.Manager) {
-	redirectHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		u := &url.URL{
-			Scheme:   "https",
-			Host:     req.Host,
-			Path:     req.URL.Path,
-			RawQuery: req.URL.RawQuery,
-		}
-		http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
-	})
+// newRouter creates the router of the configured hosts. backends holds the
+// handler of every backend by name. Requests for other hosts go to fallback.
+func newRouter(backends map[string]http.Handler, hosts map[string][]weightedBackend, onDemand *regexp.Regexp, onDemandBackend, affinityCookie string, mw hostMiddleware, fallback http.Handler) *proxy.Router {
+	r := proxy.NewRouter(proxy.WithNotFound(fallback))
 
-	mux := http.NewServeMux()
-	mux.Handle("/", securify(isDev, redirectHandler))
+	for host, wbs := range hosts {
+		if len(wbs) == 1 {
+			r.Handle(host, mw.wrap(host, backends[wbs[0].name]))
+			continue
+		}
+		r.Handle(host, mw.wrap(host, newSplitHandler(backends, wbs, affinityCookie)))
+	}
 
-	glog.Fatal(http.ListenAndServe(":80", certMgr.HTTPHandler(mux)))
+	if onDemand != nil {
+		r.HandleMatching(onDemand, backends[onDemandBackend])
+	}
+	return r
 }
 
-func securify(isDev bool, handler http.Handler) http.Handler {
-	secureMiddleware := secure.New(secure.Options{
-		STSSeconds:            60 * 60 * 24 * 365, // One year.
-		STSIncludeSubdomains:  true,
-		STSPreload:            true,
-		FrameDeny:             true,
-		ContentTypeNosniff:    true,
-		BrowserXssFilter:      true,
-		ContentSecurityPolicy: "object-src 'none'; script-src $NONCE 'unsafe-inline' 'strict-dynamic' https:; base-uri 'none';",
-		IsDevelopment:         isDev,
-	})
-	return secureMiddleware.Handler(handler)
-}
+var notFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	glog.Infof("Got request for non-existent hostname %q", req.Host)
+	http.NotFound(rw, req)
+})
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// dynamicBackend proxies to the instances of a backend that are discovered
+// at runtime, e.g. from a service registry.
+type dynamicBackend struct {
+	name      string
+	key       []byte
+	transport http.RoundTripper
+	pages     *statusPages
+
+	mu      sync.RWMutex
+	urls    []*url.URL
+	handler http.Handler
+}
+
+func newDynamicBackend(name string, key []byte, transport http.RoundTripper, pages *statusPages) *dynamicBackend {
+	return &dynamicBackend{name: name, key: key, transport: transport, pages: pages}
+}
+
+// setInstances replaces the instances of the backend, unless they are the
+// same as the current ones. Requests to removed instances finish on the old
+// handler; the transport is shared, so nothing is closed under them.
+func (b *dynamicBackend) setInstances(urls []*url.URL) {
+	sort.Slice(urls, func(i, j int) bool { return urls[i].String() < urls[j].String() })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sameURLs(b.urls, urls) {
+		return
+	}
+	glog.Infof("Instances of backend %q changed to %v", b.name, urls)
+
+	b.urls = urls
+	b.handler = nil
+	if len(urls) > 0 {
+		b.handler = newBackendHandler(b.name, urls, b.key, b.transport, b.pages)
+	}
+}
+
+func (b *dynamicBackend) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	b.mu.RLock()
+	h := b.handler
+	b.mu.RUnlock()
+
+	if h == nil {
+		b.pages.writeError(rw, http.StatusServiceUnavailable)
+		return
+	}
+	h.ServeHTTP(rw, req)
+}
+
+func sameURLs(a, b []*url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceRegistries resolves backends declared as consul://<service>, the
+// passing instances of a Consul service, etcd:///<prefix>, the URLs stored
+// under a prefix in etcd, or a DNS name, see isDNSURL.
+type serviceRegistries struct {
+	consulAddr  string
+	consulToken string
+	etcd        *clientv3.Client
+}
+
+func isServiceURL(u *url.URL) bool {
+	return u.Scheme == "consul" || u.Scheme == "etcd" || isDNSURL(u)
+}
+
+// watch keeps the instances of b up to date with the service at u.
+func (r *serviceRegistries) watch(u *url.URL, b *dynamicBackend) {
+	switch u.Scheme {
+	case "consul":
+		r.watchConsul(u.Host, b)
+	case "etcd":
+		r.watchEtcd(u.Path, b)
+	default:
+		watchDNS(u, b)
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// watchConsul follows the passing instances of service with blocking
+// queries, see https://www.consul.io/api/features/blocking.html.
+func (r *serviceRegistries) watchConsul(service string, b *dynamicBackend) {
+	var index uint64
+	for {
+		urls, next, err := r.consulInstances(service, index)
+		if err != nil {
+			glog.Errorf("Failed to get instances of Consul service %q: %v", service, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		// The index can go backwards, e.g. when Consul restarts.
+		if next < index {
+			next = 0
+		}
+		index = next
+		b.setInstances(urls)
+	}
+}
+
+func (r *serviceRegistries) consulInstances(service string, index uint64) ([]*url.URL, uint64, error) {
+	q := url.Values{
+		"passing": {"1"},
+		"index":   {strconv.FormatUint(index, 10)},
+		"wait":    {"5m"},
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(r.consulAddr, "/")+"/v1/health/service/"+url.PathEscape(service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.consulToken != "" {
+		req.Header.Set("X-Consul-Token", r.consulToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("got %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to decode instances")
+	}
+
+	var urls []*url.URL
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		urls = append(urls, &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+		})
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "invalid X-Consul-Index")
+	}
+	return urls, next, nil
+}
+
+// watchEtcd follows the instance URLs stored under prefix in etcd.
+func (r *serviceRegistries) watchEtcd(prefix string, b *dynamicBackend) {
+	ctx := context.Background()
+	for {
+		resp, err := r.etcd.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			glog.Errorf("Failed to get instances under %q in etcd: %v", prefix, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		var urls []*url.URL
+		for _, kv := range resp.Kvs {
+			u, err := url.Parse(string(kv.Value))
+			if err != nil || u.Host == "" {
+				glog.Warningf("Ignoring instance %q of %q in etcd, invalid URL %q", kv.Key, prefix, kv.Value)
+				continue
+			}
+			urls = append(urls, u)
+		}
+		b.setInstances(urls)
+
+		// Wait for the next change, then read all instances again.
+		wctx, cancel := context.WithCancel(ctx)
+		wr, ok := <-r.etcd.Watch(wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		cancel()
+		if !ok || wr.Err() != nil {
+			glog.Errorf("Failed to watch instances under %q in etcd: %v", prefix, wr.Err())
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
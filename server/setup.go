@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jonathanwei/wile"
+	"github.com/jonathanwei/wile/proxy"
+)
+
+// setup is what the server is built from, as parsed from its config and
+// connected to while it starts.
+type setup struct {
+	c *config
+
+	backends    map[string][]*url.URL
+	hosts       map[string][]weightedBackend
+	domains     []string
+	onDemand    *regexp.Regexp
+	denyHosts   *wile.HostPatterns
+	transports  map[string]http.RoundTripper
+	mirrors     map[string]weightedBackend
+	geoRoutes   map[string]map[string]string
+	hostRates   map[string]int64
+	passthrough map[string]string
+	staticCerts map[string][2]string
+	geo         *geoIP
+	tenants     *tenants
+	discovered  *discovery
+	pages       *statusPages
+	mw          hostMiddleware
+	key         []byte
+
+	etcd     *clientv3.Client
+	certs    certSource
+	acmeMgr  *certManager
+	auditLog *wile.AuditLog
+	renewals *renewalQueue
+}
+
+// serve runs the server configured by c until it's upgraded, or only checks
+// the config with -check_config.
+func (c *config) serve() {
+	if c.configBundle != "" {
+		if c.configBundleKey == "" {
+			log.Fatal("-config_bundle requires -config_bundle_key")
+		}
+		if err := loadConfigBundle(c.configBundle, c.configBundleKey, c.connectEtcd); err != nil {
+			log.Fatalf("Failed to load -config_bundle: %v", err)
+		}
+	}
+
+	s := c.parse()
+	if c.checkConfig {
+		if !s.check() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	s.discover()
+	if !c.development {
+		etcd, err := c.connectEtcd()
+		if err != nil {
+			log.Fatalf("Failed to connect to etcd: %v", err)
+		}
+		s.etcd = etcd
+		if s.tenants != nil {
+			s.tenants.etcd = etcd
+		}
+	}
+	s.obtainCerts()
+
+	if c.adminAddr != "" {
+		go adminServer(c.adminAddr, &admin{
+			etcd:       s.etcd,
+			certs:      s.acmeMgr,
+			domains:    s.domains,
+			pages:      s.pages,
+			audit:      s.auditLog,
+			renewals:   s.renewals,
+			tenants:    s.tenants,
+			debugToken: c.adminDebugToken,
+		})
+	}
+
+	listenOpts := listenOptions{
+		httpAddrs:        splitList(c.httpAddrs),
+		httpsAddrs:       splitList(c.httpsAddrs),
+		acceptProxy:      c.acceptProxy,
+		passthroughProxy: c.sendProxy,
+		drainTimeout:     c.drainTimeout,
+		tuning:           parseListenerSpecs(c.listenerSettings, c.idleTimeout),
+	}
+	srv := proxy.NewServer(s.handler(), s.certs.GetCertificate, s.serverOptions()...)
+	run(srv, s.passthrough, listenOpts)
+}
+
+func (c *config) connectEtcd() (*clientv3.Client, error) {
+	return wile.NewEtcdClient(strings.Split(c.etcdEndpoints, ","), c.etcdCA, c.etcdCert, c.etcdKey, c.etcdUsername, c.etcdPassword, c.etcdDialTimeout)
+}
+
+// parse parses the hosts, backends and middleware of c, exiting on invalid
+// flags.
+func (c *config) parse() *setup {
+	s := &setup{c: c}
+	s.backends = parseBackendSpecs(c.backends)
+	s.hosts = parseHostSpecs(c.hosts, s.backends)
+	s.transports = parseTransportSpecs(c.backendTransport, s.backends)
+	s.mirrors = parseMirrorSpecs(c.mirror, s.hosts, s.backends)
+	s.geoRoutes = parseGeoRouteSpecs(c.geoIPRoutes, s.hosts, s.backends)
+	s.hostRates = parseBandwidthSpecs(c.hostBandwidth, s.hosts)
+	if c.accessLogSample < 0 {
+		log.Fatal("-access_log_sample must not be negative")
+	}
+
+	if c.geoIPDB != "" {
+		var err error
+		s.geo, err = newGeoIP(c.geoIPDB)
+		if err != nil {
+			log.Fatalf("Failed to load -geoip_db: %v", err)
+		}
+	} else if c.geoIPHeaders != "" || c.geoIPRoutes != "" {
+		log.Fatal("-geoip_headers and -geoip_routes require -geoip_db")
+	}
+
+	for h := range s.hosts {
+		s.domains = append(s.domains, h)
+	}
+
+	s.onDemand = parseOnDemandSpec(c.onDemandHosts, c.onDemandBackend, s.backends)
+	var err error
+	s.denyHosts, err = wile.NewHostPatterns(splitList(c.denyHosts)...)
+	if err != nil {
+		log.Fatalf("Invalid -deny_hosts: %v", err)
+	}
+	s.passthrough = parsePassthroughSpecs(c.passthroughHosts, s.hosts)
+	s.staticCerts = parseStaticCertSpecs(c.staticCerts)
+
+	if c.tenantsFile != "" {
+		if s.tenants, err = loadTenants(c.tenantsFile); err != nil {
+			log.Fatalf("Failed to load -tenants_file: %v", err)
+		}
+		if c.development {
+			log.Fatal("-tenants_file needs etcd, which isn't used in development mode")
+		}
+	}
+
+	s.discovered = newDiscovery(notFound)
+
+	s.mw = make(hostMiddleware)
+	// CORS comes first, since preflight requests carry no credentials.
+	for h, p := range parseCORSSpecs(c.cors, s.hosts) {
+		s.mw.add(h, p.middleware)
+	}
+	if c.oidcHosts != "" {
+		if c.oidcIssuer == "" || c.oidcClientID == "" || c.oidcCookieKey == "" {
+			log.Fatal("-oidc_hosts requires -oidc_issuer, -oidc_client_id and -oidc_cookie_key")
+		}
+		auth := newOIDCAuth(c.oidcIssuer, c.oidcClientID, c.oidcSecret, []byte(c.oidcCookieKey), c.oidcSessionTTL)
+		for _, h := range strings.Split(c.oidcHosts, ",") {
+			h = normalizeHost("oidc_hosts", h)
+			if _, ok := s.hosts[h]; !ok {
+				log.Fatalf("Invalid -oidc_hosts, unknown host %q", h)
+			}
+			s.mw.add(h, auth.middleware(h))
+		}
+	}
+	for h, g := range parseCredentialSpecs(c.basicAuth, c.bearerTokens, s.hosts) {
+		s.mw.add(h, g.middleware)
+	}
+	for h, su := range parseSignedURLSpecs(c.signedURLs, s.hosts) {
+		s.mw.add(h, su.middleware)
+	}
+	for h, rw := range parseRewriteSpecs(c.rewrites, s.hosts) {
+		s.mw.add(h, rw.middleware)
+	}
+	for _, h := range splitList(c.geoIPHeaders) {
+		h = normalizeHost("geoip_headers", h)
+		if _, ok := s.hosts[h]; !ok {
+			log.Fatalf("Invalid -geoip_headers, unknown host %q", h)
+		}
+		s.mw.add(h, s.geo.geoHeaders)
+	}
+
+	s.pages, err = newStatusPages(c.maintenancePage, c.errorPagesDir, c.retryAfter)
+	if err != nil {
+		log.Fatalf("Failed to load status pages: %v", err)
+	}
+	for _, h := range splitList(c.maintenanceHosts) {
+		h = normalizeHost("maintenance_hosts", h)
+		s.pages.setMaintenance(h, true)
+	}
+	return s
+}
+
+// check reports the problems of the config for -check_config, and whether
+// there were none.
+func (s *setup) check() bool {
+	c := &configCheck{}
+	var etcd *clientv3.Client
+	if !s.c.development {
+		var err error
+		if etcd, err = s.c.connectEtcd(); err != nil {
+			c.problem("etcd: %v", err)
+		} else {
+			c.etcd(etcd, s.c.certKey, s.c.accountKeyType, s.domains)
+		}
+	}
+	c.backends(s.backends, etcd)
+	if !s.c.development {
+		c.acmeEligibility(s.domains, parseCheckAddrs(s.c.checkAddrs))
+	}
+	return c.report()
+}
+
+// discover starts serving the hosts of Docker containers and Kubernetes
+// Ingresses.
+func (s *setup) discover() {
+	s.key = newAffinityKey(s.c.affinityKey)
+	if s.c.dockerSocket != "" {
+		go newDockerWatcher(s.c.dockerSocket, s.discovered, s.key, s.pages).run()
+	}
+	if s.c.ingressClass != "" {
+		ic, err := newIngressController(s.c.ingressClass, s.c.ingressNamespace, s.discovered, s.pages)
+		if err != nil {
+			log.Fatalf("Failed to watch Kubernetes Ingresses: %v", err)
+		}
+		go ic.run()
+	}
+}
+
+// obtainCerts sets up the certs served: self-signed ones in development
+// mode, ACME ones otherwise, and static ones for -static_certs.
+func (s *setup) obtainCerts() {
+	c := s.c
+	if c.development {
+		dcm, err := newDevCertManager(c.devCertDir, hostPolicy(s.domains, s.onDemand, s.discovered, s.denyHosts))
+		if err != nil {
+			log.Fatalf("Failed to create development certs: %v", err)
+		}
+		s.certs = dcm
+	} else {
+		var err error
+		s.auditLog, err = wile.NewAuditLog(s.etcd, "/wile/audit", []byte(c.certKey))
+		if err != nil {
+			log.Fatalf("Failed to create audit log: %v", err)
+		}
+		go checkpointLoop(s.auditLog)
+
+		var shards *shardRing
+		if c.shardIssuance && !c.standby {
+			id := c.replicaID
+			if id == "" {
+				if id, err = os.Hostname(); err != nil {
+					log.Fatalf("Failed to get hostname for -replica_id: %v", err)
+				}
+			}
+			shards = newShardRing(s.etcd, "/wile/replicas", id)
+			go shards.run()
+		}
+
+		configured := hostPolicy(s.domains, s.onDemand, s.discovered, s.denyHosts)
+		policy := shards.hostPolicy(s.tenants.hostPolicy(configured), s.domains)
+		s.acmeMgr = newACMECertManager(s.etcd, c, s.tenants, s.domains, configured, policy, s.auditLog)
+		s.certs = s.acmeMgr
+
+		if !c.standby {
+			ari := newARIClient(strings.Split(c.acmeEndpoints, ","))
+			s.renewals = newRenewalQueue(wile.NewEtcdCache(s.etcd, "/wile/renewals"), s.acmeMgr, s.domains, ari, shards)
+			go s.renewals.run()
+		}
+	}
+
+	if c.ocspStapling || c.mustStaple {
+		s.certs = newOCSPStapler(s.certs)
+	}
+
+	if c.unknownSNI != "error" {
+		dcs, err := newDefaultCertSource(c.unknownSNI, hostPolicy(s.domains, s.onDemand, s.discovered, s.denyHosts), s.certs)
+		if err != nil {
+			log.Fatalf("Invalid -unknown_sni: %v", err)
+		}
+		s.certs = dcs
+	}
+
+	if len(s.staticCerts) > 0 {
+		scs, err := newStaticCertSource(s.staticCerts, s.certs)
+		if err != nil {
+			log.Fatalf("Failed to load static certs: %v", err)
+		}
+		s.certs = scs
+	}
+
+	if s.acmeMgr != nil && c.verifyInterval > 0 {
+		go s.acmeMgr.verifyLoop(s.domains, c.verifyAddr, c.verifyInterval)
+	}
+}
+
+// handler returns the handler of all requests, from the access log down to
+// the backends.
+func (s *setup) handler() http.Handler {
+	c := s.c
+	affinity := parseSplitAffinity(c.splitAffinity)
+	for name, urls := range s.backends {
+		if urls[0].Scheme == "etcd" && s.etcd == nil {
+			log.Fatalf("Backend %q needs etcd, which isn't used in development mode", name)
+		}
+	}
+	registries := &serviceRegistries{
+		consulAddr:  c.consulAddr,
+		consulToken: c.consulToken,
+		etcd:        s.etcd,
+	}
+	handlers := newBackendHandlers(s.backends, s.key, s.transports, s.pages, registries)
+	for h, f := range parseFilterSpecs(c.requestFilters, s.hosts, handlers) {
+		s.mw.add(h, f.middleware)
+	}
+	for h, wb := range s.mirrors {
+		// Mirroring comes last, so that the copies are rewritten like the
+		// originals.
+		s.mw.add(h, newMirror(handlers[wb.name], float64(wb.weight)).middleware)
+	}
+	for h, countries := range s.geoRoutes {
+		routes := make(map[string]http.Handler)
+		for country, b := range countries {
+			routes[country] = handlers[b]
+		}
+		s.mw.add(h, s.geo.geoRoutes(routes))
+	}
+	wellKnown := parseWellKnownSpecs(c.wellKnown, handlers)
+	handler := s.pages.wrap(wellKnown.wrap(newRouter(handlers, s.hosts, s.onDemand, c.onDemandBackend, affinity, s.mw, s.discovered)))
+	if c.hostBandwidth != "" || c.clientBandwidth > 0 {
+		handler = newThrottle(s.hostRates, c.clientBandwidth).wrap(handler)
+	}
+	if c.bufferRequests {
+		handler = newRequestBuffer(c.bufferMemory, c.maxRequestBody, c.minRequestRate).wrap(handler)
+	}
+	if s.tenants != nil {
+		handler = s.tenants.wrap(handler)
+	}
+	return newAccessLog(newHostLabels(s.domains, c.metricsMaxHosts), c.accessLogSample).wrap(handler)
+}
+
+func (s *setup) serverOptions() []proxy.ServerOption {
+	c := s.c
+	opts := []proxy.ServerOption{
+		proxy.WithDevelopment(c.development),
+		proxy.WithHTTPHandler(s.certs.HTTPHandler),
+		proxy.WithRedirectPort(c.redirectPort),
+		proxy.WithRedirectExemptPaths(splitList(c.redirectExempt)...),
+		proxy.WithPlainHosts(splitList(c.plainHosts)...),
+		proxy.WithTimeouts(c.readHeaderTimeout, c.idleTimeout),
+	}
+	if c.ticketKeyRotation > 0 {
+		if s.acmeMgr == nil {
+			log.Fatal("-session_ticket_rotation needs etcd, which isn't used in development mode")
+		}
+		opts = append(opts, proxy.WithTLSConfigHook(func(cfg *tls.Config) {
+			shareTicketKeys(s.acmeMgr.cache(), cfg, c.ticketKeyRotation)
+		}))
+	}
+	return opts
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("backend " + req.URL.Path))
+	}))
+	defer backend.Close()
+
+	var c config
+	fs := flag.NewFlagSet("wile", flag.ContinueOnError)
+	c.registerFlags(fs)
+	err := fs.Parse([]string{
+		"-backends=api:" + backend.URL,
+		"-hosts=example.com:api",
+		"-rewrites=example.com:add_prefix=/v2",
+		"-maintenance_hosts=down.example.com",
+		"-insecure_development_mode",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.httpsAddrs != ":443" || c.redirectPort != 443 {
+		t.Errorf("defaults not set: -https_addr %q, -redirect_port %d", c.httpsAddrs, c.redirectPort)
+	}
+
+	s := c.parse()
+	if len(s.domains) != 1 || s.domains[0] != "example.com" {
+		t.Errorf("domains = %q, want example.com", s.domains)
+	}
+	h := s.handler()
+
+	tests := []struct {
+		host     string
+		wantCode int
+		wantBody string
+	}{
+		{"example.com", http.StatusOK, "backend /v2/a"},
+		{"other.example.com", http.StatusNotFound, ""},
+		{"down.example.com", http.StatusServiceUnavailable, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/a", nil)
+		req.Host = tt.host
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		body, _ := ioutil.ReadAll(rw.Body)
+		if rw.Code != tt.wantCode || (tt.wantBody != "" && string(body) != tt.wantBody) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.host, rw.Code, body, tt.wantCode, tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// replicaTTL is how long a replica stays registered after it stops
+	// refreshing its lease, e.g. because it crashed.
+	replicaTTL           = 30 * time.Second
+	replicaRetryInterval = 5 * time.Second
+	replicaPollInterval  = 15 * time.Second
+)
+
+// shardRing splits domains between the replicas registered in etcd, so that
+// each domain is obtained and renewed by one replica. All replicas still
+// serve all certs from the shared cache. Domains are assigned by rendezvous
+// hashing, so a replica joining or leaving only moves its own share.
+type shardRing struct {
+	etcd       *clientv3.Client
+	etcdPrefix string
+	id         string
+
+	mu       sync.RWMutex
+	replicas []string
+}
+
+func newShardRing(etcd *clientv3.Client, etcdPrefix, id string) *shardRing {
+	return &shardRing{etcd: etcd, etcdPrefix: etcdPrefix, id: id}
+}
+
+// run registers the replica and keeps the list of replicas up to date.
+func (s *shardRing) run() {
+	go func() {
+		for {
+			err := s.register()
+			glog.Errorf("Replica %q lost its registration, retrying: %v", s.id, err)
+			time.Sleep(replicaRetryInterval)
+		}
+	}()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := s.poll(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("Failed to list replicas: %v", err)
+		}
+		time.Sleep(replicaPollInterval)
+	}
+}
+
+// register puts the replica under a lease and keeps the lease alive until
+// that fails.
+func (s *shardRing) register() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lease, err := s.etcd.Grant(ctx, int64(replicaTTL/time.Second))
+	if err != nil {
+		return errors.Wrap(err, "failed to grant lease")
+	}
+	_, err = s.etcd.Put(ctx, path.Join(s.etcdPrefix, s.id), time.Now().UTC().Format(time.RFC3339), clientv3.WithLease(lease.ID))
+	if err != nil {
+		return errors.Wrap(err, "failed to register")
+	}
+
+	ka, err := s.etcd.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to keep lease alive")
+	}
+	glog.Infof("Registered replica %q", s.id)
+	for range ka {
+	}
+	return errors.New("lease expired")
+}
+
+func (s *shardRing) poll(ctx context.Context) error {
+	gr, err := s.etcd.Get(ctx, s.etcdPrefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+
+	var replicas []string
+	for _, kv := range gr.Kvs {
+		replicas = append(replicas, strings.TrimPrefix(string(kv.Key), s.etcdPrefix+"/"))
+	}
+
+	s.mu.Lock()
+	if !equalStrings(s.replicas, replicas) {
+		glog.Infof("Replicas sharing issuance changed to %q", replicas)
+	}
+	s.replicas = replicas
+	s.mu.Unlock()
+	return nil
+}
+
+// hostPolicy extends policy to refuse obtaining certs of domains owned by
+// another replica, which obtains them before they are requested. Hosts that
+// aren't among domains aren't sharded. A nil *shardRing doesn't restrict
+// anything.
+func (s *shardRing) hostPolicy(policy autocert.HostPolicy, domains []string) autocert.HostPolicy {
+	if s == nil {
+		return policy
+	}
+	sharded := make(map[string]bool)
+	for _, d := range domains {
+		sharded[d] = true
+	}
+	return func(ctx context.Context, host string) error {
+		if err := policy(ctx, host); err != nil {
+			return err
+		}
+		if sharded[host] && !s.owns(host) {
+			return errors.Errorf("cert of %q is obtained by another replica", host)
+		}
+		return nil
+	}
+}
+
+// owns reports whether this replica is responsible for domain. Until the
+// replicas are known, it is responsible for all of them.
+func (s *shardRing) owns(domain string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.replicas) == 0 {
+		return true
+	}
+
+	var (
+		owner string
+		best  uint64
+	)
+	for _, r := range s.replicas {
+		h := fnv.New64a()
+		io.WriteString(h, r+"\x00"+domain)
+		if w := h.Sum64(); owner == "" || w > best {
+			owner, best = r, w
+		}
+	}
+	return owner == s.id
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// testOwners returns the owner of each domain among replicas, failing unless
+// there is exactly one.
+func testOwners(t *testing.T, replicas, domains []string) map[string]string {
+	rings := make([]*shardRing, len(replicas))
+	for i, id := range replicas {
+		// Replicas list each other in the order etcd returns them, which
+		// mustn't matter.
+		order := append(append([]string(nil), replicas[i:]...), replicas[:i]...)
+		rings[i] = &shardRing{id: id, replicas: order}
+	}
+
+	owners := make(map[string]string)
+	for _, d := range domains {
+		for _, r := range rings {
+			if !r.owns(d) {
+				continue
+			}
+			if o, ok := owners[d]; ok {
+				t.Fatalf("%q owned by both %q and %q", d, o, r.id)
+			}
+			owners[d] = r.id
+		}
+		if _, ok := owners[d]; !ok {
+			t.Fatalf("%q owned by no replica of %q", d, replicas)
+		}
+	}
+	return owners
+}
+
+func TestShardRingOwns(t *testing.T) {
+	var domains []string
+	for i := 0; i < 2000; i++ {
+		domains = append(domains, fmt.Sprintf("host%d.example.com", i))
+	}
+	replicas := []string{"a", "b", "c", "d"}
+	owners := testOwners(t, replicas, domains)
+
+	counts := make(map[string]int)
+	for _, o := range owners {
+		counts[o]++
+	}
+	for _, r := range replicas {
+		if share := float64(counts[r]) / float64(len(domains)); share < 0.15 || share > 0.35 {
+			t.Errorf("replica %q owns %.0f%% of domains, want about 25%%", r, share*100)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		replicas []string
+		// moved reports whether a domain may move from owner before to
+		// owner after.
+		moved func(before, after string) bool
+	}{
+		{"replica leaves", []string{"a", "b", "d"}, func(before, after string) bool { return before == "c" }},
+		{"replica joins", []string{"a", "b", "c", "d", "e"}, func(before, after string) bool { return after == "e" }},
+	}
+	for _, tt := range tests {
+		n := 0
+		for d, after := range testOwners(t, tt.replicas, domains) {
+			if before := owners[d]; before != after {
+				n++
+				if !tt.moved(before, after) {
+					t.Errorf("%s: %q moved from %q to %q", tt.name, d, before, after)
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: no domain moved", tt.name)
+		}
+	}
+}
+
+func TestShardRingUnknownReplicas(t *testing.T) {
+	// Before the replicas are known, a replica obtains every cert itself.
+	if !(&shardRing{id: "a"}).owns("example.com") {
+		t.Error("replica without known replicas doesn't own domain")
+	}
+	// A replica whose registration isn't listed yet leaves domains to the
+	// listed ones.
+	r := &shardRing{id: "new", replicas: []string{"a", "b"}}
+	for i := 0; i < 100; i++ {
+		if d := fmt.Sprintf("host%d.example.com", i); r.owns(d) {
+			t.Errorf("unlisted replica owns %q", d)
+		}
+	}
+}
+
+func TestShardRingHostPolicy(t *testing.T) {
+	allowAll := func(context.Context, string) error { return nil }
+	domains := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}
+	owners := testOwners(t, []string{"a", "b"}, domains)
+
+	r := &shardRing{id: "a", replicas: []string{"a", "b"}}
+	policy := r.hostPolicy(allowAll, domains)
+	for _, d := range domains {
+		err := policy(context.Background(), d)
+		if owned := owners[d] == "a"; owned != (err == nil) {
+			t.Errorf("policy(%q) = %v, owned by %q", d, err, owners[d])
+		}
+	}
+	if err := policy(context.Background(), "unsharded.example.com"); err != nil {
+		t.Errorf("policy of unsharded host: %v", err)
+	}
+
+	var none *shardRing
+	if err := none.hostPolicy(allowAll, domains)(context.Background(), domains[0]); err != nil {
+		t.Errorf("policy without sharding: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedURLs only lets requests for paths under prefixes through if their URL
+// is signed with one of keys and hasn't expired. A URL is signed by adding
+// expires, a Unix time, and signature, the hex HMAC-SHA256 of
+// "<path>\n<expires>", to its query. Several keys allow rotating them.
+type signedURLs struct {
+	keys     []string
+	prefixes []string
+}
+
+func (s *signedURLs) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Backends may resolve dot segments and repeated slashes, so those
+		// can't be used to get around the prefixes.
+		if !s.protects(path.Clean(req.URL.Path)) {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		q := req.URL.Query()
+		if !s.valid(req.URL.Path, q.Get("expires"), q.Get("signature")) {
+			http.Error(rw, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+
+		// Backends don't need to see the signature.
+		q.Del("expires")
+		q.Del("signature")
+		r2 := new(http.Request)
+		*r2 = *req
+		u := *req.URL
+		u.RawQuery = q.Encode()
+		r2.URL = &u
+		h.ServeHTTP(rw, r2)
+	})
+}
+
+// protects reports whether the cleaned path is under a prefix. Cleaning
+// drops trailing slashes, so a prefix with one also protects itself without.
+func (s *signedURLs) protects(path string) bool {
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(path, p) || path == strings.TrimSuffix(p, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *signedURLs) valid(path, expires, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	for _, k := range s.keys {
+		mac := hmac.New(sha256.New, []byte(k))
+		mac.Write([]byte(path + "\n" + expires))
+		if hmac.Equal(mac.Sum(nil), sig) {
+			return true
+		}
+	}
+	return false
+}
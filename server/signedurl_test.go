@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSignature(key, path, expires string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignedURLValid(t *testing.T) {
+	s := &signedURLs{keys: []string{"new key", "old key"}, prefixes: []string{"/private/"}}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+
+	tests := []struct {
+		name                     string
+		path, expires, signature string
+		want                     bool
+	}{
+		{"signed", "/private/a", future, testSignature("new key", "/private/a", future), true},
+		{"old key", "/private/a", future, testSignature("old key", "/private/a", future), true},
+		{"upper case hex", "/private/a", future, strings.ToUpper(testSignature("new key", "/private/a", future)), true},
+		{"expired", "/private/a", past, testSignature("new key", "/private/a", past), false},
+		{"other path", "/private/b", future, testSignature("new key", "/private/a", future), false},
+		{"other expiry", "/private/a", future + "0", testSignature("new key", "/private/a", future), false},
+		{"unknown key", "/private/a", future, testSignature("other key", "/private/a", future), false},
+		{"truncated", "/private/a", future, testSignature("new key", "/private/a", future)[:32], false},
+		{"not hex", "/private/a", future, "zz", false},
+		{"no signature", "/private/a", future, "", false},
+		{"no expiry", "/private/a", "", testSignature("new key", "/private/a", ""), false},
+		{"invalid expiry", "/private/a", "soon", testSignature("new key", "/private/a", "soon"), false},
+	}
+	for _, tt := range tests {
+		if got := s.valid(tt.path, tt.expires, tt.signature); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignedURLMiddleware(t *testing.T) {
+	s := &signedURLs{keys: []string{"key"}, prefixes: []string{"/private/"}}
+	h := s.middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.URL.RawQuery))
+	}))
+	expires := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	signed := func(path string) string {
+		return path + "?" + url.Values{
+			"expires":   {expires},
+			"signature": {testSignature("key", path, expires)},
+			"x":         {"1"},
+		}.Encode()
+	}
+
+	tests := []struct {
+		target string
+		status int
+		// query is the query passed on.
+		query string
+	}{
+		{"/public/a?x=1", http.StatusOK, "x=1"},
+		{"/private/a?x=1", http.StatusForbidden, ""},
+		{signed("/private/a"), http.StatusOK, "x=1"},
+		{signed("/private/a") + "&signature=00", http.StatusOK, "x=1"},
+		{"/public/../private/a", http.StatusForbidden, ""},
+		{"//private/a", http.StatusForbidden, ""},
+		{"/private/./a", http.StatusForbidden, ""},
+		{"/%70rivate/a", http.StatusForbidden, ""},
+		{"/private/", http.StatusForbidden, ""},
+		{"/private", http.StatusForbidden, ""},
+		{"/private/.", http.StatusForbidden, ""},
+		{"/private//", http.StatusForbidden, ""},
+		{signed("/private/"), http.StatusOK, "x=1"},
+		{"/privateer", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.URL, _ = url.ParseRequestURI(tt.target)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.target, rw.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && rw.Body.String() != tt.query {
+			t.Errorf("GET %s: passed on query %q, want %q", tt.target, rw.Body.String(), tt.query)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jonathanwei/wile/proxy"
+)
+
+func parseCheckAddrs(spec string) []net.IP {
+	if spec == "" {
+		addrs, err := localAddrs()
+		if err != nil {
+			log.Fatalf("Failed to get the IPs of this host: %v", err)
+		}
+		return addrs
+	}
+
+	var addrs []net.IP
+	for _, a := range strings.Split(spec, ",") {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			log.Fatalf("Invalid -check_addrs IP %q", a)
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// normalizeHost normalizes a host given in flagName with proxy.NormalizeHost,
+// so that it matches the normalized hosts of requests and handshakes.
+func normalizeHost(flagName, host string) string {
+	n, err := proxy.NormalizeHost(host)
+	if err != nil {
+		log.Fatalf("Invalid -%s host %q, %v", flagName, host, err)
+	}
+	return n
+}
+
+// parseSplitAffinity returns the name of the affinity cookie, or "" to use the
+// client IP.
+func parseSplitAffinity(spec string) string {
+	if spec == "ip" {
+		return ""
+	}
+	if strings.HasPrefix(spec, "cookie:") && len(spec) > len("cookie:") {
+		return strings.TrimPrefix(spec, "cookie:")
+	}
+	log.Fatalf("Invalid -split_affinity %q", spec)
+	return ""
+}
+
+func parseOnDemandSpec(spec, backend string, backends map[string][]*url.URL) *regexp.Regexp {
+	if spec == "" {
+		return nil
+	}
+
+	// Require the whole host to match, otherwise "example\.com" would also
+	// allow "example.com.attacker.net".
+	re, err := regexp.Compile("^(?:" + spec + ")$")
+	if err != nil {
+		log.Fatalf("Invalid -on_demand_hosts %q, %v", spec, err)
+	}
+
+	if _, ok := backends[backend]; !ok {
+		log.Fatalf("Invalid -on_demand_backend %q, unknown backend", backend)
+	}
+
+	return re
+}
+
+func parseBackendSpecs(specs string) map[string][]*url.URL {
+	backends := make(map[string][]*url.URL)
+	for _, spec := range splitList(specs) {
+		fatal := func(msg string) {
+			log.Fatalf("Invalid backend spec %q, %s", spec, msg)
+		}
+
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			fatal("missing ':'")
+		}
+
+		name := spec[:idx]
+		ustr := spec[idx+1:]
+
+		if len(name) == 0 {
+			fatal("empty name not allowed")
+		}
+
+		if len(ustr) == 0 {
+			fatal("empty url not allowed")
+		}
+
+		if _, ok := backends[name]; ok {
+			fatal("duplicate backend name")
+		}
+
+		for _, us := range strings.Split(ustr, "|") {
+			u, err := url.Parse(us)
+			if err != nil {
+				fatal(fmt.Sprintf("couldn't parse url: %v", err))
+			}
+			backends[name] = append(backends[name], u)
+		}
+
+		for _, u := range backends[name] {
+			switch {
+			case !isServiceURL(u):
+			case len(backends[name]) > 1:
+				fatal("service urls can't be combined with other instances")
+			case u.Scheme == "consul" && u.Host == "":
+				fatal("missing consul service")
+			case u.Scheme == "etcd" && (u.Host != "" || u.Path == ""):
+				fatal("etcd url must be etcd:///<prefix>")
+			case u.Scheme == "dns+http" && u.Port() == "":
+				fatal("missing port")
+			}
+		}
+	}
+
+	return backends
+}
+
+// weightedBackend is one of the backends of a host whose traffic is split
+// between several.
+type weightedBackend struct {
+	name   string
+	weight int
+}
+
+func parseHostSpecs(specs string, backends map[string][]*url.URL) map[string][]weightedBackend {
+	hosts := make(map[string][]weightedBackend)
+	for _, spec := range splitList(specs) {
+		fatal := func(msg string) {
+			log.Fatalf("Invalid host spec %q, %s", spec, msg)
+		}
+
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			fatal("missing ':'")
+		}
+
+		host := spec[:idx]
+		split := spec[idx+1:]
+
+		if len(host) == 0 {
+			fatal("empty host not allowed")
+		}
+		host = normalizeHost("hosts", host)
+
+		if _, ok := hosts[host]; ok {
+			fatal("duplicate host not allowed")
+		}
+
+		var wbs []weightedBackend
+		for _, wb := range strings.Split(split, "|") {
+			backend, weight := wb, 1
+			if idx := strings.Index(wb, "="); idx != -1 {
+				backend = wb[:idx]
+
+				var err error
+				weight, err = strconv.Atoi(wb[idx+1:])
+				if err != nil || weight <= 0 {
+					fatal("weight must be a positive integer")
+				}
+			}
+
+			if _, ok := backends[backend]; !ok {
+				fatal("unknown backend")
+			}
+
+			wbs = append(wbs, weightedBackend{backend, weight})
+		}
+
+		hosts[host] = wbs
+	}
+
+	return hosts
+}
+
+func parsePassthroughSpecs(specs string, hosts map[string][]weightedBackend) map[string]string {
+	passthrough := make(map[string]string)
+	if specs == "" {
+		return passthrough
+	}
+
+	for _, spec := range strings.Split(specs, ",") {
+		fatal := func(msg string) {
+			log.Fatalf("Invalid passthrough spec %q, %s", spec, msg)
+		}
+
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			fatal("missing ':'")
+		}
+
+		host := spec[:idx]
+		addr := spec[idx+1:]
+
+		if len(host) == 0 {
+			fatal("empty host not allowed")
+		}
+		host = normalizeHost("passthrough_hosts", host)
+
+		if _, ok := passthrough[host]; ok {
+			fatal("duplicate host not allowed")
+		}
+
+		if _, ok := hosts[host]; ok {
+			fatal("host is also in -hosts")
+		}
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fatal(fmt.Sprintf("invalid address: %v", err))
+		}
+
+		passthrough[host] = addr
+	}
+
+	return passthrough
+}
+
+func parseCredentialSpecs(basicAuth, bearerTokens string, hosts map[string][]weightedBackend) map[string]*credentialGate {
+	gates := make(map[string]*credentialGate)
+
+	parse := func(flagName, specs string, load func(g *credentialGate, file string) error) {
+		for _, spec := range splitList(specs) {
+			idx := strings.Index(spec, ":")
+			if idx == -1 {
+				log.Fatalf("Invalid -%s spec %q, missing ':'", flagName, spec)
+			}
+			host, file := normalizeHost(flagName, spec[:idx]), spec[idx+1:]
+
+			if _, ok := hosts[host]; !ok {
+				log.Fatalf("Invalid -%s spec %q, unknown host", flagName, spec)
+			}
+
+			g, ok := gates[host]
+			if !ok {
+				g = &credentialGate{realm: host}
+				gates[host] = g
+			}
+
+			err := load(g, file)
+			if err != nil {
+				log.Fatalf("Invalid -%s spec %q, %v", flagName, spec, err)
+			}
+		}
+	}
+
+	parse("basic_auth", basicAuth, func(g *credentialGate, file string) error {
+		var err error
+		g.users, err = loadHtpasswd(file)
+		return err
+	})
+	parse("bearer_tokens", bearerTokens, func(g *credentialGate, file string) error {
+		var err error
+		g.tokens, err = loadTokens(file)
+		return err
+	})
+
+	return gates
+}
+
+func parseTransportSpecs(specs string, backends map[string][]*url.URL) map[string]http.RoundTripper {
+	transports := make(map[string]http.RoundTripper)
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			log.Fatalf("Invalid transport spec %q, missing ':'", spec)
+		}
+		name := spec[:idx]
+
+		if _, ok := backends[name]; !ok {
+			log.Fatalf("Invalid transport spec %q, unknown backend", spec)
+		}
+		if _, ok := transports[name]; ok {
+			log.Fatalf("Invalid transport spec %q, duplicate backend not allowed", spec)
+		}
+
+		t, err := newTransport(spec[idx+1:])
+		if err != nil {
+			log.Fatalf("Invalid transport spec %q, %v", spec, err)
+		}
+		transports[name] = t
+	}
+	return transports
+}
+
+func parseListenerSpecs(specs string, idleTimeout time.Duration) map[string]*listenerTuning {
+	tuning := make(map[string]*listenerTuning)
+	for _, spec := range splitList(specs) {
+		// Addresses contain colons, but settings don't.
+		idx := strings.LastIndex(spec[:strings.Index(spec+"=", "=")], ":")
+		if idx == -1 {
+			log.Fatalf("Invalid listener spec %q, missing ':'", spec)
+		}
+		addr := spec[:idx]
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Fatalf("Invalid listener spec %q, %v", spec, err)
+		}
+		if _, ok := tuning[addr]; ok {
+			log.Fatalf("Invalid listener spec %q, duplicate address not allowed", spec)
+		}
+
+		t, err := newListenerTuning(spec[idx+1:], idleTimeout)
+		if err != nil {
+			log.Fatalf("Invalid listener spec %q, %v", spec, err)
+		}
+		tuning[addr] = t
+	}
+	return tuning
+}
+
+func parseRewriteSpecs(specs string, hosts map[string][]weightedBackend) map[string]*rewriter {
+	rewriters := make(map[string]*rewriter)
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			log.Fatalf("Invalid rewrite spec %q, missing ':'", spec)
+		}
+		host := normalizeHost("rewrites", spec[:idx])
+
+		if _, ok := hosts[host]; !ok {
+			log.Fatalf("Invalid rewrite spec %q, unknown host", spec)
+		}
+		if _, ok := rewriters[host]; ok {
+			log.Fatalf("Invalid rewrite spec %q, duplicate host not allowed", spec)
+		}
+
+		rw, err := newRewriter(spec[idx+1:])
+		if err != nil {
+			log.Fatalf("Invalid rewrite spec %q, %v", spec, err)
+		}
+		rewriters[host] = rw
+	}
+	return rewriters
+}
+
+func parseCORSSpecs(specs string, hosts map[string][]weightedBackend) map[string]*corsPolicy {
+	policies := make(map[string]*corsPolicy)
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			log.Fatalf("Invalid CORS spec %q, missing ':'", spec)
+		}
+		host := normalizeHost("cors", spec[:idx])
+
+		if _, ok := hosts[host]; !ok {
+			log.Fatalf("Invalid CORS spec %q, unknown host", spec)
+		}
+		if _, ok := policies[host]; ok {
+			log.Fatalf("Invalid CORS spec %q, duplicate host not allowed", spec)
+		}
+
+		p, err := newCORSPolicy(spec[idx+1:])
+		if err != nil {
+			log.Fatalf("Invalid CORS spec %q, %v", spec, err)
+		}
+		policies[host] = p
+	}
+	return policies
+}
+
+func parseBandwidthSpecs(specs string, hosts map[string][]weightedBackend) map[string]int64 {
+	rates := make(map[string]int64)
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			log.Fatalf("Invalid bandwidth spec %q, missing ':'", spec)
+		}
+		host := normalizeHost("host_bandwidth", spec[:idx])
+
+		if _, ok := hosts[host]; !ok {
+			log.Fatalf("Invalid bandwidth spec %q, unknown host", spec)
+		}
+		if _, ok := rates[host]; ok {
+			log.Fatalf("Invalid bandwidth spec %q, duplicate host not allowed", spec)
+		}
+
+		rate, err := strconv.ParseInt(spec[idx+1:], 10, 64)
+		if err != nil || rate <= 0 {
+			log.Fatalf("Invalid bandwidth spec %q, rate must be a positive integer", spec)
+		}
+		rates[host] = rate
+	}
+	return rates
+}
+
+// parseMirrorSpecs returns the shadow backend of each host, with the
+// percentage of requests to copy as its weight.
+func parseMirrorSpecs(specs string, hosts map[string][]weightedBackend, backends map[string][]*url.URL) map[string]weightedBackend {
+	mirrors := make(map[string]weightedBackend)
+	for _, spec := range splitList(specs) {
+		fatal := func(msg string) {
+			log.Fatalf("Invalid mirror spec %q, %s", spec, msg)
+		}
+
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			fatal("missing ':'")
+		}
+		host := normalizeHost("mirror", spec[:idx])
+		if _, ok := hosts[host]; !ok {
+			fatal("unknown host")
+		}
+		if _, ok := mirrors[host]; ok {
+			fatal("duplicate host not allowed")
+		}
+
+		shadow := spec[idx+1:]
+		idx = strings.Index(shadow, "=")
+		if idx == -1 {
+			fatal("missing '='")
+		}
+		backend := shadow[:idx]
+		if _, ok := backends[backend]; !ok {
+			fatal("unknown backend")
+		}
+		percent, err := strconv.Atoi(shadow[idx+1:])
+		if err != nil || percent <= 0 || percent > 100 {
+			fatal("percent must be an integer from 1 to 100")
+		}
+
+		mirrors[host] = weightedBackend{backend, percent}
+	}
+	return mirrors
+}
+
+// parseGeoRouteSpecs returns the backend of each country, by host.
+func parseGeoRouteSpecs(specs string, hosts map[string][]weightedBackend, backends map[string][]*url.URL) map[string]map[string]string {
+	routes := make(map[string]map[string]string)
+	for _, spec := range splitList(specs) {
+		fatal := func(msg string) {
+			log.Fatalf("Invalid GeoIP route spec %q, %s", spec, msg)
+		}
+
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			fatal("missing ':'")
+		}
+		host := normalizeHost("geoip_routes", spec[:idx])
+		if _, ok := hosts[host]; !ok {
+			fatal("unknown host")
+		}
+		if _, ok := routes[host]; ok {
+			fatal("duplicate host not allowed")
+		}
+
+		countries := make(map[string]string)
+		for _, route := range strings.Split(spec[idx+1:], "|") {
+			idx := strings.Index(route, "=")
+			if idx != 2 {
+				fatal("routes must be <country>=<backend>")
+			}
+			country, backend := strings.ToUpper(route[:idx]), route[idx+1:]
+			if _, ok := backends[backend]; !ok {
+				fatal("unknown backend")
+			}
+			countries[country] = backend
+		}
+		routes[host] = countries
+	}
+	return routes
+}
+
+func parseFilterSpecs(specs string, hosts map[string][]weightedBackend, handlers map[string]http.Handler) map[string]*requestFilter {
+	filters := make(map[string]*requestFilter)
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, ":")
+		if idx == -1 {
+			log.Fatalf("Invalid request filter spec %q, missing ':'", spec)
+		}
+		host := normalizeHost("request_filters", spec[:idx])
+
+		if _, ok := hosts[host]; !ok {
+			log.Fatalf("Invalid request filter spec %q, unknown host", spec)
+		}
+		if _, ok := filters[host]; ok {
+			log.Fatalf("Invalid request filter spec %q, duplicate host not allowed", spec)
+		}
+
+		f, err := newRequestFilter(host, spec[idx+1:], handlers)
+		if err != nil {
+			log.Fatalf("Invalid request filter spec %q, %v", spec, err)
+		}
+		filters[host] = f
+	}
+	return filters
+}
+
+func parseWellKnownSpecs(specs string, handlers map[string]http.Handler) *wellKnown {
+	w := newWellKnown()
+	for _, spec := range splitList(specs) {
+		idx := strings.Index(spec, "=")
+		if idx == -1 {
+			log.Fatalf("Invalid well-known spec %q, missing '='", spec)
+		}
+		if err := w.add(spec[:idx], spec[idx+1:], handlers); err != nil {
+			log.Fatalf("Invalid well-known spec %q, %v", spec, err)
+		}
+	}
+	return w
+}
+
+func parseSignedURLSpecs(specs string, hosts map[string][]weightedBackend) map[string]*signedURLs {
+	signed := make(map[string]*signedURLs)
+	for _, spec := range splitList(specs) {
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			log.Fatalf("Invalid signed URL spec %q, must be <host>:<key file>:<prefix>|<prefix>|...", spec)
+		}
+		host := normalizeHost("signed_urls", parts[0])
+
+		if _, ok := hosts[host]; !ok {
+			log.Fatalf("Invalid signed URL spec %q, unknown host", spec)
+		}
+		if _, ok := signed[host]; ok {
+			log.Fatalf("Invalid signed URL spec %q, duplicate host not allowed", spec)
+		}
+
+		keys, err := loadTokens(parts[1])
+		if err != nil {
+			log.Fatalf("Invalid signed URL spec %q, %v", spec, err)
+		}
+		if len(keys) == 0 {
+			log.Fatalf("Invalid signed URL spec %q, no keys in %q", spec, parts[1])
+		}
+
+		prefixes := strings.Split(parts[2], "|")
+		for _, p := range prefixes {
+			if !strings.HasPrefix(p, "/") {
+				log.Fatalf("Invalid signed URL spec %q, prefix %q must start with '/'", spec, p)
+			}
+		}
+		signed[host] = &signedURLs{keys, prefixes}
+	}
+	return signed
+}
+
+func parseStaticCertSpecs(specs string) map[string][2]string {
+	files := make(map[string][2]string)
+	if specs == "" {
+		return files
+	}
+
+	for _, spec := range strings.Split(specs, ",") {
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			log.Fatalf("Invalid static cert spec %q, must be <host>:<cert file>:<key file>", spec)
+		}
+
+		host := normalizeHost("static_certs", parts[0])
+		if _, ok := files[host]; ok {
+			log.Fatalf("Invalid static cert spec %q, duplicate host not allowed", spec)
+		}
+		files[host] = [2]string{parts[1], parts[2]}
+	}
+
+	return files
+}
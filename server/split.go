@@ -0,0 +1,61 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+)
+
+// splitHandler splits the traffic of a host between several backends by
+// weight. Clients are assigned a backend by hashing their IP or affinity
+// cookie, so that they keep seeing the same one.
+type splitHandler struct {
+	handlers []http.Handler
+	// cumulative[i] is the sum of the weights of backends 0 to i.
+	cumulative     []uint32
+	affinityCookie string
+}
+
+func newSplitHandler(backends map[string]http.Handler, wbs []weightedBackend, affinityCookie string) *splitHandler {
+	s := &splitHandler{affinityCookie: affinityCookie}
+
+	var total uint32
+	for _, wb := range wbs {
+		total += uint32(wb.weight)
+		s.handlers = append(s.handlers, backends[wb.name])
+		s.cumulative = append(s.cumulative, total)
+	}
+	return s
+}
+
+func (s *splitHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	n := s.affinity(req) % s.cumulative[len(s.cumulative)-1]
+	for i, c := range s.cumulative {
+		if n < c {
+			s.handlers[i].ServeHTTP(rw, req)
+			return
+		}
+	}
+}
+
+func (s *splitHandler) affinity(req *http.Request) uint32 {
+	key := ""
+	if s.affinityCookie != "" {
+		if c, err := req.Cookie(s.affinityCookie); err == nil {
+			key = c.Value
+		}
+	}
+	if key == "" {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return rand.Uint32()
+		}
+		key = ip
+	}
+
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return h.Sum32()
+}
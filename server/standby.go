@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var errStandby = errors.New("standby replicas don't contact the ACME server")
+
+// standbyTransport fails every request. It is the transport of the ACME
+// clients of standby replicas, so that neither a cache miss nor one of
+// autocert's renewal timers reaches the CA.
+type standbyTransport struct{}
+
+func (standbyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.Wrapf(errStandby, "refusing %s %s", req.Method, req.URL)
+}
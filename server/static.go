@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// staticCertSource serves certs from files for some hosts, and gets the certs
+// of all other hosts from next. The files are checked for changes every
+// pollInterval, so that rotated certs are picked up without a restart, at
+// most pollInterval after they are written.
+type staticCertSource struct {
+	next certSource
+
+	mu    sync.RWMutex
+	certs map[string]*staticCert
+}
+
+type staticCert struct {
+	certFile, keyFile string
+
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+const pollInterval = 30 * time.Second
+
+// newStaticCertSource creates a staticCertSource. files maps hosts to their
+// cert and key files.
+func newStaticCertSource(files map[string][2]string, next certSource) (*staticCertSource, error) {
+	s := &staticCertSource{
+		next:  next,
+		certs: make(map[string]*staticCert),
+	}
+
+	for host, f := range files {
+		sc := &staticCert{certFile: f[0], keyFile: f[1]}
+		_, err := sc.load()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load cert of %q", host)
+		}
+		s.certs[host] = sc
+	}
+
+	go s.pollLoop()
+	return s, nil
+}
+
+func (s *staticCertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	sc, ok := s.certs[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]
+	var cert *tls.Certificate
+	if ok {
+		cert = sc.cert
+	}
+	s.mu.RUnlock()
+
+	if ok {
+		return cert, nil
+	}
+	return s.next.GetCertificate(hello)
+}
+
+func (s *staticCertSource) HTTPHandler(fallback http.Handler) http.Handler {
+	return s.next.HTTPHandler(fallback)
+}
+
+func (s *staticCertSource) pollLoop() {
+	for range time.Tick(pollInterval) {
+		s.mu.RLock()
+		var hosts []string
+		for h := range s.certs {
+			hosts = append(hosts, h)
+		}
+		s.mu.RUnlock()
+
+		for _, h := range hosts {
+			s.mu.RLock()
+			sc := *s.certs[h]
+			s.mu.RUnlock()
+
+			changed, err := sc.load()
+			if err != nil {
+				glog.Errorf("Failed to reload cert of %q, keeping the old one: %v", h, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			s.mu.Lock()
+			s.certs[h] = &sc
+			s.mu.Unlock()
+			glog.Infof("Reloaded cert of %q, expires %v", h, sc.cert.Leaf.NotAfter)
+		}
+	}
+}
+
+// load reads the cert if either file changed since it was last read, and
+// reports whether it did.
+func (sc *staticCert) load() (bool, error) {
+	certInfo, err := os.Stat(sc.certFile)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat cert")
+	}
+	keyInfo, err := os.Stat(sc.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat key")
+	}
+
+	if sc.cert != nil && certInfo.ModTime().Equal(sc.certMod) && keyInfo.ModTime().Equal(sc.keyMod) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(sc.certFile, sc.keyFile)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load cert")
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, errors.Wrap(err, "failed to parse cert")
+	}
+
+	sc.cert = &cert
+	sc.certMod, sc.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return true, nil
+}
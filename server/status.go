@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type certStatus struct {
+	Domain        string     `json:"domain"`
+	KeyType       string     `json:"key_type,omitempty"`
+	Serial        string     `json:"serial,omitempty"`
+	Issuer        string     `json:"issuer,omitempty"`
+	NotBefore     *time.Time `json:"not_before,omitempty"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	DaysRemaining int        `json:"days_remaining"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// status reports the cached certs of every domain. autocert stores ECDSA
+// certs under the domain and RSA certs under "<domain>+rsa".
+func (c *certManager) status(ctx context.Context, domains []string) ([]certStatus, error) {
+	domains = append([]string(nil), domains...)
+	sort.Strings(domains)
+
+	var statuses []certStatus
+	for _, d := range domains {
+		var found []certStatus
+		for _, kt := range []string{"ecdsa", "rsa"} {
+			key := d
+			if kt == "rsa" {
+				key += "+rsa"
+			}
+
+			leaf, err := cachedLeaf(ctx, c.cache(), key)
+			if err == autocert.ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read cert for %q", key)
+			}
+
+			notBefore, notAfter := leaf.NotBefore, leaf.NotAfter
+			found = append(found, certStatus{
+				Domain:        d,
+				KeyType:       kt,
+				Serial:        fmt.Sprintf("%x", leaf.SerialNumber),
+				Issuer:        leaf.Issuer.CommonName,
+				NotBefore:     &notBefore,
+				NotAfter:      &notAfter,
+				DaysRemaining: int(math.Floor(time.Until(notAfter).Hours() / 24)),
+			})
+		}
+
+		if len(found) == 0 {
+			found = append(found, certStatus{Domain: d})
+		}
+
+		if ce, ok := c.lastError(d); ok {
+			for i := range found {
+				t := ce.time
+				found[i].LastError = ce.err.Error()
+				found[i].LastErrorTime = &t
+			}
+		}
+
+		statuses = append(statuses, found...)
+	}
+	return statuses, nil
+}
+
+func cachedLeaf(ctx context.Context, cache autocert.Cache, key string) (*x509.Certificate, error) {
+	data, err := cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeaf(data)
+}
+
+// parseLeaf parses the leaf cert out of an autocert cache entry, which holds
+// the private key followed by the cert chain, all PEM encoded.
+func parseLeaf(data []byte) (*x509.Certificate, error) {
+	for {
+		var b *pem.Block
+		b, data = pem.Decode(data)
+		if b == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if b.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(b.Bytes)
+		}
+	}
+}
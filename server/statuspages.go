@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile/proxy"
+	"github.com/pkg/errors"
+)
+
+const defaultMaintenancePage = "<!DOCTYPE html>\n<title>Down for maintenance</title>\n<h1>Down for maintenance</h1>\n<p>Please try again later.</p>\n"
+
+// statusPages serves the pages of hosts in maintenance mode and of failed
+// backends.
+type statusPages struct {
+	maintenancePage []byte
+	retryAfter      time.Duration
+	// errorPages maps status codes to custom pages. Without one, the status
+	// is sent without a body.
+	errorPages map[int][]byte
+
+	mu          sync.RWMutex
+	maintenance map[string]bool
+}
+
+// newStatusPages creates a statusPages. If set, maintenancePage is the file
+// with the maintenance page, and errorPagesDir the directory holding 502.html
+// and 504.html.
+func newStatusPages(maintenancePage, errorPagesDir string, retryAfter time.Duration) (*statusPages, error) {
+	p := &statusPages{
+		maintenancePage: []byte(defaultMaintenancePage),
+		retryAfter:      retryAfter,
+		errorPages:      make(map[int][]byte),
+		maintenance:     make(map[string]bool),
+	}
+
+	if maintenancePage != "" {
+		page, err := ioutil.ReadFile(maintenancePage)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read maintenance page")
+		}
+		p.maintenancePage = page
+	}
+
+	if errorPagesDir != "" {
+		for _, code := range []int{http.StatusBadGateway, http.StatusGatewayTimeout} {
+			page, err := ioutil.ReadFile(filepath.Join(errorPagesDir, fmt.Sprintf("%d.html", code)))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %d page", code)
+			}
+			p.errorPages[code] = page
+		}
+	}
+
+	return p, nil
+}
+
+func (p *statusPages) setMaintenance(host string, on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if on {
+		p.maintenance[host] = true
+	} else {
+		delete(p.maintenance, host)
+	}
+}
+
+func (p *statusPages) maintenanceHosts() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var hosts []string
+	for h := range p.maintenance {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// wrap serves the maintenance page for hosts in maintenance mode, and passes
+// all other requests to h.
+func (p *statusPages) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host, err := proxy.NormalizeHost(req.Host)
+		if err != nil {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		p.mu.RLock()
+		on := p.maintenance[proxy.StripPort(host)]
+		p.mu.RUnlock()
+
+		if !on {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		rw.Header().Set("Retry-After", fmt.Sprint(int(p.retryAfter.Seconds())))
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write(p.maintenancePage)
+	})
+}
+
+// reverseProxy creates a reverse proxy to u that serves the custom error
+// pages when u fails. If transport is nil, http.DefaultTransport is used.
+func (p *statusPages) reverseProxy(u *url.URL, transport http.RoundTripper) *proxy.Proxy {
+	return proxy.New(u, proxy.WithTransport(transport), proxy.WithErrorHandler(func(rw http.ResponseWriter, req *http.Request, err error) {
+		glog.Warningf("Backend %s failed for %s%s: %v", u, req.Host, req.URL.Path, err)
+		p.writeError(rw, proxy.ErrorStatus(err))
+	}))
+}
+
+func (p *statusPages) writeError(rw http.ResponseWriter, code int) {
+	page, ok := p.errorPages[code]
+	if !ok {
+		rw.WriteHeader(code)
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(code)
+	rw.Write(page)
+}
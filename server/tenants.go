@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/jonathanwei/wile"
+	"github.com/jonathanwei/wile/proxy"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	tenantRequests    = expvar.NewMap("tenant_requests")
+	tenantRateLimited = expvar.NewMap("tenant_rate_limited")
+)
+
+const (
+	// quotaReservationTTL is how long, in seconds, a host holds a slot of
+	// its tenant's MaxCerts while its cert is obtained. addCert keeps it.
+	quotaReservationTTL = 10 * 60
+	maxQuotaAttempts    = 5
+)
+
+var validTenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// tenant is a user of a shared deployment. Its API keys only give access to
+// the hosts matching Domains on the admin server.
+type tenant struct {
+	Name string `json:"name"`
+	// Domains are host patterns, see wile.HostPatterns. The patterns of
+	// different tenants must not overlap, see patternsOverlap.
+	Domains []string `json:"domains"`
+	APIKeys []string `json:"api_keys"`
+	// MaxCerts, if not 0, is the most hosts certs are obtained for.
+	MaxCerts int `json:"max_certs"`
+	// RequestRate, if not 0, is the most requests per second to all hosts of
+	// the tenant, see requestLimiter.
+	RequestRate float64 `json:"request_rate"`
+
+	patterns *wile.HostPatterns
+	limiter  *requestLimiter
+}
+
+// tenants are the tenants of a deployment. The hosts each tenant has certs
+// for are kept in etcd under etcdPrefix, for the MaxCerts quotas. A nil
+// *tenants has no tenants and doesn't restrict anything.
+type tenants struct {
+	list       []*tenant
+	etcd       *clientv3.Client
+	etcdPrefix string
+	// certs is the cache of the certs, by their plain keys. Hosts whose
+	// certs were deleted from it no longer count towards MaxCerts.
+	certs autocert.Cache
+}
+
+// loadTenants reads a JSON array of tenants from file.
+func loadTenants(file string) (*tenants, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tenants")
+	}
+	var list []*tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, errors.Wrap(err, "invalid tenants")
+	}
+
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i, t := range list {
+		if !validTenantName.MatchString(t.Name) {
+			return nil, errors.Errorf("invalid tenant name %q", t.Name)
+		}
+		if names[t.Name] {
+			return nil, errors.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+
+		for _, k := range t.APIKeys {
+			if k == "" || keys[k] {
+				return nil, errors.Errorf("tenant %q has an empty or duplicate API key", t.Name)
+			}
+			keys[k] = true
+		}
+		if t.MaxCerts < 0 || t.RequestRate < 0 {
+			return nil, errors.Errorf("tenant %q has a negative quota", t.Name)
+		}
+
+		if t.patterns, err = wile.NewHostPatterns(t.Domains...); err != nil {
+			return nil, errors.Wrapf(err, "invalid domains of tenant %q", t.Name)
+		}
+		for _, u := range list[:i] {
+			for _, a := range t.Domains {
+				for _, b := range u.Domains {
+					if patternsOverlap(a, b) {
+						return nil, errors.Errorf("domain %q of tenant %q overlaps %q of tenant %q", a, t.Name, b, u.Name)
+					}
+				}
+			}
+		}
+		if t.RequestRate > 0 {
+			t.limiter = newRequestLimiter(t.RequestRate)
+		}
+	}
+	return &tenants{list: list, etcdPrefix: "/wile/tenants"}, nil
+}
+
+// patternsOverlap reports whether host patterns a and b can match the same
+// host. Regexps are only compared with exact hosts, since they can't be
+// compared with wildcards or each other in general; hosts matching the
+// regexps of several tenants belong to the first one.
+func patternsOverlap(a, b string) bool {
+	isExact := func(p string) bool {
+		return !strings.HasPrefix(p, "*.") && !(len(p) >= 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/"))
+	}
+	if isExact(b) {
+		a, b = b, a
+	}
+	if isExact(a) {
+		p, err := wile.NewHostPatterns(b)
+		return err == nil && p.Match(a)
+	}
+	if strings.HasPrefix(a, "*.") && strings.HasPrefix(b, "*.") {
+		return strings.HasSuffix(a[1:], b[1:]) || strings.HasSuffix(b[1:], a[1:])
+	}
+	return false
+}
+
+func (ts *tenants) forHost(host string) *tenant {
+	if ts == nil {
+		return nil
+	}
+	for _, t := range ts.list {
+		if t.patterns.Match(host) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (ts *tenants) forKey(key string) *tenant {
+	if ts == nil || key == "" {
+		return nil
+	}
+	for _, t := range ts.list {
+		for _, k := range t.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// hostPolicy extends policy to reject hosts of tenants that have reached
+// their MaxCerts, unless the host already has a cert. Otherwise it reserves a
+// slot for the host, so that concurrent requests for different hosts can't
+// exceed the quota together.
+func (ts *tenants) hostPolicy(policy autocert.HostPolicy) autocert.HostPolicy {
+	if ts == nil {
+		return policy
+	}
+	return func(ctx context.Context, host string) error {
+		if err := policy(ctx, host); err != nil {
+			return err
+		}
+		t := ts.forHost(host)
+		if t == nil || t.MaxCerts == 0 {
+			return nil
+		}
+
+		key := ts.etcdKey(t, host)
+		prefix := ts.etcdKey(t, "") + "/"
+		for attempt := 0; attempt < maxQuotaAttempts; attempt++ {
+			gr, err := ts.etcd.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+			if err != nil {
+				return errors.Wrapf(err, "failed to read certs of tenant %q", t.Name)
+			}
+			for _, kv := range gr.Kvs {
+				if string(kv.Key) == key {
+					return nil
+				}
+			}
+			if gr.Count >= int64(t.MaxCerts) {
+				released, err := ts.releaseDeleted(ctx, gr.Kvs)
+				if err != nil {
+					return errors.Wrapf(err, "failed to release deleted certs of tenant %q", t.Name)
+				}
+				if released {
+					continue
+				}
+				return errors.Errorf("tenant %q has reached its quota of %d certs", t.Name, t.MaxCerts)
+			}
+
+			ok, err := ts.reserve(ctx, key, prefix, gr.Header.Revision)
+			if err != nil {
+				return errors.Wrapf(err, "failed to reserve cert of tenant %q", t.Name)
+			}
+			if ok {
+				return nil
+			}
+		}
+		return errors.Errorf("too many concurrent cert requests for tenant %q", t.Name)
+	}
+}
+
+// reserve records key, the host of a tenant, for quotaReservationTTL, unless
+// any host under prefix was added since revision rev. It reports whether it
+// did.
+func (ts *tenants) reserve(ctx context.Context, key, prefix string, rev int64) (bool, error) {
+	lease, err := ts.etcd.Grant(ctx, quotaReservationTTL)
+	if err != nil {
+		return false, err
+	}
+	tr, err := ts.etcd.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision(prefix), "<", rev+1).WithPrefix(),
+	).Then(
+		clientv3.OpPut(key, "", clientv3.WithLease(lease.ID)),
+	).Commit()
+	if err != nil || !tr.Succeeded {
+		ts.etcd.Revoke(ctx, lease.ID)
+		return false, err
+	}
+	return true, nil
+}
+
+// addCert records that the tenant of host, if any, has a cert for it. This
+// makes the reservation of hostPolicy permanent.
+func (ts *tenants) addCert(ctx context.Context, host string) error {
+	t := ts.forHost(host)
+	if t == nil {
+		return nil
+	}
+	_, err := ts.etcd.Put(ctx, ts.etcdKey(t, host), "")
+	return errors.Wrapf(err, "failed to record cert of tenant %q", t.Name)
+}
+
+// removeCert records that the tenant of host, if any, no longer has a cert
+// for it, releasing its slot of MaxCerts.
+func (ts *tenants) removeCert(ctx context.Context, host string) error {
+	t := ts.forHost(host)
+	if t == nil {
+		return nil
+	}
+	_, err := ts.etcd.Delete(ctx, ts.etcdKey(t, host))
+	return errors.Wrapf(err, "failed to release cert of tenant %q", t.Name)
+}
+
+// releaseDeleted removes the recorded hosts in kvs whose certs were deleted,
+// e.g. by wilectl, and reports whether it removed any. Reservations of certs
+// still being obtained are kept.
+func (ts *tenants) releaseDeleted(ctx context.Context, kvs []*mvccpb.KeyValue) (bool, error) {
+	if ts.certs == nil {
+		return false, nil
+	}
+	released := false
+	for _, kv := range kvs {
+		if kv.Lease != 0 {
+			continue
+		}
+		host := path.Base(string(kv.Key))
+		deleted, err := certDeleted(ctx, ts.certs, host)
+		if err != nil {
+			return released, err
+		}
+		if !deleted {
+			continue
+		}
+		// Unless the cert was obtained again since.
+		tr, err := ts.etcd.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		).Then(
+			clientv3.OpDelete(string(kv.Key)),
+		).Commit()
+		if err != nil {
+			return released, err
+		}
+		released = released || tr.Succeeded
+	}
+	return released, nil
+}
+
+// certDeleted reports whether certs has no cert of either key type for host.
+func certDeleted(ctx context.Context, certs autocert.Cache, host string) (bool, error) {
+	for _, key := range []string{host, host + "+rsa"} {
+		_, err := certs.Get(ctx, key)
+		if err == nil {
+			return false, nil
+		}
+		if err != autocert.ErrCacheMiss {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (ts *tenants) etcdKey(t *tenant, host string) string {
+	return path.Join(ts.etcdPrefix, t.Name, host)
+}
+
+// wrap counts the requests of each tenant, and rejects those beyond its
+// RequestRate.
+func (ts *tenants) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Hosts are matched the way the router matches them.
+		host, err := proxy.NormalizeHost(req.Host)
+		if err != nil {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		t := ts.forHost(proxy.StripPort(host))
+		if t == nil {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		tenantRequests.Add(t.Name, 1)
+		if t.limiter != nil && !t.limiter.allow() {
+			tenantRateLimited.Add(t.Name, 1)
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// requestLimiter is a token bucket of requests, refilled at rate requests per
+// second and holding at most a second's worth, or one request.
+type requestLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRequestLimiter(rate float64) *requestLimiter {
+	burst := math.Max(rate, 1)
+	return &requestLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (l *requestLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+type tenantContextKey struct{}
+
+// tenantAuth requires requests to h to carry the API key of a tenant as a
+// bearer token, and passes the tenant on in their context. Without tenants,
+// requests are passed on as they are.
+func (ts *tenants) tenantAuth(h http.HandlerFunc) http.HandlerFunc {
+	if ts == nil {
+		return h
+	}
+	return func(rw http.ResponseWriter, req *http.Request) {
+		t := ts.forKey(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if t == nil {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(rw, req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, t)))
+	}
+}
+
+// allows reports whether the tenant of req, if any, may access host.
+func (ts *tenants) allows(req *http.Request, host string) bool {
+	t, ok := req.Context().Value(tenantContextKey{}).(*tenant)
+	return !ok || ts.forHost(host) == t
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jonathanwei/wile"
+)
+
+// testTenants loads tenants from the JSON in data.
+func testTenants(t *testing.T, data string) (*tenants, error) {
+	f, err := ioutil.TempFile("", "tenants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return loadTenants(f.Name())
+}
+
+const testTenantsJSON = `[
+	{"name": "acme", "domains": ["acme.com", "*.acme.com"], "api_keys": ["acme-key"]},
+	{"name": "shop", "domains": ["*.shop.example.org", "/^shop-[0-9]+\\.example\\.org$/"], "api_keys": ["shop-key"], "request_rate": 1},
+	{"name": "other", "domains": ["other.net"], "api_keys": ["other-key", "other-key-2"]}
+]`
+
+func TestTenantOwnership(t *testing.T) {
+	ts, err := testTenants(t, testTenantsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		// owner is the name of the tenant owning host, or "" for none.
+		owner string
+	}{
+		{"acme.com", "acme"},
+		{"www.acme.com", "acme"},
+		{"a.shop.example.org", "shop"},
+		{"shop.example.org", ""},
+		{"shop-1.example.org", "shop"},
+		{"shop-x.example.org", ""},
+		{"shop-1.example.org.evil.test", ""},
+		{"other.net", "other"},
+		{"www.other.net", ""},
+		{"notacme.com", ""},
+		{"acme.com.evil.test", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		owner := ""
+		if o := ts.forHost(tt.host); o != nil {
+			owner = o.Name
+		}
+		if owner != tt.owner {
+			t.Errorf("forHost(%q) = %q, want %q", tt.host, owner, tt.owner)
+		}
+
+		for _, key := range []string{"acme-key", "shop-key", "other-key-2"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, ts.forKey(key)))
+			want := ts.forKey(key).Name == tt.owner
+			if got := ts.allows(req, tt.host); got != want {
+				t.Errorf("allows(%q) for tenant of %q = %v, want %v", tt.host, key, got, want)
+			}
+		}
+
+		// Without a tenant, e.g. with the operator token, everything is
+		// allowed.
+		if !ts.allows(httptest.NewRequest("GET", "/", nil), tt.host) {
+			t.Errorf("allows(%q) without tenant = false", tt.host)
+		}
+	}
+}
+
+func TestTenantAuth(t *testing.T) {
+	ts, err := testTenants(t, testTenantsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ts.tenantAuth(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Context().Value(tenantContextKey{}).(*tenant).Name))
+	})
+
+	tests := []struct {
+		auth string
+		// want is the tenant name written, or "" for a rejected request.
+		want string
+	}{
+		{"Bearer acme-key", "acme"},
+		{"Bearer other-key-2", "other"},
+		{"Bearer wrong-key", ""},
+		{"Bearer acme-key ", ""},
+		{"Bearer ", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rw := httptest.NewRecorder()
+		h(rw, req)
+
+		if tt.want == "" {
+			if rw.Code != http.StatusUnauthorized {
+				t.Errorf("Authorization %q: status %d, want %d", tt.auth, rw.Code, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if got := rw.Body.String(); got != tt.want {
+			t.Errorf("Authorization %q: tenant %q, want %q", tt.auth, got, tt.want)
+		}
+	}
+}
+
+func TestTenantRateLimitHosts(t *testing.T) {
+	ts, err := testTenants(t, testTenantsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ts.wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	// shop allows one request per second; spellings of its hosts share it.
+	for i, host := range []string{"shop-1.example.org", "SHOP-1.Example.org.:443"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if rw.Code != want {
+			t.Errorf("request %d to %q: status %d, want %d", i, host, rw.Code, want)
+		}
+	}
+}
+
+func TestLoadTenantsInvalid(t *testing.T) {
+	tests := []string{
+		`[{"name": "Acme", "domains": ["acme.com"]}]`,
+		`[{"name": "acme", "domains": ["acme.com"]}, {"name": "acme", "domains": ["acme.net"]}]`,
+		`[{"name": "acme", "domains": ["acme.com"], "api_keys": [""]}]`,
+		`[{"name": "acme", "domains": ["acme.com"], "api_keys": ["k"]}, {"name": "b", "domains": ["b.com"], "api_keys": ["k"]}]`,
+		`[{"name": "acme", "domains": ["acme.com"], "max_certs": -1}]`,
+		`[{"name": "acme", "domains": ["*"]}]`,
+		`[{"name": "acme", "domains": ["/[/"]}]`,
+		`[{"name": "acme", "domains": ["*.acme.com"]}, {"name": "shop", "domains": ["*.shop.acme.com"]}]`,
+		`[{"name": "acme", "domains": ["/^.*$/"]}, {"name": "b", "domains": ["b.com"]}]`,
+		`{"name": "acme"}`,
+	}
+	for _, data := range tests {
+		if _, err := testTenants(t, data); err == nil {
+			t.Errorf("loadTenants(%s) succeeded", data)
+		}
+	}
+}
+
+func TestPatternsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"acme.com", "acme.com", true},
+		{"acme.com", "www.acme.com", false},
+		{"www.acme.com", "*.acme.com", true},
+		{"*.acme.com", "acme.com", false},
+		{"*.acme.com", "*.shop.acme.com", true},
+		{"*.shop.acme.com", "*.acme.com", true},
+		{"*.acme.com", "*.notacme.com", false},
+		// Suffixes only overlap at label boundaries.
+		{"*.acme.com", "*.cme.com", false},
+		{"/^shop-[0-9]+\\.acme\\.com$/", "shop-1.acme.com", true},
+		{"shop-x.acme.com", "/^shop-[0-9]+\\.acme\\.com$/", false},
+		// Regexps are only compared with exact hosts.
+		{"/^shop-[0-9]+\\.acme\\.com$/", "*.acme.com", false},
+		{"/acme/", "/acme/", false},
+	}
+	for _, tt := range tests {
+		if got := patternsOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("patternsOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCertDeleted(t *testing.T) {
+	ctx := context.Background()
+	certs := wile.NewMemoryCache()
+	certs.Put(ctx, "ecdsa.acme.com", []byte("cert"))
+	certs.Put(ctx, "rsa.acme.com+rsa", []byte("cert"))
+
+	for host, want := range map[string]bool{
+		"ecdsa.acme.com": false,
+		"rsa.acme.com":   false,
+		"gone.acme.com":  true,
+	} {
+		got, err := certDeleted(ctx, certs, host)
+		if err != nil || got != want {
+			t.Errorf("certDeleted(%q) = %v, %v, want %v", host, got, err, want)
+		}
+	}
+
+	faulty := wile.NewFaultInjectingCache(certs, wile.Faults{GetErrorRate: 1}, 1)
+	if _, err := certDeleted(ctx, faulty, "gone.acme.com"); err == nil {
+		t.Error("certDeleted succeeded while the cache fails")
+	}
+}
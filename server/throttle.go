@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jonathanwei/wile/proxy"
+)
+
+const (
+	// throttleChunk is the most a throttled write sends at once.
+	throttleChunk = 16 << 10
+	// clientLimiterTTL is how long the limiter of a client is kept after its
+	// last response.
+	clientLimiterTTL = time.Minute
+)
+
+// bandwidthLimiter is a token bucket of bytes, refilled at rate bytes per
+// second and holding at most a second's worth.
+type bandwidthLimiter struct {
+	rate int64
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n bytes may be sent, or ctx is done. n must not exceed
+// the rate.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.lastUsed = now
+	// Take the tokens right away, so that concurrent writers queue up behind
+	// each other.
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *bandwidthLimiter) idleSince(t time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastUsed.Before(t)
+}
+
+// throttle limits the bandwidth of responses, per host and per client IP.
+// Connections hijacked for upgrades, such as WebSockets, aren't limited.
+type throttle struct {
+	hosts      map[string]*bandwidthLimiter
+	clientRate int64
+
+	mu        sync.Mutex
+	clients   map[string]*bandwidthLimiter
+	lastSweep time.Time
+}
+
+// newThrottle creates a throttle with the rates in bytes per second of hosts,
+// and of each client if clientRate isn't 0.
+func newThrottle(hostRates map[string]int64, clientRate int64) *throttle {
+	t := &throttle{
+		hosts:      make(map[string]*bandwidthLimiter),
+		clientRate: clientRate,
+		clients:    make(map[string]*bandwidthLimiter),
+		lastSweep:  time.Now(),
+	}
+	for h, r := range hostRates {
+		t.hosts[h] = newBandwidthLimiter(r)
+	}
+	return t
+}
+
+func (t *throttle) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var limiters []*bandwidthLimiter
+		if l, ok := t.hosts[proxy.StripPort(req.Host)]; ok {
+			limiters = append(limiters, l)
+		}
+		if t.clientRate > 0 {
+			limiters = append(limiters, t.client(req.RemoteAddr))
+		}
+		if len(limiters) == 0 {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		h.ServeHTTP(&throttledWriter{ResponseWriter: rw, ctx: req.Context(), limiters: limiters}, req)
+	})
+}
+
+func (t *throttle) client(remoteAddr string) *bandwidthLimiter {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) > clientLimiterTTL {
+		for c, l := range t.clients {
+			if l.idleSince(now.Add(-clientLimiterTTL)) {
+				delete(t.clients, c)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	l, ok := t.clients[ip]
+	if !ok {
+		l = newBandwidthLimiter(t.clientRate)
+		t.clients[ip] = l
+	}
+	return l
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*bandwidthLimiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		for _, l := range w.limiters {
+			if int64(n) > l.rate {
+				n = int(l.rate)
+			}
+		}
+
+		for _, l := range w.limiters {
+			if err := l.wait(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// hijack the connection.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
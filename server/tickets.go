@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// shareTicketKeys makes cfg use the session ticket keys shared through cache,
+// see wile.RotateSessionTicketKeys. http.Server serves a clone of cfg with
+// its own ALPN protocols, so the keys can't be set on cfg, nor on a config
+// returned by GetConfigForClient; instead, tickets are encrypted with a config
+// holding the current keys. Until the keys are first read, that config has
+// the keys of crypto/tls.
+func shareTicketKeys(cache autocert.Cache, cfg *tls.Config, period time.Duration) {
+	var current atomic.Value
+	current.Store(&tls.Config{})
+	keys := func() *tls.Config {
+		return current.Load().(*tls.Config)
+	}
+	cfg.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return keys().EncryptTicket(cs, ss)
+	}
+	cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return keys().DecryptTicket(identity, cs)
+	}
+
+	set := func(k [][32]byte) {
+		c := &tls.Config{}
+		c.SetSessionTicketKeys(k)
+		current.Store(c)
+	}
+	go func() {
+		for {
+			err := wile.RotateSessionTicketKeys(context.Background(), cache, period, set)
+			glog.Errorf("Failed to rotate session ticket keys, retrying: %v", err)
+			time.Sleep(time.Minute)
+		}
+	}()
+}
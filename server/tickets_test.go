@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathanwei/wile"
+)
+
+func TestShareTicketKeys(t *testing.T) {
+	entry := testCertEntry(t, "example.com", time.Now().Add(time.Hour))
+	cert, err := tls.X509KeyPair(entry, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := wile.NewMemoryCache()
+
+	var hooked int32
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		cfg := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				atomic.AddInt32(&hooked, 1)
+				return nil, nil
+			},
+		}
+		shareTicketKeys(cache, cfg, time.Hour)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := &http.Server{
+			TLSConfig: cfg,
+			Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		}
+		go hs.ServeTLS(ln, "", "")
+		defer hs.Close()
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	sessions := tls.NewLRUClientSessionCache(1)
+	get := func(addr string) *tls.ConnectionState {
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "example.com",
+				InsecureSkipVerify: true,
+				ClientSessionCache: sessions,
+			},
+			ForceAttemptHTTP2: true,
+		}
+		defer tr.CloseIdleConnections()
+		res, err := (&http.Client{Transport: tr}).Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS
+	}
+
+	// The servers read the keys in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		get(addrs[0])
+		cs := get(addrs[1])
+		if cs.NegotiatedProtocol != "h2" {
+			t.Fatalf("negotiated %q, want h2", cs.NegotiatedProtocol)
+		}
+		if cs.DidResume {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session from one server wasn't resumed by the other")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&hooked) == 0 {
+		t.Error("existing GetConfigForClient wasn't called")
+	}
+}
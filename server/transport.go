@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newTransport creates a transport with the settings in spec, a
+// '|'-separated list of <setting>=<value>. Settings that aren't given have the
+// values of http.DefaultTransport.
+func newTransport(spec string) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	for _, setting := range strings.Split(spec, "|") {
+		idx := strings.Index(setting, "=")
+		if idx == -1 {
+			return nil, errors.Errorf("setting %q is missing '='", setting)
+		}
+		name, value := setting[:idx], setting[idx+1:]
+
+		var err error
+		switch name {
+		case "max_idle_conns":
+			t.MaxIdleConns, err = strconv.Atoi(value)
+		case "max_idle_conns_per_host":
+			t.MaxIdleConnsPerHost, err = strconv.Atoi(value)
+		case "idle_conn_timeout":
+			t.IdleConnTimeout, err = time.ParseDuration(value)
+		case "disable_keep_alives":
+			t.DisableKeepAlives, err = strconv.ParseBool(value)
+		case "dial_timeout":
+			dialer.Timeout, err = time.ParseDuration(value)
+		case "tls_handshake_timeout":
+			t.TLSHandshakeTimeout, err = time.ParseDuration(value)
+		case "response_header_timeout":
+			t.ResponseHeaderTimeout, err = time.ParseDuration(value)
+		default:
+			return nil, errors.Errorf("unknown setting %q", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+
+	t.DialContext = dialer.DialContext
+	return t, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// listenerTuning holds the connection settings of the clients of a listener.
+type listenerTuning struct {
+	// http2 is nil unless an HTTP/2 setting was given, in which case the
+	// HTTP/2 support of net/http is replaced by one configured with it.
+	http2        *http2.Server
+	idleTimeout  time.Duration
+	keepAlives   bool
+	tcpKeepAlive time.Duration
+}
+
+// newListenerTuning parses spec, a '|'-separated list of <setting>=<value>.
+// Settings that aren't given keep their defaults; idleTimeout is the default
+// idle timeout.
+func newListenerTuning(spec string, idleTimeout time.Duration) (*listenerTuning, error) {
+	t := &listenerTuning{
+		idleTimeout: idleTimeout,
+		keepAlives:  true,
+	}
+	h2 := &http2.Server{}
+
+	for _, setting := range strings.Split(spec, "|") {
+		idx := strings.Index(setting, "=")
+		if idx == -1 {
+			return nil, errors.Errorf("setting %q is missing '='", setting)
+		}
+		name, value := setting[:idx], setting[idx+1:]
+
+		var err error
+		switch name {
+		case "http2_max_concurrent_streams":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			h2.MaxConcurrentStreams = uint32(n)
+			t.http2 = h2
+		case "http2_max_frame_size":
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 32)
+			if err == nil && (n < 16<<10 || n > 1<<24-1) {
+				err = errors.New("must be between 16384 and 16777215")
+			}
+			h2.MaxReadFrameSize = uint32(n)
+			t.http2 = h2
+		case "http2_idle_timeout":
+			h2.IdleTimeout, err = time.ParseDuration(value)
+			t.http2 = h2
+		case "idle_timeout":
+			t.idleTimeout, err = time.ParseDuration(value)
+		case "keep_alives":
+			t.keepAlives, err = strconv.ParseBool(value)
+		case "tcp_keep_alive":
+			t.tcpKeepAlive, err = time.ParseDuration(value)
+		default:
+			return nil, errors.Errorf("unknown setting %q", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+	return t, nil
+}
+
+// apply configures s, which serves l, with the settings, and returns the
+// listener to serve.
+func (t *listenerTuning) apply(s *http.Server, l net.Listener, useTLS bool) (net.Listener, error) {
+	s.IdleTimeout = t.idleTimeout
+	s.SetKeepAlivesEnabled(t.keepAlives)
+	if t.http2 != nil {
+		if !useTLS {
+			return nil, errors.New("HTTP/2 settings only apply to HTTPS listeners")
+		}
+		// Copied, so that servers of several listeners don't share it.
+		h2 := *t.http2
+		if err := http2.ConfigureServer(s, &h2); err != nil {
+			return nil, err
+		}
+	}
+	if t.tcpKeepAlive != 0 {
+		l = keepAliveListener{l, t.tcpKeepAlive}
+	}
+	return l, nil
+}
+
+// keepAliveListener sets the TCP keep-alive period of accepted connections.
+// A negative period disables TCP keep-alives.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.period < 0 {
+			tc.SetKeepAlive(false)
+		} else {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return c, nil
+}
+
+// sameAddr reports whether addr, as given in a flag, is the address of l. An
+// address without a host, or with an unspecified one, matches any listener
+// on its port.
+func sameAddr(addr string, l net.Listener) bool {
+	la, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ta, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || ta.Port != la.Port {
+		return false
+	}
+	return ta.IP == nil || ta.IP.IsUnspecified() || ta.IP.Equal(la.IP)
+}
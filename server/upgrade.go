@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// The environment variable telling an upgraded process the names of the
+// sockets it inherits. The sockets start at fd 3, followed by a pipe to close
+// once the process is ready to serve.
+const upgradeFDsEnv = "WILE_UPGRADE_FDS"
+
+// upgrader replaces the running binary without dropping the listening
+// sockets: on SIGUSR2 it starts the binary again, passing it the sockets, and
+// once the new process is ready it stops accepting connections, waits for
+// open requests and exits.
+//
+// Passthrough connections aren't waited for, and are cut when the process
+// exits.
+type upgrader struct {
+	drainTimeout time.Duration
+
+	names     []string
+	listeners []net.Listener
+	servers   []*http.Server
+}
+
+func (u *upgrader) add(name string, l net.Listener, s *http.Server) {
+	u.names = append(u.names, name)
+	u.listeners = append(u.listeners, l)
+	u.servers = append(u.servers, s)
+}
+
+// ready tells the process that started this one, if any, that it can exit.
+func (u *upgrader) ready() {
+	env := os.Getenv(upgradeFDsEnv)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(upgradeFDsEnv)
+
+	n := len(strings.Split(env, ":"))
+	os.NewFile(uintptr(3+n), "ready").Close()
+}
+
+func (u *upgrader) waitForUpgrade() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+
+	for range sigs {
+		glog.Info("Got SIGUSR2, upgrading")
+		err := u.upgrade()
+		if err != nil {
+			glog.Errorf("Failed to upgrade: %v", err)
+			continue
+		}
+		u.drain()
+		return
+	}
+}
+
+func (u *upgrader) upgrade() error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range u.listeners {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return errors.Errorf("can't pass on listener %v", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return errors.Wrapf(err, "failed to get file of listener %v", l.Addr())
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "failed to create pipe")
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	path, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "failed to find executable")
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeFDsEnv+"="+strings.Join(u.names, ":"))
+	err = cmd.Start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start new process")
+	}
+	w.Close()
+	files = files[:len(files)-1]
+
+	// The pipe is closed without anything written to it, either by the new
+	// process when it is ready or by the kernel when it dies.
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	closed := make(chan struct{})
+	go func() {
+		var b [1]byte
+		r.Read(b[:])
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		return errors.New("new process didn't get ready in time")
+	}
+
+	select {
+	case err := <-exited:
+		return errors.Errorf("new process exited: %v", err)
+	case <-time.After(time.Second):
+	}
+
+	glog.Infof("New process %d is ready", cmd.Process.Pid)
+	return nil
+}
+
+func (u *upgrader) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), u.drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range u.servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				glog.Warningf("Failed to drain server: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	glog.Flush()
+}
+
+// upgradeFiles returns the sockets passed by the process that started this one
+// in an upgrade.
+func upgradeFiles() []*os.File {
+	env := os.Getenv(upgradeFDsEnv)
+	if env == "" {
+		return nil
+	}
+
+	var files []*os.File
+	for i, name := range strings.Split(env, ":") {
+		fd := 3 + i
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
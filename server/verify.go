@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var verifyFailures = expvar.NewMap("cert_verify_failures")
+
+// verifyLoop periodically connects to addr, or to each domain on port 443 if
+// addr is empty, and checks that the cert served for each domain is the one in
+// the cache and is valid for the domain. Mismatches are logged and counted in
+// the cert_verify_failures var.
+func (c *certManager) verifyLoop(domains []string, addr string, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, d := range domains {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err := c.verify(ctx, d, addr)
+			cancel()
+
+			if err != nil {
+				glog.Errorf("Cert verification of %q failed: %v", d, err)
+				verifyFailures.Add(d, 1)
+			}
+		}
+	}
+}
+
+func (c *certManager) verify(ctx context.Context, domain, addr string) error {
+	if addr == "" {
+		addr = net.JoinHostPort(domain, "443")
+	}
+
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %q", addr)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The chain is checked against the cache rather than the system roots,
+	// which may not include the CA, e.g. a staging one.
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         domain,
+		InsecureSkipVerify: true,
+	})
+	err = tc.Handshake()
+	if err != nil {
+		return errors.Wrapf(err, "TLS handshake with %q failed", addr)
+	}
+
+	served := tc.ConnectionState().PeerCertificates
+	if len(served) == 0 {
+		return errors.New("no cert served")
+	}
+	leaf := served[0]
+
+	err = leaf.VerifyHostname(domain)
+	if err != nil {
+		return errors.Wrap(err, "served cert doesn't cover domain")
+	}
+
+	for _, key := range []string{domain, domain + "+rsa"} {
+		cached, err := cachedLeaf(ctx, c.cache(), key)
+		if err == autocert.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read cert for %q", key)
+		}
+		if bytes.Equal(cached.Raw, leaf.Raw) {
+			return nil
+		}
+	}
+	return errors.Errorf("served cert with serial %x isn't in the cache", leaf.SerialNumber)
+}
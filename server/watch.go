@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/golang/glog"
+	"github.com/jonathanwei/wile"
+)
+
+// watchCerts drops certs from memory when another replica changes them, so
+// that they are read again from etcd. keys are the changed keys in etcd,
+// which c.hashKey maps cache keys to. Changes written by this replica are
+// skipped, since it already serves them.
+func (c *certManager) watchCerts(keys <-chan string, layered *wile.LayeredCache, domains []string) {
+	for key := range keys {
+		if c.ownWrites.consume(key) {
+			continue
+		}
+		layered.Invalidate(key)
+
+		if certKey, ok := c.certKey(key, domains); ok {
+			glog.Infof("Cert %q changed in etcd, reloading it", certKey)
+			c.certs.drop(certKey)
+		}
+	}
+	glog.Error("Stopped watching certs in etcd")
+}
+
+// certKey returns the cache key of the cert stored under key, if its domain
+// is one of domains or has been served.
+func (c *certManager) certKey(key string, domains []string) (string, bool) {
+	check := func(d string) (string, bool) {
+		for _, k := range []string{d, d + "+rsa"} {
+			if c.hashKey(k) == key {
+				return k, true
+			}
+		}
+		return "", false
+	}
+
+	for _, d := range domains {
+		if k, ok := check(d); ok {
+			return k, true
+		}
+	}
+
+	var found string
+	c.served.Range(func(k, _ interface{}) bool {
+		var ok bool
+		found, ok = check(k.(string))
+		return !ok
+	})
+	return found, found != ""
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// webhookCache tells an external service about HTTP-01 challenges, so that it
+// can serve them from wherever the CA's validation requests land, e.g. a CDN.
+//
+// autocert stores the response to each challenge in the cache under
+// "<token>+http-01" and deletes it when the challenge is done; these writes are
+// turned into "present" and "cleanup" POSTs to url. autocert ignores errors
+// from the cache here, so failed hooks are only logged.
+type webhookCache struct {
+	autocert.Cache
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookCache(cache autocert.Cache, url, secret string) *webhookCache {
+	return &webhookCache{
+		Cache:  cache,
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type webhookRequest struct {
+	Action           string `json:"action"`
+	Type             string `json:"type"`
+	Token            string `json:"token"`
+	KeyAuthorization string `json:"key_authorization,omitempty"`
+}
+
+func (w *webhookCache) Put(ctx context.Context, key string, data []byte) error {
+	err := w.Cache.Put(ctx, key, data)
+	if err != nil {
+		return err
+	}
+
+	if token, ok := httpTokenFromKey(key); ok {
+		return w.call(ctx, webhookRequest{Action: "present", Type: "http-01", Token: token, KeyAuthorization: string(data)})
+	}
+	return nil
+}
+
+func (w *webhookCache) Delete(ctx context.Context, key string) error {
+	err := w.Cache.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if token, ok := httpTokenFromKey(key); ok {
+		return w.call(ctx, webhookRequest{Action: "cleanup", Type: "http-01", Token: token})
+	}
+	return nil
+}
+
+func (w *webhookCache) call(ctx context.Context, wr webhookRequest) error {
+	body, err := json.Marshal(wr)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal webhook request")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+w.secret)
+	}
+
+	resp, err := w.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			err = fmt.Errorf("status %s: %s", resp.Status, msg)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Challenge webhook %s of token %q failed: %v", wr.Action, wr.Token, err)
+		return errors.Wrapf(err, "challenge webhook %s failed", wr.Action)
+	}
+	return nil
+}
+
+func httpTokenFromKey(key string) (string, bool) {
+	if !strings.HasSuffix(key, "+http-01") {
+		return "", false
+	}
+	return strings.TrimSuffix(key, "+http-01"), true
+}
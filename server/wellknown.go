@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const wellKnownPrefix = "/.well-known/"
+
+// wellKnown serves some /.well-known/ paths of all hosts, such as
+// security.txt or mta-sts.txt, instead of the backends of the hosts. Paths
+// are exact, or prefixes if they end in a slash.
+type wellKnown struct {
+	exact    map[string]http.Handler
+	prefixes map[string]http.Handler
+}
+
+func newWellKnown() *wellKnown {
+	return &wellKnown{
+		exact:    make(map[string]http.Handler),
+		prefixes: make(map[string]http.Handler),
+	}
+}
+
+// add serves name, a path under /.well-known/, with target, either
+// file:<path> or a handler in backends. file: serves a file for exact names
+// and a directory for prefixes.
+func (w *wellKnown) add(name, target string, backends map[string]http.Handler) error {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || path.Clean("/"+name) != "/"+strings.TrimSuffix(name, "/") {
+		return errors.Errorf("invalid path %q", name)
+	}
+	if strings.HasPrefix(name, "acme-challenge") {
+		return errors.New("acme-challenge is always answered by the ACME client")
+	}
+	isPrefix := strings.HasSuffix(name, "/")
+	p := wellKnownPrefix + name
+	if _, ok := w.exact[p]; ok {
+		return errors.Errorf("duplicate path %q", name)
+	}
+	if _, ok := w.prefixes[p]; ok {
+		return errors.Errorf("duplicate path %q", name)
+	}
+
+	var h http.Handler
+	switch {
+	case strings.HasPrefix(target, "file:"):
+		file := strings.TrimPrefix(target, "file:")
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if isPrefix != info.IsDir() {
+			return errors.Errorf("%q must be a directory iff the path ends in '/'", file)
+		}
+		if isPrefix {
+			h = http.StripPrefix(p, http.FileServer(http.Dir(file)))
+		} else {
+			h = staticFile(file)
+		}
+	default:
+		b, ok := backends[target]
+		if !ok {
+			return errors.Errorf("unknown backend %q", target)
+		}
+		h = b
+	}
+
+	if isPrefix {
+		w.prefixes[p] = h
+	} else {
+		w.exact[p] = h
+	}
+	return nil
+}
+
+func (w *wellKnown) wrap(h http.Handler) http.Handler {
+	if len(w.exact) == 0 && len(w.prefixes) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if wh := w.handler(req.URL.Path); wh != nil {
+			wh.ServeHTTP(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func (w *wellKnown) handler(p string) http.Handler {
+	if !strings.HasPrefix(p, wellKnownPrefix) {
+		return nil
+	}
+	if h, ok := w.exact[p]; ok {
+		return h
+	}
+	// The longest prefix wins.
+	var (
+		best    http.Handler
+		bestLen int
+	)
+	for prefix, h := range w.prefixes {
+		if strings.HasPrefix(p, prefix) && len(prefix) > bestLen {
+			best, bestLen = h, len(prefix)
+		}
+	}
+	return best
+}
+
+// staticFile serves file, which is read on every request so that changes are
+// picked up. The content type is guessed from its extension.
+func staticFile(file string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			rw.Header().Set("Allow", "GET, HEAD")
+			http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			http.NotFound(rw, req)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.NotFound(rw, req)
+			return
+		}
+		http.ServeContent(rw, req, file, info.ModTime(), f)
+	})
+}
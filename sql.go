@@ -0,0 +1,317 @@
+package wile
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// SQLDialect is the SQL database an SQLCache is stored in.
+type SQLDialect string
+
+const (
+	Postgres SQLDialect = "postgres"
+	MySQL    SQLDialect = "mysql"
+)
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlMigrations are the schema changes of each dialect, in order. %[1]s is the
+// table name. Only ever append to them.
+var sqlMigrations = map[SQLDialect][]sqlMigration{
+	Postgres: {
+		{stmt: `CREATE TABLE IF NOT EXISTS %[1]s (
+			cache_key VARCHAR(255) PRIMARY KEY,
+			data BYTEA NOT NULL,
+			version BIGINT NOT NULL,
+			mtime TIMESTAMP NOT NULL
+		)`},
+		{stmt: `CREATE INDEX IF NOT EXISTS %[1]s_mtime ON %[1]s (mtime)`},
+	},
+	MySQL: {
+		{stmt: `CREATE TABLE IF NOT EXISTS %[1]s (
+			cache_key VARCHAR(255) NOT NULL PRIMARY KEY,
+			data MEDIUMBLOB NOT NULL,
+			version BIGINT NOT NULL,
+			mtime DATETIME(6) NOT NULL
+		)`},
+		// MySQL has no CREATE INDEX IF NOT EXISTS.
+		{
+			stmt:    `CREATE INDEX %[1]s_mtime ON %[1]s (mtime)`,
+			applied: `SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = '%[1]s' AND index_name = '%[1]s_mtime'`,
+		},
+	},
+}
+
+type sqlMigration struct {
+	stmt string
+	// applied, if set, counts the rows showing that stmt was already
+	// applied, for statements that can't be made idempotent.
+	applied string
+}
+
+// SQLCache is a cache in a table of a Postgres or MySQL database, for
+// deployments without etcd. It implements Versioner with a version column
+// counting the writes of each entry.
+//
+// Connections come from the pool of the *sql.DB, so limits such as
+// SetMaxOpenConns apply; one *sql.DB can be shared by several caches.
+type SQLCache struct {
+	db      *sql.DB
+	dialect SQLDialect
+	table   string
+}
+
+// NewSQLCache creates a cache in table, migrating its schema to the latest
+// version first. The applied migrations are recorded in <table>_migrations.
+// The caller must import the database driver.
+func NewSQLCache(ctx context.Context, db *sql.DB, dialect SQLDialect, table string) (*SQLCache, error) {
+	if _, ok := sqlMigrations[dialect]; !ok {
+		return nil, errors.Errorf("unsupported SQL dialect %q", dialect)
+	}
+	if !validTable.MatchString(table) {
+		return nil, errors.Errorf("invalid table name %q", table)
+	}
+
+	s := &SQLCache{db, dialect, table}
+	if err := s.migrate(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLCache) migrate(ctx context.Context) error {
+	migrations := s.table + "_migrations"
+	_, err := s.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrations+" (version INT NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return errors.Wrap(err, "failed to create migrations table")
+	}
+
+	var current sql.NullInt64
+	err = s.db.QueryRowContext(ctx, "SELECT MAX(version) FROM "+migrations).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "failed to read schema version")
+	}
+
+	for i, m := range sqlMigrations[s.dialect] {
+		version := int64(i + 1)
+		if version <= current.Int64 {
+			continue
+		}
+
+		// Another process may apply the same migration concurrently. MySQL
+		// commits DDL right away, which is why the migrations themselves
+		// tolerate being applied twice, and a version recorded in the
+		// meantime counts as applied.
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to begin migration")
+		}
+		if err := s.apply(ctx, tx, m); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to apply migration %d", version)
+		}
+		if _, err := tx.ExecContext(ctx, s.query("INSERT INTO "+migrations+" (version) VALUES (?)"), version); err != nil {
+			tx.Rollback()
+			if recorded, rerr := s.recorded(ctx, migrations, version); rerr == nil && recorded {
+				continue
+			}
+			return errors.Wrapf(err, "failed to record migration %d", version)
+		}
+		if err := tx.Commit(); err != nil {
+			if recorded, rerr := s.recorded(ctx, migrations, version); rerr == nil && recorded {
+				continue
+			}
+			return errors.Wrapf(err, "failed to commit migration %d", version)
+		}
+	}
+	return nil
+}
+
+// apply runs the statement of m unless it was already applied. Should it fail
+// because another process applied it first, that counts as applied too.
+func (s *SQLCache) apply(ctx context.Context, tx *sql.Tx, m sqlMigration) error {
+	if m.applied == "" {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(m.stmt, s.table))
+		return err
+	}
+
+	applied := func() (bool, error) {
+		var n int
+		err := tx.QueryRowContext(ctx, fmt.Sprintf(m.applied, s.table)).Scan(&n)
+		return n > 0, err
+	}
+	if ok, err := applied(); err != nil || ok {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(m.stmt, s.table))
+	if err != nil {
+		if ok, aerr := applied(); aerr == nil && ok {
+			return nil
+		}
+	}
+	return err
+}
+
+// recorded reports whether version is recorded in the migrations table.
+func (s *SQLCache) recorded(ctx context.Context, migrations string, version int64) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, s.query("SELECT COUNT(*) FROM "+migrations+" WHERE version = ?"), version).Scan(&n)
+	return n > 0, err
+}
+
+// query replaces the ? placeholders of q with $1, $2, ... for Postgres.
+func (s *SQLCache) query(q string) string {
+	if s.dialect != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := s.GetVersion(ctx, key)
+	return data, err
+}
+
+// GetVersion returns the value of key and its version, see Versioner.
+func (s *SQLCache) GetVersion(ctx context.Context, key string) ([]byte, int64, error) {
+	var (
+		data    []byte
+		version int64
+	)
+	err := s.db.QueryRowContext(ctx, s.query("SELECT data, version FROM "+s.table+" WHERE cache_key = ?"), key).Scan(&data, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, 0, withKind(ErrCacheUnavailable, errors.Wrapf(err, "failed to get %q", key))
+	}
+	return data, version, nil
+}
+
+func (s *SQLCache) Put(ctx context.Context, key string, data []byte) error {
+	var q string
+	switch s.dialect {
+	case Postgres:
+		q = "INSERT INTO " + s.table + " (cache_key, data, version, mtime) VALUES (?, ?, 1, ?) ON CONFLICT (cache_key) DO UPDATE SET data = EXCLUDED.data, version = " + s.table + ".version + 1, mtime = EXCLUDED.mtime"
+	default:
+		q = "INSERT INTO " + s.table + " (cache_key, data, version, mtime) VALUES (?, ?, 1, ?) ON DUPLICATE KEY UPDATE data = VALUES(data), version = version + 1, mtime = VALUES(mtime)"
+	}
+	_, err := s.db.ExecContext(ctx, s.query(q), key, data, time.Now().UTC())
+	return withKind(ErrCacheUnavailable, errors.Wrapf(err, "failed to put %q", key))
+}
+
+// PutIfVersion stores data under key if its version is still version, see
+// Versioner.
+func (s *SQLCache) PutIfVersion(ctx context.Context, key string, data []byte, version int64) (int64, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	now := time.Now().UTC()
+	if version == 0 {
+		q := "INSERT IGNORE INTO " + s.table + " (cache_key, data, version, mtime) VALUES (?, ?, 1, ?)"
+		if s.dialect == Postgres {
+			q = "INSERT INTO " + s.table + " (cache_key, data, version, mtime) VALUES (?, ?, 1, ?) ON CONFLICT (cache_key) DO NOTHING"
+		}
+		res, err = s.db.ExecContext(ctx, s.query(q), key, data, now)
+	} else {
+		q := "UPDATE " + s.table + " SET data = ?, version = version + 1, mtime = ? WHERE cache_key = ? AND version = ?"
+		res, err = s.db.ExecContext(ctx, s.query(q), data, now, key, version)
+	}
+	if err != nil {
+		return 0, withKind(ErrCacheUnavailable, errors.Wrapf(err, "failed to put %q", key))
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to put %q", key)
+	}
+	if n != 1 {
+		return 0, nil
+	}
+	return version + 1, nil
+}
+
+func (s *SQLCache) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM "+s.table+" WHERE cache_key = ?"), key)
+	return withKind(ErrCacheUnavailable, errors.Wrapf(err, "failed to delete %q", key))
+}
+
+// List returns all keys starting with prefix.
+func (s *SQLCache) List(ctx context.Context, prefix string) ([]string, error) {
+	pattern := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT cache_key FROM "+s.table+" WHERE cache_key LIKE ? ESCAPE '!' ORDER BY cache_key"), pattern)
+	if err != nil {
+		return nil, withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to list keys"))
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, errors.Wrap(err, "failed to list keys")
+		}
+		keys = append(keys, key)
+	}
+	return keys, errors.Wrap(rows.Err(), "failed to list keys")
+}
+
+// Purge deletes the keys last written before olderThan and returns them, see
+// Purger.
+func (s *SQLCache) Purge(ctx context.Context, olderThan time.Time, keep []string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT cache_key, version FROM "+s.table+" WHERE mtime < ?"), olderThan.UTC())
+	if err != nil {
+		return nil, withKind(ErrCacheUnavailable, errors.Wrap(err, "failed to list stale keys"))
+	}
+	type entry struct {
+		key     string
+		version int64
+	}
+	var stale []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.key, &e.version); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "failed to list stale keys")
+		}
+		if purgeable(e.key, keep) {
+			stale = append(stale, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to list stale keys")
+	}
+
+	var purged []string
+	for _, e := range stale {
+		// Only delete if the key wasn't rewritten since we listed it.
+		res, err := s.db.ExecContext(ctx, s.query("DELETE FROM "+s.table+" WHERE cache_key = ? AND version = ?"), e.key, e.version)
+		if err != nil {
+			return purged, errors.Wrapf(err, "failed to purge %q", e.key)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			purged = append(purged, e.key)
+		}
+	}
+	return purged, nil
+}
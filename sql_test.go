@@ -0,0 +1,360 @@
+package wile
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// fakeSQL is a database/sql driver that understands the Postgres statements
+// of SQLCache, on a table named cache. Databases are shared by name.
+type fakeSQL struct {
+	mu  sync.Mutex
+	dbs map[string]*fakeDB
+}
+
+type fakeDB struct {
+	mu sync.Mutex
+	// ddl holds the schema changes made, in order.
+	ddl        []string
+	migrations map[int64]bool
+	rows       map[string]*fakeRow
+}
+
+type fakeRow struct {
+	data    []byte
+	version int64
+	mtime   time.Time
+}
+
+func init() {
+	sql.Register("wilefake", &fakeSQL{dbs: make(map[string]*fakeDB)})
+}
+
+func (d *fakeSQL) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		db = &fakeDB{migrations: make(map[int64]bool), rows: make(map[string]*fakeRow)}
+		d.dbs[name] = db
+	}
+	return &fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.db, strings.Join(strings.Fields(query), " ")}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db, q := s.db, s.query
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var n int64
+	switch {
+	case strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS cache_migrations "):
+	case strings.HasPrefix(q, "CREATE"):
+		db.ddl = append(db.ddl, q)
+	case q == "INSERT INTO cache_migrations (version) VALUES ($1)":
+		v := args[0].(int64)
+		if db.migrations[v] {
+			return nil, errors.New("duplicate key")
+		}
+		db.migrations[v] = true
+		n = 1
+	case strings.HasPrefix(q, "INSERT INTO cache (cache_key, data, version, mtime) VALUES ($1, $2, 1, $3) ON CONFLICT (cache_key) DO UPDATE"):
+		key := args[0].(string)
+		r, ok := db.rows[key]
+		if !ok {
+			r = &fakeRow{}
+			db.rows[key] = r
+		}
+		r.data, r.mtime = args[1].([]byte), args[2].(time.Time)
+		r.version++
+		n = 1
+	case strings.HasPrefix(q, "INSERT INTO cache (cache_key, data, version, mtime) VALUES ($1, $2, 1, $3) ON CONFLICT (cache_key) DO NOTHING"):
+		key := args[0].(string)
+		if _, ok := db.rows[key]; !ok {
+			db.rows[key] = &fakeRow{args[1].([]byte), 1, args[2].(time.Time)}
+			n = 1
+		}
+	case q == "UPDATE cache SET data = $1, version = version + 1, mtime = $2 WHERE cache_key = $3 AND version = $4":
+		if r, ok := db.rows[args[2].(string)]; ok && r.version == args[3].(int64) {
+			r.data, r.mtime = args[0].([]byte), args[1].(time.Time)
+			r.version++
+			n = 1
+		}
+	case q == "DELETE FROM cache WHERE cache_key = $1":
+		if _, ok := db.rows[args[0].(string)]; ok {
+			delete(db.rows, args[0].(string))
+			n = 1
+		}
+	case q == "DELETE FROM cache WHERE cache_key = $1 AND version = $2":
+		if r, ok := db.rows[args[0].(string)]; ok && r.version == args[1].(int64) {
+			delete(db.rows, args[0].(string))
+			n = 1
+		}
+	default:
+		return nil, errors.Errorf("unexpected statement %q", q)
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db, q := s.db, s.query
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch q {
+	case "SELECT MAX(version) FROM cache_migrations":
+		var max driver.Value
+		for v := range db.migrations {
+			if max == nil || v > max.(int64) {
+				max = v
+			}
+		}
+		return &fakeRows{cols: []string{"max"}, rows: [][]driver.Value{{max}}}, nil
+	case "SELECT COUNT(*) FROM cache_migrations WHERE version = $1":
+		var n int64
+		if db.migrations[args[0].(int64)] {
+			n = 1
+		}
+		return &fakeRows{cols: []string{"count"}, rows: [][]driver.Value{{n}}}, nil
+	case "SELECT data, version FROM cache WHERE cache_key = $1":
+		rows := &fakeRows{cols: []string{"data", "version"}}
+		if r, ok := db.rows[args[0].(string)]; ok {
+			rows.rows = append(rows.rows, []driver.Value{r.data, r.version})
+		}
+		return rows, nil
+	case "SELECT cache_key FROM cache WHERE cache_key LIKE $1 ESCAPE '!' ORDER BY cache_key":
+		like := likeRegexp(args[0].(string), '!')
+		var keys []string
+		for k := range db.rows {
+			if like.MatchString(k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		rows := &fakeRows{cols: []string{"cache_key"}}
+		for _, k := range keys {
+			rows.rows = append(rows.rows, []driver.Value{k})
+		}
+		return rows, nil
+	case "SELECT cache_key, version FROM cache WHERE mtime < $1":
+		rows := &fakeRows{cols: []string{"cache_key", "version"}}
+		for k, r := range db.rows {
+			if r.mtime.Before(args[0].(time.Time)) {
+				rows.rows = append(rows.rows, []driver.Value{k, r.version})
+			}
+		}
+		return rows, nil
+	}
+	return nil, errors.Errorf("unexpected query %q", q)
+}
+
+// likeRegexp returns a regexp matching what the LIKE pattern does.
+func likeRegexp(pattern string, escape rune) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == escape:
+			escaped = true
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openFakeSQL(t *testing.T) (*sql.DB, *fakeDB) {
+	db, err := sql.Open("wilefake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Driver().Open(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, conn.(*fakeConn).db
+}
+
+func TestSQLCacheMigrations(t *testing.T) {
+	ctx := context.Background()
+	db, fake := openFakeSQL(t)
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := NewSQLCache(ctx, db, Postgres, "cache"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fake.ddl) != len(sqlMigrations[Postgres]) {
+		t.Fatalf("applied %d migrations, want each of the %d once: %q", len(fake.ddl), len(sqlMigrations[Postgres]), fake.ddl)
+	}
+
+	// Only new migrations are applied to an existing table.
+	defer func(m []sqlMigration) { sqlMigrations[Postgres] = m }(sqlMigrations[Postgres])
+	sqlMigrations[Postgres] = append(sqlMigrations[Postgres], sqlMigration{stmt: "CREATE INDEX IF NOT EXISTS %[1]s_data ON %[1]s (data)"})
+	if _, err := NewSQLCache(ctx, db, Postgres, "cache"); err != nil {
+		t.Fatal(err)
+	}
+	want := "CREATE INDEX IF NOT EXISTS cache_data ON cache (data)"
+	if len(fake.ddl) != len(sqlMigrations[Postgres]) || fake.ddl[len(fake.ddl)-1] != want {
+		t.Errorf("after adding a migration, applied %q, want it last", fake.ddl)
+	}
+	if !fake.migrations[int64(len(sqlMigrations[Postgres]))] {
+		t.Error("new migration wasn't recorded")
+	}
+}
+
+func TestSQLCacheRejectsBadConfig(t *testing.T) {
+	db, _ := openFakeSQL(t)
+	defer db.Close()
+
+	if _, err := NewSQLCache(context.Background(), db, "sqlite", "cache"); err == nil {
+		t.Error("unsupported dialect accepted")
+	}
+	if _, err := NewSQLCache(context.Background(), db, Postgres, "cache; DROP TABLE cache"); err == nil {
+		t.Error("invalid table name accepted")
+	}
+}
+
+func TestSQLCacheList(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openFakeSQL(t)
+	defer db.Close()
+	c, err := NewSQLCache(ctx, db, Postgres, "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a_b", "a%b", "a!b", "axb", "ab"} {
+		if err := c.Put(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The LIKE wildcards and escape character match only themselves.
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"a!b", "a%b", "a_b", "ab", "axb"}},
+		{"a", []string{"a!b", "a%b", "a_b", "ab", "axb"}},
+		{"a_", []string{"a_b"}},
+		{"a%", []string{"a%b"}},
+		{"a!", []string{"a!b"}},
+		{"ax", []string{"axb"}},
+		{"b", nil},
+	} {
+		got, err := c.List(ctx, tc.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("List(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestSQLCachePutIfVersion(t *testing.T) {
+	ctx := context.Background()
+	db, _ := openFakeSQL(t)
+	defer db.Close()
+	c, err := NewSQLCache(ctx, db, Postgres, "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(data string, version, want int64) {
+		t.Helper()
+		got, err := c.PutIfVersion(ctx, "key", []byte(data), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("PutIfVersion(%q, %d) = %d, want %d", data, version, got, want)
+		}
+	}
+	check := func(data string, version int64) {
+		t.Helper()
+		got, v, err := c.GetVersion(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data || v != version {
+			t.Errorf("GetVersion = %q, %d, want %q, %d", got, v, data, version)
+		}
+	}
+
+	if _, _, err := c.GetVersion(ctx, "key"); err != autocert.ErrCacheMiss {
+		t.Fatalf("GetVersion of a missing key = %v, want ErrCacheMiss", err)
+	}
+	put("a", 0, 1)
+	put("b", 0, 0) // Created in the meantime.
+	check("a", 1)
+	put("c", 1, 2)
+	put("d", 1, 0) // Written in the meantime.
+	check("c", 2)
+
+	if err := c.Put(ctx, "key", []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	put("f", 2, 0)
+	check("e", 3)
+}
+
+var _ Versioner = (*SQLCache)(nil)
+var _ Versioner = (*EtcdCache)(nil)
@@ -0,0 +1,103 @@
+package wile
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// TicketKeysCacheKey is the cache key session ticket keys are stored under.
+const TicketKeysCacheKey = "wile_session_ticket_keys"
+
+const (
+	// ticketKeysKept is the number of ticket keys kept, the newest encrypting
+	// new tickets and all of them decrypting tickets.
+	ticketKeysKept = 3
+	// ticketKeysPoll is how often keys are read from the cache, to pick up
+	// the rotations of other processes.
+	ticketKeysPoll = time.Minute
+)
+
+type ticketKey struct {
+	Created time.Time `json:"created"`
+	Key     []byte    `json:"key"`
+}
+
+// RotateSessionTicketKeys shares session ticket keys with every process using
+// cache, so that sessions resume on all of them, and rotates them every
+// period. Tickets stay valid for up to 3 periods. Keys should only be stored
+// in an encrypting cache. set is called with the keys whenever they are read,
+// newest first, e.g. with tls.Config.SetSessionTicketKeys. It blocks until ctx
+// is done.
+func RotateSessionTicketKeys(ctx context.Context, cache autocert.Cache, period time.Duration, set func(keys [][32]byte)) error {
+	t := time.NewTicker(ticketKeysPoll)
+	defer t.Stop()
+
+	for {
+		keys, err := rotateTicketKeys(ctx, cache, period)
+		if err != nil {
+			return err
+		}
+		set(keys)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// rotateTicketKeys returns the current keys, newest first, adding a new one
+// if the newest is older than period.
+func rotateTicketKeys(ctx context.Context, cache autocert.Cache, period time.Duration) ([][32]byte, error) {
+	var stored []ticketKey
+	data, err := cache.Get(ctx, TicketKeysCacheKey)
+	switch {
+	case err == autocert.ErrCacheMiss:
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to read session ticket keys")
+	default:
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, errors.Wrap(err, "invalid session ticket keys")
+		}
+	}
+
+	if len(stored) == 0 || time.Since(stored[0].Created) >= period {
+		k := ticketKey{Created: time.Now().UTC(), Key: make([]byte, 32)}
+		if _, err := io.ReadFull(rand.Reader, k.Key); err != nil {
+			return nil, errors.Wrap(err, "failed to generate session ticket key")
+		}
+		stored = append([]ticketKey{k}, stored...)
+		if len(stored) > ticketKeysKept {
+			stored = stored[:ticketKeysKept]
+		}
+
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal session ticket keys")
+		}
+		// Processes rotating at the same time overwrite each other's keys.
+		// The tickets they issued with the lost key fail to resume, which
+		// only costs a full handshake.
+		if err := cache.Put(ctx, TicketKeysCacheKey, data); err != nil {
+			return nil, errors.Wrap(err, "failed to store session ticket keys")
+		}
+	}
+
+	var keys [][32]byte
+	for _, k := range stored {
+		if len(k.Key) != 32 {
+			return nil, errors.New("invalid session ticket key length")
+		}
+		var key [32]byte
+		copy(key[:], k.Key)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
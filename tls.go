@@ -0,0 +1,29 @@
+package wile
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TLSConfig returns a tls.Config serving the certs of getCertificate, e.g.
+// autocert.Manager.GetCertificate, with modern defaults: TLS 1.2 or later,
+// only forward-secret AEAD cipher suites, and ALPN for HTTP/2, HTTP/1.1 and
+// TLS-ALPN-01 challenges. Session ticket keys are left to crypto/tls, which
+// rotates them daily.
+func TLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+}
@@ -0,0 +1,179 @@
+package wile
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/context"
+)
+
+// VaultCache is a cache in a HashiCorp Vault KV version 2 secrets engine.
+// Each key is a secret under prefix whose value field holds the data, so
+// Vault keeps the previous versions, and access to certs and account keys can
+// be audited and limited with Vault policies. Delete only deletes the latest
+// version, which can be undeleted in Vault.
+type VaultCache struct {
+	client *http.Client
+	addr   string
+	token  string
+	mount  string
+	prefix string
+}
+
+// NewVaultCache creates a cache in the KV engine at mount of the Vault server
+// at addr, e.g. https://vault.example.com:8200, authenticating with token.
+// The token needs create, read, update, delete and list on
+// <mount>/data/<prefix>/* and <mount>/metadata/<prefix>/*.
+func NewVaultCache(client *http.Client, addr, token, mount, prefix string) *VaultCache {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &VaultCache{
+		client: client,
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		mount:  strings.Trim(mount, "/"),
+		prefix: strings.Trim(prefix, "/"),
+	}
+}
+
+type vaultSecret struct {
+	Value []byte `json:"value"`
+}
+
+func (v *VaultCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Data vaultSecret `json:"data"`
+		} `json:"data"`
+	}
+	found, err := v.do(ctx, "GET", v.url("data", key), nil, &resp)
+	if err != nil {
+		return nil, vaultWrap(err, "failed to get %q", key)
+	}
+	if !found {
+		return nil, autocert.ErrCacheMiss
+	}
+	return resp.Data.Data.Value, nil
+}
+
+func (v *VaultCache) Put(ctx context.Context, key string, data []byte) error {
+	req := struct {
+		Data vaultSecret `json:"data"`
+	}{vaultSecret{data}}
+	_, err := v.do(ctx, "POST", v.url("data", key), req, nil)
+	return vaultWrap(err, "failed to put %q", key)
+}
+
+func (v *VaultCache) Delete(ctx context.Context, key string) error {
+	_, err := v.do(ctx, "DELETE", v.url("data", key), nil, nil)
+	return vaultWrap(err, "failed to delete %q", key)
+}
+
+// List returns all keys starting with prefix.
+func (v *VaultCache) List(ctx context.Context, prefix string) ([]string, error) {
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	_, err := v.do(ctx, "LIST", v.url("metadata", ""), nil, &resp)
+	if err != nil {
+		return nil, vaultWrap(err, "failed to list keys")
+	}
+
+	var keys []string
+	for _, k := range resp.Data.Keys {
+		// Keys ending in a slash are directories, which this cache doesn't
+		// create.
+		if strings.HasSuffix(k, "/") {
+			continue
+		}
+		if k, err := url.PathUnescape(k); err == nil && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (v *VaultCache) url(kind, key string) string {
+	u := v.addr + "/v1/" + v.mount + "/" + kind + "/"
+	if v.prefix != "" {
+		u += v.prefix + "/"
+	}
+	return u + url.PathEscape(key)
+}
+
+// do sends a request to Vault, and decodes the response into out, if not nil.
+// It returns false if the secret doesn't exist.
+func (v *VaultCache) do(ctx context.Context, method, u string, in, out interface{}) (bool, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return false, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Vault-Token", v.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, withKind(ErrCacheUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 500:
+		return false, withKind(ErrCacheUnavailable, vaultError(resp))
+	case resp.StatusCode >= 300:
+		return false, vaultError(resp)
+	}
+
+	if out == nil {
+		return true, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, errors.Wrap(err, "invalid response from Vault")
+	}
+	return true, nil
+}
+
+// vaultWrap adds context to err, keeping the kind of a *Error outermost.
+func vaultWrap(err error, format string, args ...interface{}) error {
+	if e, ok := err.(*Error); ok {
+		return withKind(e.Kind, errors.Wrapf(e.Err, format, args...))
+	}
+	return errors.Wrapf(err, format, args...)
+}
+
+func vaultError(resp *http.Response) error {
+	var e struct {
+		Errors []string `json:"errors"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+		return errors.Errorf("Vault returned %s: %s", resp.Status, strings.Join(e.Errors, "; "))
+	}
+	return errors.Errorf("Vault returned %s", resp.Status)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/ed25519"
+)
+
+const usage = `Usage: wilectl [flags] <command> [args]
+
+Commands:
+  list [prefix]         List the keys in the cache. Keys are hashed if -cert_key is set.
+  dump <key>            Print the value of key.
+  export <key> <file>   Write the value of key to file.
+  import <key> <file>   Store the contents of file under key.
+  delete <key>          Delete key.
+  purge <age>           Delete the entries last written more than age ago, e.g.
+                        2160h, such as the certs of domains no longer served.
+                        Certs are rewritten when renewed, so age should be well
+                        beyond the renewal interval. The ACME account and
+                        session ticket keys are never purged, which needs
+                        -cert_key if the server encrypts the cache.
+  backup <file>         Write an encrypted backup of the whole cache to file.
+  restore <file>        Put all entries of a backup into the cache.
+  migrate <from> <to>   Copy all entries from one cache to another.
+  preissue <file>       Obtain certs for the domains in file, one per line, that
+                        don't have one yet, e.g. before moving them to wile.
+                        The servers sharing the cache answer the challenges.
+                        Orders are paced by -preissue_interval, and rate
+                        limits wait -preissue_backoff. Needs -cert_key and
+                        isn't limited by -timeout.
+  keygen <file>         Write a new ed25519 private key for signing config
+                        bundles to file, and print its public key.
+  sign-config <key file> <config file> <bundle file>
+                        Sign a JSON object of server flags, such as
+                        {"hosts": "..."}, for the server's -config_bundle.
+
+If -cert_key is set, values are decrypted when read and encrypted when
+written, the same way the server does. <key> is then the plain key, e.g.
+a domain name; list still shows the hashed keys. Backups hold the values as
+stored, so a backup of an encrypted cache needs -cert_key after restoring.
+
+The caches of migrate are given as etcd:<prefix>, dir:<path>,
+vault:<mount>/<prefix>, for a Vault KV version 2 engine at $VAULT_ADDR with the
+token in $VAULT_TOKEN, or sql:<driver>/<table>, for a table of the Postgres or
+MySQL database at $WILE_SQL_DSN, whose schema is migrated first. The driver,
+postgres, pgx or mysql, must be linked into wilectl with a blank import.
+-cert_key doesn't apply to them. Entries are copied as stored, unless -migrate_cert_key
+is set, in which case they are encrypted with it on the way, e.g. to move a
+plaintext cache to an encrypted one. Every copied entry is read back and
+compared before migrate moves on.
+
+Flags:
+`
+
+func main() {
+	var (
+		etcdEndpoints        = flag.String("etcd_endpoints", "localhost:2378", "Comma-separated list of etcd endpoints.")
+		etcdCA               = flag.String("etcd_ca", "", "If set, connect to etcd over TLS and verify its certificate against the CA certificates in this PEM file.")
+		etcdCert             = flag.String("etcd_cert", "", "The client certificate to present to etcd, in PEM format. Requires -etcd_ca.")
+		etcdKey              = flag.String("etcd_key", "", "The private key of -etcd_cert, in PEM format.")
+		etcdUsername         = flag.String("etcd_username", "", "The user to authenticate to etcd as.")
+		etcdPassword         = flag.String("etcd_password", "", "The password of -etcd_username.")
+		etcdDialTimeout      = flag.Duration("etcd_dial_timeout", 5*time.Second, "The timeout for establishing a connection to etcd.")
+		etcdPrefix           = flag.String("etcd_prefix", "/wile/acme/http", "The etcd prefix of the cache.")
+		certKey              = flag.String("cert_key", "", "The key the server encrypts certificates in etcd with.")
+		backupPassphraseFile = flag.String("backup_passphrase_file", "", "The file holding the passphrase that backups are encrypted with.")
+		migrateCertKey       = flag.String("migrate_cert_key", "", "If set, migrate encrypts the entries it copies with this key.")
+		acmeServer           = flag.String("acme", "https://acme-staging.api.letsencrypt.org/directory", "The ACME server preissue obtains certs from.")
+		email                = flag.String("email", "", "The email to use when registering with acme.")
+		accountKeyType       = flag.String("account_key_type", string(wile.ECDSAP256), "The type of the ACME account key, as for the server.")
+		certKeyType          = flag.String("cert_key_type", "auto", "The type of the keys of certs preissue obtains. Either auto, for ECDSA P-256, or rsa, for RSA 2048, as for the server.")
+		preissueInterval     = flag.Duration("preissue_interval", 30*time.Second, "The time preissue waits between orders.")
+		preissueBackoff      = flag.Duration("preissue_backoff", time.Hour, "The time preissue waits after hitting a rate limit.")
+		timeout              = flag.Duration("timeout", time.Minute, "The timeout for the whole command.")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// These don't need etcd.
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "keygen":
+		checkArgs(cmd, args, 1, 1)
+
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %q: %v", args[0], err)
+		}
+		_, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("Failed to write %q: %v", args[0], err)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+		return
+
+	case "sign-config":
+		checkArgs(cmd, args, 3, 3)
+
+		data, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			log.Fatalf("Failed to read %q: %v", args[0], err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != ed25519.PrivateKeySize {
+			log.Fatalf("%q doesn't hold a key written by keygen", args[0])
+		}
+
+		payload, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Fatalf("Failed to read %q: %v", args[1], err)
+		}
+		var flags map[string]string
+		if err := json.Unmarshal(payload, &flags); err != nil {
+			log.Fatalf("Invalid config in %q, want a JSON object of flag names to values: %v", args[1], err)
+		}
+
+		bundle, err := wile.SignConfigBundle(ed25519.PrivateKey(key), payload)
+		if err != nil {
+			log.Fatalf("Failed to sign config: %v", err)
+		}
+		if err := ioutil.WriteFile(args[2], bundle, 0644); err != nil {
+			log.Fatalf("Failed to write %q: %v", args[2], err)
+		}
+		return
+	}
+
+	etcd, err := wile.NewEtcdClient(strings.Split(*etcdEndpoints, ","), *etcdCA, *etcdCert, *etcdKey, *etcdUsername, *etcdPassword, *etcdDialTimeout)
+	if err != nil {
+		log.Fatalf("Failed to connect to etcd: %v", err)
+	}
+	defer etcd.Close()
+
+	raw := wile.NewEtcdCache(etcd, *etcdPrefix)
+
+	var cache autocert.Cache = raw
+	if *certKey != "" {
+		cache, err = wile.NewEncryptingCache(raw, []byte(*certKey))
+		if err != nil {
+			log.Fatalf("Failed to create cache: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "list":
+		checkArgs(cmd, args, 0, 1)
+
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+
+		keys, err := raw.List(ctx, prefix)
+		if err != nil {
+			log.Fatalf("Failed to list keys: %v", err)
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+
+	case "dump":
+		checkArgs(cmd, args, 1, 1)
+
+		data := get(ctx, cache, args[0])
+		os.Stdout.Write(data)
+
+	case "export":
+		checkArgs(cmd, args, 2, 2)
+
+		data := get(ctx, cache, args[0])
+		err := ioutil.WriteFile(args[1], data, 0600)
+		if err != nil {
+			log.Fatalf("Failed to write %q: %v", args[1], err)
+		}
+
+	case "import":
+		checkArgs(cmd, args, 2, 2)
+
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			log.Fatalf("Failed to read %q: %v", args[1], err)
+		}
+		err = cache.Put(ctx, args[0], data)
+		if err != nil {
+			log.Fatalf("Failed to put %q: %v", args[0], err)
+		}
+
+	case "delete":
+		checkArgs(cmd, args, 1, 1)
+
+		err := cache.Delete(ctx, args[0])
+		if err != nil {
+			log.Fatalf("Failed to delete %q: %v", args[0], err)
+		}
+
+	case "purge":
+		checkArgs(cmd, args, 1, 1)
+
+		age, err := time.ParseDuration(args[0])
+		if err != nil || age <= 0 {
+			log.Fatalf("Invalid age %q, e.g. 2160h for 90 days", args[0])
+		}
+		if *certKey == "" {
+			// The account key of an encrypted cache is stored under a hashed
+			// name, and can't be told from other keys without -cert_key.
+			keys, err := raw.List(ctx, "acme_account+key")
+			if err != nil {
+				log.Fatalf("Failed to list keys: %v", err)
+			}
+			if len(keys) == 0 {
+				log.Fatal("No plain ACME account key in the cache; if the server encrypts the cache, purge needs -cert_key")
+			}
+		}
+
+		purged, err := cache.(wile.Purger).Purge(ctx, time.Now().Add(-age), nil)
+		for _, k := range purged {
+			fmt.Println(k)
+		}
+		if err != nil {
+			log.Fatalf("Failed to purge cache after %d keys: %v", len(purged), err)
+		}
+
+	case "backup":
+		checkArgs(cmd, args, 1, 1)
+
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("Failed to create %q: %v", args[0], err)
+		}
+		err = wile.Export(ctx, raw, f, passphrase(*backupPassphraseFile))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(args[0])
+			log.Fatalf("Failed to back up cache: %v", err)
+		}
+
+	case "restore":
+		checkArgs(cmd, args, 1, 1)
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalf("Failed to open %q: %v", args[0], err)
+		}
+		defer f.Close()
+
+		keys, err := wile.Import(ctx, raw, f, passphrase(*backupPassphraseFile))
+		if err != nil {
+			log.Fatalf("Failed to restore backup after %d keys: %v", len(keys), err)
+		}
+		fmt.Printf("Restored %d keys\n", len(keys))
+
+	case "preissue":
+		checkArgs(cmd, args, 1, 1)
+
+		if *certKey == "" {
+			log.Fatal("preissue needs -cert_key, since the server only reads encrypted certs")
+		}
+		failed := preissue(cache, args[0], preissueConfig{
+			acmeServer:     *acmeServer,
+			email:          *email,
+			accountKeyType: *accountKeyType,
+			certKeyType:    *certKeyType,
+			interval:       *preissueInterval,
+			backoff:        *preissueBackoff,
+		})
+		if failed > 0 {
+			log.Fatalf("Failed to obtain %d certs", failed)
+		}
+
+	case "migrate":
+		checkArgs(cmd, args, 2, 2)
+
+		from := openCache(ctx, etcd, args[0])
+		var to autocert.Cache = openCache(ctx, etcd, args[1])
+		if *migrateCertKey != "" {
+			to, err = wile.NewEncryptingCache(to, []byte(*migrateCertKey))
+			if err != nil {
+				log.Fatalf("Failed to create cache: %v", err)
+			}
+		}
+
+		keys, err := from.List(ctx, "")
+		if err != nil {
+			log.Fatalf("Failed to list keys of %q: %v", args[0], err)
+		}
+		for _, k := range keys {
+			data, err := from.Get(ctx, k)
+			if err == autocert.ErrCacheMiss {
+				continue
+			}
+			if err != nil {
+				log.Fatalf("Failed to get %q: %v", k, err)
+			}
+
+			if err := to.Put(ctx, k, data); err != nil {
+				log.Fatalf("Failed to put %q: %v", k, err)
+			}
+			if got := get(ctx, to, k); !bytes.Equal(got, data) {
+				log.Fatalf("Copy of %q differs from the original", k)
+			}
+			fmt.Println(k)
+		}
+
+	default:
+		log.Fatalf("Unknown command %q", cmd)
+	}
+}
+
+func checkArgs(cmd string, args []string, min, max int) {
+	if len(args) < min || len(args) > max {
+		log.Fatalf("Wrong number of arguments for %q, see -help", cmd)
+	}
+}
+
+type listingCache interface {
+	autocert.Cache
+	wile.Lister
+}
+
+// sqlDialects maps the database/sql drivers sql: caches may use to their
+// dialects.
+var sqlDialects = map[string]wile.SQLDialect{
+	"postgres": wile.Postgres,
+	"pgx":      wile.Postgres,
+	"mysql":    wile.MySQL,
+}
+
+// openCache opens a cache given as etcd:<prefix>, dir:<path>,
+// vault:<mount>/<prefix> or sql:<driver>/<table>.
+func openCache(ctx context.Context, etcd *clientv3.Client, spec string) listingCache {
+	i := strings.Index(spec, ":")
+	if i < 0 || i == len(spec)-1 {
+		log.Fatalf("Invalid cache %q, want etcd:<prefix>, dir:<path>, vault:<mount>/<prefix> or sql:<driver>/<table>", spec)
+	}
+	switch kind, arg := spec[:i], spec[i+1:]; kind {
+	case "etcd":
+		return wile.NewEtcdCache(etcd, arg)
+	case "dir":
+		return wile.NewDirCache(arg)
+	case "vault":
+		addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+		if addr == "" || token == "" {
+			log.Fatalf("Cache %q needs $VAULT_ADDR and $VAULT_TOKEN", spec)
+		}
+		parts := strings.SplitN(arg, "/", 2)
+		prefix := ""
+		if len(parts) == 2 {
+			prefix = parts[1]
+		}
+		return wile.NewVaultCache(nil, addr, token, parts[0], prefix)
+	case "sql":
+		parts := strings.SplitN(arg, "/", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid cache %q, want sql:<driver>/<table>", spec)
+		}
+		dialect, ok := sqlDialects[parts[0]]
+		if !ok {
+			log.Fatalf("Unsupported SQL driver %q in %q, want postgres, pgx or mysql", parts[0], spec)
+		}
+		dsn := os.Getenv("WILE_SQL_DSN")
+		if dsn == "" {
+			log.Fatalf("Cache %q needs $WILE_SQL_DSN", spec)
+		}
+		db, err := sql.Open(parts[0], dsn)
+		if err != nil {
+			log.Fatalf("Failed to open %q, registered drivers are %v: %v", spec, sql.Drivers(), err)
+		}
+		cache, err := wile.NewSQLCache(ctx, db, dialect, parts[1])
+		if err != nil {
+			log.Fatalf("Failed to open %q: %v", spec, err)
+		}
+		return cache
+	default:
+		log.Fatalf("Unknown cache type %q in %q", kind, spec)
+		return nil
+	}
+}
+
+func passphrase(file string) []byte {
+	if file == "" {
+		log.Fatal("-backup_passphrase_file is required")
+	}
+	p, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Failed to read backup passphrase: %v", err)
+	}
+	p = bytes.TrimSpace(p)
+	if len(p) == 0 {
+		log.Fatalf("Backup passphrase in %q is empty", file)
+	}
+	return p
+}
+
+func get(ctx context.Context, cache autocert.Cache, key string) []byte {
+	data, err := cache.Get(ctx, key)
+	if err == autocert.ErrCacheMiss {
+		log.Fatalf("No value for %q", key)
+	}
+	if err != nil {
+		log.Fatalf("Failed to get %q: %v", key, err)
+	}
+	return data
+}
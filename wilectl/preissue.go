@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jonathanwei/wile"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// preissueConfig holds the flags of preissue.
+type preissueConfig struct {
+	acmeServer     string
+	email          string
+	accountKeyType string
+	certKeyType    string
+	interval       time.Duration
+	backoff        time.Duration
+}
+
+// preissue obtains certs for the domains in file that don't have one in cache
+// yet, one every cfg.interval. Challenges are stored in cache for the servers
+// sharing it to answer, so the domains must already point at them. After a
+// rate limit error, it waits cfg.backoff before trying the domain again. It
+// returns the number of domains it failed to get a cert for.
+func preissue(cache autocert.Cache, file string, cfg preissueConfig) int {
+	domains, err := readDomains(file)
+	if err != nil {
+		log.Fatalf("Failed to read domains: %v", err)
+	}
+	if cfg.certKeyType != "auto" && cfg.certKeyType != "rsa" {
+		log.Fatalf("Unknown -cert_key_type %q", cfg.certKeyType)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	key, err := wile.AccountKey(ctx, cache, wile.KeyType(cfg.accountKeyType))
+	cancel()
+	if err != nil {
+		log.Fatalf("Failed to get account key: %v", err)
+	}
+
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       cache,
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: 30 * 24 * time.Hour,
+		Client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.acmeServer,
+		},
+		Email: cfg.email,
+	}
+	// Enables HTTP-01 challenges, which are answered from the cache.
+	m.HTTPHandler(nil)
+
+	// autocert picks the key type from the ClientHello.
+	hello := &tls.ClientHelloInfo{
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	suffix := ""
+	if cfg.certKeyType == "rsa" {
+		hello.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+		hello.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+		suffix = "+rsa"
+	}
+
+	failed := 0
+	var last time.Time
+	for i, d := range domains {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err := cache.Get(ctx, d+suffix)
+		cancel()
+		if err == nil {
+			fmt.Printf("[%d/%d] %s: already has a cert\n", i+1, len(domains), d)
+			continue
+		}
+
+		for {
+			time.Sleep(time.Until(last.Add(cfg.interval)))
+			last = time.Now()
+
+			h := *hello
+			h.ServerName = d
+			_, err = m.GetCertificate(&h)
+			if err == nil || !strings.Contains(err.Error(), "urn:ietf:params:acme:error:rateLimited") {
+				break
+			}
+			fmt.Printf("[%d/%d] %s: rate limited, retrying in %v: %v\n", i+1, len(domains), d, cfg.backoff, err)
+			time.Sleep(cfg.backoff)
+		}
+		if err != nil {
+			fmt.Printf("[%d/%d] %s: failed: %v\n", i+1, len(domains), d, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[%d/%d] %s: obtained cert\n", i+1, len(domains), d)
+	}
+	return failed
+}
+
+// readDomains reads one domain per line from file, skipping empty lines and
+// lines starting with #.
+func readDomains(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var domains []string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		d := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s.Text()), "."))
+		if d == "" || strings.HasPrefix(d, "#") || seen[d] {
+			continue
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	return domains, s.Err()
+}